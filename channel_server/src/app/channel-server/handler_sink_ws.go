@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"channelling"
+	"channelling/server"
+)
+
+// makeSinkWSHandler lets backend services attach to the WebSocket sink of
+// a pipeline session.
+func makeSinkWSHandler(pipelineManager channelling.PipelineManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		receivingSink, ok := server.AuthorizeSink(pipelineManager, r)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sink, ok := receivingSink.(channelling.WebSocketSink)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		sink.ServeWebSocket(ws)
+	}
+}
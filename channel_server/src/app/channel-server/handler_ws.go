@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"strings"
 
 	"channelling"
 	"channelling/server"
@@ -37,6 +38,55 @@ func makeWSHandler(connectionCounter channelling.ConnectionCounter, sessionManag
 			return
 		}
 
+		// Require a usable access token when enabled.
+		accessToken := r.FormValue("a")
+		if config.AccessTokens != nil {
+			if err := config.AccessTokens.Validate(accessToken); err != nil {
+				log.Println("Rejected websocket with access token", err)
+				config.Audit(&channelling.AuditEvent{
+					Action:     "token.connect",
+					Outcome:    channelling.AuditOutcomeFailure,
+					RemoteAddr: r.RemoteAddr,
+					Reason:     err.Error(),
+				})
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		// Authenticate devices with their API key or client certificate.
+		var device *channelling.Device
+		var err error
+		if deviceID := r.FormValue("device"); deviceID != "" {
+			if config.Devices == nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if key := r.Header.Get("X-Device-Key"); key != "" {
+				device, err = config.Devices.Authenticate(deviceID, key)
+			} else if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+				device, err = config.Devices.AuthenticateCertificate(deviceID, r.TLS.PeerCertificates[0])
+			} else {
+				err = channelling.ErrDeviceInvalidCredentials
+			}
+			event := &channelling.AuditEvent{
+				Action:     "device.connect",
+				Outcome:    channelling.AuditOutcomeSuccess,
+				Actor:      channelling.DeviceUseridPrefix + deviceID,
+				RemoteAddr: r.RemoteAddr,
+			}
+			if err != nil {
+				event.Outcome = channelling.AuditOutcomeFailure
+				event.Reason = err.Error()
+			}
+			config.Audit(event)
+			if err != nil {
+				log.Println("Rejected websocket for device", deviceID, err)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
 		// Upgrade to Websocket mode.
 		ws, err := upgrader.Upgrade(w, r, nil)
 		if _, ok := err.(websocket.HandshakeError); ok {
@@ -52,20 +102,56 @@ func makeWSHandler(connectionCounter channelling.ConnectionCounter, sessionManag
 
 		st := sessionManager.DecodeSessionToken(token)
 
-		log.Printf("token: %s\n", token)
-		log.Printf("st id: %s, sid: %s\n", st.Id, st.Sid)
+		log.Printf("st id: %s\n", st.Id)
 
 
 		var userid string
-		if users != nil {
-			userid, _ = users.GetUserID(r)
-			if userid == "" {
+		if device != nil {
+			userid = channelling.DeviceUseridPrefix + device.Id
+			st.Roles = []string{channelling.DeviceRole}
+			st.DisplayName = device.Name
+		} else if users != nil {
+			if identity, _ := users.GetUserIdentity(r); identity != nil && identity.Userid != "" {
+				userid = identity.Userid
+				st.Roles = identity.Roles
+				st.DisplayName = identity.DisplayName
+			} else if config.Users == nil || config.Users.UserExists(st.Userid) {
 				userid = st.Userid
 			}
+			if strings.HasPrefix(userid, channelling.DeviceUseridPrefix) {
+				// Device userids are reserved for authenticated devices.
+				userid = ""
+			}
+		}
+
+		if config.AccessTokens != nil {
+			if err := config.AccessTokens.Bind(accessToken, st.Id); err != nil {
+				log.Println("Failed to bind access token", st.Id, err)
+				ws.Close()
+				return
+			}
+			defer config.AccessTokens.Release(st.Id)
 		}
 
 		// Create a new connection instance.
 		session := sessionManager.CreateSession(st, userid)
+		session.SetRemoteAddr(r.RemoteAddr)
+		// Prefer the region of the client, else map the client network.
+		if region := r.FormValue("region"); region != "" && len(region) <= 32 {
+			session.SetRegion(region)
+		} else if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			session.SetRegion(config.TurnRegion(forwarded))
+		} else {
+			session.SetRegion(config.TurnRegion(r.RemoteAddr))
+		}
+		// Clients behind restrictive firewalls only get ICE servers they
+		// can reach.
+		if transports, err := channelling.ParseIceTransports(strings.Split(r.FormValue("transports"), ",")); err == nil {
+			session.SetTransports(transports)
+		}
+		if device != nil {
+			session.SetDevice(device.Id, device.Capabilities)
+		}
 		client := channelling.NewClient(codec, channellingAPI, session)
 		conn := channelling.NewConnection(connectionCounter.CountConnection(), ws, client)
 
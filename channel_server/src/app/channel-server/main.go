@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"flag"
 	"fmt"
@@ -137,6 +138,17 @@ func runner(runtime phoenix.Runtime) error {
 		tokenProvider = channelling.TokenFileProvider(tokenFile)
 	}
 
+	// Create access tokens, these replace the token file.
+	var accessTokens channelling.AccessTokens
+	if accessTokensFile, _ := runtime.GetString("app", "accessTokens"); accessTokensFile != "" {
+		accessTokens, err = channelling.NewAccessTokens(accessTokensFile)
+		if err != nil {
+			return fmt.Errorf("Failed to load access tokens: %s", err)
+		}
+		log.Printf("Using access tokens from %s\n", accessTokensFile)
+		tokenProvider = channelling.AccessTokenProvider(accessTokens)
+	}
+
 	// Nats pub/sub supports.
 	natsChannellingTrigger, _ := runtime.GetBool("nats", "channelling_trigger")
 	natsChannellingTriggerSubject, _ := runtime.GetString("nats", "channelling_trigger_subject")
@@ -150,13 +162,63 @@ func runner(runtime phoenix.Runtime) error {
 			natsconnection.DefaultEstablishTimeout = time.Duration(natsEstablishTimeout) * time.Second
 		}
 	}
+	natsRequired, _ := runtime.GetBool("nats", "required")
 	natsClientId, _ := runtime.GetString("nats", "client_id")
+	natsTriggers, _ := runtime.GetString("nats", "triggers")
+	natsAdminCredential, _ := runtime.GetString("nats", "adminCredential")
 
 	// Load remaining configuration items.
 	config, err = server.NewConfig(runtime, tokenProvider != nil)
 	if err != nil {
 		return err
 	}
+	config.Policy, err = server.NewPolicy(runtime)
+	if err != nil {
+		return err
+	}
+	config.AccessTokens = accessTokens
+
+	// Start embedded STUN/TURN server, which is used by clients when no
+	// other servers are configured.
+	turnServer, err := server.NewTurnServer(runtime, turnSecret, serverRealm)
+	if err != nil {
+		return err
+	}
+	if turnServer != nil {
+		if err = turnServer.Start(); err != nil {
+			return fmt.Errorf("Failed to start STUN/TURN server: %s", err)
+		}
+		defer turnServer.Close()
+		stunURIs, turnURIs := turnServer.URIs()
+		if len(config.StunURIs) == 0 {
+			config.StunURIs = stunURIs
+		}
+		if len(config.TurnURIs) == 0 {
+			config.TurnURIs = turnURIs
+		}
+	}
+
+	// Start embedded NATS server, which replaces the NATS url.
+	natsServer, err := server.NewNatsServer(runtime)
+	if err != nil {
+		return err
+	}
+	if natsServer != nil {
+		if err = natsServer.Start(); err != nil {
+			return fmt.Errorf("Failed to start NATS server: %s", err)
+		}
+		defer natsServer.Close()
+		natsconnection.DefaultURL = natsServer.URL()
+	}
+
+	// Create device registry.
+	if devicesFile, _ := runtime.GetString("devices", "database"); devicesFile != "" {
+		config.Devices, err = channelling.NewDeviceRegistry(devicesFile)
+		if err != nil {
+			return fmt.Errorf("Failed to load devices: %s", err)
+		}
+		log.Printf("Using devices from %s\n", devicesFile)
+	}
 
 	// Load templates.
 	templates = template.New("")
@@ -256,6 +318,10 @@ func runner(runtime phoenix.Runtime) error {
 		}
 		// Explicitly set random to use.
 		tlsConfig.Rand = rand.Reader
+		if requestClientCertificates, _ := runtime.GetBool("devices", "requestClientCertificates"); requestClientCertificates {
+			// Client certificates are verified against the pinned device fingerprints.
+			tlsConfig.ClientAuth = tls.RequestClientCert
+		}
 		log.Println("Native TLS configuration intialized")
 		runtime.DefaultHTTPSHandler(r)
 	}
@@ -269,14 +335,67 @@ func runner(runtime phoenix.Runtime) error {
 	tickets := channelling.NewTickets(sessionSecret, encryptionSecret, computedRealm)
 	sessionManager := channelling.NewSessionManager(config, tickets, hub, roomManager, roomManager, buddyImages, sessionSecret)
 	statsManager := channelling.NewStatsManager(hub, roomManager, sessionManager)
-	busManager := channelling.NewBusManager(apiConsumer, natsClientId, natsChannellingTrigger, natsChannellingTriggerSubject)
-	pipelineManager := channelling.NewPipelineManager(busManager, sessionManager, sessionManager, sessionManager)
+	busOutbox, err := server.NewBusOutbox(runtime)
+	if err != nil {
+		return err
+	}
+	var busManager channelling.BusManager
+	if !natsChannellingTrigger {
+		// Post trigger events to webhooks without NATS.
+		if busManager, err = server.NewWebhookBus(runtime, apiConsumer, natsClientId, channelling.ParseBusTriggers(natsTriggers)); err != nil {
+			return err
+		}
+	}
+	if busManager == nil && natsChannellingTrigger && natsRequired {
+		// Fail instead of running without NATS.
+		if busManager, err = channelling.NewNatsBusManager(apiConsumer, natsClientId, natsChannellingTriggerSubject, busOutbox, channelling.ParseBusTriggers(natsTriggers)); err != nil {
+			return fmt.Errorf("Failed to connect NATS bus: %s", err)
+		}
+	}
+	if busManager == nil {
+		busManager = channelling.NewBusManager(apiConsumer, natsClientId, natsChannellingTrigger, natsChannellingTriggerSubject, busOutbox, channelling.ParseBusTriggers(natsTriggers))
+	}
+	var pipelineLog channelling.PipelineLog
+	if pipelinesEnabled {
+		if pipelineLog, err = server.NewPipelineLog(runtime); err != nil {
+			return err
+		}
+		if pipelineLog != nil {
+			defer pipelineLog.Close()
+		}
+	}
+	pipelineManager := channelling.NewPipelineManager(busManager, sessionManager, sessionManager, sessionManager, server.NewSinkFactory(runtime, busManager), pipelineLog, server.NewPipelineTokens(runtime, sessionSecret))
+	config.AuditLog, err = server.NewAuditLog(runtime, busManager)
+	if err != nil {
+		return err
+	}
+	var chatHistory channelling.ChatHistory
+	if config.ChatHistoryEnabled {
+		chatHistoryPath, _ := runtime.GetString("chathistory", "path")
+		chatHistory = channelling.NewChatHistory(chatHistoryPath, server.NewChatHistoryLimits(runtime))
+		log.Println("Chat history is enabled!")
+	}
+	var offlineMessages channelling.OfflineMessages
+	if config.OfflineMessagesEnabled {
+		offlineMessages = server.NewOfflineMessages(runtime)
+		log.Println("Offline messages are enabled!")
+	}
+	chatModerator, err := server.NewChatModerator(runtime, busManager)
+	if err != nil {
+		return err
+	}
 	if err := roomManager.SetBusManager(busManager); err != nil {
 		return err
 	}
+	if natsAdminCredential != "" && natsChannellingTrigger {
+		if err := channelling.NewBusAdmin(busManager, natsAdminCredential, hub, roomManager, statsManager).Start(); err != nil {
+			return err
+		}
+		log.Println("Bus admin requests are enabled")
+	}
 
 	// Create API.
-	channellingAPI := api.New(config, roomManager, tickets, sessionManager, statsManager, hub, hub, hub, busManager, pipelineManager)
+	channellingAPI := api.New(config, roomManager, tickets, sessionManager, statsManager, hub, hub, hub, busManager, pipelineManager, chatHistory, offlineMessages, chatModerator, channelling.NewChatMessages())
 	apiConsumer.SetChannellingAPI(channellingAPI)
 
 	// Start bus.
@@ -298,24 +417,46 @@ func runner(runtime phoenix.Runtime) error {
 	rest.SetMux(r.PathPrefix("/api/v1/").Subrouter())
 	rest.AddResource(&server.Rooms{}, "/rooms")
 	rest.AddResource(config, "/config")
-	rest.AddResourceWithWrapper(&server.Tokens{tokenProvider}, httputils.MakeGzipHandler, "/tokens")
+	rest.AddResourceWithWrapper(&server.Tokens{tokenProvider, config}, httputils.MakeGzipHandler, "/tokens")
+	if accessTokens != nil {
+		accessTokensAdminSecret, _ := runtime.GetString("app", "accessTokensAdminSecret")
+		rest.AddResource(&server.AccessTokensAdmin{accessTokens, accessTokensAdminSecret, config}, "/tokens/admin", "/tokens/admin/{token}")
+	}
+	if config.Devices != nil {
+		devicesAdminSecret, _ := runtime.GetString("devices", "adminSecret")
+		rest.AddResource(&server.DevicesAdmin{config.Devices, devicesAdminSecret, config}, "/devices/admin", "/devices/admin/{id}")
+	}
+	if config.AuditLog != nil {
+		auditAdminSecret, _ := runtime.GetString("audit", "adminSecret")
+		rest.AddResource(&server.AuditAdmin{config.AuditLog, auditAdminSecret}, "/audit/admin")
+	}
 
 	var users *server.Users
 	if config.UsersEnabled {
 		// Create Users handler.
 		users = server.NewUsers(hub, tickets, sessionManager, config.UsersMode, serverRealm, runtime)
-		rest.AddResource(&server.Sessions{tickets, hub, users}, "/sessions/{id}/")
-		if config.UsersAllowRegistration {
+		rest.AddResource(&server.Sessions{tickets, hub, users, config}, "/sessions/{id}/")
+		if local, ok := users.LocalHandler(); ok {
+			config.Users = local
+			rest.AddResource(&server.LocalUsers{users, local, config.UsersAllowRegistration, config}, "/users/local/{action}")
+			rest.AddResource(&server.LocalUsersAdmin{users, local, config}, "/users/local/admin/users", "/users/local/admin/users/{userid}")
+		} else if config.UsersAllowRegistration {
 			rest.AddResource(users, "/users")
 		}
+		if oidc, ok := users.OIDCHandler(); ok {
+			rest.AddResource(&server.OIDCLogin{users, oidc}, "/oidc/login")
+			rest.AddResource(&server.OIDCCallback{oidc, config}, "/oidc/callback")
+		}
 	}
 	if statsEnabled {
-		rest.AddResourceWithWrapper(&server.Stats{statsManager}, httputils.MakeGzipHandler, "/stats")
+		rest.AddResourceWithWrapper(&server.Stats{statsManager, turnServer, busManager, natsServer}, httputils.MakeGzipHandler, "/stats")
 		log.Println("Stats are enabled!")
 	}
 	if pipelinesEnabled {
 		pipelineManager.Start()
-		rest.AddResource(&server.Pipelines{pipelineManager, channellingAPI}, "/pipelines/{id}")
+		rest.AddResource(&server.Pipelines{pipelineManager, channellingAPI, config}, "/pipelines/{id}")
+		rest.AddResource(&server.PipelineExport{pipelineManager, config}, "/pipelines/{id}/export")
+		rest.AddResource(&server.Sinks{pipelineManager}, "/sinks/{id}")
 		log.Println("Pipelines API is enabled!")
 	}
 
@@ -337,6 +478,9 @@ func runner(runtime phoenix.Runtime) error {
 
 	// Finally add websocket handler.
 	r.Handle("/ws", makeWSHandler(statsManager, sessionManager, codec, channellingAPI, users))
+	if pipelinesEnabled {
+		r.Handle("/sinks/{id}/ws", makeSinkWSHandler(pipelineManager))
+	}
 
 	// Simple room handler.
 	r.HandleFunc("/{room}", httputils.MakeGzipHandler(roomHandler))
@@ -0,0 +1,358 @@
+package channelling
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAccessTokenUnknown     = errors.New("unknown token")
+	ErrAccessTokenExpired     = errors.New("token expired")
+	ErrAccessTokenRevoked     = errors.New("token revoked")
+	ErrAccessTokenUsedUp      = errors.New("token has no uses left")
+	ErrAccessTokenMaxSessions = errors.New("token has too many sessions")
+	ErrAccessTokenExists      = errors.New("token exists")
+)
+
+// AccessToken is an access token with limits, for example a time limited
+// pass. Zero values mean no limit.
+type AccessToken struct {
+	Token       string   `json:"token"`
+	Label       string   `json:"label,omitempty"`
+	Expires     int64    `json:"expires,omitempty"`  // Unix time after which the token is invalid.
+	Duration    int64    `json:"duration,omitempty"` // Seconds the token is valid after its first use.
+	Rooms       []string `json:"rooms,omitempty"`    // Glob patterns of room names which can be joined.
+	MaxSessions int      `json:"maxSessions,omitempty"`
+	MaxUses     int      `json:"maxUses,omitempty"`
+	Uses        int      `json:"uses"`
+	Sessions    int      `json:"sessions"` // Currently connected sessions.
+	Revoked     bool     `json:"revoked,omitempty"`
+	Created     int64    `json:"created"`
+	FirstUsed   int64    `json:"firstUsed,omitempty"`
+	LastUsed    int64    `json:"lastUsed,omitempty"`
+}
+
+func (token *AccessToken) valid(now time.Time) error {
+	switch {
+	case token.Revoked:
+		return ErrAccessTokenRevoked
+	case token.Expires > 0 && now.Unix() >= token.Expires:
+		return ErrAccessTokenExpired
+	case token.Duration > 0 && token.FirstUsed > 0 && now.Unix() >= token.FirstUsed+token.Duration:
+		return ErrAccessTokenExpired
+	}
+	return nil
+}
+
+// AllowsRoom returns true if the room name matches one of the room
+// patterns of the token, or if the token has none.
+func (token *AccessToken) AllowsRoom(roomName string) bool {
+	if len(token.Rooms) == 0 {
+		return true
+	}
+	for _, pattern := range token.Rooms {
+		if ok, _ := path.Match(pattern, roomName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessTokens stores access tokens and tracks the sessions using them.
+type AccessTokens interface {
+	Validate(token string) error
+	Bind(token, sessionID string) error
+	Release(sessionID string)
+	AllowsRoom(sessionID, roomName string) bool
+	Create(token *AccessToken) (*AccessToken, error)
+	Update(token string, update func(*AccessToken)) (*AccessToken, error)
+	Delete(token string) error
+	Get(token string) (*AccessToken, bool)
+	List() []*AccessToken
+}
+
+// accessTokenBinding counts the connections of a session using a token.
+type accessTokenBinding struct {
+	token       string
+	connections int
+}
+
+type accessTokens struct {
+	sync.Mutex
+	filename string
+	tokens   map[string]*AccessToken
+	sessions map[string]*accessTokenBinding
+}
+
+// NewAccessTokens loads the access tokens from the JSON file, which is
+// written on every change.
+func NewAccessTokens(filename string) (AccessTokens, error) {
+	at := &accessTokens{
+		filename: filename,
+		tokens:   make(map[string]*AccessToken),
+		sessions: make(map[string]*accessTokenBinding),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return at, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var stored struct {
+		Tokens []*AccessToken `json:"tokens"`
+	}
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	for _, token := range stored.Tokens {
+		// Sessions do not survive a restart.
+		token.Sessions = 0
+		at.tokens[token.Token] = token
+	}
+
+	return at, nil
+}
+
+// save must be called with the lock held.
+func (at *accessTokens) save() error {
+	var stored struct {
+		Tokens []*AccessToken `json:"tokens"`
+	}
+	stored.Tokens = at.list()
+	data, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := at.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, at.filename)
+}
+
+func (at *accessTokens) check(token *AccessToken, now time.Time) error {
+	if err := token.valid(now); err != nil {
+		return err
+	}
+	if token.MaxUses > 0 && token.Uses >= token.MaxUses {
+		return ErrAccessTokenUsedUp
+	}
+	if token.MaxSessions > 0 && token.Sessions >= token.MaxSessions {
+		return ErrAccessTokenMaxSessions
+	}
+	return nil
+}
+
+// Validate returns nil if a session could use the token now.
+func (at *accessTokens) Validate(token string) error {
+	at.Lock()
+	defer at.Unlock()
+
+	accessToken, ok := at.tokens[strings.ToLower(token)]
+	if !ok {
+		return ErrAccessTokenUnknown
+	}
+	return at.check(accessToken, time.Now())
+}
+
+// Bind uses the token for a connection of the session and counts the use.
+// Further connections of the same session (reconnects) are not counted.
+func (at *accessTokens) Bind(token, sessionID string) error {
+	at.Lock()
+	defer at.Unlock()
+
+	token = strings.ToLower(token)
+	accessToken, ok := at.tokens[token]
+	if !ok {
+		return ErrAccessTokenUnknown
+	}
+	now := time.Now()
+	binding, bound := at.sessions[sessionID]
+	if bound && binding.token == token {
+		if err := accessToken.valid(now); err != nil {
+			return err
+		}
+		binding.connections++
+		return nil
+	}
+	if err := at.check(accessToken, now); err != nil {
+		return err
+	}
+	if bound {
+		at.release(binding.token)
+	}
+
+	accessToken.Uses++
+	accessToken.Sessions++
+	accessToken.LastUsed = now.Unix()
+	if accessToken.FirstUsed == 0 {
+		accessToken.FirstUsed = accessToken.LastUsed
+	}
+	at.sessions[sessionID] = &accessTokenBinding{token: token, connections: 1}
+
+	if err := at.save(); err != nil {
+		log.Println("Failed to save access tokens", err)
+	}
+	return nil
+}
+
+// Release ends a connection of the session.
+func (at *accessTokens) Release(sessionID string) {
+	at.Lock()
+	defer at.Unlock()
+
+	if binding, ok := at.sessions[sessionID]; ok {
+		binding.connections--
+		if binding.connections <= 0 {
+			delete(at.sessions, sessionID)
+			at.release(binding.token)
+		}
+	}
+}
+
+func (at *accessTokens) release(token string) {
+	if accessToken, ok := at.tokens[token]; ok && accessToken.Sessions > 0 {
+		accessToken.Sessions--
+	}
+}
+
+// AllowsRoom returns true if the token of the session is still valid and
+// allows to join the room. Sessions without token are not connected
+// through the WebSocket and are allowed.
+func (at *accessTokens) AllowsRoom(sessionID, roomName string) bool {
+	at.Lock()
+	defer at.Unlock()
+
+	binding, ok := at.sessions[sessionID]
+	if !ok {
+		return true
+	}
+	accessToken, ok := at.tokens[binding.token]
+	return ok && accessToken.valid(time.Now()) == nil && accessToken.AllowsRoom(roomName)
+}
+
+// Create adds the token, a random token is generated when it has none.
+func (at *accessTokens) Create(token *AccessToken) (*AccessToken, error) {
+	if token.Token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		token.Token = hex.EncodeToString(b)
+	}
+	token.Token = strings.ToLower(token.Token)
+	for _, pattern := range token.Rooms {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	at.Lock()
+	defer at.Unlock()
+	if _, ok := at.tokens[token.Token]; ok {
+		return nil, ErrAccessTokenExists
+	}
+	token.Uses, token.Sessions, token.FirstUsed, token.LastUsed = 0, 0, 0, 0
+	token.Created = time.Now().Unix()
+	at.tokens[token.Token] = token
+	if err := at.save(); err != nil {
+		delete(at.tokens, token.Token)
+		return nil, err
+	}
+
+	c := *token
+	return &c, nil
+}
+
+func (at *accessTokens) Update(token string, update func(*AccessToken)) (*AccessToken, error) {
+	at.Lock()
+	defer at.Unlock()
+
+	accessToken, ok := at.tokens[strings.ToLower(token)]
+	if !ok {
+		return nil, ErrAccessTokenUnknown
+	}
+	update(accessToken)
+	if err := at.save(); err != nil {
+		return nil, err
+	}
+
+	c := *accessToken
+	return &c, nil
+}
+
+func (at *accessTokens) Delete(token string) error {
+	at.Lock()
+	defer at.Unlock()
+
+	token = strings.ToLower(token)
+	if _, ok := at.tokens[token]; !ok {
+		return ErrAccessTokenUnknown
+	}
+	// Sessions keep their binding, so they can not join rooms anymore.
+	delete(at.tokens, token)
+
+	return at.save()
+}
+
+func (at *accessTokens) Get(token string) (*AccessToken, bool) {
+	at.Lock()
+	defer at.Unlock()
+
+	accessToken, ok := at.tokens[strings.ToLower(token)]
+	if !ok {
+		return nil, false
+	}
+	c := *accessToken
+	return &c, true
+}
+
+func (at *accessTokens) List() []*AccessToken {
+	at.Lock()
+	defer at.Unlock()
+	return at.list()
+}
+
+func (at *accessTokens) list() []*AccessToken {
+	tokens := make([]*AccessToken, 0, len(at.tokens))
+	for _, accessToken := range at.tokens {
+		c := *accessToken
+		tokens = append(tokens, &c)
+	}
+	sort.Sort(accessTokensByCreated(tokens))
+	return tokens
+}
+
+type accessTokensByCreated []*AccessToken
+
+func (a accessTokensByCreated) Len() int      { return len(a) }
+func (a accessTokensByCreated) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a accessTokensByCreated) Less(i, j int) bool {
+	if a[i].Created == a[j].Created {
+		return a[i].Token < a[j].Token
+	}
+	return a[i].Created < a[j].Created
+}
+
+// AccessTokenProvider is a TokenProvider accepting the tokens which are
+// currently usable.
+func AccessTokenProvider(tokens AccessTokens) TokenProvider {
+	return func(token string) string {
+		if tokens.Validate(token) != nil {
+			return ""
+		}
+		return strings.ToLower(token)
+	}
+}
@@ -0,0 +1,82 @@
+package channelling
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_AccessTokens_Limits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tokens.json")
+
+	tokens, _ := NewAccessTokens(filename)
+	pass, err := tokens.Create(&AccessToken{Label: "pass", Rooms: []string{"wawaji-*"}, MaxSessions: 1, MaxUses: 2})
+	if err != nil || len(pass.Token) != 32 {
+		t.Fatalf("Unexpected token %+v %v", pass, err)
+	}
+
+	if err := tokens.Bind(pass.Token, "session-1"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// Reconnects of the same session are no new use.
+	if err := tokens.Bind(pass.Token, "session-1"); err != nil {
+		t.Fatalf("Unexpected error %v on reconnect", err)
+	}
+	if err := tokens.Bind(pass.Token, "session-2"); err != ErrAccessTokenMaxSessions {
+		t.Errorf("Expected max sessions, but got %v", err)
+	}
+	if !tokens.AllowsRoom("session-1", "wawaji-1") || tokens.AllowsRoom("session-1", "lobby") {
+		t.Error("Unexpected room permissions")
+	}
+	if !tokens.AllowsRoom("backend-session", "lobby") {
+		t.Error("Expected sessions without token to be allowed")
+	}
+
+	tokens.Release("session-1")
+	if err := tokens.Bind(pass.Token, "session-2"); err != ErrAccessTokenMaxSessions {
+		t.Errorf("Expected session to be still connected, but got %v", err)
+	}
+	tokens.Release("session-1")
+	if err := tokens.Bind(pass.Token, "session-2"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	tokens.Release("session-2")
+	if err := tokens.Validate(pass.Token); err != ErrAccessTokenUsedUp {
+		t.Errorf("Expected token to be used up, but got %v", err)
+	}
+
+	// Counters and limits are stored.
+	tokens, _ = NewAccessTokens(filename)
+	if stored, ok := tokens.Get(pass.Token); !ok || stored.Uses != 2 || stored.Sessions != 0 || stored.FirstUsed == 0 {
+		t.Errorf("Unexpected stored token %+v", stored)
+	}
+
+	timed, _ := tokens.Create(&AccessToken{Token: "Timed", Duration: 60})
+	if err := tokens.Bind("timed", "session-3"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	tokens.Update("timed", func(token *AccessToken) {
+		token.FirstUsed = time.Now().Add(-time.Hour).Unix()
+	})
+	if err := tokens.Validate(timed.Token); err != ErrAccessTokenExpired || tokens.AllowsRoom("session-3", "lobby") {
+		t.Errorf("Expected token to be expired, but got %v", err)
+	}
+
+	tokens.Update("timed", func(token *AccessToken) {
+		token.FirstUsed = 0
+		token.Revoked = true
+	})
+	if err := tokens.Validate("TIMED"); err != ErrAccessTokenRevoked {
+		t.Errorf("Expected token to be revoked, but got %v", err)
+	}
+	if AccessTokenProvider(tokens)("timed") != "" {
+		t.Error("Expected provider to reject revoked token")
+	}
+}
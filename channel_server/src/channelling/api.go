@@ -7,6 +7,7 @@ const (
 
 type ChannellingAPI interface {
 	OnConnect(*Client, *Session) (interface{}, error)
+	OnConnectProcessed(*Client, *Session, interface{}, error)
 	OnDisconnect(*Client, *Session)
 	OnIncoming(Sender, *Session, *DataIncoming) (interface{}, error)
 	OnIncomingProcessed(Sender, *Session, *DataIncoming, interface{}, error)
@@ -21,7 +21,12 @@ type channellingAPI struct {
 	Unicaster         channelling.Unicaster
 	BusManager        channelling.BusManager
 	PipelineManager   channelling.PipelineManager
+	ChatHistory       channelling.ChatHistory
+	OfflineMessages   channelling.OfflineMessages
+	ChatModerator     channelling.ChatModerator
+	ChatMessages      channelling.ChatMessages
 	config            *channelling.Config
+	turnRefresher     *turnRefresher
 }
 
 // New creates and initializes a new ChannellingAPI using
@@ -36,7 +41,11 @@ func New(config *channelling.Config,
 	turnDataCreator channelling.TurnDataCreator,
 	unicaster channelling.Unicaster,
 	busManager channelling.BusManager,
-	pipelineManager channelling.PipelineManager) channelling.ChannellingAPI {
+	pipelineManager channelling.PipelineManager,
+	chatHistory channelling.ChatHistory,
+	offlineMessages channelling.OfflineMessages,
+	chatModerator channelling.ChatModerator,
+	chatMessages channelling.ChatMessages) channelling.ChannellingAPI {
 	return &channellingAPI{
 		roomStatus,
 		sessionEncoder,
@@ -47,7 +56,12 @@ func New(config *channelling.Config,
 		unicaster,
 		busManager,
 		pipelineManager,
+		chatHistory,
+		offlineMessages,
+		chatModerator,
+		chatMessages,
 		config,
+		newTurnRefresher(),
 	}
 }
 
@@ -62,13 +76,24 @@ func (api *channellingAPI) OnConnect(client *channelling.Client, session *channe
 	return self, err
 }
 
+func (api *channellingAPI) OnConnectProcessed(client *channelling.Client, session *channelling.Session, reply interface{}, err error) {
+	if err == nil {
+		// Sessions authenticated on connect get their messages after Self.
+		api.DeliverOfflineMessages(session)
+	}
+}
+
 func (api *channellingAPI) OnDisconnect(client *channelling.Client, session *channelling.Session) {
+	api.stopTurnRefresh(session)
 	api.Unicaster.OnDisconnect(client, session)
 	api.BusManager.Trigger(channelling.BusManagerDisconnect, session.Id, "", nil, nil)
 }
 
 func (api *channellingAPI) OnIncoming(sender channelling.Sender, session *channelling.Session, msg *channelling.DataIncoming) (interface{}, error) {
 	var pipeline *channelling.Pipeline
+	if err := api.authorizeIncoming(session, msg); err != nil {
+		return nil, err
+	}
 	switch msg.Type {
 	case "Self":		//获取个人信息
 		log.Println("OnIncoming -> HandleSelf")
@@ -96,8 +121,23 @@ func (api *channellingAPI) OnIncoming(sender channelling.Sender, session *channe
 			log.Println("Received invalid chat message.", msg)
 			break
 		}
+		if channelling.IsChatChange(msg.Chat.Chat) {
+			return nil, api.HandleChatChange(session, msg.Chat)
+		}
+
+		if msg.Chat.To != "" {
+			// Chats to pipeline sessions are sent to their sink.
+			if sink, _ := api.PipelineManager.FindSinkAndSession(msg.Chat.To); sink != nil {
+				pipeline = api.PipelineManager.GetPipeline(channelling.PipelineNamespaceChat, sender, session, msg.Chat.To)
+			}
+		}
+		api.HandleChat(session, msg.Chat, pipeline)
+	case "ChatHistory":	//获取聊天记录
+		if msg.ChatHistory == nil {
+			return nil, channelling.NewDataError("bad_request", "message did not contain ChatHistory")
+		}
 
-		api.HandleChat(session, msg.Chat)
+		return api.HandleChatHistory(session, msg.ChatHistory)
 	case "Offer":
 		if msg.Offer == nil || msg.Offer.Offer == nil {
 			log.Println("Received invalid offer message.", msg)
@@ -161,6 +201,12 @@ func (api *channellingAPI) OnIncoming(sender channelling.Sender, session *channe
 		//log.Println("Status", msg.Status)
 		session.Update(&channelling.SessionUpdate{Types: []string{"Status"}, Status: msg.Status.Status})
 		session.BroadcastStatus()
+		api.BusManager.Trigger(channelling.BusManagerStatus, session.Id, "", &channelling.BusEventStatus{
+			Version: channelling.BusEventVersion,
+			Roomid:  session.Roomid,
+			Userid:  session.Userid(),
+			Status:  msg.Status.Status,
+		}, nil)
 	case "Conference":
 		if msg.Conference == nil {
 			log.Println("Received invalid conference message.", msg)
@@ -170,6 +216,20 @@ func (api *channellingAPI) OnIncoming(sender channelling.Sender, session *channe
 		api.HandleConference(session, msg.Conference)
 	case "Alive":
 		return msg.Alive, nil
+	case "DeviceTelemetry":
+		if msg.DeviceTelemetry == nil {
+			return nil, channelling.NewDataError("bad_request", "message did not contain DeviceTelemetry")
+		}
+
+		return nil, api.HandleDeviceTelemetry(session, msg.DeviceTelemetry)
+	case "DeviceCommand":
+		if msg.DeviceCommand == nil {
+			return nil, channelling.NewDataError("bad_request", "message did not contain DeviceCommand")
+		}
+
+		return nil, api.HandleDeviceCommand(session, msg.DeviceCommand, sender)
+	case "IceServers":
+		return api.HandleIceServers(session, msg.IceServers)
 	case "Sessions":
 		if msg.Sessions == nil || msg.Sessions.Sessions == nil {
 			return nil, channelling.NewDataError("bad_request", "message did not contain Sessions")
@@ -189,5 +249,7 @@ func (api *channellingAPI) OnIncomingProcessed(sender channelling.Sender, sessio
 		api.JoinRoomProcessed(sender, session, msg, reply, err)
 	case "Room":
 		api.RoomProcessed(sender, session, msg, reply, err)
+	case "Authentication":
+		api.AuthenticationProcessed(sender, session, msg, reply, err)
 	}
 }
@@ -91,8 +91,8 @@ func NewTestChannellingAPI() (channelling.ChannellingAPI, *fakeClient, *channell
 	client, roomManager := &fakeClient{}, &fakeRoomManager{}
 	sessionNonces := securecookie.New(securecookie.GenerateRandomKey(64), nil)
 	session := channelling.NewSession(nil, nil, roomManager, roomManager, nil, sessionNonces, "", "")
-	busManager := channelling.NewBusManager(apiConsumer, "", false, "")
-	api := New(nil, roomManager, nil, nil, nil, nil, nil, nil, busManager, nil)
+	busManager := channelling.NewBusManager(apiConsumer, "", false, "", nil, nil)
+	api := New(nil, roomManager, nil, nil, nil, nil, nil, nil, busManager, nil, nil, nil, nil, nil)
 	apiConsumer.SetChannellingAPI(api)
 	return api, client, session, roomManager
 }
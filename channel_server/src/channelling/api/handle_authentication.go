@@ -2,6 +2,7 @@ package api
 
 import (
 	"log"
+	"time"
 
 	"channelling"
 )
@@ -9,10 +10,35 @@ import (
 func (api *channellingAPI) HandleAuthentication(session *channelling.Session, st *channelling.SessionToken) (*channelling.DataSelf, error) {
 	if err := api.SessionManager.Authenticate(session, st, ""); err != nil {
 		log.Println("Authentication failed", err, st.Userid, st.Nonce)
+		api.config.Audit(&channelling.AuditEvent{
+			Action:     "session.authenticate",
+			Outcome:    channelling.AuditOutcomeFailure,
+			Actor:      st.Userid,
+			Session:    session.Id,
+			RemoteAddr: session.RemoteAddr(),
+			Reason:     err.Error(),
+		})
+		api.BusManager.Trigger(channelling.BusManagerAuthentication, session.Id, st.Userid, &channelling.BusEventAuthentication{
+			Version: channelling.BusEventVersion,
+			Userid:  st.Userid,
+			Reason:  err.Error(),
+		}, nil)
 		return nil, err
 	}
 
 	log.Println("Authentication success", session.Userid())
+	api.config.Audit(&channelling.AuditEvent{
+		Action:     "session.authenticate",
+		Outcome:    channelling.AuditOutcomeSuccess,
+		Actor:      session.Userid(),
+		Session:    session.Id,
+		RemoteAddr: session.RemoteAddr(),
+	})
+	api.BusManager.Trigger(channelling.BusManagerAuthentication, session.Id, session.Userid(), &channelling.BusEventAuthentication{
+		Version: channelling.BusEventVersion,
+		Userid:  session.Userid(),
+		Success: true,
+	}, nil)
 	self, err := api.HandleSelf(session)
 	if err == nil {
 		session.BroadcastStatus()
@@ -20,3 +46,56 @@ func (api *channellingAPI) HandleAuthentication(session *channelling.Session, st
 
 	return self, err
 }
+
+func (api *channellingAPI) AuthenticationProcessed(sender channelling.Sender, session *channelling.Session, msg *channelling.DataIncoming, reply interface{}, err error) {
+	if err == nil {
+		api.DeliverOfflineMessages(session)
+	}
+}
+
+// DeliverOfflineMessages sends the chat messages stored while the user of
+// the session was offline and tells the senders that they were delivered.
+func (api *channellingAPI) DeliverOfflineMessages(session *channelling.Session) {
+	userid := session.Userid()
+	if api.OfflineMessages == nil || userid == "" {
+		return
+	}
+
+	for _, message := range api.OfflineMessages.Take(userid) {
+		chat := message.Chat
+		api.Unicaster.Unicast(session.Id, &channelling.DataOutgoing{
+			From: message.From,
+			To:   session.Id,
+			Data: &channelling.DataChat{
+				To:     session.Id,
+				Userid: chat.Userid,
+				Type:   chat.Type,
+				Chat:   chat.Chat,
+			},
+		}, nil)
+
+		if chat.Chat.Mid == "" {
+			continue
+		}
+		// Mid is below Status so this does not trigger another status.
+		delivered := &channelling.DataChat{
+			To:   message.From,
+			Type: "Chat",
+			Chat: &channelling.DataChatMessage{
+				Time:   time.Now().Unix(),
+				Status: &channelling.DataChatStatus{Mid: chat.Chat.Mid, State: "delivered"},
+			},
+		}
+		if message.Userid == "" {
+			session.Unicast(message.From, delivered, nil)
+		} else if !api.sendUserChat(session, message.Userid, delivered) {
+			// Sender is offline as well, keep the status for later.
+			delivered.Userid = message.Userid
+			api.OfflineMessages.Store(message.Userid, &channelling.OfflineMessage{
+				From:   session.Id,
+				Userid: userid,
+				Chat:   delivered,
+			})
+		}
+	}
+}
@@ -28,15 +28,27 @@ import (
 	"channelling"
 )
 
-func (api *channellingAPI) HandleChat(session *channelling.Session, chat *channelling.DataChat) {
+// HandleChat sends the chat. Unicasts are sent through the pipeline when
+// it is not nil.
+func (api *channellingAPI) HandleChat(session *channelling.Session, chat *channelling.DataChat, pipeline *channelling.Pipeline) {
 	// TODO(longsleep): Limit sent chat messages per incoming connection.
 	msg := chat.Chat
 	to := chat.To
 
+	msg.Time = time.Now().Unix()//Format(time.RFC3339)
+	if !api.moderateChat(session, chat) {
+		return
+	}
+
 	if !msg.NoEcho {
 		session.Unicast(session.Id, chat, nil)
 	}
-	msg.Time = time.Now().Unix()//Format(time.RFC3339)
+
+	//发送给用户
+	if to == "" && chat.Userid != "" {
+		api.handleUserChat(session, chat)
+		return
+	}
 
 	//广播
 	if to == "" {
@@ -44,6 +56,9 @@ func (api *channellingAPI) HandleChat(session *channelling.Session, chat *channe
 		if session.Hello {
 			api.StatsCounter.CountBroadcastChat()
 			session.Broadcast(chat)
+			api.addChatHistory(session, "", "", chat)
+			api.recordChat(session, msg, session.Roomid, "", "")
+			api.triggerChat(session, msg, session.Roomid, "", "")
 		}
 	} else {
 		//单播
@@ -61,22 +76,139 @@ func (api *channellingAPI) HandleChat(session *channelling.Session, chat *channe
 					return
 				}
 				msg.Status.ContactRequest.Userid = session.Userid()
+				api.BusManager.Trigger(channelling.BusManagerContactRequest, session.Id, "", &channelling.BusEventContactRequest{
+					Version: channelling.BusEventVersion,
+					To:      to,
+					Userid:  msg.Status.ContactRequest.Userid,
+					Id:      msg.Status.ContactRequest.Id,
+					Success: msg.Status.ContactRequest.Success,
+				}, nil)
 			}
 		} else {
 			api.StatsCounter.CountUnicastChat()
 		}
 
-		session.Unicast(to, chat, nil)
-		if msg.Mid != "" {
-			// Send out delivery confirmation status chat message.
-			session.Unicast(session.Id, &channelling.DataChat{
-				To: to, 
-				Type: "Chat", 
-				Chat: &channelling.DataChatMessage{
-					Mid: msg.Mid, 
-					Status: &channelling.DataChatStatus{State: "sent"},
-				},
-			}, nil)
+		session.Unicast(to, chat, pipeline)
+		api.addChatHistory(session, to, "", chat)
+		api.recordChat(session, msg, "", to, "")
+		api.triggerChat(session, msg, "", to, "")
+		api.sendChatState(session, to, msg, "sent")
+	}
+}
+
+// handleUserChat sends the chat to all sessions of the user addressed by
+// Userid. If the user has no live sessions, the chat of an authenticated
+// sender to an existing user is stored and delivered when the user
+// authenticates the next time.
+func (api *channellingAPI) handleUserChat(session *channelling.Session, chat *channelling.DataChat) {
+	msg := chat.Chat
+	if msg.Status != nil && msg.Status.ContactRequest != nil {
+		log.Println("Ignoring contact request to user.", chat.Userid)
+		return
+	}
+	if msg.Status == nil {
+		api.StatsCounter.CountUnicastChat()
+	}
+
+	if !api.sendUserChat(session, chat.Userid, chat) {
+		if api.OfflineMessages == nil || !channelling.IsOfflineMessage(msg) {
+			return
+		}
+		if session.Userid() == "" || !api.SessionManager.UserExists(chat.Userid) {
+			log.Println("Ignoring offline message to user.", chat.Userid)
+			return
+		}
+		if !api.OfflineMessages.Store(chat.Userid, &channelling.OfflineMessage{
+			From:   session.Id,
+			Userid: session.Userid(),
+			Chat:   chat,
+		}) {
+			log.Println("Offline messages are full, dropped message to user.", chat.Userid)
+			return
+		}
+	}
+	api.addChatHistory(session, "", chat.Userid, chat)
+	api.recordChat(session, msg, "", "", chat.Userid)
+	api.triggerChat(session, msg, "", "", chat.Userid)
+	api.sendChatState(session, "", msg, "sent")
+}
+
+// sendUserChat unicasts the chat to all live sessions of a user and returns
+// false if there were none.
+func (api *channellingAPI) sendUserChat(session *channelling.Session, userid string, chat *channelling.DataChat) bool {
+	user, ok := api.SessionManager.GetUser(userid)
+	if !ok {
+		return false
+	}
+	ids := user.SessionIds()
+	for _, id := range ids {
+		session.Unicast(id, &channelling.DataChat{
+			To:     id,
+			Userid: chat.Userid,
+			Type:   chat.Type,
+			Chat:   chat.Chat,
+		}, nil)
+	}
+
+	return len(ids) > 0
+}
+
+func (api *channellingAPI) sendChatState(session *channelling.Session, to string, msg *channelling.DataChatMessage, state string) {
+	if msg.Mid != "" {
+		// Send out delivery status chat message.
+		session.Unicast(session.Id, &channelling.DataChat{
+			To: to, 
+			Type: "Chat", 
+			Chat: &channelling.DataChatMessage{
+				Mid: msg.Mid, 
+				Status: &channelling.DataChatStatus{State: state},
+			},
+		}, nil)
+	}
+}
+
+// recordChat remembers where a message with a Mid was sent, so it can be
+// edited, deleted and reacted to later.
+func (api *channellingAPI) recordChat(session *channelling.Session, msg *channelling.DataChatMessage, roomid, to, toUserid string) {
+	if api.ChatMessages == nil || msg.Mid == "" || !channelling.IsChatHistoryMessage(msg) {
+		return
+	}
+
+	if to != "" && toUserid == "" {
+		if peer, ok := api.Unicaster.GetSession(to); ok {
+			toUserid = peer.Userid()
 		}
 	}
+	api.ChatMessages.Add(&channelling.ChatMessageRecord{
+		Mid:      msg.Mid,
+		From:     session.Id,
+		Userid:   session.Userid(),
+		Roomid:   roomid,
+		To:       to,
+		ToUserid: toUserid,
+	})
+}
+
+// triggerChat sends the chat event on the bus, with the message only when
+// enabled in the configuration.
+func (api *channellingAPI) triggerChat(session *channelling.Session, msg *channelling.DataChatMessage, roomid, to, toUserid string) {
+	if !channelling.IsChatHistoryMessage(msg) {
+		return
+	}
+
+	event := &channelling.BusEventChat{
+		Version:  channelling.BusEventVersion,
+		Roomid:   roomid,
+		To:       to,
+		ToUserid: toUserid,
+		Userid:   session.Userid(),
+		Mid:      msg.Mid,
+		Time:     msg.Time,
+	}
+	if api.config != nil && api.config.BusChatContent {
+		event.Message = msg.Message
+	} else {
+		event.Redacted = true
+	}
+	api.BusManager.Trigger(channelling.BusManagerChat, session.Id, "", event, nil)
 }
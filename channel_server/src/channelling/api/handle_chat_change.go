@@ -0,0 +1,148 @@
+package api
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"channelling"
+)
+
+const (
+	maxReactionLength = 32
+)
+
+// HandleChatChange edits, deletes or reacts to an earlier chat message and
+// sends the change to the room or the unicast peer of that message.
+func (api *channellingAPI) HandleChatChange(session *channelling.Session, chat *channelling.DataChat) error {
+	if api.ChatMessages == nil {
+		return channelling.NewDataError("chat_changes_not_enabled", "Chat message changes are not enabled")
+	}
+
+	status := chat.Chat.Status
+	var mid string
+	switch {
+	case status.Edit != nil:
+		mid = status.Edit.Mid
+	case status.Delete != nil:
+		mid = status.Delete.Mid
+	default:
+		mid = status.Reaction.Mid
+	}
+	record, ok := api.ChatMessages.Find(session, mid)
+	if !ok || record.Deleted || !record.IsParticipant(session) {
+		return channelling.NewDataError("unknown_message", "Unknown chat message")
+	}
+
+	now := time.Now().Unix()
+	change := &channelling.DataChatStatus{}
+	var update func(*channelling.DataChatMessage)
+	switch {
+	case status.Edit != nil:
+		if !api.mayChangeChat(session, &record) {
+			return channelling.NewDataError("not_allowed", "Only the sender or a room owner can edit this message")
+		}
+		edited := &channelling.DataChatMessage{Message: status.Edit.Message, Time: now}
+		if edited.Message == "" {
+			return channelling.NewDataError("bad_request", "edit without message, use delete instead")
+		}
+		if !api.moderateChat(session, &channelling.DataChat{To: record.To, Userid: record.ToUserid, Type: "Chat", Chat: edited}) {
+			return channelling.NewDataError("message_blocked", "Edited message was blocked")
+		}
+		change.Edit = &channelling.DataChatEdit{Mid: mid, Message: edited.Message, Time: now}
+		update = func(msg *channelling.DataChatMessage) {
+			msg.Message = edited.Message
+			msg.Edited = now
+		}
+	case status.Delete != nil:
+		if !api.mayChangeChat(session, &record) {
+			return channelling.NewDataError("not_allowed", "Only the sender or a room owner can delete this message")
+		}
+		if !api.ChatMessages.Delete(&record) {
+			return channelling.NewDataError("unknown_message", "Unknown chat message")
+		}
+		change.Delete = &channelling.DataChatDelete{Mid: mid}
+		update = func(msg *channelling.DataChatMessage) {
+			msg.Message = ""
+			msg.Status = nil
+			msg.Reactions = nil
+			msg.Deleted = true
+		}
+	default:
+		reaction := status.Reaction.Reaction
+		if reaction == "" || len(reaction) > maxReactionLength || !utf8.ValidString(reaction) {
+			return channelling.NewDataError("bad_request", "invalid reaction")
+		}
+		reactor := session.Userid()
+		if reactor == "" {
+			reactor = session.Id
+		}
+		reactions, ok := api.ChatMessages.React(&record, reactor, reaction, status.Reaction.Remove)
+		if !ok {
+			return channelling.NewDataError("reaction_not_allowed", "Cannot add more reactions to this message")
+		}
+		change.Reaction = &channelling.DataChatReaction{
+			Mid:       mid,
+			Reaction:  reaction,
+			Remove:    status.Reaction.Remove,
+			Reactions: reactions,
+		}
+		update = func(msg *channelling.DataChatMessage) {
+			msg.Reactions = reactions
+		}
+	}
+
+	api.updateChatHistory(&record, update)
+	api.sendChatChange(session, &record, &channelling.DataChatMessage{Time: now, Status: change})
+	return nil
+}
+
+// mayChangeChat returns true if the session sent the message or if the
+// user of the session is an owner of the room the message was sent to.
+func (api *channellingAPI) mayChangeChat(session *channelling.Session, record *channelling.ChatMessageRecord) bool {
+	if record.IsSender(session) {
+		return true
+	}
+	if record.Roomid == "" {
+		return false
+	}
+	room, ok := api.RoomStatusManager.Get(record.Roomid)
+	return ok && room.IsOwner(session.Userid())
+}
+
+func (api *channellingAPI) updateChatHistory(record *channelling.ChatMessageRecord, update func(*channelling.DataChatMessage)) {
+	if api.ChatHistory == nil {
+		return
+	}
+
+	if record.Roomid != "" {
+		var roomType string
+		if room, ok := api.RoomStatusManager.Get(record.Roomid); ok {
+			roomType = room.GetType()
+		}
+		api.ChatHistory.Update(channelling.ChatHistoryRoomKey(record.Roomid), roomType, record.Mid, update)
+	} else if record.Userid != "" && record.ToUserid != "" {
+		api.ChatHistory.Update(channelling.ChatHistoryUserKey(record.Userid, record.ToUserid), channelling.ChatHistoryTypeUser, record.Mid, update)
+	}
+}
+
+// sendChatChange sends the change to the room of the message, or to the
+// other side of the unicast conversation, and back to the session.
+func (api *channellingAPI) sendChatChange(session *channelling.Session, record *channelling.ChatMessageRecord, msg *channelling.DataChatMessage) {
+	if record.Roomid != "" {
+		chat := &channelling.DataChat{Type: "Chat", Chat: msg}
+		session.Broadcast(chat)
+		session.Unicast(session.Id, chat, nil)
+		return
+	}
+
+	to, userid := record.From, record.Userid
+	if record.IsSender(session) {
+		to, userid = record.To, record.ToUserid
+	}
+	if userid != "" {
+		api.sendUserChat(session, userid, &channelling.DataChat{Userid: userid, Type: "Chat", Chat: msg})
+	} else {
+		session.Unicast(to, &channelling.DataChat{To: to, Type: "Chat", Chat: msg}, nil)
+	}
+	session.Unicast(session.Id, &channelling.DataChat{To: to, Userid: userid, Type: "Chat", Chat: msg}, nil)
+}
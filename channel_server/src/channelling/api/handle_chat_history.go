@@ -0,0 +1,76 @@
+package api
+
+import (
+	"channelling"
+)
+
+func (api *channellingAPI) HandleChatHistory(session *channelling.Session, request *channelling.DataChatHistoryRequest) (*channelling.DataChatHistory, error) {
+	if api.ChatHistory == nil {
+		return nil, channelling.NewDataError("chat_history_not_enabled", "Chat history is not enabled")
+	}
+
+	key, historyType, err := api.chatHistoryKey(session, request.To, request.Userid)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, more := api.ChatHistory.Get(key, historyType, request)
+	return &channelling.DataChatHistory{
+		Type:     "ChatHistory",
+		To:       request.To,
+		Userid:   request.Userid,
+		Messages: messages,
+		More:     more,
+	}, nil
+}
+
+func (api *channellingAPI) addChatHistory(session *channelling.Session, to, userid string, chat *channelling.DataChat) {
+	if api.ChatHistory == nil || !channelling.IsChatHistoryMessage(chat.Chat) {
+		return
+	}
+
+	key, historyType, err := api.chatHistoryKey(session, to, userid)
+	if err != nil {
+		// Not a conversation we keep history for.
+		return
+	}
+
+	api.ChatHistory.Add(key, historyType, &channelling.DataChatHistoryEntry{
+		From:   session.Id,
+		Userid: session.Userid(),
+		To:     to,
+		Chat:   chat.Chat,
+	})
+}
+
+// chatHistoryKey returns the history key and type for the current room of
+// the session when to and userid are empty, or for the unicast conversation
+// between the user of the session and the given peer.
+func (api *channellingAPI) chatHistoryKey(session *channelling.Session, to, userid string) (string, string, error) {
+	if to == "" && userid == "" {
+		if !session.Hello {
+			return "", "", channelling.NewDataError("not_in_room", "Cannot get chat history without a current room")
+		}
+
+		var roomType string
+		if room, ok := api.RoomStatusManager.Get(session.Roomid); ok {
+			roomType = room.GetType()
+		}
+		return channelling.ChatHistoryRoomKey(session.Roomid), roomType, nil
+	}
+
+	suserid := session.Userid()
+	if suserid == "" {
+		return "", "", channelling.NewDataError("no_userid", "Chat history for conversations requires an authenticated user")
+	}
+	if userid == "" {
+		if peer, ok := api.Unicaster.GetSession(to); ok {
+			userid = peer.Userid()
+		}
+	}
+	if userid == "" {
+		return "", "", channelling.NewDataError("no_such_user", "cannot retrieve user for conversation")
+	}
+
+	return channelling.ChatHistoryUserKey(suserid, userid), channelling.ChatHistoryTypeUser, nil
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"log"
+
+	"channelling"
+)
+
+// moderateChat runs the chat filters for the message and returns false if
+// the message must not be sent. Filters might rewrite the message.
+func (api *channellingAPI) moderateChat(session *channelling.Session, chat *channelling.DataChat) bool {
+	if api.ChatModerator == nil {
+		return true
+	}
+
+	msg := chat.Chat
+	ctx := &channelling.ChatFilterContext{
+		Session: session,
+		To:      chat.To,
+		Userid:  chat.Userid,
+	}
+	if chat.To == "" && chat.Userid == "" {
+		if room, ok := api.RoomStatusManager.Get(session.Roomid); ok {
+			ctx.RoomType = room.GetType()
+		}
+	} else {
+		ctx.RoomType = channelling.ChatHistoryTypeUser
+	}
+
+	original := *msg
+	action, reason := api.ChatModerator.Moderate(ctx, msg)
+	if action == channelling.ChatFilterAllow {
+		return true
+	}
+
+	log.Println("Chat message moderated", action, reason, session.Id)
+	moderation := &channelling.DataModeration{
+		Type:   "Moderation",
+		Action: action.String(),
+		Reason: reason,
+		From:   session.Id,
+		Userid: session.Userid(),
+		To:     chat.To,
+		Roomid: session.Roomid,
+		Chat:   &original,
+	}
+	api.notifyModerators(session, moderation)
+	api.BusManager.Trigger(channelling.BusManagerModeration, session.Id, reason, moderation, nil)
+
+	if action == channelling.ChatFilterDrop {
+		api.sendChatState(session, chat.To, msg, "blocked")
+		return false
+	}
+
+	return true
+}
+
+// notifyModerators sends the moderation to all moderators in the room of
+// the session.
+func (api *channellingAPI) notifyModerators(session *channelling.Session, moderation *channelling.DataModeration) {
+	room, ok := api.RoomStatusManager.Get(session.Roomid)
+	if !ok {
+		return
+	}
+
+	for _, id := range room.SessionIDs() {
+		if id == session.Id {
+			continue
+		}
+		if moderator, ok := api.Unicaster.GetSession(id); ok && api.ChatModerator.IsModerator(moderator) {
+			api.Unicaster.Unicast(id, &channelling.DataOutgoing{
+				From: session.Id,
+				To:   id,
+				Data: moderation,
+			}, nil)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"channelling"
+)
+
+// HandleDeviceTelemetry sends the telemetry of a device session to the
+// other sessions in its room.
+func (api *channellingAPI) HandleDeviceTelemetry(session *channelling.Session, telemetry *channelling.DataDeviceTelemetry) error {
+	deviceID := session.DeviceId()
+	if deviceID == "" {
+		return channelling.NewDataError("device_only", "Only device sessions can send telemetry")
+	}
+	if !session.Hello {
+		return channelling.NewDataError("not_in_room", "Cannot send telemetry without a current room")
+	}
+
+	session.Broadcast(&channelling.DataDeviceTelemetry{
+		Type:      "DeviceTelemetry",
+		DeviceId:  deviceID,
+		Telemetry: telemetry.Telemetry,
+	})
+	return nil
+}
+
+// HandleDeviceCommand sends a command of an authorized user session to all
+// sessions of the device. Without connected device sessions, the command
+// is sent through a pipeline to the pipeline session of the device.
+func (api *channellingAPI) HandleDeviceCommand(session *channelling.Session, command *channelling.DataDeviceCommand, sender channelling.Sender) error {
+	if command.DeviceId == "" || command.Command == "" {
+		return channelling.NewDataError("bad_request", "command without device or command")
+	}
+	if !api.mayCommandDevice(session, command.DeviceId) {
+		return channelling.NewDataError("device_not_allowed", "Not allowed to control this device")
+	}
+
+	deviceCommand := &channelling.DataDeviceCommand{
+		Type:     "DeviceCommand",
+		DeviceId: command.DeviceId,
+		Command:  command.Command,
+		Args:     command.Args,
+		Userid:   session.Userid(),
+	}
+	sent := false
+	if user, ok := api.SessionManager.GetUser(channelling.DeviceUseridPrefix + command.DeviceId); ok {
+		for _, id := range user.SessionIds() {
+			// Users can not pose as device by having a device userid.
+			if device, ok := api.Unicaster.GetSession(id); !ok || device.DeviceId() != command.DeviceId {
+				continue
+			}
+			session.Unicast(id, deviceCommand, nil)
+			sent = true
+		}
+	}
+	if !sent {
+		if device, ok := api.PipelineManager.GetDeviceSession(command.DeviceId); ok {
+			pipeline := api.PipelineManager.GetPipeline(channelling.PipelineNamespaceDevice, sender, session, device.Id)
+			session.Unicast(device.Id, deviceCommand, pipeline)
+			sent = pipeline != nil
+		}
+	}
+	if !sent {
+		return channelling.NewDataError("device_not_connected", "Device is not connected")
+	}
+
+	return nil
+}
+
+// mayCommandDevice returns true for authenticated user sessions which are
+// granted device control by the policy, or without policy which are bound
+// to the device in the device registry. Room metadata can be changed by
+// clients and is never trusted.
+func (api *channellingAPI) mayCommandDevice(session *channelling.Session, deviceID string) bool {
+	if session.Userid() == "" || session.DeviceId() != "" || api.config == nil {
+		return false
+	}
+	if api.config.Policy != nil {
+		return api.config.Allowed(session, channelling.PermissionDeviceControl, deviceID)
+	}
+	if api.config.Devices == nil {
+		return false
+	}
+
+	device, ok := api.config.Devices.Get(deviceID)
+	return ok && !device.Disabled && device.MayControl(session)
+}
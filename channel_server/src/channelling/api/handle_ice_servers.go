@@ -0,0 +1,54 @@
+package api
+
+import (
+	"strings"
+
+	"channelling"
+)
+
+// HandleIceServers returns the ICE servers of the session. Clients behind
+// restrictive firewalls send the transports they can use, which are kept
+// for all further ICE server lists of the session.
+func (api *channellingAPI) HandleIceServers(session *channelling.Session, iceServers *channelling.DataIceServers) (*channelling.DataIceServers, error) {
+	if iceServers != nil && iceServers.Transports != nil {
+		transports, err := channelling.ParseIceTransports(iceServers.Transports)
+		if err != nil {
+			return nil, err
+		}
+		session.SetTransports(transports)
+	}
+
+	return api.createIceServers(session), nil
+}
+
+// createIceServers returns the ICE servers for the current room of the
+// session with fresh TURN credentials.
+func (api *channellingAPI) createIceServers(session *channelling.Session) *channelling.DataIceServers {
+	iceServers := &channelling.DataIceServers{
+		Type:       "IceServers",
+		Transports: session.Transports(),
+		Turn:       api.TurnDataCreator.CreateTurnData(session),
+		Stun:       api.config.StunURIsForSession(session),
+	}
+	session.SetIceServers(api.iceServersKey(session))
+	api.scheduleTurnRefresh(session, iceServers.Turn)
+
+	return iceServers
+}
+
+// iceServersKey returns the STUN and TURN servers selected for the session,
+// which change with the pool of its room.
+func (api *channellingAPI) iceServersKey(session *channelling.Session) string {
+	return strings.Join(api.config.StunURIsForSession(session), " ") + "|" + strings.Join(api.config.TurnURIsForSession(session), " ")
+}
+
+// sendIceServers pushes the ICE servers to the session when joining a room
+// selected other STUN/TURN servers. Otherwise the servers and the refresh of
+// their credentials are kept.
+func (api *channellingAPI) sendIceServers(session *channelling.Session) {
+	if !session.SetIceServers(api.iceServersKey(session)) {
+		return
+	}
+	iceServers := api.createIceServers(session)
+	api.Unicaster.Unicast(session.Id, &channelling.DataOutgoing{From: session.Id, To: session.Id, Data: iceServers}, nil)
+}
@@ -32,5 +32,6 @@ func (api *channellingAPI) HandleJoinRoom(session *channelling.Session, dataJoin
 func (api *channellingAPI) JoinRoomProcessed(sender channelling.Sender, session *channelling.Session, msg *channelling.DataIncoming, reply interface{}, err error) {
 	if err == nil {
 		api.SendConferenceRoomUpdate(session)
+		api.sendIceServers(session)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"channelling"
+)
+
+// authorizeIncoming checks the permissions the policy requires for the
+// incoming message. Room joins and creation are checked by the room
+// manager.
+func (api *channellingAPI) authorizeIncoming(session *channelling.Session, msg *channelling.DataIncoming) error {
+	if api.config == nil || api.config.Policy == nil {
+		return nil
+	}
+
+	switch msg.Type {
+	case "Chat":
+		if msg.Chat == nil || msg.Chat.Chat == nil {
+			return nil
+		}
+		resource := channelling.ChatHistoryTypeUser
+		if msg.Chat.To == "" && msg.Chat.Userid == "" {
+			resource = api.sessionRoomType(session)
+		}
+		if !api.config.Allowed(session, channelling.PermissionChatSend, resource) {
+			return channelling.NewDataError("chat_not_allowed", "Not allowed to send chat messages")
+		}
+		if status := msg.Chat.Chat.Status; status != nil && status.ContactRequest != nil && !api.config.Allowed(session, channelling.PermissionContacts, "") {
+			return channelling.NewDataError("contacts_not_allowed", "Not allowed to use contacts")
+		}
+	case "Users":
+		if !api.config.Allowed(session, channelling.PermissionUsersList, api.sessionRoomType(session)) {
+			return channelling.NewDataError("users_not_allowed", "Not allowed to list users")
+		}
+	case "Sessions":
+		if msg.Sessions != nil && msg.Sessions.Sessions != nil && msg.Sessions.Sessions.Type == "contact" && !api.config.Allowed(session, channelling.PermissionContacts, "") {
+			return channelling.NewDataError("contacts_not_allowed", "Not allowed to use contacts")
+		}
+	case "Room":
+		if msg.Room != nil && msg.Room.Metadata != nil && msg.Room.Metadata.DeviceId != "" && !api.config.Allowed(session, channelling.PermissionDeviceControl, msg.Room.Metadata.DeviceId) {
+			return channelling.NewDataError("device_not_allowed", "Not allowed to control this device")
+		}
+	}
+
+	return nil
+}
+
+func (api *channellingAPI) sessionRoomType(session *channelling.Session) string {
+	if room, ok := api.RoomStatusManager.Get(session.Roomid); ok {
+		return room.GetType()
+	}
+	return ""
+}
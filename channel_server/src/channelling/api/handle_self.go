@@ -7,13 +7,25 @@ import (
 )
 
 func (api *channellingAPI) HandleSelf(session *channelling.Session) (*channelling.DataSelf, error) {
+	self, err := api.createSelf(session)
+	if err != nil {
+		return nil, err
+	}
+	api.BusManager.Trigger(channelling.BusManagerSession, session.Id, session.Userid(), nil, nil)
+
+	return self, nil
+}
+
+// createSelf returns a Self document with fresh TURN credentials, which are
+// refreshed again before they expire.
+func (api *channellingAPI) createSelf(session *channelling.Session) (*channelling.DataSelf, error) {
 	token, err := api.SessionEncoder.EncodeSessionToken(session)
 	if err != nil {
 		log.Println("Error in OnRegister", err)
 		return nil, err
 	}
 
-	log.Println("Created new session token", len(token), token)
+	log.Println("Created new session token", len(token))
 	self := &channelling.DataSelf{
 		Type:       "Self",
 		Id:         session.Id,
@@ -24,9 +36,10 @@ func (api *channellingAPI) HandleSelf(session *channelling.Session) (*channellin
 		Version:    api.config.Version,
 		ApiVersion: apiVersion,
 		Turn:       api.TurnDataCreator.CreateTurnData(session),
-		Stun:       api.config.StunURIs,
+		Stun:       api.config.StunURIsForSession(session),
 	}
-	api.BusManager.Trigger(channelling.BusManagerSession, session.Id, session.Userid(), nil, nil)
+	session.SetIceServers(api.iceServersKey(session))
+	api.scheduleTurnRefresh(session, self.Turn)
 
 	return self, nil
 }
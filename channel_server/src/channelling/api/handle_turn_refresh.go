@@ -0,0 +1,65 @@
+package api
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"channelling"
+)
+
+// turnRefreshFactor is the part of the TURN credential lifetime after which
+// a fresh Self document is pushed to the session.
+const turnRefreshFactor = 0.9
+
+type turnRefresher struct {
+	sync.Mutex
+	timers map[*channelling.Session]*time.Timer
+}
+
+func newTurnRefresher() *turnRefresher {
+	return &turnRefresher{timers: make(map[*channelling.Session]*time.Timer)}
+}
+
+// scheduleTurnRefresh pushes a fresh Self document to the session before
+// its TURN credentials expire.
+func (api *channellingAPI) scheduleTurnRefresh(session *channelling.Session, turn *channelling.DataTurn) {
+	if turn == nil || turn.Ttl <= 0 {
+		return
+	}
+	delay := time.Duration(float64(turn.Ttl)*turnRefreshFactor) * time.Second
+
+	api.turnRefresher.Lock()
+	if timer, ok := api.turnRefresher.timers[session]; ok {
+		timer.Stop()
+	}
+	api.turnRefresher.timers[session] = time.AfterFunc(delay, func() {
+		api.refreshTurn(session)
+	})
+	api.turnRefresher.Unlock()
+}
+
+func (api *channellingAPI) stopTurnRefresh(session *channelling.Session) {
+	api.turnRefresher.Lock()
+	if timer, ok := api.turnRefresher.timers[session]; ok {
+		timer.Stop()
+		delete(api.turnRefresher.timers, session)
+	}
+	api.turnRefresher.Unlock()
+}
+
+func (api *channellingAPI) refreshTurn(session *channelling.Session) {
+	// Sessions which were replaced or disconnected meanwhile are not
+	// refreshed.
+	if current, ok := api.Unicaster.GetSession(session.Id); !ok || current != session {
+		api.stopTurnRefresh(session)
+		return
+	}
+
+	self, err := api.createSelf(session)
+	if err != nil {
+		log.Println("Failed to refresh TURN credentials", session.Id, err)
+		return
+	}
+	api.Unicaster.Unicast(session.Id, &channelling.DataOutgoing{From: session.Id, To: session.Id, Data: self}, nil)
+}
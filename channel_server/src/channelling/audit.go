@@ -0,0 +1,245 @@
+package channelling
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+
+	auditQueryLimit    = 100
+	auditQueryLimitMax = 1000
+)
+
+// AuditEvent is a security relevant event, stored as one JSON line.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Outcome    string    `json:"outcome"`
+	Actor      string    `json:"actor,omitempty"`      // Userid, device or admin.
+	Session    string    `json:"session,omitempty"`    // Public session id.
+	RemoteAddr string    `json:"remoteAddr,omitempty"` // Remote address of the request.
+	Target     string    `json:"target,omitempty"`     // Affected user, room, token or device.
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// AuditFilter selects audit events. Empty fields match all events.
+type AuditFilter struct {
+	Action  string
+	Outcome string
+	Actor   string
+	Session string
+	Target  string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+func (filter *AuditFilter) match(event *AuditEvent) bool {
+	switch {
+	case filter.Action != "" && filter.Action != event.Action:
+	case filter.Outcome != "" && filter.Outcome != event.Outcome:
+	case filter.Actor != "" && filter.Actor != event.Actor:
+	case filter.Session != "" && filter.Session != event.Session:
+	case filter.Target != "" && filter.Target != event.Target:
+	case !filter.Since.IsZero() && event.Time.Before(filter.Since):
+	case !filter.Until.IsZero() && event.Time.After(filter.Until):
+	default:
+		return true
+	}
+	return false
+}
+
+// AuditPublisher publishes audit events, eg. the BusManager.
+type AuditPublisher interface {
+	Publish(subject string, v interface{}) error
+}
+
+// AuditLog is an append only log of audit events.
+type AuditLog interface {
+	Record(event *AuditEvent)
+	Query(filter *AuditFilter) ([]*AuditEvent, error)
+}
+
+type auditLog struct {
+	sync.Mutex
+	filename  string
+	maxSize   int64
+	maxFiles  int
+	file      *os.File
+	size      int64
+	publisher AuditPublisher
+	subject   string
+}
+
+// NewAuditLog appends audit events to the file, which is rotated to
+// filename.1 to filename.<maxFiles> when it grows beyond maxSize bytes.
+// Events are also published to the subject when a publisher is given.
+func NewAuditLog(filename string, maxSize int64, maxFiles int, publisher AuditPublisher, subject string) (AuditLog, error) {
+	audit := &auditLog{
+		filename:  filename,
+		maxSize:   maxSize,
+		maxFiles:  maxFiles,
+		publisher: publisher,
+		subject:   subject,
+	}
+	if err := audit.open(); err != nil {
+		return nil, err
+	}
+
+	return audit, nil
+}
+
+func (audit *auditLog) open() error {
+	file, err := os.OpenFile(audit.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	audit.file = file
+	audit.size = info.Size()
+
+	return nil
+}
+
+// rotate must be called with the lock held.
+func (audit *auditLog) rotate() error {
+	audit.file.Close()
+	audit.file = nil
+	for i := audit.maxFiles; i > 1; i-- {
+		os.Rename(audit.rotated(i-1), audit.rotated(i))
+	}
+	if audit.maxFiles > 0 {
+		if err := os.Rename(audit.filename, audit.rotated(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(audit.filename); err != nil {
+		return err
+	}
+
+	return audit.open()
+}
+
+func (audit *auditLog) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", audit.filename, i)
+}
+
+func (audit *auditLog) Record(event *AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Failed to encode audit event", err)
+		return
+	}
+	data = append(data, '\n')
+
+	audit.Lock()
+	if audit.file != nil && audit.maxSize > 0 && audit.size > 0 && audit.size+int64(len(data)) > audit.maxSize {
+		if err = audit.rotate(); err != nil {
+			log.Println("Failed to rotate audit log", err)
+		}
+	}
+	if audit.file == nil {
+		// Rotation failed before, try to open again.
+		err = audit.open()
+	}
+	if audit.file != nil {
+		var n int
+		n, err = audit.file.Write(data)
+		audit.size += int64(n)
+	}
+	audit.Unlock()
+	if err != nil {
+		log.Println("Failed to write audit event", err)
+	}
+
+	if audit.publisher != nil && audit.subject != "" {
+		if err := audit.publisher.Publish(audit.subject, event); err != nil {
+			log.Println("Failed to publish audit event", err)
+		}
+	}
+}
+
+// Query returns the latest matching events, oldest first.
+func (audit *auditLog) Query(filter *AuditFilter) ([]*AuditEvent, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = auditQueryLimit
+	} else if limit > auditQueryLimitMax {
+		limit = auditQueryLimitMax
+	}
+
+	// Open the files with the lock held, rotation only renames them and
+	// open files can be read without the lock.
+	audit.Lock()
+	var files []io.Reader
+	var closers []io.Closer
+	defer func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+	for i := audit.maxFiles; i >= 0; i-- {
+		filename := audit.filename
+		if i > 0 {
+			filename = audit.rotated(i)
+		}
+		file, err := os.Open(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			audit.Unlock()
+			return nil, err
+		}
+		closers = append(closers, file)
+		if i == 0 {
+			// Stop at the size written so far.
+			files = append(files, io.LimitReader(file, audit.size))
+		} else {
+			files = append(files, file)
+		}
+	}
+	audit.Unlock()
+
+	var events []*AuditEvent
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			event := &AuditEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), event); err != nil || !filter.match(event) {
+				continue
+			}
+			events = append(events, event)
+			if len(events) > limit {
+				events = events[1:]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// Audit records the event when an audit log is configured.
+func (config *Config) Audit(event *AuditEvent) {
+	if config == nil || config.AuditLog == nil {
+		return
+	}
+	config.AuditLog.Record(event)
+}
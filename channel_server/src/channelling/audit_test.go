@@ -0,0 +1,93 @@
+package channelling
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeAuditPublisher struct {
+	subjects []string
+}
+
+func (publisher *fakeAuditPublisher) Publish(subject string, v interface{}) error {
+	publisher.subjects = append(publisher.subjects, subject)
+	return nil
+}
+
+func Test_AuditLog_RotateAndQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	publisher := &fakeAuditPublisher{}
+	audit, err := NewAuditLog(filename, 400, 2, publisher, "channelling.audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < 8; i++ {
+		outcome := AuditOutcomeSuccess
+		if i%2 == 1 {
+			outcome = AuditOutcomeFailure
+		}
+		audit.Record(&AuditEvent{Action: "session.patch", Outcome: outcome, Actor: "u1", Session: "s1", RemoteAddr: "127.0.0.1:1234"})
+	}
+	audit.Record(&AuditEvent{Action: "room.pin", Outcome: AuditOutcomeSuccess, Actor: "u2", Target: "lobby"})
+
+	if len(publisher.subjects) != 9 || publisher.subjects[0] != "channelling.audit" {
+		t.Errorf("Unexpected published events %v", publisher.subjects)
+	}
+	if _, err := os.Stat(filename + ".1"); err != nil {
+		t.Errorf("Expected rotated audit log, %v", err)
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 2 rotated files, %v", err)
+	}
+
+	events, err := audit.Query(&AuditFilter{Action: "room.pin"})
+	if err != nil || len(events) != 1 || events[0].Target != "lobby" || events[0].Time.Before(start) {
+		t.Errorf("Unexpected events %+v %v", events, err)
+	}
+	events, _ = audit.Query(&AuditFilter{Outcome: AuditOutcomeFailure, Limit: 2})
+	if len(events) != 2 || events[0].Time.After(events[1].Time) {
+		t.Errorf("Unexpected limited events %+v", events)
+	}
+	if events, _ := audit.Query(&AuditFilter{Since: time.Now().Add(time.Minute)}); len(events) != 0 {
+		t.Errorf("Expected no events in the future, but got %+v", events)
+	}
+
+	// Without audit log nothing is recorded.
+	var config *Config
+	config.Audit(&AuditEvent{Action: "room.pin"})
+}
+
+func Test_AuditLog_ReopensAfterFailedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+
+	audit, err := NewAuditLog(filename, 100, 1, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Record(&AuditEvent{Action: "session.patch", Outcome: AuditOutcomeSuccess})
+
+	// Rotation fails while the directory is gone.
+	os.RemoveAll(dir)
+	audit.Record(&AuditEvent{Action: "session.patch", Outcome: AuditOutcomeSuccess})
+
+	os.MkdirAll(dir, 0700)
+	audit.Record(&AuditEvent{Action: "room.pin", Outcome: AuditOutcomeSuccess})
+	if events, err := audit.Query(&AuditFilter{Action: "room.pin"}); err != nil || len(events) != 1 {
+		t.Errorf("Expected event after reopening, but got %+v %v", events, err)
+	}
+}
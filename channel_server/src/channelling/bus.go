@@ -1,15 +1,34 @@
 package channelling
 
+import (
+	"encoding/json"
+)
+
 type SessionCreateRequest struct {
 	Id           string
 	Session      *DataSession
 	Room         *DataRoom
+	Roles        []string
 	SetAsDefault bool
+	Sink         *SinkRequest `json:",omitempty"` // Selects the sink, NATS when omitted.
+}
+
+// SinkRequest selects the sink of a pipeline session.
+type SinkRequest struct {
+	Type string // nats, webhook, file or websocket.
+	URL  string `json:",omitempty"` // URL of webhook sinks.
 }
 
 type DataSink struct {
+	Type       string `json:",omitempty"`
+	Id         string `json:",omitempty"`
 	SubjectOut string `json:subject_out"`
 	SubjectIn  string `json:subject_in"`
+	Token      string `json:",omitempty"` // Secret of the webhook callback and WebSocket end points.
+	// Access tokens of the pipelines REST API, see PipelineTokens.
+	PipelineToken        string `json:",omitempty"`
+	PipelineReadToken    string `json:",omitempty"`
+	PipelineTokenExpires int64  `json:",omitempty"`
 }
 
 type DataSinkOutgoing struct {
@@ -18,3 +37,45 @@ type DataSinkOutgoing struct {
 	FromUserid string
 	Pipe       string `json:",omitempty"`
 }
+
+// BusSessionRequest is a request of a pipeline session created with
+// channelling.session.create, selected by its bus Id.
+type BusSessionRequest struct {
+	Id     string
+	Room   *DataRoom        `json:",omitempty"` // Room to join.
+	Status interface{}      `json:",omitempty"` // Status to set.
+	To     string           `json:",omitempty"` // Recipient of chats and unicasts.
+	Chat   *DataChatMessage `json:",omitempty"` // Chat to send.
+	Data   json.RawMessage  `json:",omitempty"` // Data to unicast or broadcast.
+}
+
+// BusReply is the reply to session and admin requests on the bus.
+type BusReply struct {
+	Success bool
+	Code    string      `json:",omitempty"`
+	Message string      `json:",omitempty"`
+	Data    interface{} `json:",omitempty"`
+}
+
+// NewBusReply returns the reply for the result of a request.
+func NewBusReply(data interface{}, err error) *BusReply {
+	if err == nil {
+		return &BusReply{Success: true, Data: data}
+	}
+	if dataError, ok := err.(*DataError); ok {
+		return &BusReply{Code: dataError.Code, Message: dataError.Message}
+	}
+	return &BusReply{Code: "internal_error", Message: err.Error()}
+}
+
+// BusAdminRequest is a request on the admin subjects of the bus.
+type BusAdminRequest struct {
+	Credential  string               // Shared bus credential.
+	Session     string               `json:",omitempty"` // Session to kick, remove from its room or message.
+	Roomid      string               `json:",omitempty"` // Room to message.
+	Name        string               `json:",omitempty"` // Room name to configure.
+	Type        string               `json:",omitempty"` // Room type to configure.
+	Credentials *DataRoomCredentials `json:",omitempty"` // Room credentials to configure.
+	Data        json.RawMessage      `json:",omitempty"` // Message data.
+	Details     bool                 `json:",omitempty"` // Stats with details.
+}
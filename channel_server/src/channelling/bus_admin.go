@@ -0,0 +1,126 @@
+package channelling
+
+import (
+	"crypto/subtle"
+	"log"
+)
+
+// BusAdmin serves the admin requests on the bus, which act on the client
+// sessions and rooms.
+type BusAdmin interface {
+	Start() error
+}
+
+type busAdmin struct {
+	bus        BusManager
+	credential string
+	hub        Hub
+	rooms      RoomManager
+	stats      StatsGenerator
+}
+
+// NewBusAdmin creates the admin of the bus. Requests need to carry the
+// credential.
+func NewBusAdmin(bus BusManager, credential string, hub Hub, rooms RoomManager, stats StatsGenerator) BusAdmin {
+	return &busAdmin{bus, credential, hub, rooms, stats}
+}
+
+// Start subscribes the admin subjects below the subject prefix of the bus.
+func (admin *busAdmin) Start() error {
+	for name, handle := range map[string]func(*BusAdminRequest) (interface{}, error){
+		"kick":    admin.kick,
+		"leave":   admin.leave,
+		"message": admin.message,
+		"room":    admin.room,
+		"stats":   admin.stat,
+	} {
+		if _, err := admin.bus.Subscribe(admin.bus.PrefixSubject("admin."+name), admin.handler(name, handle)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (admin *busAdmin) handler(name string, handle func(*BusAdminRequest) (interface{}, error)) func(subject, reply string, msg *BusAdminRequest) {
+	return func(subject, reply string, msg *BusAdminRequest) {
+		var result interface{}
+		var err error
+		if msg == nil || subtle.ConstantTimeCompare([]byte(msg.Credential), []byte(admin.credential)) != 1 {
+			err = NewDataError("unauthorized", "invalid bus credential")
+		} else {
+			result, err = handle(msg)
+		}
+
+		if err != nil {
+			log.Println("Failed bus admin request", name, err)
+		} else {
+			log.Println("Bus admin request", name, msg.Session, msg.Roomid, msg.Name)
+		}
+		if reply != "" {
+			admin.bus.Publish(reply, NewBusReply(result, err))
+		}
+	}
+}
+
+func (admin *busAdmin) kick(msg *BusAdminRequest) (interface{}, error) {
+	client, ok := admin.hub.GetClient(msg.Session)
+	if !ok {
+		return nil, NewDataError("session_not_found", "no such session")
+	}
+
+	client.Close()
+	return nil, nil
+}
+
+func (admin *busAdmin) leave(msg *BusAdminRequest) (interface{}, error) {
+	session, ok := admin.hub.GetSession(msg.Session)
+	if !ok {
+		return nil, NewDataError("session_not_found", "no such session")
+	}
+	if _, ok := session.CurrentRoom(); !ok {
+		return nil, NewDataError("not_in_room", "session is not in a room")
+	}
+
+	session.LeaveRoom()
+	admin.hub.Unicast(session.Id, &DataOutgoing{
+		To:   session.Id,
+		Data: &DataSession{Type: "Left", Id: session.Id, Status: "forced"},
+	}, nil)
+	return nil, nil
+}
+
+func (admin *busAdmin) message(msg *BusAdminRequest) (interface{}, error) {
+	if len(msg.Data) == 0 {
+		return nil, NewDataError("bad_request", "request did not contain Data")
+	}
+
+	switch {
+	case msg.Session != "":
+		if _, ok := admin.hub.GetClient(msg.Session); !ok {
+			return nil, NewDataError("session_not_found", "no such session")
+		}
+		admin.hub.Unicast(msg.Session, &DataOutgoing{To: msg.Session, Data: msg.Data}, nil)
+	case msg.Roomid != "":
+		if _, ok := admin.rooms.Get(msg.Roomid); !ok {
+			return nil, NewDataError("room_not_found", "no such room")
+		}
+		admin.rooms.Broadcast("", msg.Roomid, &DataOutgoing{Data: msg.Data})
+	default:
+		return nil, NewDataError("bad_request", "request did not contain Session or Roomid")
+	}
+
+	return nil, nil
+}
+
+func (admin *busAdmin) room(msg *BusAdminRequest) (interface{}, error) {
+	if msg.Type == "" && msg.Credentials == nil {
+		return nil, NewDataError("bad_request", "request did not contain Type or Credentials")
+	}
+
+	return nil, admin.rooms.ConfigureRoom(msg.Name, msg.Type, msg.Credentials)
+}
+
+func (admin *busAdmin) stat(msg *BusAdminRequest) (interface{}, error) {
+	return admin.stats.Stat(msg.Details), nil
+}
@@ -0,0 +1,82 @@
+package channelling
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats"
+)
+
+type fakeSubscribeBus struct {
+	fakePublishBus
+	handlers map[string]nats.Handler
+}
+
+func (bus *fakeSubscribeBus) Subscribe(subject string, cb nats.Handler) (*nats.Subscription, error) {
+	bus.handlers[subject] = cb
+	return nil, nil
+}
+
+func (bus *fakeSubscribeBus) PrefixSubject(subject string) string {
+	return "channelling.trigger." + subject
+}
+
+func (bus *fakeSubscribeBus) request(t *testing.T, name string, msg *BusAdminRequest) *BusReply {
+	handler, ok := bus.handlers["channelling.trigger.admin."+name].(func(string, string, *BusAdminRequest))
+	if !ok {
+		t.Fatalf("No handler for %s", name)
+	}
+	handler("", "reply", msg)
+	return bus.published["reply"].(*BusReply)
+}
+
+type fakeAdminHub struct {
+	Hub
+}
+
+func (hub *fakeAdminHub) GetClient(sessionID string) (*Client, bool) {
+	return nil, false
+}
+
+func (hub *fakeAdminHub) GetSession(id string) (*Session, bool) {
+	return nil, false
+}
+
+type fakeStatsGenerator struct{}
+
+func (stats *fakeStatsGenerator) Stat(details bool) *HubStat {
+	return &HubStat{Rooms: 1}
+}
+
+func Test_BusAdmin_Requests(t *testing.T) {
+	bus := &fakeSubscribeBus{fakePublishBus{nil, make(map[string]interface{})}, make(map[string]nats.Handler)}
+	rooms := NewRoomManager(&Config{RoomTypeDefault: RoomTypeRoom}, nil)
+	if err := NewBusAdmin(bus, "secret", &fakeAdminHub{}, rooms, &fakeStatsGenerator{}).Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := bus.request(t, "stats", &BusAdminRequest{Credential: "wrong"}); reply.Success || reply.Code != "unauthorized" {
+		t.Errorf("Expected unauthorized request, but got %+v", reply)
+	}
+	if reply := bus.request(t, "stats", &BusAdminRequest{Credential: "secret"}); !reply.Success || reply.Data.(*HubStat).Rooms != 1 {
+		t.Errorf("Unexpected stats reply %+v", reply)
+	}
+	for _, name := range []string{"kick", "leave", "message"} {
+		msg := &BusAdminRequest{Credential: "secret", Session: "unknown", Data: []byte(`{"Type":"Notice"}`)}
+		if reply := bus.request(t, name, msg); reply.Code != "session_not_found" {
+			t.Errorf("Expected %s of unknown session to fail, but got %+v", name, reply)
+		}
+	}
+	if reply := bus.request(t, "message", &BusAdminRequest{Credential: "secret", Roomid: "Room:unknown", Data: []byte(`{}`)}); reply.Code != "room_not_found" {
+		t.Errorf("Expected message to unknown room to fail, but got %+v", reply)
+	}
+
+	if reply := bus.request(t, "room", &BusAdminRequest{Credential: "secret", Name: "arena", Credentials: &DataRoomCredentials{PIN: "1234"}}); reply.Code != "room_not_found" {
+		t.Errorf("Expected credentials of unknown room to fail, but got %+v", reply)
+	}
+	if reply := bus.request(t, "room", &BusAdminRequest{Credential: "secret", Name: "arena", Type: RoomTypeConference}); !reply.Success {
+		t.Errorf("Unexpected room reply %+v", reply)
+	}
+	if roomID := rooms.MakeRoomID("arena", ""); roomID != RoomTypeConference+":arena" {
+		t.Errorf("Expected configured room type, but got %s", roomID)
+	}
+}
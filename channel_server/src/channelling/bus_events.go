@@ -0,0 +1,126 @@
+package channelling
+
+import (
+	"strings"
+)
+
+// Trigger events added with BusEventVersion 1.
+const (
+	BusManagerRoomCreated    = "roomcreated"
+	BusManagerRoomExpired    = "roomexpired"
+	BusManagerJoined         = "joined"
+	BusManagerLeft           = "left"
+	BusManagerStatus         = "status"
+	BusManagerChat           = "chat"
+	BusManagerAuthentication = "authentication"
+	BusManagerContactRequest = "contactrequest"
+)
+
+// BusEventVersion is the version of the schemas of the trigger event Data
+// below. It is increased on incompatible changes, new fields are added
+// without changing it.
+const BusEventVersion = 1
+
+// BusTriggersDefault are the triggers sent when none are configured.
+var BusTriggersDefault = []string{
+	BusManagerStartup,
+	BusManagerOffer,
+	BusManagerAnswer,
+	BusManagerBye,
+	BusManagerConnect,
+	BusManagerDisconnect,
+	BusManagerSession,
+	BusManagerModeration,
+}
+
+// BusTriggersAll selects all triggers.
+const BusTriggersAll = "all"
+
+// ParseBusTriggers returns the enabled triggers of a comma separated list,
+// BusTriggersDefault when empty.
+func ParseBusTriggers(value string) map[string]bool {
+	names := BusTriggersDefault
+	if value = strings.TrimSpace(value); value != "" {
+		names = strings.Split(value, ",")
+	}
+	triggers := make(map[string]bool)
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			triggers[name] = true
+		}
+	}
+
+	return triggers
+}
+
+// BusEventRoom is the data of roomcreated and roomexpired, From is the
+// session which created the room (empty when expired).
+//
+//	{"Version": 1, "Roomid": "Room:abc", "Name": "abc", "Type": "Room"}
+type BusEventRoom struct {
+	Version int
+	Roomid  string
+	Name    string
+	Type    string
+}
+
+// BusEventMember is the data of joined and left, From is the session.
+//
+//	{"Version": 1, "Roomid": "Room:abc", "Userid": "user-id"}
+type BusEventMember struct {
+	Version int
+	Roomid  string
+	Userid  string `json:",omitempty"`
+}
+
+// BusEventStatus is the data of status, From is the session.
+//
+//	{"Version": 1, "Roomid": "Room:abc", "Userid": "user-id", "Status": {...}}
+type BusEventStatus struct {
+	Version int
+	Roomid  string      `json:",omitempty"`
+	Userid  string      `json:",omitempty"`
+	Status  interface{} `json:",omitempty"`
+}
+
+// BusEventChat is the data of chat, From is the sending session. Roomid is
+// set for broadcasts, To for unicasts and ToUserid for chats to users.
+// Message is only set when chat content is enabled, else Redacted is true.
+//
+//	{"Version": 1, "Roomid": "Room:abc", "Userid": "user-id", "Mid": "1",
+//	 "Message": "Hello", "Time": 1430680814}
+type BusEventChat struct {
+	Version  int
+	Roomid   string `json:",omitempty"`
+	To       string `json:",omitempty"`
+	ToUserid string `json:",omitempty"`
+	Userid   string `json:",omitempty"`
+	Mid      string `json:",omitempty"`
+	Message  string `json:",omitempty"`
+	Redacted bool   `json:",omitempty"`
+	Time     int64
+}
+
+// BusEventAuthentication is the data of authentication, From is the
+// session and Payload the user id.
+//
+//	{"Version": 1, "Userid": "user-id", "Success": false, "Reason": "..."}
+type BusEventAuthentication struct {
+	Version int
+	Userid  string
+	Success bool
+	Reason  string `json:",omitempty"`
+}
+
+// BusEventContactRequest is the data of contactrequest, From is the
+// requesting session.
+//
+//	{"Version": 1, "To": "session-id", "Userid": "user-id", "Id": "1",
+//	 "Success": true}
+type BusEventContactRequest struct {
+	Version int
+	To      string
+	Userid  string `json:",omitempty"`
+	Id      string
+	Success bool
+}
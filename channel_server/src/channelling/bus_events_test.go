@@ -0,0 +1,55 @@
+package channelling
+
+import (
+	"sync"
+	"testing"
+)
+
+type fakeTriggerBus struct {
+	BusManager
+	sync.Mutex
+	triggers []*BusTrigger
+}
+
+func (bus *fakeTriggerBus) Trigger(name, from, payload string, data interface{}, pipeline *Pipeline) error {
+	bus.Lock()
+	bus.triggers = append(bus.triggers, &BusTrigger{Name: name, From: from, Payload: payload, Data: data})
+	bus.Unlock()
+	return nil
+}
+
+func Test_ParseBusTriggers(t *testing.T) {
+	if triggers := ParseBusTriggers(""); !triggers[BusManagerOffer] || triggers[BusManagerChat] {
+		t.Errorf("Unexpected default triggers %v", triggers)
+	}
+	if triggers := ParseBusTriggers(" joined, left,,chat"); len(triggers) != 3 || !triggers[BusManagerLeft] {
+		t.Errorf("Unexpected triggers %v", triggers)
+	}
+}
+
+func Test_RoomWorker_TriggersMemberEvents(t *testing.T) {
+	bus := &fakeTriggerBus{}
+	worker := NewRoomWorker(&roomManager{Config: &Config{}, BusManager: bus}, testRoomID, testRoomName, testRoomType, nil)
+	go worker.Start()
+
+	if _, err := worker.Join(nil, &Session{Id: "1", userid: "alice"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	worker.Leave("1")
+	worker.Leave("1")
+	// Wait for the worker to process the leaves.
+	worker.GetUsers()
+
+	bus.Lock()
+	defer bus.Unlock()
+	if len(bus.triggers) != 2 {
+		t.Fatalf("Expected 2 triggers, but got %d", len(bus.triggers))
+	}
+	for i, name := range []string{BusManagerJoined, BusManagerLeft} {
+		trigger := bus.triggers[i]
+		event, ok := trigger.Data.(*BusEventMember)
+		if trigger.Name != name || trigger.From != "1" || !ok || event.Version != BusEventVersion || event.Roomid != testRoomID || event.Userid != "alice" {
+			t.Errorf("Unexpected %s trigger %+v %+v", name, trigger, trigger.Data)
+		}
+	}
+}
@@ -1,15 +1,16 @@
 package channelling
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats"
 
 	"natsconnection"
+	"randomstring"
 )
 
 const (
@@ -20,6 +21,16 @@ const (
 	BusManagerConnect    = "connect"
 	BusManagerDisconnect = "disconnect"
 	BusManagerSession    = "session"
+	BusManagerModeration = "moderation"
+)
+
+const (
+	// busPublishBatch is the number of events published before the
+	// delivery is confirmed with a flush.
+	busPublishBatch  = 100
+	busFlushTimeout  = 5 * time.Second
+	busRetryDelayMin = 100 * time.Millisecond
+	busRetryDelayMax = 30 * time.Second
 )
 
 // BusManager 提供了与 消息总线进行通信的API.
@@ -34,11 +45,23 @@ type BusManager interface {
 	BindSendChan(subject string, channel interface{}) error
 	PrefixSubject(string) string
 	CreateSink(string) Sink
+	// Stats returns the outbox metrics, nil without bus.
+	Stats() *BusStats
+}
+
+// BusStats are the metrics of the outbound bus events.
+type BusStats struct {
+	Backlog   int    `json:"backlog"`
+	Capacity  int    `json:"capacity"`
+	Published uint64 `json:"published"`
+	Dropped   uint64 `json:"dropped"`
+	Retries   uint64 `json:"retries"`
 }
 
 // BusTrigger 作为序列化 后端系统总线 trigger 事件的容器.
 type BusTrigger struct {
 	Id       string
+	EventId  string // Unique id of the event, kept when it is published again.
 	Name     string
 	From     string
 	Payload  string      `json:",omitempty"`
@@ -53,14 +76,15 @@ func BusSubjectTrigger(prefix, suffix string) string {
 
 // NewBusManager 创建和初始化一个新的 BusManager, 根据 useNats开关决定是否使用 NATS.
 // 目的是为了简化API, 封装与后端消息总线进行连接和收发数据的逻辑.
-func NewBusManager(apiConsumer ChannellingAPIConsumer, id string, useNats bool, subjectPrefix string) BusManager {
+// Trigger events are queued in the outbox, or in memory when nil. Only the
+// triggers enabled in triggers are sent, BusTriggersDefault when nil. When
+// NATS cannot be connected, a bus without NATS is returned.
+func NewBusManager(apiConsumer ChannellingAPIConsumer, id string, useNats bool, subjectPrefix string, outbox BusOutbox, triggers map[string]bool) BusManager {
 	var b BusManager
 	var err error
 	if useNats {
-		b, err = newNatsBus(apiConsumer, id, subjectPrefix)
-		if err == nil {
-			log.Println("NATS bus connected")
-		} else {
+		b, err = NewNatsBusManager(apiConsumer, id, subjectPrefix, outbox, triggers)
+		if err != nil {
 			log.Println("Error connecting NATS bus", err)
 			b = &noopBus{apiConsumer, id}
 		}
@@ -71,6 +95,18 @@ func NewBusManager(apiConsumer ChannellingAPIConsumer, id string, useNats bool,
 	return b
 }
 
+// NewNatsBusManager connects the NATS bus and returns the connection error
+// instead of falling back to a bus without NATS.
+func NewNatsBusManager(apiConsumer ChannellingAPIConsumer, id string, subjectPrefix string, outbox BusOutbox, triggers map[string]bool) (BusManager, error) {
+	b, err := newNatsBus(apiConsumer, id, subjectPrefix, outbox, triggers)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("NATS bus connected")
+
+	return b, nil
+}
+
 type noopBus struct {
 	ChannellingAPIConsumer
 	id string
@@ -112,15 +148,23 @@ func (bus *noopBus) CreateSink(id string) Sink {
 	return nil
 }
 
+func (bus *noopBus) Stats() *BusStats {
+	return nil
+}
+
 type natsBus struct {
 	ChannellingAPIConsumer
-	id           string
-	prefix       string
-	ec           *natsconnection.EncodedConnection
-	triggerQueue chan *busQueueEntry
+	id        string
+	prefix    string
+	ec        *natsconnection.EncodedConnection
+	outbox    BusOutbox
+	triggers  map[string]bool
+	published uint64
+	dropped   uint64
+	retries   uint64
 }
 
-func newNatsBus(apiConsumer ChannellingAPIConsumer, id, prefix string) (*natsBus, error) {
+func newNatsBus(apiConsumer ChannellingAPIConsumer, id, prefix string, outbox BusOutbox, triggers map[string]bool) (*natsBus, error) {
 	ec, err := natsconnection.EstablishJSONEncodedConnection(nil)
 	if err != nil {
 		return nil, err
@@ -128,15 +172,20 @@ func newNatsBus(apiConsumer ChannellingAPIConsumer, id, prefix string) (*natsBus
 	if prefix == "" {
 		prefix = "channelling.trigger"
 	}
-	// Create buffered channel for outbound NATS data.
-	triggerQueue := make(chan *busQueueEntry, 50)
+	if outbox == nil {
+		// Keep outbound NATS data in memory.
+		outbox, _ = NewBusOutbox("", 0)
+	}
+	if triggers == nil {
+		triggers = ParseBusTriggers("")
+	}
 
-	return &natsBus{apiConsumer, id, prefix, ec, triggerQueue}, nil
+	return &natsBus{ChannellingAPIConsumer: apiConsumer, id: id, prefix: prefix, ec: ec, outbox: outbox, triggers: triggers}, nil
 }
 
 func (bus *natsBus) Start() {
 	// Start go routine to process outbount NATS publishing.
-	go chPublish(bus.ec, bus.triggerQueue)
+	go bus.publishOutbox()
 	bus.Trigger(BusManagerStartup, bus.id, "", nil, nil)
 }
 
@@ -149,8 +198,12 @@ func (bus *natsBus) Request(subject string, v interface{}, vPtr interface{}, tim
 }
 
 func (bus *natsBus) Trigger(name, from, payload string, data interface{}, pipeline *Pipeline) (err error) {
+	if !bus.triggers[name] && !bus.triggers[BusTriggersAll] {
+		return nil
+	}
 	trigger := &BusTrigger{
 		Id:      bus.id,
+		EventId: randomstring.NewRandomString(20),
 		Name:    name,
 		From:    from,
 		Payload: payload,
@@ -159,18 +212,24 @@ func (bus *natsBus) Trigger(name, from, payload string, data interface{}, pipeli
 	if pipeline != nil {
 		trigger.Pipeline = pipeline.GetID()
 	}
-	entry := &busQueueEntry{BusSubjectTrigger(bus.prefix, name), trigger}
-	select {
-	case bus.triggerQueue <- entry:
-		// sent ok
-	default:
-		log.Println("Failed to queue NATS event - queue full?")
-		err = errors.New("NATS trigger queue full")
+	if err = bus.outbox.Push(BusSubjectTrigger(bus.prefix, name), trigger); err != nil {
+		atomic.AddUint64(&bus.dropped, 1)
+		log.Println("Failed to queue NATS event", name, err)
 	}
 
 	return err
 }
 
+func (bus *natsBus) Stats() *BusStats {
+	return &BusStats{
+		Backlog:   bus.outbox.Len(),
+		Capacity:  bus.outbox.Capacity(),
+		Published: atomic.LoadUint64(&bus.published),
+		Dropped:   atomic.LoadUint64(&bus.dropped),
+		Retries:   atomic.LoadUint64(&bus.retries),
+	}
+}
+
 func (bus *natsBus) PrefixSubject(sub string) string {
 	return fmt.Sprintf("%s.%s", bus.prefix, sub)
 }
@@ -192,18 +251,40 @@ func (bus *natsBus) CreateSink(id string) (sink Sink) {
 	return
 }
 
-type busQueueEntry struct {
-	subject string
-	data    interface{}
-}
-
-func chPublish(ec *natsconnection.EncodedConnection, channel chan (*busQueueEntry)) {
+// publishOutbox publishes the events of the outbox in order. Events are
+// removed after NATS confirmed them, and are published again with back off
+// while NATS is not available, so they are delivered at least once.
+func (bus *natsBus) publishOutbox() {
+	delay := busRetryDelayMin
 	for {
-		entry := <-channel
-		err := ec.Publish(entry.subject, entry.data)
+		entries := bus.outbox.Peek(busPublishBatch)
+		if len(entries) == 0 {
+			<-bus.outbox.Notify()
+			continue
+		}
+
+		var err error
+		for _, entry := range entries {
+			if err = bus.ec.Publish(entry.Subject, entry.Data); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = bus.ec.FlushTimeout(busFlushTimeout)
+		}
 		if err != nil {
-			log.Println("Failed to publish to NATS", entry.subject, err)
+			atomic.AddUint64(&bus.retries, 1)
+			log.Println("Failed to publish to NATS, retrying", len(entries), delay, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > busRetryDelayMax {
+				delay = busRetryDelayMax
+			}
+			continue
 		}
+
+		delay = busRetryDelayMin
+		bus.outbox.Remove(entries)
+		atomic.AddUint64(&bus.published, uint64(len(entries)))
 	}
 }
 
@@ -215,6 +296,7 @@ type natsSink struct {
 	SubjectOut string
 	SubjectIn  string
 	sub        *nats.Subscription
+	channel    chan *DataIncoming
 	sendQueue  chan *DataSinkOutgoing
 }
 
@@ -262,12 +344,14 @@ func (sink *natsSink) Close() {
 
 func (sink *natsSink) Export() *DataSink {
 	return &DataSink{
+		Type:       SinkTypeNATS,
+		Id:         sink.id,
 		SubjectOut: sink.SubjectOut,
 		SubjectIn:  sink.SubjectIn,
 	}
 }
 
-func (sink *natsSink) BindRecvChan(channel interface{}) (*nats.Subscription, error) {
+func (sink *natsSink) BindRecvChan(channel chan *DataIncoming) error {
 	sink.Lock()
 	defer sink.Unlock()
 	if sink.sub != nil {
@@ -276,8 +360,21 @@ func (sink *natsSink) BindRecvChan(channel interface{}) (*nats.Subscription, err
 	}
 	sub, err := sink.bm.BindRecvChan(sink.SubjectIn, channel)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	sink.sub = sub
-	return sub, nil
+	sink.channel = channel
+	return nil
+}
+
+func (sink *natsSink) UnbindRecvChan(channel chan *DataIncoming) {
+	sink.Lock()
+	defer sink.Unlock()
+	if sink.sub != nil && sink.channel == channel {
+		if err := sink.sub.Unsubscribe(); err != nil {
+			log.Println("Failed to unsubscribe NATS sink", err)
+		}
+		sink.sub = nil
+		sink.channel = nil
+	}
 }
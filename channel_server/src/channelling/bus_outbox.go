@@ -0,0 +1,366 @@
+package channelling
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// BusOutboxCapacityDefault is the number of pending events kept when
+	// no capacity is configured.
+	BusOutboxCapacityDefault = 10000
+	busOutboxSegmentSuffix   = ".log"
+	busOutboxSegmentSize     = 1024 * 1024
+	busOutboxLineMax         = 1024 * 1024
+)
+
+// BusOutboxEntry is an event waiting to be published on the bus.
+type BusOutboxEntry struct {
+	seq     uint64
+	segment int
+	Subject string
+	Data    json.RawMessage
+}
+
+// busOutboxRecord is a stored event, or the events removed after they
+// were published, stored as one JSON line.
+type busOutboxRecord struct {
+	Seq     uint64          `json:"seq,omitempty"`
+	Subject string          `json:"subject,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Removed []uint64        `json:"removed,omitempty"`
+}
+
+// BusOutbox queues the events of the bus until they are published.
+type BusOutbox interface {
+	// Push queues the event, it fails when the outbox is full.
+	Push(subject string, data interface{}) error
+	// Peek returns at most n of the oldest events.
+	Peek(n int) []*BusOutboxEntry
+	// Remove removes events returned by Peek once they are published.
+	Remove(entries []*BusOutboxEntry)
+	Len() int
+	Capacity() int
+	// Notify receives a value when events were pushed.
+	Notify() <-chan bool
+}
+
+type busOutbox struct {
+	sync.Mutex
+	dir      string
+	capacity int
+	entries  []*BusOutboxEntry
+	pending  map[int]int // Segment -> number of entries not removed.
+	next     uint64
+	notify   chan bool
+
+	// writeMutex serializes the writes to the log, the outbox is not
+	// locked while writing.
+	writeMutex sync.Mutex
+	segments   []int
+	file       *os.File
+	size       int64
+}
+
+// NewBusOutbox creates an outbox for capacity events (default
+// BusOutboxCapacityDefault when <= 0). With dir the events are appended to
+// a segmented log in that directory and survive restarts, otherwise they
+// are kept in memory.
+func NewBusOutbox(dir string, capacity int) (BusOutbox, error) {
+	if capacity <= 0 {
+		capacity = BusOutboxCapacityDefault
+	}
+	outbox := &busOutbox{
+		dir:      dir,
+		capacity: capacity,
+		pending:  make(map[int]int),
+		next:     1,
+		notify:   make(chan bool, 1),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if err := outbox.load(); err != nil {
+			return nil, err
+		}
+		// Always append to a new segment, the last one might end with a
+		// partial line.
+		segment := 1
+		if len(outbox.segments) > 0 {
+			segment = outbox.segments[len(outbox.segments)-1] + 1
+		}
+		if err := outbox.open(segment); err != nil {
+			return nil, err
+		}
+		outbox.expire()
+	}
+
+	return outbox, nil
+}
+
+// load reads the events stored by a previous run.
+func (outbox *busOutbox) load() error {
+	files, err := ioutil.ReadDir(outbox.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, busOutboxSegmentSuffix) {
+			continue
+		}
+		segment, err := strconv.Atoi(strings.TrimSuffix(name, busOutboxSegmentSuffix))
+		if err != nil || segment <= 0 {
+			continue
+		}
+		outbox.segments = append(outbox.segments, segment)
+	}
+	sort.Ints(outbox.segments)
+
+	entries := make(map[uint64]*BusOutboxEntry)
+	for _, segment := range outbox.segments {
+		err := outbox.scan(segment, func(record *busOutboxRecord) {
+			for _, seq := range record.Removed {
+				delete(entries, seq)
+			}
+			if record.Seq > 0 && record.Subject != "" {
+				entries[record.Seq] = &BusOutboxEntry{seq: record.Seq, segment: segment, Subject: record.Subject, Data: record.Data}
+			}
+			if record.Seq >= outbox.next {
+				outbox.next = record.Seq + 1
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		outbox.entries = append(outbox.entries, entry)
+		outbox.pending[entry.segment]++
+	}
+	sort.Slice(outbox.entries, func(i, j int) bool { return outbox.entries[i].seq < outbox.entries[j].seq })
+	if len(outbox.entries) > 0 {
+		log.Println("Loaded pending bus events", len(outbox.entries))
+		outbox.notify <- true
+	}
+
+	return nil
+}
+
+// scan calls f for all records in the segment.
+func (outbox *busOutbox) scan(segment int, f func(*busOutboxRecord)) error {
+	file, err := os.Open(outbox.segmentFilename(segment))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), busOutboxLineMax)
+	for scanner.Scan() {
+		record := &busOutboxRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			log.Println("Skipping invalid bus outbox record in segment", segment, err)
+			continue
+		}
+		f(record)
+	}
+
+	return scanner.Err()
+}
+
+func (outbox *busOutbox) segmentFilename(segment int) string {
+	return filepath.Join(outbox.dir, fmt.Sprintf("%08d%s", segment, busOutboxSegmentSuffix))
+}
+
+// open must be called with the write lock held or before the outbox is
+// shared.
+func (outbox *busOutbox) open(segment int) error {
+	file, err := os.OpenFile(outbox.segmentFilename(segment), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if len(outbox.segments) == 0 || outbox.segments[len(outbox.segments)-1] != segment {
+		outbox.segments = append(outbox.segments, segment)
+	}
+	outbox.file = file
+	outbox.size = info.Size()
+
+	return nil
+}
+
+// write appends the record to the log and returns the segment it was
+// written to. It must be called with the write lock held.
+func (outbox *busOutbox) write(record *busOutboxRecord) (int, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) >= busOutboxLineMax {
+		return 0, fmt.Errorf("bus event too large (%d bytes)", len(data))
+	}
+	data = append(data, '\n')
+
+	if outbox.file != nil && outbox.size > 0 && outbox.size+int64(len(data)) > busOutboxSegmentSize {
+		outbox.file.Close()
+		outbox.file = nil
+	}
+	if outbox.file == nil {
+		// Start the next segment, again when it failed to open before.
+		if err = outbox.open(outbox.segments[len(outbox.segments)-1] + 1); err != nil {
+			return 0, err
+		}
+	}
+	n, err := outbox.file.Write(data)
+	outbox.size += int64(n)
+	if err == nil {
+		err = outbox.file.Sync()
+	}
+	if err != nil {
+		// Continue with a new segment after a partial write.
+		outbox.file.Close()
+		outbox.file = nil
+	}
+
+	return outbox.segments[len(outbox.segments)-1], err
+}
+
+// expire removes the oldest segments without pending entries. It must be
+// called with the write lock held or before the outbox is shared. The
+// current segment is never removed.
+func (outbox *busOutbox) expire() {
+	for len(outbox.segments) > 1 {
+		segment := outbox.segments[0]
+		outbox.Lock()
+		pending := outbox.pending[segment]
+		outbox.Unlock()
+		if pending > 0 {
+			break
+		}
+		if err := os.Remove(outbox.segmentFilename(segment)); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove bus outbox segment", segment, err)
+			break
+		}
+		outbox.segments = outbox.segments[1:]
+	}
+}
+
+func (outbox *busOutbox) Push(subject string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	entry := &BusOutboxEntry{Subject: subject, Data: raw}
+
+	// Hold the write lock until the entry is added, so events are queued
+	// in the order of the log.
+	outbox.writeMutex.Lock()
+	defer outbox.writeMutex.Unlock()
+
+	outbox.Lock()
+	if len(outbox.entries) >= outbox.capacity {
+		outbox.Unlock()
+		return NewDataError("bus_outbox_full", "bus outbox is full")
+	}
+	entry.seq = outbox.next
+	outbox.next++
+	outbox.Unlock()
+
+	if outbox.dir != "" {
+		if entry.segment, err = outbox.write(&busOutboxRecord{Seq: entry.seq, Subject: subject, Data: raw}); err != nil {
+			return err
+		}
+	}
+
+	outbox.Lock()
+	outbox.entries = append(outbox.entries, entry)
+	outbox.pending[entry.segment]++
+	outbox.Unlock()
+
+	select {
+	case outbox.notify <- true:
+	default:
+	}
+
+	return nil
+}
+
+func (outbox *busOutbox) Peek(n int) []*BusOutboxEntry {
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	if n > len(outbox.entries) {
+		n = len(outbox.entries)
+	}
+	entries := make([]*BusOutboxEntry, n)
+	copy(entries, outbox.entries)
+	return entries
+}
+
+func (outbox *busOutbox) Remove(entries []*BusOutboxEntry) {
+	removed := make(map[uint64]bool, len(entries))
+	for _, entry := range entries {
+		removed[entry.seq] = true
+	}
+
+	outbox.Lock()
+	var seqs []uint64
+	kept := outbox.entries[:0]
+	for _, entry := range outbox.entries {
+		if !removed[entry.seq] {
+			kept = append(kept, entry)
+			continue
+		}
+		seqs = append(seqs, entry.seq)
+		if outbox.pending[entry.segment]--; outbox.pending[entry.segment] <= 0 {
+			delete(outbox.pending, entry.segment)
+		}
+	}
+	for i := len(kept); i < len(outbox.entries); i++ {
+		outbox.entries[i] = nil
+	}
+	outbox.entries = kept
+	outbox.Unlock()
+
+	if outbox.dir == "" || len(seqs) == 0 {
+		return
+	}
+	outbox.writeMutex.Lock()
+	defer outbox.writeMutex.Unlock()
+	if _, err := outbox.write(&busOutboxRecord{Removed: seqs}); err != nil {
+		// The events are published again after a restart.
+		log.Println("Failed to store removed bus outbox entries", len(seqs), err)
+		return
+	}
+	outbox.expire()
+}
+
+func (outbox *busOutbox) Len() int {
+	outbox.Lock()
+	defer outbox.Unlock()
+	return len(outbox.entries)
+}
+
+func (outbox *busOutbox) Capacity() int {
+	return outbox.capacity
+}
+
+func (outbox *busOutbox) Notify() <-chan bool {
+	return outbox.notify
+}
@@ -0,0 +1,112 @@
+package channelling
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_BusOutbox_PersistsUntilRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outbox, err := NewBusOutbox(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"connect", "offer", "bye"} {
+		if err := outbox.Push("channelling.trigger."+name, &BusTrigger{EventId: name, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := outbox.Push("channelling.trigger.disconnect", &BusTrigger{}); err == nil {
+		t.Error("Expected full outbox to fail")
+	}
+	select {
+	case <-outbox.Notify():
+	default:
+		t.Error("Expected notification")
+	}
+
+	outbox.Remove(outbox.Peek(1))
+
+	// Reopening loads the pending events in order.
+	outbox, err = NewBusOutbox(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Len() != 2 {
+		t.Fatalf("Expected 2 pending events, but got %d", outbox.Len())
+	}
+	entries := outbox.Peek(10)
+	if entries[0].Subject != "channelling.trigger.offer" || string(entries[1].Data) != `{"Id":"","EventId":"bye","Name":"bye","From":""}` {
+		t.Errorf("Unexpected entries %s %s", entries[0].Subject, entries[1].Data)
+	}
+	if err := outbox.Push("channelling.trigger.disconnect", &BusTrigger{}); err != nil {
+		t.Fatal(err)
+	}
+	outbox.Remove(entries)
+	if entries = outbox.Peek(10); len(entries) != 1 || entries[0].Subject != "channelling.trigger.disconnect" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected 1 stored event, but got %d", len(files))
+	}
+}
+
+func Test_BusOutbox_SkipsPartialRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outbox, err := NewBusOutbox(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.Push("channelling.trigger.connect", &BusTrigger{})
+	outbox.Push("channelling.trigger.offer", &BusTrigger{})
+	// A record partially written before a crash.
+	file, err := os.OpenFile(filepath.Join(dir, "00000001.log"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"seq":3,"subject":"channelling.trig`)
+	file.Close()
+
+	if outbox, err = NewBusOutbox(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Len() != 2 {
+		t.Fatalf("Expected 2 pending events, but got %d", outbox.Len())
+	}
+	outbox.Push("channelling.trigger.bye", &BusTrigger{})
+	outbox.Remove(outbox.Peek(1))
+
+	if outbox, err = NewBusOutbox(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	entries := outbox.Peek(10)
+	if len(entries) != 2 || entries[0].Subject != "channelling.trigger.offer" || entries[1].Subject != "channelling.trigger.bye" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+func Test_BusOutbox_Memory(t *testing.T) {
+	outbox, err := NewBusOutbox("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Capacity() != BusOutboxCapacityDefault {
+		t.Errorf("Unexpected capacity %d", outbox.Capacity())
+	}
+	outbox.Push("subject", "data")
+	if entries := outbox.Peek(10); len(entries) != 1 || string(entries[0].Data) != `"data"` {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
@@ -0,0 +1,200 @@
+package channelling
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"randomstring"
+)
+
+const (
+	webhookQueueSize     = 1000
+	webhookRetryDelayMax = 30 * time.Second
+)
+
+// Webhook is an URL to which trigger events are posted.
+type Webhook struct {
+	Name   string
+	URL    string
+	Events map[string]bool // Triggers posted to the URL, all when empty or with "all".
+}
+
+// webhookBus posts trigger events to webhooks instead of publishing them
+// on NATS. All other bus functionality is not available.
+type webhookBus struct {
+	noopBus
+	webhooks    []*webhookQueue
+	secret      []byte
+	concurrency int
+	retries     int
+	retryDelay  time.Duration
+	client      *http.Client
+	triggers    map[string]bool
+	published   uint64
+	dropped     uint64
+	retried     uint64
+}
+
+type webhookQueue struct {
+	*Webhook
+	queue chan *webhookEvent
+}
+
+type webhookEvent struct {
+	name string
+	id   string
+	body []byte
+}
+
+// NewWebhookBus creates a bus which posts the enabled triggers (default
+// BusTriggersDefault when nil) as JSON to the webhooks, signed with the
+// secret. Each webhook is posted to by concurrency workers, failed posts
+// are retried up to retries times.
+func NewWebhookBus(apiConsumer ChannellingAPIConsumer, id string, webhooks []*Webhook, secret string, concurrency, retries int, timeout time.Duration, triggers map[string]bool) BusManager {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if triggers == nil {
+		triggers = ParseBusTriggers("")
+	}
+	bus := &webhookBus{
+		noopBus:     noopBus{apiConsumer, id},
+		secret:      []byte(secret),
+		concurrency: concurrency,
+		retries:     retries,
+		retryDelay:  time.Second,
+		client:      &http.Client{Timeout: timeout},
+		triggers:    triggers,
+	}
+	for _, webhook := range webhooks {
+		bus.webhooks = append(bus.webhooks, &webhookQueue{webhook, make(chan *webhookEvent, webhookQueueSize)})
+	}
+
+	return bus
+}
+
+func (bus *webhookBus) Start() {
+	for _, webhook := range bus.webhooks {
+		for i := 0; i < bus.concurrency; i++ {
+			go bus.post(webhook)
+		}
+	}
+	bus.Trigger(BusManagerStartup, bus.id, "", nil, nil)
+}
+
+func (bus *webhookBus) Trigger(name, from, payload string, data interface{}, pipeline *Pipeline) error {
+	if !bus.triggers[name] && !bus.triggers[BusTriggersAll] {
+		return nil
+	}
+	trigger := &BusTrigger{
+		Id:      bus.id,
+		EventId: randomstring.NewRandomString(20),
+		Name:    name,
+		From:    from,
+		Payload: payload,
+		Data:    data,
+	}
+	if pipeline != nil {
+		trigger.Pipeline = pipeline.GetID()
+	}
+	body, err := json.Marshal(trigger)
+	if err != nil {
+		return err
+	}
+
+	event := &webhookEvent{name, trigger.EventId, body}
+	for _, webhook := range bus.webhooks {
+		if len(webhook.Events) > 0 && !webhook.Events[name] && !webhook.Events[BusTriggersAll] {
+			continue
+		}
+		select {
+		case webhook.queue <- event:
+		default:
+			atomic.AddUint64(&bus.dropped, 1)
+			log.Println("Failed to queue webhook event - queue full", webhook.Name, name)
+			err = NewDataError("bus_outbox_full", "webhook queue is full")
+		}
+	}
+
+	return err
+}
+
+// Signature returns the value of the X-Channelling-Signature header of the
+// body.
+func (bus *webhookBus) Signature(body []byte) string {
+	mac := hmac.New(sha256.New, bus.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (bus *webhookBus) post(webhook *webhookQueue) {
+	for event := range webhook.queue {
+		delay := bus.retryDelay
+		for attempt := 0; ; attempt++ {
+			retry, err := bus.postEvent(webhook, event)
+			if err == nil {
+				atomic.AddUint64(&bus.published, 1)
+				break
+			}
+			if !retry || attempt >= bus.retries {
+				atomic.AddUint64(&bus.dropped, 1)
+				log.Println("Failed to post webhook event", webhook.Name, event.name, err)
+				break
+			}
+			atomic.AddUint64(&bus.retried, 1)
+			time.Sleep(delay)
+			if delay *= 2; delay > webhookRetryDelayMax {
+				delay = webhookRetryDelayMax
+			}
+		}
+	}
+}
+
+// postEvent returns whether a failed post should be retried.
+func (bus *webhookBus) postEvent(webhook *webhookQueue, event *webhookEvent) (bool, error) {
+	request, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(event.body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Channelling-Event", event.name)
+	request.Header.Set("X-Channelling-Event-Id", event.id)
+	if len(bus.secret) > 0 {
+		request.Header.Set("X-Channelling-Signature", bus.Signature(event.body))
+	}
+	response, err := bus.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode < 300:
+		return false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned status %d", response.StatusCode)
+	}
+	return false, fmt.Errorf("webhook returned status %d", response.StatusCode)
+}
+
+func (bus *webhookBus) Stats() *BusStats {
+	stats := &BusStats{
+		Published: atomic.LoadUint64(&bus.published),
+		Dropped:   atomic.LoadUint64(&bus.dropped),
+		Retries:   atomic.LoadUint64(&bus.retried),
+	}
+	for _, webhook := range bus.webhooks {
+		stats.Backlog += len(webhook.queue)
+		stats.Capacity += cap(webhook.queue)
+	}
+
+	return stats
+}
@@ -0,0 +1,66 @@
+package channelling
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_WebhookBus_PostsSignedEvents(t *testing.T) {
+	var attempts int32
+	received := make(chan *BusTrigger, 10)
+	var bus *webhookBus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to test retries.
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Channelling-Signature") != bus.Signature(body) {
+			t.Errorf("Invalid signature %s", r.Header.Get("X-Channelling-Signature"))
+		}
+		trigger := &BusTrigger{}
+		if err := json.Unmarshal(body, trigger); err != nil || r.Header.Get("X-Channelling-Event") != trigger.Name || r.Header.Get("X-Channelling-Event-Id") != trigger.EventId {
+			t.Errorf("Unexpected event %s %v", body, err)
+		}
+		received <- trigger
+	}))
+	defer server.Close()
+
+	webhooks := []*Webhook{
+		{Name: "calls", URL: server.URL, Events: map[string]bool{BusManagerOffer: true}},
+		{Name: "all", URL: server.URL},
+		{Name: "wildcard", URL: server.URL, Events: ParseBusTriggers(BusTriggersAll)},
+	}
+	bus = NewWebhookBus(NewChannellingAPIConsumer(), "server-1", webhooks, "secret", 1, 2, time.Second, ParseBusTriggers("offer,joined")).(*webhookBus)
+	bus.retryDelay = time.Millisecond
+	bus.Start()
+
+	bus.Trigger(BusManagerOffer, "session-1", "session-2", nil, nil)
+	bus.Trigger(BusManagerJoined, "session-1", "", &BusEventMember{Version: BusEventVersion, Roomid: "Room:abc"}, nil)
+	bus.Trigger(BusManagerDisconnect, "session-1", "", nil, nil)
+
+	counts := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		select {
+		case trigger := <-received:
+			counts[trigger.Name]++
+			if trigger.Id != "server-1" || trigger.EventId == "" {
+				t.Errorf("Unexpected trigger %+v", trigger)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 5 events, but got %v", counts)
+		}
+	}
+	if counts[BusManagerOffer] != 3 || counts[BusManagerJoined] != 2 {
+		t.Errorf("Unexpected events %v", counts)
+	}
+	if stats := bus.Stats(); stats.Retries != 1 || stats.Capacity != 3*webhookQueueSize {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
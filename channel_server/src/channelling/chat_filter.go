@@ -0,0 +1,274 @@
+package channelling
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChatFilterAction is the result of a ChatFilter.
+type ChatFilterAction int
+
+const (
+	ChatFilterAllow ChatFilterAction = iota
+	ChatFilterFlag
+	ChatFilterDrop
+)
+
+const (
+	chatFilterFloodCleanup = 60 * time.Second
+)
+
+var chatFilterActions = map[string]ChatFilterAction{
+	"allow": ChatFilterAllow,
+	"flag":  ChatFilterFlag,
+	"drop":  ChatFilterDrop,
+}
+
+func (action ChatFilterAction) String() string {
+	switch action {
+	case ChatFilterFlag:
+		return "flag"
+	case ChatFilterDrop:
+		return "drop"
+	}
+
+	return "allow"
+}
+
+// ParseChatFilterAction returns the action for the given name.
+func ParseChatFilterAction(name string) (ChatFilterAction, bool) {
+	action, ok := chatFilterActions[strings.ToLower(name)]
+	return action, ok
+}
+
+// ChatFilterContext describes where a chat message is sent.
+type ChatFilterContext struct {
+	Session  *Session
+	To       string // Session id of the recipient, empty for broadcasts.
+	Userid   string // User id of the recipient.
+	RoomType string // Room type, or ChatHistoryTypeUser for unicast chats.
+}
+
+// ChatFilter checks a chat message. Filters can rewrite msg.Message in
+// place and return the action together with a reason.
+type ChatFilter interface {
+	Filter(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string)
+}
+
+// ChatFilterFunc adapts a function to the ChatFilter interface.
+type ChatFilterFunc func(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string)
+
+func (f ChatFilterFunc) Filter(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string) {
+	return f(ctx, msg)
+}
+
+// NewBlacklistChatFilter matches the given words case insensitive. When
+// mask is true the words are replaced by asterisks, else the action is
+// returned.
+func NewBlacklistChatFilter(words []string, action ChatFilterAction, mask bool) ChatFilter {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word == "" {
+			continue
+		}
+		// Word boundaries in Go are ASCII only, so they are only used on
+		// sides starting or ending with an ASCII word character. Other
+		// words, eg. in Chinese, match as substrings.
+		term := regexp.QuoteMeta(word)
+		if isASCIIWordChar(word[0]) {
+			term = `\b` + term
+		}
+		if isASCIIWordChar(word[len(word)-1]) {
+			term = term + `\b`
+		}
+		quoted = append(quoted, term)
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	re := regexp.MustCompile(`(?i)(` + strings.Join(quoted, "|") + `)`)
+
+	return ChatFilterFunc(func(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string) {
+		if !re.MatchString(msg.Message) {
+			return ChatFilterAllow, ""
+		}
+		if mask {
+			msg.Message = re.ReplaceAllStringFunc(msg.Message, func(word string) string {
+				return strings.Repeat("*", len([]rune(word)))
+			})
+			return ChatFilterAllow, ""
+		}
+
+		return action, "blacklist"
+	})
+}
+
+func isASCIIWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// ChatFilterReplacement is a regular expression with its replacement.
+type ChatFilterReplacement struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+// NewReplaceChatFilter rewrites the message with all replacements in order.
+func NewReplaceChatFilter(replacements []*ChatFilterReplacement) ChatFilter {
+	if len(replacements) == 0 {
+		return nil
+	}
+
+	return ChatFilterFunc(func(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string) {
+		for _, replacement := range replacements {
+			msg.Message = replacement.Regexp.ReplaceAllString(msg.Message, replacement.Replacement)
+		}
+		return ChatFilterAllow, ""
+	})
+}
+
+// NewMaxLengthChatFilter drops messages with more than maxLength characters.
+func NewMaxLengthChatFilter(maxLength int) ChatFilter {
+	if maxLength <= 0 {
+		return nil
+	}
+
+	return ChatFilterFunc(func(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string) {
+		if len([]rune(msg.Message)) > maxLength {
+			return ChatFilterDrop, "too_long"
+		}
+		return ChatFilterAllow, ""
+	})
+}
+
+var chatFilterLinkRegexp = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+`)
+
+// NewLinkChatFilter replaces links in the message with replacement.
+func NewLinkChatFilter(replacement string) ChatFilter {
+	return ChatFilterFunc(func(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string) {
+		msg.Message = chatFilterLinkRegexp.ReplaceAllString(msg.Message, replacement)
+		return ChatFilterAllow, ""
+	})
+}
+
+type floodChatFilter struct {
+	sync.Mutex
+	maxMessages int
+	interval    time.Duration
+	sent        map[string][]time.Time
+}
+
+// NewFloodChatFilter drops messages when a session sends more than
+// maxMessages within interval.
+func NewFloodChatFilter(maxMessages int, interval time.Duration) ChatFilter {
+	if maxMessages <= 0 || interval <= 0 {
+		return nil
+	}
+	filter := &floodChatFilter{
+		maxMessages: maxMessages,
+		interval:    interval,
+		sent:        make(map[string][]time.Time),
+	}
+
+	go func() {
+		for _ = range time.Tick(chatFilterFloodCleanup) {
+			filter.cleanup()
+		}
+	}()
+
+	return filter
+}
+
+func (filter *floodChatFilter) recent(sent []time.Time, now time.Time) []time.Time {
+	expired := now.Add(-filter.interval)
+	for idx, stamp := range sent {
+		if stamp.After(expired) {
+			return sent[idx:]
+		}
+	}
+
+	return nil
+}
+
+func (filter *floodChatFilter) Filter(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string) {
+	now := time.Now()
+	filter.Lock()
+	defer filter.Unlock()
+
+	sent := filter.recent(filter.sent[ctx.Session.Id], now)
+	if len(sent) >= filter.maxMessages {
+		filter.sent[ctx.Session.Id] = sent
+		return ChatFilterDrop, "flood"
+	}
+	filter.sent[ctx.Session.Id] = append(sent, now)
+
+	return ChatFilterAllow, ""
+}
+
+func (filter *floodChatFilter) cleanup() {
+	now := time.Now()
+	filter.Lock()
+	for id, sent := range filter.sent {
+		if sent = filter.recent(sent, now); len(sent) == 0 {
+			delete(filter.sent, id)
+		} else {
+			filter.sent[id] = sent
+		}
+	}
+	filter.Unlock()
+}
+
+// ChatClassifyRequest is sent to the bus to classify a chat message.
+type ChatClassifyRequest struct {
+	From     string
+	Userid   string `json:",omitempty"`
+	To       string `json:",omitempty"`
+	Roomid   string `json:",omitempty"`
+	RoomType string `json:",omitempty"`
+	Message  string
+}
+
+// ChatClassifyResponse is the reply of an external classifier. An empty
+// Action allows the message, a non empty Message replaces the text.
+type ChatClassifyResponse struct {
+	Action  string
+	Reason  string `json:",omitempty"`
+	Message string `json:",omitempty"`
+}
+
+// NewBusChatFilter asks an external classifier on the bus. If the
+// classifier does not answer within timeout, failAction is returned.
+func NewBusChatFilter(busManager BusManager, timeout time.Duration, failAction ChatFilterAction) ChatFilter {
+	subject := busManager.PrefixSubject("chat.classify")
+
+	return ChatFilterFunc(func(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string) {
+		request := &ChatClassifyRequest{
+			From:     ctx.Session.Id,
+			Userid:   ctx.Session.Userid(),
+			To:       ctx.To,
+			RoomType: ctx.RoomType,
+			Message:  msg.Message,
+		}
+		if ctx.To == "" && ctx.Userid == "" {
+			request.Roomid = ctx.Session.Roomid
+		}
+		response := &ChatClassifyResponse{}
+		if err := busManager.Request(subject, request, response, timeout); err != nil {
+			log.Println("Chat classifier request failed", err)
+			return failAction, "classifier_unavailable"
+		}
+		if response.Message != "" {
+			msg.Message = response.Message
+		}
+		action, _ := ParseChatFilterAction(response.Action)
+		reason := response.Reason
+		if reason == "" && action != ChatFilterAllow {
+			reason = "classifier"
+		}
+
+		return action, reason
+	})
+}
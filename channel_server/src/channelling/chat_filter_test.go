@@ -0,0 +1,80 @@
+package channelling
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_ChatModerator_Moderate_RewritesAndDrops(t *testing.T) {
+	moderator := NewChatModerator(map[string][]ChatFilter{
+		"": []ChatFilter{
+			NewMaxLengthChatFilter(20),
+			NewBlacklistChatFilter([]string{"darn"}, ChatFilterDrop, true),
+			NewReplaceChatFilter([]*ChatFilterReplacement{{regexp.MustCompile(`colour`), "color"}}),
+			NewLinkChatFilter("[link]"),
+		},
+		RoomTypeConference: []ChatFilter{
+			NewBlacklistChatFilter([]string{"darn"}, ChatFilterFlag, false),
+		},
+	}, []string{"moderator"})
+	ctx := &ChatFilterContext{Session: &Session{Id: "a-session"}}
+
+	msg := &DataChatMessage{Message: "Darn colour www.example.com"}
+	if action, _ := moderator.Moderate(ctx, msg); action != ChatFilterDrop {
+		t.Errorf("Expected too long message to be dropped, but got %v", action)
+	}
+
+	msg = &DataChatMessage{Message: "Darn colour http://x"}
+	if action, _ := moderator.Moderate(ctx, msg); action != ChatFilterAllow {
+		t.Errorf("Expected message to be allowed, but got %v", action)
+	}
+	if msg.Message != "**** color [link]" {
+		t.Errorf("Expected rewritten message, but got %q", msg.Message)
+	}
+
+	ctx.RoomType = RoomTypeConference
+	msg = &DataChatMessage{Message: "darn"}
+	if action, reason := moderator.Moderate(ctx, msg); action != ChatFilterFlag || reason != "blacklist" {
+		t.Errorf("Expected message to be flagged by blacklist, but got %v %v", action, reason)
+	}
+
+	msg = &DataChatMessage{Status: &DataChatStatus{Typing: "start"}}
+	if action, _ := moderator.Moderate(ctx, msg); action != ChatFilterAllow {
+		t.Errorf("Expected status message to pass, but got %v", action)
+	}
+}
+
+func Test_BlacklistChatFilter_Filter_MatchesCJK(t *testing.T) {
+	filter := NewBlacklistChatFilter([]string{"笨蛋", "darn", "c++"}, ChatFilterDrop, true)
+	ctx := &ChatFilterContext{Session: &Session{Id: "a-session"}}
+
+	msg := &DataChatMessage{Message: "你是笨蛋吗 darn c++ darned"}
+	filter.Filter(ctx, msg)
+	if msg.Message != "你是**吗 **** *** darned" {
+		t.Errorf("Expected masked message, but got %q", msg.Message)
+	}
+
+	filter = NewBlacklistChatFilter([]string{"笨蛋"}, ChatFilterDrop, false)
+	if action, _ := filter.Filter(ctx, &DataChatMessage{Message: "笨蛋"}); action != ChatFilterDrop {
+		t.Errorf("Expected CJK word to be dropped, but got %v", action)
+	}
+}
+
+func Test_FloodChatFilter_Filter_DropsTooManyMessages(t *testing.T) {
+	filter := NewFloodChatFilter(2, time.Minute)
+	ctx := &ChatFilterContext{Session: &Session{Id: "a-session"}}
+	other := &ChatFilterContext{Session: &Session{Id: "another-session"}}
+
+	for i := 0; i < 2; i++ {
+		if action, _ := filter.Filter(ctx, &DataChatMessage{Message: "hello"}); action != ChatFilterAllow {
+			t.Fatalf("Expected message %d to be allowed, but got %v", i, action)
+		}
+	}
+	if action, reason := filter.Filter(ctx, &DataChatMessage{Message: "hello"}); action != ChatFilterDrop || reason != "flood" {
+		t.Errorf("Expected flood to be dropped, but got %v %v", action, reason)
+	}
+	if action, _ := filter.Filter(other, &DataChatMessage{Message: "hello"}); action != ChatFilterAllow {
+		t.Errorf("Expected other session to be allowed, but got %v", action)
+	}
+}
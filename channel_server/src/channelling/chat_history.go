@@ -0,0 +1,435 @@
+package channelling
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ChatHistoryTypeUser is the type used to look up retention limits
+	// for unicast conversations between two users.
+	ChatHistoryTypeUser = "User"
+
+	chatHistoryDefaultLimit = 50
+	chatHistoryMaxLimit     = 200
+	chatHistoryCleanup      = 60 * time.Second
+)
+
+// ChatHistoryLimits define how many and how old messages are kept.
+type ChatHistoryLimits struct {
+	MaxMessages int
+	MaxAge      time.Duration // Zero keeps messages until they are pushed out.
+}
+
+// ChatHistory stores chat messages per room and per conversation.
+type ChatHistory interface {
+	Add(key, historyType string, entry *DataChatHistoryEntry)
+	Get(key, historyType string, request *DataChatHistoryRequest) ([]*DataChatHistoryEntry, bool)
+	Update(key, historyType, mid string, update func(*DataChatMessage)) bool
+}
+
+// ChatHistoryRoomKey returns the history key for broadcast chats in a room.
+func ChatHistoryRoomKey(roomID string) string {
+	return fmt.Sprintf("room:%s", roomID)
+}
+
+// ChatHistoryUserKey returns the history key for unicast chats between two
+// users. The key is the same for both directions.
+func ChatHistoryUserKey(userid1, userid2 string) string {
+	userids := []string{userid1, userid2}
+	sort.Strings(userids)
+	return fmt.Sprintf("user:%s|%s", userids[0], userids[1])
+}
+
+// IsChatHistoryMessage returns true for chat messages which are worth
+// keeping, that is everything except typing and delivery states.
+func IsChatHistoryMessage(msg *DataChatMessage) bool {
+	if msg.Status == nil {
+		return msg.Message != ""
+	}
+
+	return msg.Status.FileInfo != nil || msg.Status.Geolocation != nil
+}
+
+type chatHistory struct {
+	mutex  sync.RWMutex
+	rings  map[string]*chatHistoryRing
+	limits map[string]*ChatHistoryLimits
+	path   string
+}
+
+// NewChatHistory creates a new ChatHistory with retention limits per room
+// type. The limits for the empty type are used as default. If path is not
+// empty, messages are also written to disk and loaded back when a
+// conversation is accessed the first time.
+func NewChatHistory(path string, limits map[string]*ChatHistoryLimits) ChatHistory {
+	h := &chatHistory{
+		rings:  make(map[string]*chatHistoryRing),
+		limits: limits,
+		path:   path,
+	}
+	if h.limits == nil {
+		h.limits = make(map[string]*ChatHistoryLimits)
+	}
+	if h.path != "" {
+		if err := os.MkdirAll(h.path, 0700); err != nil {
+			log.Println("Failed to create chat history folder, disabling persistence", err)
+			h.path = ""
+		}
+	}
+
+	go func() {
+		for _ = range time.Tick(chatHistoryCleanup) {
+			h.cleanup()
+		}
+	}()
+
+	return h
+}
+
+func (h *chatHistory) getLimits(historyType string) *ChatHistoryLimits {
+	if limits, ok := h.limits[historyType]; ok {
+		return limits
+	}
+	if limits, ok := h.limits[""]; ok {
+		return limits
+	}
+
+	return &ChatHistoryLimits{MaxMessages: 100}
+}
+
+func (h *chatHistory) ring(key, historyType string, create bool) *chatHistoryRing {
+	h.mutex.RLock()
+	ring, ok := h.rings[key]
+	h.mutex.RUnlock()
+	if ok || (!create && h.path == "") {
+		return ring
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// Need to re-check, another thread might have created the ring while we waited for the lock.
+	if ring, ok = h.rings[key]; ok {
+		return ring
+	}
+
+	ring = newChatHistoryRing(h.getLimits(historyType))
+	if h.path != "" {
+		sum := sha256.Sum256([]byte(key))
+		ring.filename = filepath.Join(h.path, fmt.Sprintf("%s.log", hex.EncodeToString(sum[:])))
+		ring.load()
+		// Drop messages which expired while the file was not loaded.
+		ring.prune()
+	}
+	if !create && ring.count == 0 {
+		return nil
+	}
+	h.rings[key] = ring
+
+	return ring
+}
+
+func (h *chatHistory) Add(key, historyType string, entry *DataChatHistoryEntry) {
+	h.ring(key, historyType, true).add(entry)
+}
+
+func (h *chatHistory) Get(key, historyType string, request *DataChatHistoryRequest) ([]*DataChatHistoryEntry, bool) {
+	if ring := h.ring(key, historyType, false); ring != nil {
+		return ring.get(request)
+	}
+
+	return []*DataChatHistoryEntry{}, false
+}
+
+// Update calls update with a copy of the message with the given Mid and
+// replaces the message with the copy.
+func (h *chatHistory) Update(key, historyType, mid string, update func(*DataChatMessage)) bool {
+	if ring := h.ring(key, historyType, false); ring != nil {
+		return ring.update(mid, update)
+	}
+
+	return false
+}
+
+func (h *chatHistory) cleanup() {
+	h.mutex.Lock()
+	loaded := make(map[string]bool)
+	for key, ring := range h.rings {
+		if ring.prune() == 0 {
+			// Empty rings are loaded again from disk when needed.
+			delete(h.rings, key)
+		} else if ring.filename != "" {
+			loaded[ring.filename] = true
+		}
+	}
+	h.mutex.Unlock()
+
+	if h.path != "" {
+		h.sweep(loaded)
+	}
+}
+
+// sweep removes the files of conversations which are not loaded and were
+// not written within the longest retention, so all their messages expired.
+// Files are kept when any history type keeps messages without age limit.
+func (h *chatHistory) sweep(loaded map[string]bool) {
+	var maxAge time.Duration
+	if _, ok := h.limits[""]; !ok {
+		return
+	}
+	for _, limits := range h.limits {
+		if limits.MaxAge <= 0 {
+			return
+		}
+		if limits.MaxAge > maxAge {
+			maxAge = limits.MaxAge
+		}
+	}
+
+	files, err := ioutil.ReadDir(h.path)
+	if err != nil {
+		log.Println("Failed to read chat history folder", err)
+		return
+	}
+	expired := time.Now().Add(-maxAge)
+	for _, info := range files {
+		filename := filepath.Join(h.path, info.Name())
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".log") || loaded[filename] || info.ModTime().After(expired) {
+			continue
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove chat history file", err)
+		}
+	}
+}
+
+// chatHistoryRing is a fixed size ring buffer of chat history entries in
+// chronological order, optionally backed by a JSON lines file.
+type chatHistoryRing struct {
+	sync.Mutex
+	limits   *ChatHistoryLimits
+	entries  []*DataChatHistoryEntry
+	start    int
+	count    int
+	filename string
+	lines    int
+}
+
+func newChatHistoryRing(limits *ChatHistoryLimits) *chatHistoryRing {
+	size := limits.MaxMessages
+	if size < 1 {
+		size = 1
+	}
+
+	return &chatHistoryRing{
+		limits:  limits,
+		entries: make([]*DataChatHistoryEntry, size),
+	}
+}
+
+func (ring *chatHistoryRing) at(idx int) *DataChatHistoryEntry {
+	return ring.entries[(ring.start+idx)%len(ring.entries)]
+}
+
+func (ring *chatHistoryRing) push(entry *DataChatHistoryEntry) {
+	if ring.count == len(ring.entries) {
+		// Full, overwrite the oldest entry.
+		ring.entries[ring.start] = entry
+		ring.start = (ring.start + 1) % len(ring.entries)
+	} else {
+		ring.entries[(ring.start+ring.count)%len(ring.entries)] = entry
+		ring.count++
+	}
+}
+
+func (ring *chatHistoryRing) add(entry *DataChatHistoryEntry) {
+	ring.Lock()
+	defer ring.Unlock()
+
+	ring.push(entry)
+	if ring.filename == "" {
+		return
+	}
+
+	if ring.lines >= 2*len(ring.entries) {
+		// Rewrite the file so it does not grow without bounds.
+		ring.compact()
+		return
+	}
+
+	f, err := os.OpenFile(ring.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Println("Failed to open chat history file", err)
+		return
+	}
+	defer f.Close()
+	if err = json.NewEncoder(f).Encode(entry); err != nil {
+		log.Println("Failed to write chat history", err)
+		return
+	}
+	ring.lines++
+}
+
+func (ring *chatHistoryRing) update(mid string, update func(*DataChatMessage)) bool {
+	ring.Lock()
+	defer ring.Unlock()
+
+	for idx := ring.count - 1; idx >= 0; idx-- {
+		entry := ring.at(idx)
+		if entry.Chat.Mid != mid {
+			continue
+		}
+		// Entries are shared with sent messages, so replace with copies.
+		c := *entry
+		chat := *entry.Chat
+		c.Chat = &chat
+		update(c.Chat)
+		ring.entries[(ring.start+idx)%len(ring.entries)] = &c
+		if ring.filename != "" {
+			ring.compact()
+		}
+		return true
+	}
+
+	return false
+}
+
+// prune removes expired entries, also from the file, and returns the
+// number of remaining entries.
+func (ring *chatHistoryRing) prune() int {
+	ring.Lock()
+	defer ring.Unlock()
+
+	removed := 0
+	if ring.limits.MaxAge > 0 {
+		expired := time.Now().Add(-ring.limits.MaxAge).Unix()
+		for ring.count > 0 && ring.at(0).Chat.Time < expired {
+			ring.entries[ring.start] = nil
+			ring.start = (ring.start + 1) % len(ring.entries)
+			ring.count--
+			removed++
+		}
+	}
+	if ring.filename != "" && (removed > 0 || ring.lines > ring.count) {
+		if ring.count == 0 {
+			if err := os.Remove(ring.filename); err != nil && !os.IsNotExist(err) {
+				log.Println("Failed to remove chat history file", err)
+			}
+			ring.lines = 0
+		} else {
+			ring.compact()
+		}
+	}
+
+	return ring.count
+}
+
+func (ring *chatHistoryRing) get(request *DataChatHistoryRequest) ([]*DataChatHistoryEntry, bool) {
+	ring.Lock()
+	defer ring.Unlock()
+
+	limit := request.Limit
+	if limit <= 0 || limit > chatHistoryMaxLimit {
+		limit = chatHistoryDefaultLimit
+	}
+	var expired int64
+	if ring.limits.MaxAge > 0 {
+		expired = time.Now().Add(-ring.limits.MaxAge).Unix()
+	}
+
+	// Walk backwards from the newest entry to support paging into the past.
+	end := ring.count
+	if request.Before != "" {
+		for idx := ring.count - 1; idx >= 0; idx-- {
+			if ring.at(idx).Chat.Mid == request.Before {
+				end = idx
+				break
+			}
+		}
+	}
+	entries := make([]*DataChatHistoryEntry, 0, limit)
+	more := false
+	for idx := end - 1; idx >= 0; idx-- {
+		entry := ring.at(idx)
+		if request.Until > 0 && entry.Chat.Time >= request.Until {
+			continue
+		}
+		if entry.Chat.Time <= request.Since || entry.Chat.Time < expired {
+			break
+		}
+		if len(entries) == limit {
+			more = true
+			break
+		}
+		entries = append(entries, entry)
+	}
+
+	// Return in chronological order.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries, more
+}
+
+func (ring *chatHistoryRing) load() {
+	f, err := os.Open(ring.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to open chat history file", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		entry := &DataChatHistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil || entry.Chat == nil {
+			log.Println("Ignoring invalid chat history line", ring.filename, err)
+			continue
+		}
+		ring.push(entry)
+		ring.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("Failed to read chat history file", err)
+	}
+}
+
+func (ring *chatHistoryRing) compact() {
+	tmp := fmt.Sprintf("%s.tmp", ring.filename)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		log.Println("Failed to create chat history file", err)
+		return
+	}
+	encoder := json.NewEncoder(f)
+	for idx := 0; idx < ring.count; idx++ {
+		if err = encoder.Encode(ring.at(idx)); err != nil {
+			break
+		}
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, ring.filename)
+	}
+	if err != nil {
+		log.Println("Failed to write chat history file", err)
+		os.Remove(tmp)
+		return
+	}
+	ring.lines = ring.count
+}
@@ -0,0 +1,94 @@
+package channelling
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func addTestChatHistory(history ChatHistory, key string, count int) {
+	now := time.Now().Unix()
+	for i := 0; i < count; i++ {
+		history.Add(key, "", &DataChatHistoryEntry{
+			From: "a-session",
+			Chat: &DataChatMessage{Message: "hello", Mid: fmt.Sprintf("mid-%d", i), Time: now},
+		})
+	}
+}
+
+func Test_ChatHistory_Get_ReturnsNewestMessagesInOrder(t *testing.T) {
+	history := NewChatHistory("", map[string]*ChatHistoryLimits{"": &ChatHistoryLimits{MaxMessages: 10}})
+	addTestChatHistory(history, "room:foo", 15)
+
+	entries, more := history.Get("room:foo", "", &DataChatHistoryRequest{Limit: 3})
+	if len(entries) != 3 || !more {
+		t.Fatalf("Expected 3 entries and more, but got %d entries and %v", len(entries), more)
+	}
+	if mid := entries[2].Chat.Mid; mid != "mid-14" {
+		t.Errorf("Expected newest entry mid-14, but got %v", mid)
+	}
+
+	entries, more = history.Get("room:foo", "", &DataChatHistoryRequest{Before: "mid-7", Limit: 10})
+	if len(entries) != 2 || more {
+		t.Fatalf("Expected 2 entries before mid-7 without more, but got %d entries and %v", len(entries), more)
+	}
+	if mid := entries[0].Chat.Mid; mid != "mid-5" {
+		t.Errorf("Expected oldest retained entry mid-5, but got %v", mid)
+	}
+}
+
+func Test_ChatHistory_Get_LoadsPersistedMessages(t *testing.T) {
+	path, err := ioutil.TempDir("", "chathistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	limits := map[string]*ChatHistoryLimits{"": &ChatHistoryLimits{MaxMessages: 5}}
+	addTestChatHistory(NewChatHistory(path, limits), ChatHistoryUserKey("b", "a"), 12)
+
+	entries, _ := NewChatHistory(path, limits).Get(ChatHistoryUserKey("a", "b"), "", &DataChatHistoryRequest{})
+	if len(entries) != 5 {
+		t.Fatalf("Expected 5 persisted entries, but got %d", len(entries))
+	}
+	if mid := entries[0].Chat.Mid; mid != "mid-7" {
+		t.Errorf("Expected oldest persisted entry mid-7, but got %v", mid)
+	}
+}
+
+func Test_ChatHistory_Cleanup_ExpiresPersistedMessages(t *testing.T) {
+	path, err := ioutil.TempDir("", "chathistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	limits := map[string]*ChatHistoryLimits{"": &ChatHistoryLimits{MaxMessages: 10, MaxAge: time.Hour}}
+	history := NewChatHistory(path, limits).(*chatHistory)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	for i := 0; i < 3; i++ {
+		history.Add("room:old", "", &DataChatHistoryEntry{Chat: &DataChatMessage{Message: "old", Mid: fmt.Sprintf("old-%d", i), Time: old}})
+		history.Add("room:mixed", "", &DataChatHistoryEntry{Chat: &DataChatMessage{Message: "old", Mid: fmt.Sprintf("old-%d", i), Time: old}})
+	}
+	addTestChatHistory(history, "room:mixed", 2)
+
+	// A file of a conversation which is not loaded and expired.
+	stale := filepath.Join(path, "stale.log")
+	if err := ioutil.WriteFile(stale, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(stale, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+
+	history.cleanup()
+	if files, _ := ioutil.ReadDir(path); len(files) != 1 {
+		t.Errorf("Expected only the file of the mixed room, but got %d files", len(files))
+	}
+
+	entries, _ := NewChatHistory(path, limits).Get("room:mixed", "", &DataChatHistoryRequest{})
+	if len(entries) != 2 || entries[0].Chat.Mid != "mid-0" {
+		t.Errorf("Expected 2 persisted entries, but got %d", len(entries))
+	}
+}
@@ -0,0 +1,224 @@
+package channelling
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	chatMessagesMaxAge       = 24 * time.Hour
+	chatMessagesCleanup      = 5 * time.Minute
+	chatMessagesMaxReactions = 50
+)
+
+// IsChatChange returns true for chat messages which edit, delete or react
+// to an earlier message.
+func IsChatChange(msg *DataChatMessage) bool {
+	return msg.Status != nil && (msg.Status.Edit != nil || msg.Status.Delete != nil || msg.Status.Reaction != nil)
+}
+
+// ChatMessageRecord remembers where a chat message with a Mid was sent, so
+// later edits, deletes and reactions can be validated and routed.
+type ChatMessageRecord struct {
+	Mid       string
+	From      string // Session id of the sender.
+	Userid    string // User id of the sender.
+	Roomid    string // Set for broadcasts to a room.
+	To        string // Session id of the unicast recipient.
+	ToUserid  string // User id of the unicast recipient.
+	Deleted   bool
+	seq       uint64
+	stamp     time.Time
+	reactions map[string]map[string]bool
+}
+
+// IsSender returns true if the session sent the message.
+func (record *ChatMessageRecord) IsSender(session *Session) bool {
+	if session.Id == record.From {
+		return true
+	}
+	userid := session.Userid()
+	return userid != "" && userid == record.Userid
+}
+
+// IsParticipant returns true if the session sent or received the message,
+// which for room messages means being in that room.
+func (record *ChatMessageRecord) IsParticipant(session *Session) bool {
+	if record.Roomid != "" {
+		return session.Hello && session.Roomid == record.Roomid
+	}
+	if record.IsSender(session) || session.Id == record.To {
+		return true
+	}
+	userid := session.Userid()
+	return userid != "" && userid == record.ToUserid
+}
+
+// ChatMessages keeps records of recently sent chat messages. Mids are
+// chosen by the clients, so records are kept per sender and conversation
+// and found for the session which changes the message.
+type ChatMessages interface {
+	Add(record *ChatMessageRecord) bool
+	// Find returns the record of the message with mid which the session
+	// sent to one of its conversations, else the first one sent to them.
+	Find(session *Session, mid string) (ChatMessageRecord, bool)
+	Delete(record *ChatMessageRecord) bool
+	React(record *ChatMessageRecord, reactor, reaction string, remove bool) (map[string][]string, bool)
+}
+
+type chatMessages struct {
+	sync.Mutex
+	seq     uint64
+	records map[string][]*ChatMessageRecord
+}
+
+// NewChatMessages creates a new in memory ChatMessages store. Records are
+// kept for one day.
+func NewChatMessages() ChatMessages {
+	m := &chatMessages{
+		records: make(map[string][]*ChatMessageRecord),
+	}
+
+	go func() {
+		for _ = range time.Tick(chatMessagesCleanup) {
+			m.cleanup()
+		}
+	}()
+
+	return m
+}
+
+// Add stores the record. A sender can not use a Mid twice in the same
+// conversation.
+func (m *chatMessages) Add(record *ChatMessageRecord) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, existing := range m.records[record.Mid] {
+		if existing.From == record.From && existing.Roomid == record.Roomid && existing.To == record.To && existing.ToUserid == record.ToUserid {
+			return false
+		}
+	}
+	m.seq++
+	record.seq = m.seq
+	record.stamp = time.Now()
+	m.records[record.Mid] = append(m.records[record.Mid], record)
+
+	return true
+}
+
+func (m *chatMessages) Find(session *Session, mid string) (ChatMessageRecord, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	var found *ChatMessageRecord
+	for _, record := range m.records[mid] {
+		if !record.IsParticipant(session) {
+			continue
+		}
+		if record.IsSender(session) {
+			found = record
+			break
+		}
+		if found == nil {
+			found = record
+		}
+	}
+	if found == nil {
+		return ChatMessageRecord{}, false
+	}
+	c := *found
+	c.reactions = nil
+
+	return c, true
+}
+
+// get returns the stored record of a record returned by Find.
+func (m *chatMessages) get(record *ChatMessageRecord) (*ChatMessageRecord, bool) {
+	for _, stored := range m.records[record.Mid] {
+		if stored.seq == record.seq {
+			return stored, true
+		}
+	}
+
+	return nil, false
+}
+
+func (m *chatMessages) Delete(record *ChatMessageRecord) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.get(record)
+	if !ok || stored.Deleted {
+		return false
+	}
+	stored.Deleted = true
+	stored.reactions = nil
+
+	return true
+}
+
+// React adds or removes a reaction of reactor and returns all reactions
+// of the message.
+func (m *chatMessages) React(record *ChatMessageRecord, reactor, reaction string, remove bool) (map[string][]string, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	stored, ok := m.get(record)
+	if !ok || stored.Deleted {
+		return nil, false
+	}
+	if stored.reactions == nil {
+		stored.reactions = make(map[string]map[string]bool)
+	}
+	reactors, ok := stored.reactions[reaction]
+	if remove {
+		if ok {
+			delete(reactors, reactor)
+			if len(reactors) == 0 {
+				delete(stored.reactions, reaction)
+			}
+		}
+	} else {
+		if !ok {
+			if len(stored.reactions) >= chatMessagesMaxReactions {
+				return nil, false
+			}
+			reactors = make(map[string]bool)
+			stored.reactions[reaction] = reactors
+		}
+		reactors[reactor] = true
+	}
+
+	reactions := make(map[string][]string, len(stored.reactions))
+	for reaction, reactors := range stored.reactions {
+		ids := make([]string, 0, len(reactors))
+		for id := range reactors {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		reactions[reaction] = ids
+	}
+
+	return reactions, true
+}
+
+func (m *chatMessages) cleanup() {
+	expired := time.Now().Add(-chatMessagesMaxAge)
+	m.Lock()
+	for mid, records := range m.records {
+		kept := records[:0]
+		for _, record := range records {
+			if !record.stamp.Before(expired) {
+				kept = append(kept, record)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.records, mid)
+		} else {
+			m.records[mid] = kept
+		}
+	}
+	m.Unlock()
+}
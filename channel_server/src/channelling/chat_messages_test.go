@@ -0,0 +1,73 @@
+package channelling
+
+import (
+	"testing"
+)
+
+func Test_ChatMessages_Find_ReturnsTheRecordOfTheSession(t *testing.T) {
+	messages := NewChatMessages()
+	if !messages.Add(&ChatMessageRecord{Mid: "mid", From: "mallory", Roomid: "room"}) {
+		t.Fatal("Expected first record to be added")
+	}
+	if !messages.Add(&ChatMessageRecord{Mid: "mid", From: "alice", Roomid: "room"}) {
+		t.Fatal("Expected record of another sender with the same mid to be added")
+	}
+	if !messages.Add(&ChatMessageRecord{Mid: "mid", From: "bob", Roomid: "another-room"}) {
+		t.Fatal("Expected record in another room with the same mid to be added")
+	}
+	if messages.Add(&ChatMessageRecord{Mid: "mid", From: "alice", Roomid: "room"}) {
+		t.Error("Expected mid to be used once per sender and conversation")
+	}
+
+	alice := &Session{Id: "alice", Hello: true, Roomid: "room"}
+	if record, ok := messages.Find(alice, "mid"); !ok || !record.IsSender(alice) {
+		t.Errorf("Expected the record of the sender, but got %v", record.From)
+	}
+	if record, ok := messages.Find(&Session{Id: "carol", Hello: true, Roomid: "room"}, "mid"); !ok || record.From != "mallory" {
+		t.Errorf("Expected the first record of the room, but got %v", record.From)
+	}
+	if record, ok := messages.Find(&Session{Id: "dave", Hello: true, Roomid: "another-room"}, "mid"); !ok || record.From != "bob" {
+		t.Errorf("Expected the record of the other room, but got %v", record.From)
+	}
+	if _, ok := messages.Find(&Session{Id: "eve"}, "mid"); ok {
+		t.Error("Expected no record outside of the conversations")
+	}
+}
+
+func Test_ChatMessages_React_AggregatesReactions(t *testing.T) {
+	messages := NewChatMessages()
+	messages.Add(&ChatMessageRecord{Mid: "mid", From: "a-session"})
+	record, _ := messages.Find(&Session{Id: "a-session"}, "mid")
+
+	messages.React(&record, "bob", "+1", false)
+	messages.React(&record, "alice", "+1", false)
+	reactions, ok := messages.React(&record, "bob", "heart", false)
+	if !ok || len(reactions["+1"]) != 2 || reactions["+1"][0] != "alice" || len(reactions["heart"]) != 1 {
+		t.Fatalf("Unexpected reactions %v", reactions)
+	}
+
+	reactions, _ = messages.React(&record, "bob", "heart", true)
+	if _, ok := reactions["heart"]; ok {
+		t.Errorf("Expected removed reaction to be gone, but got %v", reactions)
+	}
+
+	messages.Delete(&record)
+	if _, ok := messages.React(&record, "bob", "+1", false); ok {
+		t.Error("Expected reaction to deleted message to fail")
+	}
+}
+
+func Test_ChatMessageRecord_IsParticipant(t *testing.T) {
+	record := &ChatMessageRecord{Mid: "mid", From: "a-session", To: "another-session"}
+	if !record.IsParticipant(&Session{Id: "another-session"}) {
+		t.Error("Expected recipient to be a participant")
+	}
+	if record.IsParticipant(&Session{Id: "third-session"}) {
+		t.Error("Expected other session not to be a participant")
+	}
+
+	record = &ChatMessageRecord{Mid: "mid", From: "a-session", Roomid: "room"}
+	if !record.IsParticipant(&Session{Id: "third-session", Hello: true, Roomid: "room"}) {
+		t.Error("Expected session in room to be a participant")
+	}
+}
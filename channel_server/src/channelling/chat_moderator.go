@@ -0,0 +1,68 @@
+package channelling
+
+// ChatModerator runs the chat filter chain configured for a room type.
+type ChatModerator interface {
+	Moderate(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string)
+	IsModerator(session *Session) bool
+}
+
+type chatModerator struct {
+	chains         map[string][]ChatFilter
+	moderatorRoles []string
+}
+
+// NewChatModerator creates a ChatModerator with filter chains per room type.
+// The chain for the empty type is used for room types without their own
+// chain. Sessions with one of moderatorRoles are notified about blocked
+// and flagged messages.
+func NewChatModerator(chains map[string][]ChatFilter, moderatorRoles []string) ChatModerator {
+	m := &chatModerator{
+		chains:         make(map[string][]ChatFilter),
+		moderatorRoles: moderatorRoles,
+	}
+	for roomType, chain := range chains {
+		filters := make([]ChatFilter, 0, len(chain))
+		for _, filter := range chain {
+			if filter != nil {
+				filters = append(filters, filter)
+			}
+		}
+		m.chains[roomType] = filters
+	}
+
+	return m
+}
+
+func (m *chatModerator) Moderate(ctx *ChatFilterContext, msg *DataChatMessage) (ChatFilterAction, string) {
+	// Only text messages are filtered, states and file infos pass.
+	if msg.Status != nil || msg.Message == "" {
+		return ChatFilterAllow, ""
+	}
+
+	chain, ok := m.chains[ctx.RoomType]
+	if !ok {
+		chain = m.chains[""]
+	}
+	result, reason := ChatFilterAllow, ""
+	for _, filter := range chain {
+		action, filterReason := filter.Filter(ctx, msg)
+		switch action {
+		case ChatFilterDrop:
+			return action, filterReason
+		case ChatFilterFlag:
+			if result != ChatFilterFlag {
+				result, reason = action, filterReason
+			}
+		}
+	}
+	if msg.Message == "" {
+		// Nothing left after rewriting.
+		return ChatFilterDrop, "empty"
+	}
+
+	return result, reason
+}
+
+func (m *chatModerator) IsModerator(session *Session) bool {
+	return len(m.moderatorRoles) > 0 && session.HasRole(m.moderatorRoles...)
+}
@@ -43,11 +43,13 @@ func NewClient(codec Codec, api ChannellingAPI, session *Session) *Client {
 
 func (client *Client) OnConnect(conn Connection) {
 	client.Connection = conn
-	if reply, err := client.ChannellingAPI.OnConnect(client, client.session); err == nil {
+	reply, err := client.ChannellingAPI.OnConnect(client, client.session)
+	if err == nil {
 		client.reply("", reply)
 	} else {
 		log.Println("OnConnect error", err)
 	}
+	client.ChannellingAPI.OnConnectProcessed(client, client.session, reply, err)
 }
 
 func (client *Client) OnDisconnect() {
@@ -14,6 +14,12 @@ type Config struct {
 	Renegotiation                   bool                      // Renegotiation flag
 	StunURIs                        []string                  // STUN server URIs
 	TurnURIs                        []string                  // TURN server URIs
+	TurnTTL                         int                       `json:"-"` // TURN 凭证有效期 (秒)
+	TurnRoleTTLs                    map[string]int            `json:"-"` // Map of role -> TURN credential lifetime
+	TurnPools                       []*TurnPool               `json:"-"` // 按房间类型和地区选择的 TURN 服务器
+	TurnRegionNetworks              []*TurnRegionNetwork      `json:"-"` // 按网络映射的地区
+	IcePools                        map[string]*IcePool       `json:"-"` // 房间可选的 STUN/TURN 服务器池
+	RoomIcePools                    []*RoomIcePool            `json:"-"` // 按房间名选择的服务器池
 	Tokens                          bool                      // True when we got a tokens file
 	Version                         string                    // 服务器版本号
 	UsersEnabled                    bool                      // 是否开启账户模式
@@ -30,6 +36,24 @@ type Config struct {
 	ContentSecurityPolicyReportOnly string                    `json:"-"` // HTML content security policy in report only mode
 	RoomTypeDefault                 string                    `json:"-"` // 房间的默认类型
 	RoomTypes                       map[*regexp.Regexp]string `json:"-"` // Map of regular expression -> room type
+	RoomMetadataRoles               []string                  `json:"-"` // 允许修改房间元数据的角色 (empty allows everyone in the room)
+	RoomOwnerRoles                  []string                  `json:"-"` // 允许修改房间所有者的角色 (owners can always change them)
+	ChatHistoryEnabled              bool                      // 是否开启聊天记录
+	OfflineMessagesEnabled          bool                      // 是否开启离线消息
+	Users                           UserDirectory             `json:"-"` // 用户目录 (nil when the users mode keeps no accounts)
+	BusChatContent                  bool                      `json:"-"` // 总线聊天事件是否包含消息内容
+	RoomRoles                       []*RoomRoles              `json:"-"` // 加入房间需要的角色
+	Policy                          Policy                    `json:"-"` // 角色权限策略 (nil allows everything)
+	AccessTokens                    AccessTokens              `json:"-"` // 访问令牌 (nil when not enabled)
+	Devices                         DeviceRegistry            `json:"-"` // 设备注册表 (nil when not enabled)
+	AuditLog                        AuditLog                  `json:"-"` // 审计日志 (nil when not enabled)
+}
+
+// RoomRoles are the roles of which a session needs one to join rooms
+// with a name matching Regexp.
+type RoomRoles struct {
+	Regexp *regexp.Regexp
+	Roles  []string
 }
 
 func (config *Config) WithModule(m string) bool {
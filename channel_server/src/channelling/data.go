@@ -37,6 +37,17 @@ type DataRoom struct {
 	Type        string // Room type.
 	Name        string // Room name.
 	Credentials *DataRoomCredentials
+	Metadata    *DataRoomMetadata `json:",omitempty"`
+}
+
+type DataRoomMetadata struct {
+	Title       string            `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	DeviceId    string            `json:",omitempty"` // Device attached to the room.
+	IcePool     string            `json:",omitempty"` // Preferred STUN/TURN server pool.
+	StreamURLs  []string          `json:",omitempty"`
+	Extra       map[string]string `json:",omitempty"` // Custom key/values.
+	Owners      []string          `json:",omitempty"` // User ids allowed to edit and delete all chat messages.
 }
 
 type DataOffer struct {
@@ -70,6 +81,13 @@ type DataSelf struct {
 	Stun       []string
 }
 
+type DataIceServers struct {
+	Type       string
+	Transports []string `json:",omitempty"` // Transports the servers are filtered for.
+	Turn       *DataTurn
+	Stun       []string
+}
+
 type DataTurn struct {
 	Username string   `json:"username"`
 	Password string   `json:"password"`
@@ -78,16 +96,19 @@ type DataTurn struct {
 }
 
 type DataSession struct {
-	Type    string
-	Id      string
-	Userid  string      `json:",omitempty"`
-	Ua      string      `json:",omitempty"`
-	Token   string      `json:",omitempty"`
-	Version string      `json:",omitempty"`
-	Rev     uint64      `json:",omitempty"`
-	Prio    int         `json:",omitempty"`
-	Status  interface{} `json:",omitempty"`
-	stamp   int64
+	Type         string
+	Id           string
+	Userid       string      `json:",omitempty"`
+	DisplayName  string      `json:",omitempty"` // Provided by the users handler.
+	DeviceId     string      `json:",omitempty"` // Set for device sessions.
+	Capabilities []string    `json:",omitempty"` // Capabilities of device sessions.
+	Ua           string      `json:",omitempty"`
+	Token        string      `json:",omitempty"`
+	Version      string      `json:",omitempty"`
+	Rev          uint64      `json:",omitempty"`
+	Prio         int         `json:",omitempty"`
+	Status       interface{} `json:",omitempty"`
+	stamp        int64
 }
 
 type DataUser struct {
@@ -107,17 +128,21 @@ type DataStatus struct {
 }
 
 type DataChat struct {
-	To   string
-	Type string
-	Chat *DataChatMessage
+	To     string
+	Userid string `json:",omitempty"` // User id of the recipient, alternative to To.
+	Type   string
+	Chat   *DataChatMessage
 }
 
 type DataChatMessage struct {
-	Message string
-	Time    int64
-	NoEcho  bool   `json:",omitempty"`
-	Mid     string `json:",omitempty"`
-	Status  *DataChatStatus
+	Message   string
+	Time      int64
+	NoEcho    bool                `json:",omitempty"`
+	Mid       string              `json:",omitempty"`
+	Edited    int64               `json:",omitempty"` // Time of the last edit, only in chat history.
+	Deleted   bool                `json:",omitempty"` // Only in chat history.
+	Reactions map[string][]string `json:",omitempty"` // Only in chat history.
+	Status    *DataChatStatus
 }
 
 type DataChatStatus struct {
@@ -129,6 +154,62 @@ type DataChatStatus struct {
 	Geolocation    *DataGeolocation    `json:",omitempty"`
 	ContactRequest *DataContactRequest `json:",omitempty"`
 	AutoCall       *DataAutoCall       `json:",omitempty"`
+	Edit           *DataChatEdit       `json:",omitempty"`
+	Delete         *DataChatDelete     `json:",omitempty"`
+	Reaction       *DataChatReaction   `json:",omitempty"`
+}
+
+type DataChatEdit struct {
+	Mid     string
+	Message string
+	Time    int64 `json:",omitempty"` // Set by the server.
+}
+
+type DataChatDelete struct {
+	Mid string
+}
+
+type DataChatReaction struct {
+	Mid       string
+	Reaction  string
+	Remove    bool                `json:",omitempty"`
+	Reactions map[string][]string `json:",omitempty"` // Set by the server, reaction -> user or session ids.
+}
+
+type DataChatHistoryRequest struct {
+	Type   string
+	To     string `json:",omitempty"` // Session id of the unicast peer, empty for the current room.
+	Userid string `json:",omitempty"` // User id of the unicast peer, alternative to To.
+	Before string `json:",omitempty"` // Only return messages before the message with this Mid.
+	Since  int64  `json:",omitempty"` // Only return messages newer than this time.
+	Until  int64  `json:",omitempty"` // Only return messages older than this time.
+	Limit  int    `json:",omitempty"`
+}
+
+type DataChatHistory struct {
+	Type     string
+	To       string `json:",omitempty"`
+	Userid   string `json:",omitempty"`
+	Messages []*DataChatHistoryEntry
+	More     bool
+}
+
+type DataChatHistoryEntry struct {
+	From   string
+	Userid string `json:",omitempty"`
+	To     string `json:",omitempty"`
+	Chat   *DataChatMessage
+}
+
+type DataModeration struct {
+	Type   string
+	Action string
+	Reason string
+	From   string
+	Userid string `json:",omitempty"`
+	To     string `json:",omitempty"`
+	Roomid string `json:",omitempty"`
+	Chat   *DataChatMessage
 }
 
 type DataFileInfo struct {
@@ -160,20 +241,24 @@ type DataAutoCall struct {
 }
 
 type DataIncoming struct {
-	Type           string
-	JoinRoom       *DataJoinRoom       `json:",omitempty"`
-	Offer          *DataOffer          `json:",omitempty"`
-	Candidate      *DataCandidate      `json:",omitempty"`
-	Answer         *DataAnswer         `json:",omitempty"`
-	Bye            *DataBye            `json:",omitempty"`
-	Status         *DataStatus         `json:",omitempty"`
-	Chat           *DataChat           `json:",omitempty"`
-	Conference     *DataConference     `json:",omitempty"`
-	Alive          *DataAlive          `json:",omitempty"`
-	Authentication *DataAuthentication `json:",omitempty"`
-	Sessions       *DataSessions       `json:",omitempty"`
-	Room           *DataRoom           `json:",omitempty"`
-	Iid            string              `json:",omitempty"`
+	Type            string
+	JoinRoom        *DataJoinRoom           `json:",omitempty"`
+	Offer           *DataOffer              `json:",omitempty"`
+	Candidate       *DataCandidate          `json:",omitempty"`
+	Answer          *DataAnswer             `json:",omitempty"`
+	Bye             *DataBye                `json:",omitempty"`
+	Status          *DataStatus             `json:",omitempty"`
+	Chat            *DataChat               `json:",omitempty"`
+	ChatHistory     *DataChatHistoryRequest `json:",omitempty"`
+	Conference      *DataConference         `json:",omitempty"`
+	Alive           *DataAlive              `json:",omitempty"`
+	Authentication  *DataAuthentication     `json:",omitempty"`
+	Sessions        *DataSessions           `json:",omitempty"`
+	Room            *DataRoom               `json:",omitempty"`
+	DeviceTelemetry *DataDeviceTelemetry    `json:",omitempty"`
+	DeviceCommand   *DataDeviceCommand      `json:",omitempty"`
+	IceServers      *DataIceServers         `json:",omitempty"`
+	Iid             string                  `json:",omitempty"`
 }
 
 type DataOutgoing struct {
@@ -206,6 +291,23 @@ type DataAlive struct {
 	Alive uint64
 }
 
+// DataDeviceTelemetry is sent by device sessions to the room of the
+// device.
+type DataDeviceTelemetry struct {
+	Type      string
+	DeviceId  string // Set by the server.
+	Telemetry map[string]interface{}
+}
+
+// DataDeviceCommand is sent by user sessions to all sessions of a device.
+type DataDeviceCommand struct {
+	Type     string
+	DeviceId string
+	Command  string
+	Args     map[string]interface{} `json:",omitempty"`
+	Userid   string                 `json:",omitempty"` // Set by the server to the commanding user.
+}
+
 type DataAuthentication struct {
 	Type           string
 	Authentication *SessionToken
@@ -0,0 +1,294 @@
+package channelling
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DeviceUseridPrefix is prepended to the device id to get the userid of
+	// device sessions.
+	DeviceUseridPrefix = "device:"
+	// DeviceRole is the role of all device sessions.
+	DeviceRole = "device"
+)
+
+var (
+	ErrDeviceUnknown            = errors.New("unknown device")
+	ErrDeviceExists             = errors.New("device exists")
+	ErrDeviceDisabled           = errors.New("device is disabled")
+	ErrDeviceInvalidCredentials = errors.New("invalid device credentials")
+	ErrDeviceInvalidId          = errors.New("invalid device id")
+
+	deviceIdPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+)
+
+// Device is a registered device. Devices authenticate with an API key, of
+// which only the hash is stored, or with a client certificate matching
+// the pinned fingerprint.
+type Device struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Controllers  []string `json:"controllers,omitempty"`  // Userids which may command the device.
+	ControlRoles []string `json:"controlRoles,omitempty"` // Roles which may command the device.
+	Disabled     bool     `json:"disabled,omitempty"`
+	KeyHash      string   `json:"keyHash,omitempty"`
+	Fingerprint  string   `json:"fingerprint,omitempty"` // Hex SHA-256 of the DER client certificate.
+	Created      int64    `json:"created"`
+	LastSeen     int64    `json:"lastSeen,omitempty"`
+}
+
+// public returns a copy without the key hash.
+func (device *Device) public() *Device {
+	c := *device
+	c.KeyHash = ""
+	return &c
+}
+
+// MayControl returns true when the device is bound to the userid or to one
+// of the roles of the session.
+func (device *Device) MayControl(session *Session) bool {
+	if userid := session.Userid(); userid != "" {
+		for _, controller := range device.Controllers {
+			if controller == userid {
+				return true
+			}
+		}
+	}
+
+	return len(device.ControlRoles) > 0 && session.HasRole(device.ControlRoles...)
+}
+
+// CertificateFingerprint returns the hex SHA-256 fingerprint of the
+// certificate as used by Device.Fingerprint.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashDeviceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// DeviceRegistry stores the registered devices.
+type DeviceRegistry interface {
+	Authenticate(id, key string) (*Device, error)
+	AuthenticateCertificate(id string, cert *x509.Certificate) (*Device, error)
+	Create(device *Device) (*Device, string, error)
+	IssueKey(id string) (string, error)
+	Update(id string, update func(*Device)) (*Device, error)
+	Delete(id string) error
+	Get(id string) (*Device, bool)
+	List() []*Device
+}
+
+type deviceRegistry struct {
+	sync.Mutex
+	filename string
+	devices  map[string]*Device
+}
+
+// NewDeviceRegistry loads the devices from the JSON file, which is written
+// on every change.
+func NewDeviceRegistry(filename string) (DeviceRegistry, error) {
+	registry := &deviceRegistry{
+		filename: filename,
+		devices:  make(map[string]*Device),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return registry, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var stored struct {
+		Devices []*Device `json:"devices"`
+	}
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	for _, device := range stored.Devices {
+		registry.devices[device.Id] = device
+	}
+
+	return registry, nil
+}
+
+// save must be called with the lock held.
+func (registry *deviceRegistry) save() error {
+	var stored struct {
+		Devices []*Device `json:"devices"`
+	}
+	for _, device := range registry.devices {
+		stored.Devices = append(stored.Devices, device)
+	}
+	sort.Sort(devicesById(stored.Devices))
+	data, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := registry.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, registry.filename)
+}
+
+func (registry *deviceRegistry) authenticate(id string, match func(*Device) bool) (*Device, error) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	device, ok := registry.devices[id]
+	if !ok || !match(device) {
+		return nil, ErrDeviceInvalidCredentials
+	}
+	if device.Disabled {
+		return nil, ErrDeviceDisabled
+	}
+	device.LastSeen = time.Now().Unix()
+
+	return device.public(), nil
+}
+
+func (registry *deviceRegistry) Authenticate(id, key string) (*Device, error) {
+	hash := hashDeviceKey(key)
+	return registry.authenticate(id, func(device *Device) bool {
+		return key != "" && device.KeyHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(device.KeyHash)) == 1
+	})
+}
+
+func (registry *deviceRegistry) AuthenticateCertificate(id string, cert *x509.Certificate) (*Device, error) {
+	fingerprint := CertificateFingerprint(cert)
+	return registry.authenticate(id, func(device *Device) bool {
+		return device.Fingerprint != "" && strings.EqualFold(device.Fingerprint, fingerprint)
+	})
+}
+
+// Create registers the device and returns its API key, unless the device
+// authenticates with a certificate only.
+func (registry *deviceRegistry) Create(device *Device) (*Device, string, error) {
+	if !deviceIdPattern.MatchString(device.Id) {
+		return nil, "", ErrDeviceInvalidId
+	}
+	var key string
+	if device.Fingerprint == "" {
+		var err error
+		if key, err = newDeviceKey(); err != nil {
+			return nil, "", err
+		}
+		device.KeyHash = hashDeviceKey(key)
+	} else {
+		device.KeyHash = ""
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.devices[device.Id]; ok {
+		return nil, "", ErrDeviceExists
+	}
+	device.Created = time.Now().Unix()
+	device.LastSeen = 0
+	registry.devices[device.Id] = device
+	if err := registry.save(); err != nil {
+		delete(registry.devices, device.Id)
+		return nil, "", err
+	}
+
+	return device.public(), key, nil
+}
+
+// IssueKey replaces the API key of the device.
+func (registry *deviceRegistry) IssueKey(id string) (string, error) {
+	key, err := newDeviceKey()
+	if err != nil {
+		return "", err
+	}
+	_, err = registry.Update(id, func(device *Device) {
+		device.KeyHash = hashDeviceKey(key)
+	})
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (registry *deviceRegistry) Update(id string, update func(*Device)) (*Device, error) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	device, ok := registry.devices[id]
+	if !ok {
+		return nil, ErrDeviceUnknown
+	}
+	update(device)
+	if err := registry.save(); err != nil {
+		return nil, err
+	}
+
+	return device.public(), nil
+}
+
+func (registry *deviceRegistry) Delete(id string) error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.devices[id]; !ok {
+		return ErrDeviceUnknown
+	}
+	delete(registry.devices, id)
+
+	return registry.save()
+}
+
+func (registry *deviceRegistry) Get(id string) (*Device, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	device, ok := registry.devices[id]
+	if !ok {
+		return nil, false
+	}
+	return device.public(), true
+}
+
+func (registry *deviceRegistry) List() []*Device {
+	registry.Lock()
+	defer registry.Unlock()
+
+	devices := make([]*Device, 0, len(registry.devices))
+	for _, device := range registry.devices {
+		devices = append(devices, device.public())
+	}
+	sort.Sort(devicesById(devices))
+	return devices
+}
+
+func newDeviceKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type devicesById []*Device
+
+func (a devicesById) Len() int           { return len(a) }
+func (a devicesById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a devicesById) Less(i, j int) bool { return a[i].Id < a[j].Id }
@@ -0,0 +1,94 @@
+package channelling
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_DeviceRegistry_Authenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "devices.json")
+
+	registry, _ := NewDeviceRegistry(filename)
+	if _, _, err := registry.Create(&Device{Id: "device:1"}); err != ErrDeviceInvalidId {
+		t.Errorf("Expected invalid id, but got %v", err)
+	}
+	device, key, err := registry.Create(&Device{Id: "claw-01", Capabilities: []string{"claw"}})
+	if err != nil || key == "" || device.KeyHash != "" {
+		t.Fatalf("Unexpected device %+v %s %v", device, key, err)
+	}
+	if _, _, err := registry.Create(&Device{Id: "claw-01"}); err != ErrDeviceExists {
+		t.Errorf("Expected device to exist, but got %v", err)
+	}
+
+	if device, err := registry.Authenticate("claw-01", key); err != nil || device.Capabilities[0] != "claw" {
+		t.Errorf("Unexpected authentication %+v %v", device, err)
+	}
+	if _, err := registry.Authenticate("claw-01", "wrong"); err != ErrDeviceInvalidCredentials {
+		t.Errorf("Expected invalid credentials, but got %v", err)
+	}
+	if _, err := registry.Authenticate("claw-02", key); err != ErrDeviceInvalidCredentials {
+		t.Errorf("Expected invalid credentials for unknown device, but got %v", err)
+	}
+
+	newKey, err := registry.IssueKey("claw-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Authenticate("claw-01", key); err != ErrDeviceInvalidCredentials {
+		t.Errorf("Expected old key to be replaced, but got %v", err)
+	}
+	registry.Update("claw-01", func(device *Device) {
+		device.Disabled = true
+	})
+	if _, err := registry.Authenticate("claw-01", newKey); err != ErrDeviceDisabled {
+		t.Errorf("Expected device to be disabled, but got %v", err)
+	}
+
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+	if _, key, _ := registry.Create(&Device{Id: "camera-01", Fingerprint: CertificateFingerprint(cert)}); key != "" {
+		t.Error("Expected no key for certificate device")
+	}
+	if _, err := registry.AuthenticateCertificate("camera-01", cert); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err := registry.AuthenticateCertificate("camera-01", &x509.Certificate{Raw: []byte("other")}); err != ErrDeviceInvalidCredentials {
+		t.Errorf("Expected invalid certificate, but got %v", err)
+	}
+	if _, err := registry.Authenticate("camera-01", ""); err != ErrDeviceInvalidCredentials {
+		t.Errorf("Expected empty key to fail, but got %v", err)
+	}
+
+	// Devices are stored.
+	registry, _ = NewDeviceRegistry(filename)
+	if devices := registry.List(); len(devices) != 2 || devices[0].Id != "camera-01" || !devices[1].Disabled {
+		t.Errorf("Unexpected stored devices %+v", devices)
+	}
+	if _, err := registry.Authenticate("camera-01", ""); err != ErrDeviceInvalidCredentials {
+		t.Errorf("Expected empty key to fail, but got %v", err)
+	}
+}
+
+func Test_Device_MayControl(t *testing.T) {
+	device := &Device{Id: "claw-01", Controllers: []string{"alice"}, ControlRoles: []string{"operator"}}
+
+	if !device.MayControl(&Session{userid: "alice"}) {
+		t.Error("Expected bound userid to control the device")
+	}
+	if !device.MayControl(&Session{userid: "bob", roles: []string{"operator"}}) {
+		t.Error("Expected bound role to control the device")
+	}
+	if device.MayControl(&Session{userid: "mallory", roles: []string{"player"}}) {
+		t.Error("Expected unbound session not to control the device")
+	}
+	if (&Device{Id: "claw-02"}).MayControl(&Session{userid: "alice"}) {
+		t.Error("Expected device without bindings not to be controlled")
+	}
+}
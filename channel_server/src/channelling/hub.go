@@ -14,15 +14,12 @@ import (
 	"time"
 )
 
-const (
-	turnTTL = 3600 // XXX(longsleep): Add to config file.
-)
-
 type Hub interface {
 	ClientStats
 	Unicaster
 	TurnDataCreator
 	ContactManager
+	GetClient(sessionID string) (client *Client, ok bool)
 }
 
 type hub struct {
@@ -83,12 +80,13 @@ func (h *hub) CreateTurnData(session *Session) *DataTurn {
 	bar.Write([]byte(id))
 	id = base64.StdEncoding.EncodeToString(bar.Sum(nil))
 	foo := hmac.New(sha1.New, h.turnSecret)
-	expiration := int32(time.Now().Unix()) + turnTTL
+	ttl := h.config.TurnTTLForSession(session)
+	expiration := int32(time.Now().Unix()) + int32(ttl)
 	user := fmt.Sprintf("%d:%s", expiration, id)
 	foo.Write([]byte(user))
 	password := base64.StdEncoding.EncodeToString(foo.Sum(nil))
 
-	return &DataTurn{user, password, turnTTL, h.config.TurnURIs}
+	return &DataTurn{user, password, ttl, h.config.TurnURIsForSession(session)}
 }
 
 func (h *hub) GetSession(id string) (session *Session, ok bool) {
@@ -216,11 +214,11 @@ func (h *hub) ContactrequestHandler(session *Session, to string, cr *DataContact
 			if suserid == "" {
 				return errors.New("no userid")
 			}
-			session, ok := h.GetSession(to)
+			toSession, ok := h.GetSession(to)
 			if !ok {
 				return errors.New("unknown to session")
 			}
-			userid := session.Userid()
+			userid := toSession.Userid()
 			if userid == "" {
 				return errors.New("to has no userid")
 			}
@@ -231,6 +229,16 @@ func (h *hub) ContactrequestHandler(session *Session, to string, cr *DataContact
 			contact := &Contact{userid, suserid}
 			// Serialize.
 			cr.Token, err = h.contacts.Encode("contact", contact)
+			if err == nil {
+				h.config.Audit(&AuditEvent{
+					Action:     "contact.token",
+					Outcome:    AuditOutcomeSuccess,
+					Actor:      suserid,
+					Session:    session.Id,
+					RemoteAddr: session.RemoteAddr(),
+					Target:     userid,
+				})
+			}
 		}
 	}
 
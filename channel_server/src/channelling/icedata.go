@@ -0,0 +1,120 @@
+package channelling
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Transports of ICE server URIs.
+const (
+	IceTransportUDP = "udp"
+	IceTransportTCP = "tcp"
+	IceTransportTLS = "tls"
+)
+
+// IcePool are STUN and TURN servers preferred by rooms, eg. the servers
+// colocated with the device of the room.
+type IcePool struct {
+	Name     string
+	StunURIs []string
+	TurnURIs []string
+}
+
+// RoomIcePool selects the IcePool named Pool for rooms with a name matching
+// Regexp.
+type RoomIcePool struct {
+	Regexp *regexp.Regexp
+	Pool   string
+}
+
+// IceTransport returns the transport of the STUN or TURN URI. TURN over TLS
+// (turns:) and STUN over TLS (stuns:) use tls, else the transport query
+// parameter selects tcp, defaulting to udp.
+func IceTransport(uri string) string {
+	scheme := uri
+	if idx := strings.Index(uri, ":"); idx >= 0 {
+		scheme = strings.ToLower(uri[:idx])
+	}
+	if scheme == "turns" || scheme == "stuns" {
+		return IceTransportTLS
+	}
+	if idx := strings.Index(uri, "?"); idx >= 0 {
+		if query, err := url.ParseQuery(uri[idx+1:]); err == nil && strings.ToLower(query.Get("transport")) == IceTransportTCP {
+			return IceTransportTCP
+		}
+	}
+	return IceTransportUDP
+}
+
+// ParseIceTransports validates and normalizes a list of transports.
+func ParseIceTransports(values []string) ([]string, error) {
+	transports := []string{}
+	for _, value := range values {
+		transport := strings.ToLower(strings.TrimSpace(value))
+		switch transport {
+		case "":
+			continue
+		case IceTransportUDP, IceTransportTCP, IceTransportTLS:
+			transports = append(transports, transport)
+		default:
+			return nil, NewDataError("bad_request", fmt.Sprintf("unknown transport %s", value))
+		}
+	}
+	return transports, nil
+}
+
+// FilterIceURIs returns the URIs using one of the transports, or all URIs
+// when no transports are given.
+func FilterIceURIs(uris []string, transports []string) []string {
+	if len(transports) == 0 {
+		return uris
+	}
+	filtered := []string{}
+	for _, uri := range uris {
+		transport := IceTransport(uri)
+		for _, t := range transports {
+			if t == transport {
+				filtered = append(filtered, uri)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// StunURIsForSession returns the STUN servers of the pool of the current
+// room or the global STUN servers, filtered by the transports of the
+// session.
+func (config *Config) StunURIsForSession(session *Session) []string {
+	uris := config.StunURIs
+	if pool := config.roomIcePool(session); pool != nil && len(pool.StunURIs) > 0 {
+		uris = pool.StunURIs
+	}
+	return FilterIceURIs(uris, session.Transports())
+}
+
+// roomIcePool returns the pool set in the metadata of the current room of
+// the session, else the pool configured for the room name.
+func (config *Config) roomIcePool(session *Session) *IcePool {
+	roomID, ok := session.CurrentRoom()
+	if len(config.IcePools) == 0 || !ok || session.RoomStatusManager == nil {
+		return nil
+	}
+	room, ok := session.RoomStatusManager.Get(roomID)
+	if !ok {
+		return nil
+	}
+	if metadata := room.GetMetadata(); metadata != nil && metadata.IcePool != "" {
+		if pool, ok := config.IcePools[metadata.IcePool]; ok {
+			return pool
+		}
+	}
+	for _, roomPool := range config.RoomIcePools {
+		if roomPool.Regexp.MatchString(room.GetName()) {
+			return config.IcePools[roomPool.Pool]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package channelling
+
+import (
+	"regexp"
+	"testing"
+)
+
+func Test_IceTransport(t *testing.T) {
+	for uri, transport := range map[string]string{
+		"stun:stun.example.com":                         IceTransportUDP,
+		"turn:turn.example.com:3478":                    IceTransportUDP,
+		"turn:turn.example.com:3478?transport=udp":      IceTransportUDP,
+		"turn:turn.example.com:3478?transport=tcp":      IceTransportTCP,
+		"turns:turn.example.com:443?transport=tcp":      IceTransportTLS,
+		"TURNS:turn.example.com:443":                    IceTransportTLS,
+		"stuns:stun.example.com:5349":                   IceTransportTLS,
+		"turn:turn.example.com?foo=bar&transport=TCP":   IceTransportTCP,
+		"turn:[2001:db8::1]:3478?transport=tcp":         IceTransportTCP,
+		"turn:[2001:db8::1]:3478":                       IceTransportUDP,
+		"turn:turn.example.com:3478?transport=sctp&x=1": IceTransportUDP,
+	} {
+		if result := IceTransport(uri); result != transport {
+			t.Errorf("Expected transport %s for %s, but got %s", transport, uri, result)
+		}
+	}
+
+	if _, err := ParseIceTransports([]string{"tcp", "quic"}); err == nil {
+		t.Error("Expected unknown transport to fail")
+	}
+	if transports, err := ParseIceTransports([]string{" TLS", "", "tcp"}); err != nil || len(transports) != 2 || transports[0] != IceTransportTLS {
+		t.Errorf("Unexpected transports %v %v", transports, err)
+	}
+}
+
+func Test_Config_IceServersForSession(t *testing.T) {
+	config := &Config{
+		RoomTypeDefault: RoomTypeRoom,
+		StunURIs:        []string{"stun:global"},
+		TurnURIs:        []string{"turn:global", "turns:global:443?transport=tcp"},
+		IcePools: map[string]*IcePool{
+			"site-a": {Name: "site-a", StunURIs: []string{"stun:site-a"}, TurnURIs: []string{"turn:site-a", "turn:site-a?transport=tcp", "turns:site-a:443?transport=tcp"}},
+			"site-b": {Name: "site-b", TurnURIs: []string{"turn:site-b"}},
+		},
+		RoomIcePools: []*RoomIcePool{{Regexp: regexp.MustCompile("^claw-"), Pool: "site-a"}},
+	}
+	rooms := NewRoomManager(config, nil)
+
+	session := &Session{Id: "1", RoomStatusManager: rooms}
+	if uris := config.StunURIsForSession(session); len(uris) != 1 || uris[0] != "stun:global" {
+		t.Errorf("Expected global STUN servers, but got %v", uris)
+	}
+
+	if _, err := rooms.JoinRoom(RoomTypeRoom+":claw-1", "claw-1", RoomTypeRoom, nil, session, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	session.Hello, session.Roomid = true, RoomTypeRoom+":claw-1"
+	if uris := config.StunURIsForSession(session); uris[0] != "stun:site-a" {
+		t.Errorf("Expected STUN servers of the room name pool, but got %v", uris)
+	}
+	if uris := config.TurnURIsForSession(session); len(uris) != 3 || uris[0] != "turn:site-a" {
+		t.Errorf("Expected TURN servers of the room name pool, but got %v", uris)
+	}
+
+	session.SetTransports([]string{IceTransportTCP, IceTransportTLS})
+	if uris := config.TurnURIsForSession(session); len(uris) != 2 || uris[0] != "turn:site-a?transport=tcp" {
+		t.Errorf("Expected filtered TURN servers, but got %v", uris)
+	}
+	if uris := config.StunURIsForSession(session); len(uris) != 0 {
+		t.Errorf("Expected no STUN servers for tcp and tls, but got %v", uris)
+	}
+	session.SetTransports(nil)
+
+	// Room metadata selects the pool, STUN servers fall back to global.
+	if _, err := rooms.UpdateRoom(session, &DataRoom{Name: "claw-1", Type: RoomTypeRoom, Metadata: &DataRoomMetadata{IcePool: "unknown"}}); err == nil {
+		t.Error("Expected unknown ICE pool to fail")
+	}
+	if _, err := rooms.UpdateRoom(session, &DataRoom{Name: "claw-1", Type: RoomTypeRoom, Metadata: &DataRoomMetadata{IcePool: "site-b"}}); err != nil {
+		t.Fatal(err)
+	}
+	if uris := config.TurnURIsForSession(session); len(uris) != 1 || uris[0] != "turn:site-b" {
+		t.Errorf("Expected TURN servers of the room metadata pool, but got %v", uris)
+	}
+	if uris := config.StunURIsForSession(session); uris[0] != "stun:global" {
+		t.Errorf("Expected global STUN servers, but got %v", uris)
+	}
+}
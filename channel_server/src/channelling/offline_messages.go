@@ -0,0 +1,139 @@
+package channelling
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	offlineMessagesCleanup = 60 * time.Second
+
+	// OfflineMessagesMaxTotalDefault is the number of messages kept for all
+	// users together.
+	OfflineMessagesMaxTotalDefault = 10000
+)
+
+// OfflineMessage is a chat message addressed to a user which had no live
+// sessions when the message was sent.
+type OfflineMessage struct {
+	From   string // Session id of the sender.
+	Userid string // User id of the sender, empty for anonymous senders.
+	Chat   *DataChat
+	stamp  time.Time
+}
+
+// OfflineMessages keeps chat messages for users until they authenticate
+// again.
+type OfflineMessages interface {
+	// Store returns false when the message was not stored, because the
+	// messages of all users reached the limit.
+	Store(userid string, message *OfflineMessage) bool
+	Take(userid string) []*OfflineMessage
+}
+
+// IsOfflineMessage returns true for chat messages which can be delivered
+// later, that is everything except typing states, auto calls and contact
+// requests which are only meaningful for live sessions.
+func IsOfflineMessage(msg *DataChatMessage) bool {
+	if msg.Status == nil {
+		return msg.Message != ""
+	}
+
+	return msg.Status.Typing == "" && msg.Status.AutoCall == nil && msg.Status.ContactRequest == nil
+}
+
+type offlineMessages struct {
+	sync.Mutex
+	limits   *ChatHistoryLimits
+	maxTotal int
+	total    int
+	messages map[string][]*OfflineMessage
+}
+
+// NewOfflineMessages creates a new in memory OfflineMessages store which
+// keeps up to MaxMessages per user for MaxAge, and no more than maxTotal
+// messages (OfflineMessagesMaxTotalDefault when 0) for all users.
+func NewOfflineMessages(limits *ChatHistoryLimits, maxTotal int) OfflineMessages {
+	m := &offlineMessages{
+		limits:   limits,
+		maxTotal: maxTotal,
+		messages: make(map[string][]*OfflineMessage),
+	}
+	if m.limits.MaxMessages < 1 {
+		m.limits.MaxMessages = 1
+	}
+	if m.maxTotal <= 0 {
+		m.maxTotal = OfflineMessagesMaxTotalDefault
+	}
+
+	go func() {
+		for _ = range time.Tick(offlineMessagesCleanup) {
+			m.cleanup()
+		}
+	}()
+
+	return m
+}
+
+func (m *offlineMessages) Store(userid string, message *OfflineMessage) bool {
+	message.stamp = time.Now()
+
+	m.Lock()
+	defer m.Unlock()
+
+	messages := append(m.messages[userid], message)
+	if len(messages) > m.limits.MaxMessages {
+		// Drop the oldest messages.
+		messages = messages[len(messages)-m.limits.MaxMessages:]
+	} else if m.total >= m.maxTotal {
+		return false
+	} else {
+		m.total++
+	}
+	m.messages[userid] = messages
+
+	return true
+}
+
+func (m *offlineMessages) Take(userid string) []*OfflineMessage {
+	m.Lock()
+	messages, ok := m.messages[userid]
+	if ok {
+		delete(m.messages, userid)
+		m.total -= len(messages)
+	}
+	m.Unlock()
+
+	return m.expire(messages, time.Now())
+}
+
+// expire returns the messages which are not yet too old.
+func (m *offlineMessages) expire(messages []*OfflineMessage, now time.Time) []*OfflineMessage {
+	if m.limits.MaxAge <= 0 {
+		return messages
+	}
+
+	expired := now.Add(-m.limits.MaxAge)
+	for idx, message := range messages {
+		if message.stamp.After(expired) {
+			return messages[idx:]
+		}
+	}
+
+	return nil
+}
+
+func (m *offlineMessages) cleanup() {
+	now := time.Now()
+	m.Lock()
+	for userid, messages := range m.messages {
+		expired := m.expire(messages, now)
+		m.total -= len(messages) - len(expired)
+		if len(expired) == 0 {
+			delete(m.messages, userid)
+		} else {
+			m.messages[userid] = expired
+		}
+	}
+	m.Unlock()
+}
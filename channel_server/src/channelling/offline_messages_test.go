@@ -0,0 +1,92 @@
+package channelling
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_OfflineMessages_Take_ReturnsNewestMessagesOnce(t *testing.T) {
+	messages := NewOfflineMessages(&ChatHistoryLimits{MaxMessages: 3}, 0)
+	for i := 0; i < 5; i++ {
+		messages.Store("bob", &OfflineMessage{
+			From: "a-session",
+			Chat: &DataChat{Userid: "bob", Type: "Chat", Chat: &DataChatMessage{Message: "hello", Mid: fmt.Sprintf("mid-%d", i)}},
+		})
+	}
+
+	taken := messages.Take("bob")
+	if len(taken) != 3 {
+		t.Fatalf("Expected 3 messages, but got %d", len(taken))
+	}
+	if mid := taken[0].Chat.Chat.Mid; mid != "mid-2" {
+		t.Errorf("Expected oldest kept message mid-2, but got %v", mid)
+	}
+	if taken = messages.Take("bob"); len(taken) != 0 {
+		t.Errorf("Expected no messages after take, but got %d", len(taken))
+	}
+}
+
+func Test_OfflineMessages_Take_DropsExpiredMessages(t *testing.T) {
+	messages := NewOfflineMessages(&ChatHistoryLimits{MaxMessages: 10, MaxAge: time.Hour}, 0).(*offlineMessages)
+	messages.Store("bob", &OfflineMessage{Chat: &DataChat{Chat: &DataChatMessage{Message: "old"}}})
+	messages.Store("bob", &OfflineMessage{Chat: &DataChat{Chat: &DataChatMessage{Message: "new"}}})
+	messages.messages["bob"][0].stamp = time.Now().Add(-2 * time.Hour)
+
+	taken := messages.Take("bob")
+	if len(taken) != 1 || taken[0].Chat.Chat.Message != "new" {
+		t.Errorf("Expected only the new message, but got %d messages", len(taken))
+	}
+}
+
+func Test_IsOfflineMessage(t *testing.T) {
+	if !IsOfflineMessage(&DataChatMessage{Message: "hello"}) {
+		t.Error("Expected text message to be kept")
+	}
+	if IsOfflineMessage(&DataChatMessage{Status: &DataChatStatus{Typing: "start"}}) {
+		t.Error("Expected typing state to be dropped")
+	}
+	if !IsOfflineMessage(&DataChatMessage{Status: &DataChatStatus{Mid: "mid", State: "delivered"}}) {
+		t.Error("Expected delivery state to be kept")
+	}
+}
+
+func Test_OfflineMessages_Store_LimitsAllUsers(t *testing.T) {
+	messages := NewOfflineMessages(&ChatHistoryLimits{MaxMessages: 2}, 3)
+	for i := 0; i < 3; i++ {
+		if !messages.Store(fmt.Sprintf("user-%d", i), &OfflineMessage{Chat: &DataChat{Chat: &DataChatMessage{Message: "hello"}}}) {
+			t.Fatalf("Expected message %d to be stored", i)
+		}
+	}
+	if messages.Store("user-3", &OfflineMessage{Chat: &DataChat{Chat: &DataChatMessage{Message: "hello"}}}) {
+		t.Error("Expected message above the total limit to be dropped")
+	}
+
+	messages.Take("user-0")
+	if !messages.Store("user-3", &OfflineMessage{Chat: &DataChat{Chat: &DataChatMessage{Message: "hello"}}}) {
+		t.Error("Expected message to be stored after take")
+	}
+}
+
+func Test_SessionManager_UserExists(t *testing.T) {
+	config := &Config{}
+	sessionManager := NewSessionManager(config, nil, nil, nil, nil, nil, []byte("secret")).(*sessionManager)
+	if sessionManager.UserExists("bob") {
+		t.Error("Expected unknown user not to exist")
+	}
+	sessionManager.knownUsers["bob"] = true
+	if !sessionManager.UserExists("bob") {
+		t.Error("Expected authenticated user to exist")
+	}
+
+	config.Users = testUserDirectory{"alice": true}
+	if sessionManager.UserExists("bob") || !sessionManager.UserExists("alice") {
+		t.Error("Expected the user directory to be used")
+	}
+}
+
+type testUserDirectory map[string]bool
+
+func (directory testUserDirectory) UserExists(userid string) bool {
+	return directory[userid]
+}
@@ -9,6 +9,10 @@ import (
 	"time"
 )
 
+// pipelineBufferSize is the number of messages kept in memory when the
+// pipeline is stored in a PipelineLog.
+const pipelineBufferSize = 100
+
 type PipelineFeedLine struct {
 	Seq int
 	Msg *DataOutgoing
@@ -23,6 +27,10 @@ type Pipeline struct {
 	to              *Session
 	expires         *time.Time
 	data            []*DataSinkOutgoing
+	start           int // Sequence number of the first message.
+	offset          int // Sequence number of data[0].
+	seq             int // Sequence number of the next message.
+	log             PipelineLog
 	sink            Sink
 	recvQueue       chan *DataIncoming
 	closed          bool
@@ -39,6 +47,13 @@ func NewPipeline(manager PipelineManager,
 		id:              id,
 		from:            from,
 		recvQueue:       make(chan *DataIncoming, 100),
+		log:             manager.GetPipelineLog(),
+	}
+	if pipeline.log != nil {
+		// Continue the sequence of a stored pipeline with the same id.
+		pipeline.seq = pipeline.log.NextSeq(id)
+		pipeline.start = pipeline.seq
+		pipeline.offset = pipeline.seq
 	}
 	go pipeline.receive()
 	pipeline.Refresh(duration)
@@ -64,6 +79,18 @@ func (pipeline *Pipeline) GetID() string {
 	return pipeline.id
 }
 
+// SinkID returns the id of the attached sink, empty when not attached.
+func (pipeline *Pipeline) SinkID() string {
+	pipeline.mutex.RLock()
+	sink := pipeline.sink
+	pipeline.mutex.RUnlock()
+	if sink == nil {
+		return ""
+	}
+
+	return sink.Export().Id
+}
+
 func (pipeline *Pipeline) Refresh(duration time.Duration) {
 	pipeline.mutex.Lock()
 	pipeline.refresh(duration)
@@ -79,6 +106,27 @@ func (pipeline *Pipeline) Add(msg *DataSinkOutgoing) *Pipeline {
 	msg.Pipe = pipeline.id
 	pipeline.mutex.Lock()
 	pipeline.data = append(pipeline.data, msg)
+	if pipeline.log != nil {
+		record := &PipelineRecord{
+			Pipe:       pipeline.id,
+			Seq:        pipeline.seq,
+			FromUserid: msg.FromUserid,
+			ToUserid:   msg.ToUserid,
+			Msg:        msg.Outgoing,
+		}
+		if pipeline.sink != nil {
+			record.Sink = pipeline.sink.Export().Id
+		}
+		if err := pipeline.log.Append(record); err != nil {
+			log.Println("Failed to store pipeline message", pipeline.id, err)
+		}
+		// Stored messages are read from the log, keep only recent ones.
+		if trim := len(pipeline.data) - pipelineBufferSize; trim > 0 {
+			pipeline.data = pipeline.data[trim:]
+			pipeline.offset += trim
+		}
+	}
+	pipeline.seq++
 	pipeline.refresh(30 * time.Second)
 	pipeline.mutex.Unlock()
 
@@ -98,6 +146,8 @@ func (pipeline *Pipeline) Close() {
 	if !pipeline.closed {
 		pipeline.expires = nil
 		if pipeline.sink != nil {
+			// Stop the sink from sending to the queue before closing it.
+			pipeline.sink.UnbindRecvChan(pipeline.recvQueue)
 			pipeline.sink = nil
 		}
 		close(pipeline.recvQueue)
@@ -133,12 +183,27 @@ func (pipeline *Pipeline) ToSession() *Session {
 }
 
 func (pipeline *Pipeline) JSONFeed(since, limit int) ([]byte, error) {
+	if pipeline.log != nil {
+		records, err := pipeline.log.Records(pipeline.id, since, limit)
+		if err != nil {
+			return nil, err
+		}
+		return PipelineJSONFeed(records)
+	}
+
 	pipeline.mutex.RLock()
+	defer pipeline.mutex.RUnlock()
 	var lineRaw []byte
 	var line *PipelineFeedLine
 	var buffer bytes.Buffer
 	var err error
-	data := pipeline.data[since:]
+	if since < pipeline.offset {
+		since = pipeline.offset
+	}
+	if since-pipeline.offset > len(pipeline.data) {
+		return buffer.Bytes(), nil
+	}
+	data := pipeline.data[since-pipeline.offset:]
 	count := 0
 	for seq, msg := range data {
 		line = &PipelineFeedLine{
@@ -157,7 +222,6 @@ func (pipeline *Pipeline) JSONFeed(since, limit int) ([]byte, error) {
 			break
 		}
 	}
-	pipeline.mutex.RUnlock()
 
 	return buffer.Bytes(), nil
 }
@@ -186,10 +250,10 @@ func (pipeline *Pipeline) FlushOutgoing(hub Hub, client *Client, to string, outg
 				pipeline.to = toSession
 				err := pipeline.attach(sink)
 				if err == nil {
-					pipeline.mutex.Unlock()
-
-					// Create incoming receiver.
+					// Create incoming receiver, with the lock held so
+					// Close unbinds it.
 					sink.BindRecvChan(pipeline.recvQueue)
+					pipeline.mutex.Unlock()
 
 					// Sink it.
 					break
@@ -227,6 +291,9 @@ func (pipeline *Pipeline) Attach(sink Sink) error {
 	log.Println("Attach sink to pipeline", pipeline.id)
 	err := pipeline.attach(sink)
 	if err == nil {
+		for _, msg := range pipeline.trimmed() {
+			sink.Write(msg)
+		}
 		for _, msg := range pipeline.data {
 			log.Println("Flushing pipeline to sink after attach", len(pipeline.data))
 			sink.Write(msg)
@@ -236,7 +303,37 @@ func (pipeline *Pipeline) Attach(sink Sink) error {
 	return err
 }
 
+// trimmed returns the messages of the pipeline which are no longer
+// buffered, read from the log. Must be called with the lock held.
+func (pipeline *Pipeline) trimmed() []*DataSinkOutgoing {
+	if pipeline.log == nil || pipeline.offset <= pipeline.start {
+		return nil
+	}
+	records, err := pipeline.log.Records(pipeline.id, pipeline.start, pipeline.offset-pipeline.start)
+	if err != nil {
+		log.Println("Failed to read pipeline messages", pipeline.id, err)
+		return nil
+	}
+
+	data := make([]*DataSinkOutgoing, 0, len(records))
+	for _, record := range records {
+		if record.Seq >= pipeline.offset {
+			break
+		}
+		data = append(data, &DataSinkOutgoing{
+			Outgoing:   record.Msg,
+			ToUserid:   record.ToUserid,
+			FromUserid: record.FromUserid,
+			Pipe:       record.Pipe,
+		})
+	}
+	return data
+}
+
 func (pipeline *Pipeline) attach(sink Sink) error {
+	if pipeline.closed {
+		return errors.New("pipeline is closed")
+	}
 	if pipeline.sink != nil {
 		return errors.New("pipeline already attached to sink")
 	}
@@ -0,0 +1,377 @@
+package channelling
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pipelineLogSegmentSuffix = ".log"
+	// pipelineLogLineMax is the maximum length of a stored message.
+	pipelineLogLineMax = 1024 * 1024
+)
+
+// PipelineRecord is a message sent through a pipeline, stored as one JSON
+// line.
+type PipelineRecord struct {
+	Pipe       string        `json:"pipe"`
+	Seq        int           `json:"seq"`
+	Time       time.Time     `json:"time"`
+	FromUserid string        `json:"fromUserid,omitempty"`
+	ToUserid   string        `json:"toUserid,omitempty"`
+	Sink       string        `json:"sink,omitempty"`
+	Msg        *DataOutgoing `json:"msg"`
+}
+
+// PipelineLog stores the messages of pipelines, so they can be replayed
+// and exported after the pipeline has expired.
+type PipelineLog interface {
+	Append(record *PipelineRecord) error
+	// NextSeq returns the sequence number of the next message of the
+	// pipeline, continuing stored pipelines.
+	NextSeq(pipe string) int
+	Has(pipe string) bool
+	// Sink returns the id of the first sink which received messages of
+	// the pipeline, empty when there was none.
+	Sink(pipe string) string
+	// Records returns the messages of the pipeline starting with sequence
+	// number since, at most limit when limit is > 0.
+	Records(pipe string, since, limit int) ([]*PipelineRecord, error)
+	// Expire removes segments beyond the retention.
+	Expire()
+	Close()
+}
+
+type pipelineLog struct {
+	sync.Mutex
+	dir         string
+	segmentSize int64
+	maxSegments int
+	retention   time.Duration
+	segments    []int
+	file        *os.File
+	size        int64
+	closed      bool
+	index       map[string][]int // Pipeline id -> segments containing it.
+	next        map[string]int   // Pipeline id -> next sequence number.
+	sinks       map[string]string
+}
+
+// NewPipelineLog opens the append only log in dir. The log is split into
+// segments of segmentSize bytes, of which at most maxSegments are kept and
+// segments older than retention are removed (0 disables the limits).
+func NewPipelineLog(dir string, segmentSize int64, maxSegments int, retention time.Duration) (PipelineLog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	plog := &pipelineLog{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSegments: maxSegments,
+		retention:   retention,
+		index:       make(map[string][]int),
+		next:        make(map[string]int),
+		sinks:       make(map[string]string),
+	}
+	if err := plog.load(); err != nil {
+		return nil, err
+	}
+	plog.Lock()
+	plog.expire()
+	plog.Unlock()
+
+	segment := 1
+	if len(plog.segments) > 0 {
+		segment = plog.segments[len(plog.segments)-1]
+	}
+	if err := plog.open(segment); err != nil {
+		return nil, err
+	}
+
+	return plog, nil
+}
+
+// load rebuilds the index from the existing segments.
+func (plog *pipelineLog) load() error {
+	files, err := ioutil.ReadDir(plog.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, pipelineLogSegmentSuffix) {
+			continue
+		}
+		segment, err := strconv.Atoi(strings.TrimSuffix(name, pipelineLogSegmentSuffix))
+		if err != nil || segment <= 0 {
+			continue
+		}
+		plog.segments = append(plog.segments, segment)
+	}
+	sort.Ints(plog.segments)
+
+	for _, segment := range plog.segments {
+		err := plog.scan(segment, func(record *PipelineRecord) bool {
+			plog.indexRecord(segment, record)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (plog *pipelineLog) segmentFilename(segment int) string {
+	return filepath.Join(plog.dir, fmt.Sprintf("%08d%s", segment, pipelineLogSegmentSuffix))
+}
+
+// open must be called with the lock held or before the log is shared.
+func (plog *pipelineLog) open(segment int) error {
+	file, err := os.OpenFile(plog.segmentFilename(segment), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if len(plog.segments) == 0 || plog.segments[len(plog.segments)-1] != segment {
+		plog.segments = append(plog.segments, segment)
+	}
+	plog.file = file
+	plog.size = info.Size()
+
+	return nil
+}
+
+func (plog *pipelineLog) indexRecord(segment int, record *PipelineRecord) {
+	segments := plog.index[record.Pipe]
+	if len(segments) == 0 || segments[len(segments)-1] != segment {
+		plog.index[record.Pipe] = append(segments, segment)
+	}
+	if record.Seq >= plog.next[record.Pipe] {
+		plog.next[record.Pipe] = record.Seq + 1
+	}
+	if _, ok := plog.sinks[record.Pipe]; !ok && record.Sink != "" {
+		plog.sinks[record.Pipe] = record.Sink
+	}
+}
+
+// scan calls f for all records in the segment until f returns false.
+func (plog *pipelineLog) scan(segment int, f func(*PipelineRecord) bool) error {
+	file, err := os.Open(plog.segmentFilename(segment))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), pipelineLogLineMax)
+	for scanner.Scan() {
+		record := &PipelineRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil || record.Pipe == "" {
+			continue
+		}
+		if !f(record) {
+			break
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (plog *pipelineLog) Append(record *PipelineRecord) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if len(data) >= pipelineLogLineMax {
+		return fmt.Errorf("pipeline message too large (%d bytes)", len(data))
+	}
+	data = append(data, '\n')
+
+	plog.Lock()
+	defer plog.Unlock()
+
+	if plog.closed {
+		return os.ErrClosed
+	}
+	if plog.file != nil && plog.segmentSize > 0 && plog.size > 0 && plog.size+int64(len(data)) > plog.segmentSize {
+		plog.file.Close()
+		plog.file = nil
+	}
+	if plog.file == nil {
+		// Start the next segment, again when it failed to open before.
+		if err = plog.open(plog.segments[len(plog.segments)-1] + 1); err != nil {
+			return err
+		}
+		plog.expire()
+	}
+	n, err := plog.file.Write(data)
+	plog.size += int64(n)
+	if err != nil {
+		return err
+	}
+	plog.indexRecord(plog.segments[len(plog.segments)-1], record)
+
+	return nil
+}
+
+func (plog *pipelineLog) NextSeq(pipe string) int {
+	plog.Lock()
+	defer plog.Unlock()
+
+	return plog.next[pipe]
+}
+
+func (plog *pipelineLog) Has(pipe string) bool {
+	plog.Lock()
+	defer plog.Unlock()
+
+	_, ok := plog.index[pipe]
+	return ok
+}
+
+func (plog *pipelineLog) Sink(pipe string) string {
+	plog.Lock()
+	defer plog.Unlock()
+
+	return plog.sinks[pipe]
+}
+
+func (plog *pipelineLog) Records(pipe string, since, limit int) ([]*PipelineRecord, error) {
+	// Copy the segments, expire changes the index in place. Segments removed
+	// while scanning are skipped.
+	plog.Lock()
+	segments := append([]int(nil), plog.index[pipe]...)
+	plog.Unlock()
+
+	records := []*PipelineRecord{}
+	for _, segment := range segments {
+		err := plog.scan(segment, func(record *PipelineRecord) bool {
+			if record.Pipe == pipe && record.Seq >= since {
+				records = append(records, record)
+			}
+			return limit <= 0 || len(records) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+func (plog *pipelineLog) Expire() {
+	plog.Lock()
+	plog.expire()
+	plog.Unlock()
+}
+
+// expire must be called with the lock held. The current segment is never
+// removed.
+func (plog *pipelineLog) expire() {
+	removed := make(map[int]bool)
+	for len(plog.segments) > 1 {
+		segment := plog.segments[0]
+		if plog.maxSegments <= 0 || len(plog.segments) <= plog.maxSegments {
+			if plog.retention <= 0 {
+				break
+			}
+			info, err := os.Stat(plog.segmentFilename(segment))
+			if err == nil && time.Since(info.ModTime()) < plog.retention {
+				break
+			}
+		}
+		if err := os.Remove(plog.segmentFilename(segment)); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove pipeline log segment", segment, err)
+			break
+		}
+		removed[segment] = true
+		plog.segments = plog.segments[1:]
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	for pipe, segments := range plog.index {
+		kept := segments[:0]
+		for _, segment := range segments {
+			if !removed[segment] {
+				kept = append(kept, segment)
+			}
+		}
+		if len(kept) == 0 {
+			delete(plog.index, pipe)
+			delete(plog.next, pipe)
+			delete(plog.sinks, pipe)
+		} else {
+			plog.index[pipe] = kept
+		}
+	}
+}
+
+func (plog *pipelineLog) Close() {
+	plog.Lock()
+	if plog.file != nil {
+		plog.file.Close()
+		plog.file = nil
+	}
+	plog.closed = true
+	plog.Unlock()
+}
+
+// PipelineJSONFeed returns the records as newline separated feed lines.
+func PipelineJSONFeed(records []*PipelineRecord) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, record := range records {
+		lineRaw, err := json.Marshal(&PipelineFeedLine{Seq: record.Seq, Msg: record.Msg})
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(lineRaw)
+		buffer.WriteString("\n")
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// ExportPipeline writes all stored records of the pipeline as newline
+// separated JSON.
+func ExportPipeline(plog PipelineLog, pipe string, w io.Writer) error {
+	records, err := plog.Records(pipe, 0, 0)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+package channelling
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_PipelineLog_AppendReplayAndExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plog, err := NewPipelineLog(dir, 512, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := 0; seq < 10; seq++ {
+		for _, pipe := range []string{"call.a.b", "call.c.d"} {
+			record := &PipelineRecord{Pipe: pipe, Seq: seq, FromUserid: "alice", Msg: &DataOutgoing{From: "a", To: "b", Data: map[string]interface{}{"Type": "Offer"}}}
+			if err := plog.Append(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	plog.Close()
+
+	// Reopening rebuilds the index from the segments.
+	plog, err = NewPipelineLog(dir, 512, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plog.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) < 2 {
+		t.Errorf("Expected multiple segments, but got %d", len(files))
+	}
+	if !plog.Has("call.a.b") || plog.Has("call.x.y") {
+		t.Error("Unexpected stored pipelines")
+	}
+	if seq := plog.NextSeq("call.c.d"); seq != 10 {
+		t.Errorf("Expected next sequence 10, but got %d", seq)
+	}
+
+	records, err := plog.Records("call.a.b", 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Seq != 4 || records[0].Pipe != "call.a.b" || records[0].FromUserid != "alice" {
+		t.Errorf("Unexpected records %+v", records)
+	}
+
+	feed, err := PipelineJSONFeed(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := &PipelineFeedLine{}
+	if lines := strings.Split(strings.TrimSpace(string(feed)), "\n"); len(lines) != 3 || json.Unmarshal([]byte(lines[2]), line) != nil || line.Seq != 6 {
+		t.Errorf("Unexpected feed %s", feed)
+	}
+
+	var buffer bytes.Buffer
+	if err := ExportPipeline(plog, "call.c.d", &buffer); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buffer.String()), "\n"); len(lines) != 10 {
+		t.Errorf("Expected 10 exported records, but got %d", len(lines))
+	}
+}
+
+func Test_PipelineLog_Retention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plog, err := NewPipelineLog(dir, 256, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plog.Close()
+
+	plog.Append(&PipelineRecord{Pipe: "call.old", Msg: &DataOutgoing{Data: strings.Repeat("x", 200)}})
+	for seq := 0; seq < 10; seq++ {
+		plog.Append(&PipelineRecord{Pipe: "call.new", Seq: seq, Msg: &DataOutgoing{Data: strings.Repeat("x", 200)}})
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("Expected 2 segments, but got %d", len(files))
+	}
+	if plog.Has("call.old") {
+		t.Error("Expected removed pipeline")
+	}
+	if records, _ := plog.Records("call.new", 0, 0); len(records) != 2 || records[1].Seq != 9 {
+		t.Errorf("Unexpected records %+v", records)
+	}
+}
+
+func Test_Pipeline_JSONFeedFromLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plog, err := NewPipelineLog(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plog.Close()
+	plog.Append(&PipelineRecord{Pipe: "call.a.b", Seq: 0, Msg: &DataOutgoing{}})
+
+	manager := NewPipelineManager(NewBusManager(NewChannellingAPIConsumer(), "", false, "", nil, nil), nil, nil, nil, nil, plog, nil)
+	pipeline := NewPipeline(manager, PipelineNamespaceCall, "call.a.b", nil, time.Minute)
+	defer pipeline.Close()
+	for i := 0; i < pipelineBufferSize+5; i++ {
+		pipeline.Add(&DataSinkOutgoing{Outgoing: &DataOutgoing{From: "a"}})
+	}
+	if len(pipeline.data) != pipelineBufferSize {
+		t.Errorf("Expected %d buffered messages, but got %d", pipelineBufferSize, len(pipeline.data))
+	}
+
+	// The sequence continues the stored pipeline.
+	feed, err := pipeline.JSONFeed(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(feed)), "\n")
+	line := &PipelineFeedLine{}
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), line) != nil || line.Seq != 1 || line.Msg.From != "a" {
+		t.Errorf("Unexpected feed %s", feed)
+	}
+	if seq := plog.NextSeq("call.a.b"); seq != pipelineBufferSize+6 {
+		t.Errorf("Unexpected next sequence %d", seq)
+	}
+}
+
+func Test_PipelineLog_ReopensAfterFailedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plog, err := NewPipelineLog(dir, 256, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plog.Close()
+	plog.Append(&PipelineRecord{Pipe: "call.a", Seq: 0, Msg: &DataOutgoing{Data: strings.Repeat("x", 200)}})
+
+	// The next segment can not be created while the directory is gone.
+	os.RemoveAll(dir)
+	if err := plog.Append(&PipelineRecord{Pipe: "call.a", Seq: 1, Msg: &DataOutgoing{Data: strings.Repeat("x", 200)}}); err == nil {
+		t.Fatal("Expected append to fail")
+	}
+
+	os.MkdirAll(dir, 0700)
+	if err := plog.Append(&PipelineRecord{Pipe: "call.a", Seq: 2, Msg: &DataOutgoing{Data: "y"}}); err != nil {
+		t.Fatalf("Expected append to open the segment again, but got %v", err)
+	}
+	if records, _ := plog.Records("call.a", 2, 0); len(records) != 1 {
+		t.Errorf("Unexpected records %+v", records)
+	}
+}
+
+func Test_PipelineLog_Sink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plog, err := NewPipelineLog(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Messages logged before the sink was attached have no sink.
+	plog.Append(&PipelineRecord{Pipe: "call.a.b", Seq: 0, Msg: &DataOutgoing{}})
+	plog.Append(&PipelineRecord{Pipe: "call.a.b", Seq: 1, Sink: "backend", Msg: &DataOutgoing{}})
+	plog.Append(&PipelineRecord{Pipe: "call.a.b", Seq: 2, Sink: "other", Msg: &DataOutgoing{}})
+	if sink := plog.Sink("call.a.b"); sink != "backend" {
+		t.Errorf("Expected sink backend, but got %q", sink)
+	}
+	plog.Close()
+
+	if plog, err = NewPipelineLog(dir, 0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer plog.Close()
+	if sink := plog.Sink("call.a.b"); sink != "backend" {
+		t.Errorf("Expected sink backend after reopening, but got %q", sink)
+	}
+	if sink := plog.Sink("call.c.d"); sink != "" {
+		t.Errorf("Unexpected sink %q", sink)
+	}
+}
+
+type recordingSink struct {
+	written []*DataSinkOutgoing
+}
+
+func (sink *recordingSink) Write(outgoing *DataSinkOutgoing) error {
+	sink.written = append(sink.written, outgoing)
+	return nil
+}
+
+func (sink *recordingSink) Enabled() bool {
+	return true
+}
+
+func (sink *recordingSink) Close() {
+}
+
+func (sink *recordingSink) Export() *DataSink {
+	return &DataSink{Id: "recording"}
+}
+
+func (sink *recordingSink) BindRecvChan(channel chan *DataIncoming) error {
+	return nil
+}
+
+func (sink *recordingSink) UnbindRecvChan(channel chan *DataIncoming) {
+}
+
+func Test_Pipeline_AttachReplaysTrimmedMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plog, err := NewPipelineLog(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plog.Close()
+	// A message of a previous pipeline with the same id.
+	plog.Append(&PipelineRecord{Pipe: "call.a.b", Seq: 0, Msg: &DataOutgoing{From: "old"}})
+
+	manager := NewPipelineManager(NewBusManager(NewChannellingAPIConsumer(), "", false, "", nil, nil), nil, nil, nil, nil, plog, nil)
+	pipeline := NewPipeline(manager, PipelineNamespaceCall, "call.a.b", nil, time.Minute)
+	defer pipeline.Close()
+	count := pipelineBufferSize + 20
+	for i := 0; i < count; i++ {
+		pipeline.Add(&DataSinkOutgoing{Outgoing: &DataOutgoing{From: "a", Data: i}, FromUserid: "alice"})
+	}
+
+	sink := &recordingSink{}
+	if err := pipeline.Attach(sink); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.written) != count {
+		t.Fatalf("Expected %d replayed messages, but got %d", count, len(sink.written))
+	}
+	for i, msg := range sink.written {
+		if data, _ := msg.Outgoing.Data.(float64); msg.Outgoing.From != "a" || msg.FromUserid != "alice" || (i < 20 && int(data) != i) {
+			t.Fatalf("Unexpected replayed message %d %+v", i, msg.Outgoing)
+		}
+	}
+	if data := sink.written[count-1].Outgoing.Data; data != count-1 {
+		t.Errorf("Expected last message %d, but got %v", count-1, data)
+	}
+}
@@ -8,7 +8,9 @@ import (
 )
 
 const (
-	PipelineNamespaceCall = "call"
+	PipelineNamespaceCall   = "call"
+	PipelineNamespaceChat   = "chat"
+	PipelineNamespaceDevice = "device"
 )
 
 type PipelineManager interface {
@@ -19,6 +21,10 @@ type PipelineManager interface {
 	GetPipelineByID(id string) (pipeline *Pipeline, ok bool)
 	GetPipeline(namespace string, sender Sender, session *Session, to string) *Pipeline
 	FindSinkAndSession(to string) (Sink, *Session)
+	GetPipelineLog() PipelineLog
+	GetSink(id string) (Sink, bool)
+	GetDeviceSession(deviceID string) (*Session, bool)
+	AuthorizePipeline(id, token string, write bool) (*PipelineToken, error)
 }
 
 type pipelineManager struct {
@@ -31,12 +37,28 @@ type pipelineManager struct {
 	sessionTable        map[string]*Session
 	sessionByBusIDTable map[string]*Session
 	sessionSinkTable    map[string]Sink
+	sinkRequestTable    map[string]SinkRequest // Session id -> request of its sink.
+	deviceSessionTable  map[string]*Session
 	duration            time.Duration
 	defaultSinkID       string
 	enabled             bool
+	sinkFactory         SinkFactory
+	log                 PipelineLog
+	tokens              PipelineTokens
 }
 
-func NewPipelineManager(busManager BusManager, sessionStore SessionStore, userStore UserStore, sessionCreator SessionCreator) PipelineManager {
+// NewPipelineManager creates the pipeline manager. Sinks of pipeline
+// sessions are created with the sinkFactory, or as NATS sinks when nil.
+// Pipelines are stored in the log when it is not nil. Sink owners receive
+// access tokens of their pipelines issued with tokens, or with a random
+// secret when nil.
+func NewPipelineManager(busManager BusManager, sessionStore SessionStore, userStore UserStore, sessionCreator SessionCreator, sinkFactory SinkFactory, pipelineLog PipelineLog, tokens PipelineTokens) PipelineManager {
+	if sinkFactory == nil {
+		sinkFactory = NewSinkFactory(busManager, "", 0)
+	}
+	if tokens == nil {
+		tokens = NewPipelineTokens(nil, 0)
+	}
 	plm := &pipelineManager{
 		BusManager:          busManager,
 		SessionStore:        sessionStore,
@@ -46,7 +68,12 @@ func NewPipelineManager(busManager BusManager, sessionStore SessionStore, userSt
 		sessionTable:        make(map[string]*Session),
 		sessionByBusIDTable: make(map[string]*Session),
 		sessionSinkTable:    make(map[string]Sink),
+		sinkRequestTable:    make(map[string]SinkRequest),
+		deviceSessionTable:  make(map[string]*Session),
 		duration:            60 * time.Second,
+		sinkFactory:         sinkFactory,
+		log:                 pipelineLog,
+		tokens:              tokens,
 	}
 
 	return plm
@@ -59,6 +86,14 @@ func (plm *pipelineManager) Start() {
 
 	plm.Subscribe("channelling.session.create", plm.sessionCreate)
 	plm.Subscribe("channelling.session.close", plm.sessionClose)
+	plm.Subscribe("channelling.session.join", plm.busSessionHandler("join", plm.sessionJoin))
+	plm.Subscribe("channelling.session.leave", plm.busSessionHandler("leave", plm.sessionLeave))
+	plm.Subscribe("channelling.session.status", plm.busSessionHandler("status", plm.sessionStatus))
+	plm.Subscribe("channelling.session.chat", plm.busSessionHandler("chat", plm.sessionChat))
+	plm.Subscribe("channelling.session.unicast", plm.busSessionHandler("unicast", plm.sessionUnicast))
+	plm.Subscribe("channelling.session.broadcast", plm.busSessionHandler("broadcast", plm.sessionBroadcast))
+	plm.Subscribe("channelling.session.users", plm.busSessionHandler("users", plm.sessionUsers))
+	plm.Subscribe("channelling.session.sink", plm.busSessionHandler("sink", plm.sessionSink))
 }
 
 func (plm *pipelineManager) cleanup() {
@@ -70,6 +105,10 @@ func (plm *pipelineManager) cleanup() {
 		}
 	}
 	plm.mutex.Unlock()
+
+	if plm.log != nil {
+		plm.log.Expire()
+	}
 }
 
 func (plm *pipelineManager) start() {
@@ -89,6 +128,7 @@ func (plm *pipelineManager) sessionCreate(subject, reply string, msg *SessionCre
 	}
 
 	var sink Sink
+	var sinkRequest SinkRequest
 
 	plm.mutex.Lock()
 	session, ok := plm.sessionByBusIDTable[msg.Id]
@@ -96,21 +136,53 @@ func (plm *pipelineManager) sessionCreate(subject, reply string, msg *SessionCre
 		// Remove existing session with same ID.
 		delete(plm.sessionTable, session.Id)
 		sink, _ = plm.sessionSinkTable[session.Id]
+		sinkRequest = plm.sinkRequestTable[session.Id]
 		delete(plm.sessionSinkTable, session.Id)
+		delete(plm.sinkRequestTable, session.Id)
+		plm.removeDeviceSession(session)
 		session.Close()
 	}
+	// Keep the sink of the previous session unless another sink is
+	// requested.
+	request := SinkRequest{Type: SinkTypeNATS}
+	if msg.Sink != nil {
+		request.URL = msg.Sink.URL
+		if msg.Sink.Type != "" {
+			request.Type = msg.Sink.Type
+		}
+	}
+	if sink != nil && sinkRequest != request {
+		sink.Close()
+		sink = nil
+	}
+	if sink == nil {
+		var err error
+		if sink, err = plm.sinkFactory.NewSink(msg.Id, msg.Sink); err != nil {
+			delete(plm.sessionByBusIDTable, msg.Id)
+			plm.mutex.Unlock()
+			log.Println("Failed to create sink", msg.Id, err)
+			if reply != "" {
+				plm.Publish(reply, NewBusReply(nil, err))
+			}
+			return
+		}
+		log.Println("Created sink", request.Type, msg.Id)
+	}
 	session = plm.CreateSession(nil, "")
 	plm.sessionByBusIDTable[msg.Id] = session
 	plm.sessionTable[session.Id] = session
-	if sink == nil {
-		sink = plm.CreateSink(msg.Id)
-		log.Println("Created NATS sink", msg.Id)
-	}
 	if reply != "" {
 		// Always reply with our sink data
-		plm.Publish(reply, sink.Export())
+		plm.Publish(reply, plm.exportSink(sink))
 	}
 	plm.sessionSinkTable[session.Id] = sink
+	plm.sinkRequestTable[session.Id] = request
+	// Pipeline sessions with a device id receive the commands of that
+	// device when it is not connected itself.
+	if msg.Session.DeviceId != "" {
+		session.SetDevice(msg.Session.DeviceId, msg.Session.Capabilities)
+		plm.deviceSessionTable[msg.Session.DeviceId] = session
+	}
 
 	if msg.SetAsDefault {
 		plm.defaultSinkID = session.Id
@@ -126,6 +198,10 @@ func (plm *pipelineManager) sessionCreate(subject, reply string, msg *SessionCre
 		session.SetUseridFake(msg.Session.Userid)
 	}
 
+	if len(msg.Roles) > 0 {
+		session.SetRoles(msg.Roles)
+	}
+
 	if msg.Room != nil {
 		room, err := session.JoinRoom(msg.Room.Name, msg.Room.Type, msg.Room.Credentials, nil)
 		log.Println("Joined NATS session to room", room, err)
@@ -146,6 +222,8 @@ func (plm *pipelineManager) sessionClose(subject, reply string, id string) {
 	if ok {
 		delete(plm.sessionByBusIDTable, id)
 		delete(plm.sessionTable, session.Id)
+		plm.removeDeviceSession(session)
+		delete(plm.sinkRequestTable, session.Id)
 		if sink, ok := plm.sessionSinkTable[session.Id]; ok {
 			delete(plm.sessionSinkTable, session.Id)
 			sink.Close()
@@ -165,6 +243,40 @@ func (plm *pipelineManager) GetPipelineByID(id string) (*Pipeline, bool) {
 	return pipeline, ok
 }
 
+// removeDeviceSession must be called with the lock held.
+func (plm *pipelineManager) removeDeviceSession(session *Session) {
+	if deviceID := session.DeviceId(); deviceID != "" && plm.deviceSessionTable[deviceID] == session {
+		delete(plm.deviceSessionTable, deviceID)
+	}
+}
+
+// GetDeviceSession returns the pipeline session standing in for the
+// device.
+func (plm *pipelineManager) GetDeviceSession(deviceID string) (*Session, bool) {
+	plm.mutex.RLock()
+	defer plm.mutex.RUnlock()
+
+	session, ok := plm.deviceSessionTable[deviceID]
+	return session, ok
+}
+
+// GetSink returns the sink of the pipeline session created with the bus id.
+func (plm *pipelineManager) GetSink(id string) (Sink, bool) {
+	plm.mutex.RLock()
+	defer plm.mutex.RUnlock()
+
+	session, ok := plm.sessionByBusIDTable[id]
+	if !ok {
+		return nil, false
+	}
+	sink, ok := plm.sessionSinkTable[session.Id]
+	return sink, ok
+}
+
+func (plm *pipelineManager) GetPipelineLog() PipelineLog {
+	return plm.log
+}
+
 func (plm *pipelineManager) PipelineID(namespace string, sender Sender, session *Session, to string) string {
 	return fmt.Sprintf("%s.%s.%s", namespace, session.Id, to)
 }
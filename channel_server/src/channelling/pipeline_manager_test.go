@@ -0,0 +1,140 @@
+package channelling
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+type fakeSessionCreator struct {
+	SessionManager
+	ImageCache
+	count int
+}
+
+func (creator *fakeSessionCreator) CreateSession(st *SessionToken, userid string) *Session {
+	creator.count++
+	return NewSession(creator, nil, nil, nil, creator, securecookie.New(securecookie.GenerateRandomKey(64), nil), fmt.Sprintf("pipeline-%d", creator.count), "")
+}
+
+func (creator *fakeSessionCreator) DestroySession(sessionID, userID string) {
+}
+
+func (creator *fakeSessionCreator) Delete(id string) {
+}
+
+func Test_PipelineManager_DeviceSessions(t *testing.T) {
+	manager := NewPipelineManager(NewBusManager(NewChannellingAPIConsumer(), "", false, "", nil, nil), nil, nil, &fakeSessionCreator{}, NewSinkFactory(nil, "", 0), nil, nil).(*pipelineManager)
+	request := &SessionCreateRequest{
+		Id:      "referee",
+		Session: &DataSession{DeviceId: "claw-1", Capabilities: []string{"move"}},
+		Sink:    &SinkRequest{Type: SinkTypeWebSocket},
+	}
+	manager.sessionCreate("", "", request)
+	session, ok := manager.GetDeviceSession("claw-1")
+	if !ok || session.DeviceId() != "claw-1" {
+		t.Fatalf("Expected device session, but got %v", session)
+	}
+
+	// Replacing the session replaces the device session.
+	manager.sessionCreate("", "", request)
+	if replaced, ok := manager.GetDeviceSession("claw-1"); !ok || replaced == session {
+		t.Errorf("Expected replaced device session, but got %v", replaced)
+	}
+
+	manager.sessionClose("", "", "referee")
+	if _, ok := manager.GetDeviceSession("claw-1"); ok {
+		t.Error("Expected device session to be removed")
+	}
+}
+
+type fakePublishBus struct {
+	BusManager
+	published map[string]interface{}
+}
+
+func (bus *fakePublishBus) Publish(subject string, v interface{}) error {
+	bus.published[subject] = v
+	return nil
+}
+
+type fakeIncomingAPI struct {
+	ChannellingAPI
+	incoming []*DataIncoming
+}
+
+func (api *fakeIncomingAPI) OnIncoming(sender Sender, session *Session, msg *DataIncoming) (interface{}, error) {
+	api.incoming = append(api.incoming, msg)
+	if msg.Type == "Users" {
+		return []*DataSession{{Id: session.Id}}, nil
+	}
+	return nil, nil
+}
+
+func (api *fakeIncomingAPI) OnIncomingProcessed(sender Sender, session *Session, msg *DataIncoming, reply interface{}, err error) {
+}
+
+func Test_PipelineManager_BusSessionRequests(t *testing.T) {
+	api := &fakeIncomingAPI{}
+	bus := &fakePublishBus{NewBusManager(NewChannellingAPIConsumer(), "", false, "", nil, nil), make(map[string]interface{})}
+	bus.SetChannellingAPI(api)
+	manager := NewPipelineManager(bus, nil, nil, &fakeSessionCreator{}, NewSinkFactory(nil, "", 0), nil, nil).(*pipelineManager)
+	manager.sessionCreate("", "", &SessionCreateRequest{Id: "referee", Session: &DataSession{}, Sink: &SinkRequest{Type: SinkTypeWebSocket}})
+
+	users := manager.busSessionHandler("users", manager.sessionUsers)
+	users("channelling.session.users", "reply", &BusSessionRequest{Id: "referee"})
+	if reply := bus.published["reply"].(*BusReply); !reply.Success || len(reply.Data.([]*DataSession)) != 1 {
+		t.Errorf("Unexpected users reply %+v", reply)
+	}
+	users("channelling.session.users", "reply", &BusSessionRequest{Id: "unknown"})
+	if reply := bus.published["reply"].(*BusReply); reply.Success || reply.Code != "unknown_session" {
+		t.Errorf("Expected unknown session, but got %+v", reply)
+	}
+
+	manager.busSessionHandler("chat", manager.sessionChat)("", "reply", &BusSessionRequest{Id: "referee", To: "player", Chat: &DataChatMessage{Message: "Go!"}})
+	if len(api.incoming) != 2 || api.incoming[1].Type != "Chat" || api.incoming[1].Chat.To != "player" {
+		t.Errorf("Expected chat to be processed, but got %+v", api.incoming)
+	}
+
+	for name, handle := range map[string]func(*Session, *BusSessionRequest) (interface{}, error){
+		"join":      manager.sessionJoin,
+		"status":    manager.sessionStatus,
+		"chat":      manager.sessionChat,
+		"unicast":   manager.sessionUnicast,
+		"broadcast": manager.sessionBroadcast,
+	} {
+		manager.busSessionHandler(name, handle)("", "reply", &BusSessionRequest{Id: "referee"})
+		if reply := bus.published["reply"].(*BusReply); reply.Code != "bad_request" {
+			t.Errorf("Expected %s to fail, but got %+v", name, reply)
+		}
+	}
+	manager.busSessionHandler("broadcast", manager.sessionBroadcast)("", "reply", &BusSessionRequest{Id: "referee", Data: []byte(`{"Type":"Score"}`)})
+	if reply := bus.published["reply"].(*BusReply); reply.Code != "not_in_room" {
+		t.Errorf("Expected broadcast without room to fail, but got %+v", reply)
+	}
+}
+
+func Test_PipelineManager_SessionCreateReplacesChangedSink(t *testing.T) {
+	bus := &fakePublishBus{NewBusManager(NewChannellingAPIConsumer(), "", false, "", nil, nil), make(map[string]interface{})}
+	manager := NewPipelineManager(bus, nil, nil, &fakeSessionCreator{}, NewSinkFactory(nil, "", 0), nil, nil).(*pipelineManager)
+	sinkOf := func(id string) Sink {
+		return manager.sessionSinkTable[manager.sessionByBusIDTable[id].Id]
+	}
+
+	manager.sessionCreate("", "reply", &SessionCreateRequest{Id: "hook", Session: &DataSession{}, Sink: &SinkRequest{Type: SinkTypeWebhook, URL: "http://a.example.com/"}})
+	sink := sinkOf("hook")
+	manager.sessionCreate("", "reply", &SessionCreateRequest{Id: "hook", Session: &DataSession{}, Sink: &SinkRequest{Type: SinkTypeWebhook, URL: "http://a.example.com/"}})
+	if sinkOf("hook") != sink {
+		t.Error("Expected sink to be kept for the same request")
+	}
+	manager.sessionCreate("", "reply", &SessionCreateRequest{Id: "hook", Session: &DataSession{}, Sink: &SinkRequest{Type: SinkTypeWebhook, URL: "http://b.example.com/"}})
+	if sinkOf("hook") == sink {
+		t.Error("Expected sink to be replaced for another URL")
+	}
+
+	manager.sessionCreate("", "reply", &SessionCreateRequest{Id: "hook", Session: &DataSession{}, Sink: &SinkRequest{Type: SinkTypeWebhook}})
+	if reply, ok := bus.published["reply"].(*BusReply); !ok || reply.Success || reply.Code != "bad_request" {
+		t.Errorf("Expected error reply, but got %+v", bus.published["reply"])
+	}
+}
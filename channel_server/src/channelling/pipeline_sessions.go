@@ -0,0 +1,119 @@
+package channelling
+
+import (
+	"log"
+)
+
+// busSessionHandler returns the handler of a session request subject.
+// Requests are processed like channeling API documents of the session,
+// the result is published to the reply subject.
+func (plm *pipelineManager) busSessionHandler(name string, handle func(*Session, *BusSessionRequest) (interface{}, error)) func(subject, reply string, msg *BusSessionRequest) {
+	return func(subject, reply string, msg *BusSessionRequest) {
+		log.Println("session", name, "via NATS", subject, reply, msg.Id)
+
+		var result interface{}
+		var err error
+		plm.mutex.RLock()
+		session, ok := plm.sessionByBusIDTable[msg.Id]
+		plm.mutex.RUnlock()
+		if ok {
+			result, err = handle(session, msg)
+		} else {
+			err = NewDataError("unknown_session", "unknown session")
+		}
+
+		if err != nil {
+			log.Println("Failed session request", name, msg.Id, err)
+		}
+		if reply != "" {
+			plm.Publish(reply, NewBusReply(result, err))
+		}
+	}
+}
+
+// incoming processes the document with the channeling API.
+func (plm *pipelineManager) incoming(session *Session, incoming *DataIncoming) (interface{}, error) {
+	api := plm.GetChannellingAPI()
+	result, err := api.OnIncoming(nil, session, incoming)
+	api.OnIncomingProcessed(nil, session, incoming, result, err)
+
+	return result, err
+}
+
+func (plm *pipelineManager) sessionJoin(session *Session, msg *BusSessionRequest) (interface{}, error) {
+	if msg.Room == nil || msg.Room.Name == "" {
+		return nil, NewDataError("bad_request", "request did not contain Room")
+	}
+
+	return plm.incoming(session, &DataIncoming{
+		Type: "JoinRoom",
+		JoinRoom: &DataJoinRoom{
+			Name:        msg.Room.Name,
+			Type:        msg.Room.Type,
+			Credentials: msg.Room.Credentials,
+		},
+	})
+}
+
+func (plm *pipelineManager) sessionLeave(session *Session, msg *BusSessionRequest) (interface{}, error) {
+	return plm.incoming(session, &DataIncoming{Type: "Leave"})
+}
+
+func (plm *pipelineManager) sessionStatus(session *Session, msg *BusSessionRequest) (interface{}, error) {
+	if msg.Status == nil {
+		return nil, NewDataError("bad_request", "request did not contain Status")
+	}
+
+	return plm.incoming(session, &DataIncoming{
+		Type:   "Status",
+		Status: &DataStatus{Type: "Status", Status: msg.Status},
+	})
+}
+
+func (plm *pipelineManager) sessionChat(session *Session, msg *BusSessionRequest) (interface{}, error) {
+	if msg.Chat == nil {
+		return nil, NewDataError("bad_request", "request did not contain Chat")
+	}
+
+	return plm.incoming(session, &DataIncoming{
+		Type: "Chat",
+		Chat: &DataChat{To: msg.To, Type: "Chat", Chat: msg.Chat},
+	})
+}
+
+func (plm *pipelineManager) sessionUnicast(session *Session, msg *BusSessionRequest) (interface{}, error) {
+	if msg.To == "" || len(msg.Data) == 0 {
+		return nil, NewDataError("bad_request", "request did not contain To and Data")
+	}
+
+	session.Unicast(msg.To, msg.Data, nil)
+	return nil, nil
+}
+
+func (plm *pipelineManager) sessionBroadcast(session *Session, msg *BusSessionRequest) (interface{}, error) {
+	if len(msg.Data) == 0 {
+		return nil, NewDataError("bad_request", "request did not contain Data")
+	}
+	if !session.Hello {
+		return nil, NewDataError("not_in_room", "Cannot broadcast without a current room")
+	}
+
+	session.Broadcast(msg.Data)
+	return nil, nil
+}
+
+func (plm *pipelineManager) sessionUsers(session *Session, msg *BusSessionRequest) (interface{}, error) {
+	return plm.incoming(session, &DataIncoming{Type: "Users"})
+}
+
+// sessionSink returns the sink with new pipeline tokens.
+func (plm *pipelineManager) sessionSink(session *Session, msg *BusSessionRequest) (interface{}, error) {
+	plm.mutex.RLock()
+	sink, ok := plm.sessionSinkTable[session.Id]
+	plm.mutex.RUnlock()
+	if !ok {
+		return nil, NewDataError("sink_unknown", "session has no sink")
+	}
+
+	return plm.exportSink(sink), nil
+}
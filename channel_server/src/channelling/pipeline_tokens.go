@@ -0,0 +1,142 @@
+package channelling
+
+import (
+	"crypto/sha256"
+	"log"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	PipelineScopeRead      = "read"
+	PipelineScopeReadWrite = "readwrite"
+
+	PipelineTokenLifetimeDefault = time.Hour
+
+	pipelineTokenName = "pipeline"
+)
+
+// PipelineToken grants access to the pipelines of a sink through the
+// pipelines REST API.
+type PipelineToken struct {
+	Sink    string
+	Scope   string
+	Expires int64 // Unix time in seconds.
+}
+
+// PipelineTokens issues and validates the signed, expiring access tokens
+// of pipelines.
+type PipelineTokens interface {
+	// Issue returns a token for the pipelines of the sink and its claims.
+	Issue(sink, scope string) (string, *PipelineToken, error)
+	Validate(token string) (*PipelineToken, error)
+}
+
+type pipelineTokens struct {
+	codec    *securecookie.SecureCookie
+	lifetime time.Duration
+}
+
+// NewPipelineTokens signs tokens with the secret, which expire after
+// lifetime (PipelineTokenLifetimeDefault when 0). Without secret a random
+// one is used, so tokens do not survive restarts.
+func NewPipelineTokens(secret []byte, lifetime time.Duration) PipelineTokens {
+	if len(secret) == 0 {
+		secret = securecookie.GenerateRandomKey(64)
+	}
+	if lifetime <= 0 {
+		lifetime = PipelineTokenLifetimeDefault
+	}
+	codec := securecookie.New(secret, nil)
+	codec.MaxAge(int(lifetime / time.Second))
+	codec.HashFunc(sha256.New)
+
+	return &pipelineTokens{codec, lifetime}
+}
+
+func (tokens *pipelineTokens) Issue(sink, scope string) (string, *PipelineToken, error) {
+	if scope != PipelineScopeRead && scope != PipelineScopeReadWrite {
+		return "", nil, NewDataError("bad_request", "unknown pipeline token scope")
+	}
+	claims := &PipelineToken{
+		Sink:    sink,
+		Scope:   scope,
+		Expires: time.Now().Add(tokens.lifetime).Unix(),
+	}
+	token, err := tokens.codec.Encode(pipelineTokenName, claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, claims, nil
+}
+
+func (tokens *pipelineTokens) Validate(token string) (*PipelineToken, error) {
+	claims := &PipelineToken{}
+	if token == "" || tokens.codec.Decode(pipelineTokenName, token, claims) != nil {
+		return nil, NewDataError("pipeline_token_invalid", "invalid pipeline token")
+	}
+	if claims.Sink == "" || time.Now().Unix() > claims.Expires {
+		return nil, NewDataError("pipeline_token_invalid", "pipeline token expired")
+	}
+
+	return claims, nil
+}
+
+// Writable returns true when the token may send to the pipelines.
+func (claims *PipelineToken) Writable() bool {
+	return claims.Scope == PipelineScopeReadWrite
+}
+
+// exportSink returns the sink data for its owner, including the tokens of
+// its pipelines.
+func (plm *pipelineManager) exportSink(sink Sink) *DataSink {
+	data := sink.Export()
+	token, claims, err := plm.tokens.Issue(data.Id, PipelineScopeReadWrite)
+	if err != nil {
+		log.Println("Failed to issue pipeline token", data.Id, err)
+		return data
+	}
+	readToken, _, err := plm.tokens.Issue(data.Id, PipelineScopeRead)
+	if err != nil {
+		log.Println("Failed to issue pipeline token", data.Id, err)
+		return data
+	}
+	data.PipelineToken = token
+	data.PipelineReadToken = readToken
+	data.PipelineTokenExpires = claims.Expires
+
+	return data
+}
+
+// AuthorizePipeline validates that the token grants access to the pipeline
+// with id, which must be writable when write is true.
+func (plm *pipelineManager) AuthorizePipeline(id, token string, write bool) (*PipelineToken, error) {
+	claims, err := plm.tokens.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+	if write && !claims.Writable() {
+		return claims, NewDataError("pipeline_forbidden", "pipeline token is read only")
+	}
+	if plm.pipelineSink(id) != claims.Sink {
+		return claims, NewDataError("pipeline_forbidden", "pipeline token does not grant access to the pipeline")
+	}
+
+	return claims, nil
+}
+
+// pipelineSink returns the id of the sink of an active or stored pipeline.
+func (plm *pipelineManager) pipelineSink(id string) string {
+	if pipeline, ok := plm.GetPipelineByID(id); ok {
+		if sinkID := pipeline.SinkID(); sinkID != "" {
+			return sinkID
+		}
+	}
+	if plm.log != nil {
+		return plm.log.Sink(id)
+	}
+
+	return ""
+}
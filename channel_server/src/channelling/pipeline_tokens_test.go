@@ -0,0 +1,100 @@
+package channelling
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_PipelineTokens(t *testing.T) {
+	tokens := NewPipelineTokens([]byte("secret"), time.Minute)
+	token, claims, err := tokens.Issue("backend", PipelineScopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Writable() || claims.Expires <= time.Now().Unix() {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	if validated, err := tokens.Validate(token); err != nil || validated.Sink != "backend" || validated.Scope != PipelineScopeRead {
+		t.Errorf("Unexpected validated token %+v %v", validated, err)
+	}
+
+	if _, err := NewPipelineTokens([]byte("other"), time.Minute).Validate(token); err == nil {
+		t.Error("Expected token of another secret to fail")
+	}
+	if _, err := tokens.Validate(token[:len(token)-2]); err == nil {
+		t.Error("Expected modified token to fail")
+	}
+	if _, _, err := tokens.Issue("backend", "admin"); err == nil {
+		t.Error("Expected unknown scope to fail")
+	}
+
+	expired, _ := tokens.(*pipelineTokens).codec.Encode(pipelineTokenName, &PipelineToken{Sink: "backend", Scope: PipelineScopeReadWrite, Expires: time.Now().Add(-time.Second).Unix()})
+	if _, err := tokens.Validate(expired); err == nil {
+		t.Error("Expected expired token to fail")
+	}
+}
+
+func Test_PipelineManager_AuthorizePipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipelines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plog, err := NewPipelineLog(dir, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plog.Close()
+
+	bus := &fakePublishBus{NewBusManager(NewChannellingAPIConsumer(), "", false, "", nil, nil), make(map[string]interface{})}
+	manager := NewPipelineManager(bus, nil, nil, &fakeSessionCreator{}, NewSinkFactory(nil, "", 0), plog, nil).(*pipelineManager)
+	manager.sessionCreate("", "reply", &SessionCreateRequest{Id: "backend", Session: &DataSession{}, Sink: &SinkRequest{Type: SinkTypeWebSocket}})
+	sink := bus.published["reply"].(*DataSink)
+	if sink.PipelineToken == "" || sink.PipelineReadToken == "" || sink.PipelineTokenExpires == 0 {
+		t.Fatalf("Expected pipeline tokens, but got %+v", sink)
+	}
+	manager.sessionCreate("", "reply", &SessionCreateRequest{Id: "other", Session: &DataSession{}, Sink: &SinkRequest{Type: SinkTypeWebSocket}})
+	otherSink := bus.published["reply"].(*DataSink)
+
+	pipeline := NewPipeline(manager, PipelineNamespaceCall, "call.a.pipeline-1", nil, time.Minute)
+	defer pipeline.Close()
+	manager.pipelineTable[pipeline.GetID()] = pipeline
+	// The first record is logged before the sink is attached.
+	pipeline.Add(&DataSinkOutgoing{Outgoing: &DataOutgoing{From: "before"}})
+	backend, _ := manager.GetSink("backend")
+	pipeline.Attach(backend)
+	pipeline.Add(&DataSinkOutgoing{Outgoing: &DataOutgoing{From: "a"}})
+
+	if _, err := manager.AuthorizePipeline(pipeline.GetID(), sink.PipelineToken, true); err != nil {
+		t.Errorf("Expected read-write token to send, but got %v", err)
+	}
+	if _, err := manager.AuthorizePipeline(pipeline.GetID(), sink.PipelineReadToken, false); err != nil {
+		t.Errorf("Expected read token to read, but got %v", err)
+	}
+	if _, err := manager.AuthorizePipeline(pipeline.GetID(), sink.PipelineReadToken, true); err == nil {
+		t.Error("Expected read token to fail sending")
+	}
+	if _, err := manager.AuthorizePipeline(pipeline.GetID(), otherSink.PipelineToken, false); err == nil {
+		t.Error("Expected token of another sink to fail")
+	}
+	if _, err := manager.AuthorizePipeline(pipeline.GetID(), "", false); err == nil {
+		t.Error("Expected missing token to fail")
+	}
+
+	// Expired pipelines are authorized with the sink of the stored records.
+	delete(manager.pipelineTable, pipeline.GetID())
+	if _, err := manager.AuthorizePipeline(pipeline.GetID(), sink.PipelineReadToken, false); err != nil {
+		t.Errorf("Expected read token to read the stored pipeline, but got %v", err)
+	}
+	if _, err := manager.AuthorizePipeline("call.a.unknown", sink.PipelineReadToken, false); err == nil {
+		t.Error("Expected unknown pipeline to fail")
+	}
+
+	// Pipeline tokens can be renewed.
+	manager.busSessionHandler("sink", manager.sessionSink)("", "reply", &BusSessionRequest{Id: "backend"})
+	if reply := bus.published["reply"].(*BusReply); !reply.Success || reply.Data.(*DataSink).PipelineToken == "" {
+		t.Errorf("Unexpected sink reply %+v", reply)
+	}
+}
@@ -0,0 +1,173 @@
+package channelling
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Permissions checked by the policy. The resource a permission is checked
+// for is noted in the comment.
+const (
+	PermissionRoomCreate    = "room.create"    // Room type.
+	PermissionRoomJoin      = "room.join"      // Room name.
+	PermissionChatSend      = "chat.send"      // Room type, or User for chats to a session or user.
+	PermissionDeviceControl = "device.control" // Device id.
+	PermissionRoomOwners    = "room.owners"    // Room type.
+	PermissionUsersList     = "users.list"     // Room type.
+	PermissionContacts      = "contacts"       // Empty.
+	PermissionAdmin         = "admin"          // Name of the admin end point.
+)
+
+// Roles every session has in the policy, in addition to its own roles.
+const (
+	PolicyRoleEveryone      = "*"
+	PolicyRoleAnonymous     = "anonymous"
+	PolicyRoleAuthenticated = "authenticated"
+)
+
+// Policy decides which permissions the roles of a session grant.
+type Policy interface {
+	Allowed(session *Session, permission, resource string) bool
+}
+
+// PolicyRules is the content of a policy file. Each role maps to a list of
+// grants in the form "permission" or "permission:resource". Both parts
+// can be glob patterns, for example "room.join:lobby-*" or "*".
+type PolicyRules struct {
+	Roles map[string][]string `json:"roles"`
+}
+
+type policyGrant struct {
+	permission string
+	resource   string
+}
+
+func (grant *policyGrant) matches(permission, resource string) bool {
+	if ok, _ := path.Match(grant.permission, permission); !ok {
+		return false
+	}
+	ok, _ := path.Match(grant.resource, resource)
+	return ok
+}
+
+// ParsePolicyRules parses and validates policy rules.
+func ParsePolicyRules(data []byte) (map[string][]*policyGrant, error) {
+	var rules PolicyRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	roles := make(map[string][]*policyGrant)
+	for role, grants := range rules.Roles {
+		for _, grant := range grants {
+			parts := strings.SplitN(grant, ":", 2)
+			g := &policyGrant{permission: parts[0], resource: "*"}
+			if len(parts) == 2 {
+				g.resource = parts[1]
+			}
+			for _, pattern := range []string{g.permission, g.resource} {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid grant %q of role %s: %s", grant, role, err)
+				}
+			}
+			roles[role] = append(roles[role], g)
+		}
+	}
+
+	return roles, nil
+}
+
+type policy struct {
+	sync.RWMutex
+	filename string
+	modTime  time.Time
+	roles    map[string][]*policyGrant
+}
+
+// NewPolicy loads the policy from a JSON file. The file is checked for
+// changes at the reload interval and loaded again without restart. A
+// policy which fails to load keeps the previous rules.
+func NewPolicy(filename string, reloadInterval time.Duration) (Policy, error) {
+	p := &policy{filename: filename}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	if reloadInterval > 0 {
+		go func() {
+			for _ = range time.Tick(reloadInterval) {
+				if err := p.Reload(); err != nil {
+					log.Println("Failed to reload policy", filename, err)
+				}
+			}
+		}()
+	}
+
+	return p, nil
+}
+
+// Reload loads the policy file again when it changed.
+func (p *policy) Reload() error {
+	info, err := os.Stat(p.filename)
+	if err != nil {
+		return err
+	}
+	p.RLock()
+	unchanged := p.roles != nil && info.ModTime().Equal(p.modTime)
+	p.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(p.filename)
+	if err != nil {
+		return err
+	}
+	roles, err := ParsePolicyRules(data)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.roles = roles
+	p.modTime = info.ModTime()
+	p.Unlock()
+	log.Printf("Loaded policy %s with %d roles\n", p.filename, len(roles))
+
+	return nil
+}
+
+func (p *policy) Allowed(session *Session, permission, resource string) bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	builtin := PolicyRoleAnonymous
+	if session.Userid() != "" {
+		builtin = PolicyRoleAuthenticated
+	}
+	for role, grants := range p.roles {
+		if role != PolicyRoleEveryone && role != builtin && !session.HasRole(role) {
+			continue
+		}
+		for _, grant := range grants {
+			if grant.matches(permission, resource) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Allowed returns true if the policy of the config grants the permission
+// to the session. Everything is allowed without policy.
+func (config *Config) Allowed(session *Session, permission, resource string) bool {
+	return config == nil || config.Policy == nil || config.Policy.Allowed(session, permission, resource)
+}
@@ -0,0 +1,78 @@
+package channelling
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestPolicy(t *testing.T, rules string) *policy {
+	roles, err := ParsePolicyRules([]byte(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &policy{roles: roles}
+}
+
+func Test_Policy_Allowed(t *testing.T) {
+	p := newTestPolicy(t, `{"roles": {
+		"*": ["room.join:lobby-*"],
+		"authenticated": ["chat.send"],
+		"player": ["room.join", "device.control:wawaji-*"],
+		"admin": ["*"]
+	}}`)
+
+	anonymous := &Session{}
+	player := &Session{userid: "player-1", roles: []string{"player"}}
+	admin := &Session{userid: "admin-1", roles: []string{"admin"}}
+
+	if !p.Allowed(anonymous, PermissionRoomJoin, "lobby-1") || p.Allowed(anonymous, PermissionRoomJoin, "game-1") {
+		t.Error("Expected anonymous session to join only lobby rooms")
+	}
+	if p.Allowed(anonymous, PermissionChatSend, RoomTypeRoom) || !p.Allowed(player, PermissionChatSend, RoomTypeRoom) {
+		t.Error("Expected only authenticated sessions to chat")
+	}
+	if !p.Allowed(player, PermissionRoomJoin, "game-1") || !p.Allowed(player, PermissionDeviceControl, "wawaji-2") || p.Allowed(player, PermissionDeviceControl, "camera-1") {
+		t.Error("Unexpected permissions of player")
+	}
+	if p.Allowed(player, PermissionAdmin, "users") || !p.Allowed(admin, PermissionAdmin, "users") {
+		t.Error("Expected only admin to access admin end points")
+	}
+}
+
+func Test_Policy_ReloadKeepsRulesOnError(t *testing.T) {
+	file, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"roles": {"*": ["chat.send"]}}`)
+	file.Close()
+
+	loaded, err := NewPolicy(file.Name(), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	p := loaded.(*policy)
+	if !p.Allowed(&Session{}, PermissionChatSend, RoomTypeRoom) {
+		t.Error("Expected chat to be allowed")
+	}
+
+	ioutil.WriteFile(file.Name(), []byte(`{"roles": {"*": ["room.join:["]}}`), 0644)
+	p.modTime = p.modTime.Add(-1)
+	if err := p.Reload(); err == nil {
+		t.Error("Expected invalid policy to fail")
+	}
+	if !p.Allowed(&Session{}, PermissionChatSend, RoomTypeRoom) {
+		t.Error("Expected previous rules to be kept")
+	}
+
+	ioutil.WriteFile(file.Name(), []byte(`{"roles": {"*": ["room.join"]}}`), 0644)
+	p.modTime = p.modTime.Add(-1)
+	if err := p.Reload(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if p.Allowed(&Session{}, PermissionChatSend, RoomTypeRoom) {
+		t.Error("Expected reloaded rules to deny chat")
+	}
+}
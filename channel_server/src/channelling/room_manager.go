@@ -30,6 +30,7 @@ type RoomManager interface {
 	Broadcaster
 	RoomStats
 	SetBusManager(bus BusManager) error
+	ConfigureRoom(name, roomType string, credentials *DataRoomCredentials) error
 }
 
 type roomManager struct {
@@ -80,11 +81,20 @@ func (rooms *roomManager) SetBusManager(BusManager BusManager) error {
 	return nil
 }
 
+// trigger sends the event when the bus is set.
+func (rooms *roomManager) trigger(name, from string, data interface{}) {
+	if rooms.BusManager != nil {
+		rooms.Trigger(name, from, "", data, nil)
+	}
+}
+
 func (rooms *roomManager) setNatsRoomType(msg *roomTypeMessage) {
 	if msg == nil {
 		return
 	}
 
+	rooms.Lock()
+	defer rooms.Unlock()
 	if msg.Type != "" {
 		log.Printf("Setting room type for %s to %s\n", msg.Path, msg.Type)
 		rooms.roomTypes[msg.Path] = msg.Type
@@ -94,6 +104,40 @@ func (rooms *roomManager) setNatsRoomType(msg *roomTypeMessage) {
 	}
 }
 
+// ConfigureRoom sets the credentials of the live room with the name (an
+// empty PIN clears them) and the type of rooms created with the name from
+// now on, when not empty.
+func (rooms *roomManager) ConfigureRoom(name, roomType string, credentials *DataRoomCredentials) error {
+	if name == "" {
+		return NewDataError("bad_request", "room name is required")
+	}
+	if credentials != nil {
+		room, ok := rooms.Get(rooms.MakeRoomID(name, ""))
+		if !ok {
+			return NewDataError("room_not_found", "no such room")
+		}
+		if err := room.Update(&DataRoom{Credentials: credentials}); err != nil {
+			return err
+		}
+		reason := "set"
+		if len(credentials.PIN) == 0 {
+			reason = "cleared"
+		}
+		rooms.Audit(&AuditEvent{
+			Action:  "room.pin",
+			Outcome: AuditOutcomeSuccess,
+			Actor:   "bus",
+			Target:  rooms.MakeRoomID(name, ""),
+			Reason:  reason,
+		})
+	}
+	if roomType != "" {
+		rooms.setNatsRoomType(&roomTypeMessage{Path: name, Type: roomType})
+	}
+
+	return nil
+}
+
 func (rooms *roomManager) RoomUsers(session *Session) []*DataSession {
 	if room, ok := rooms.Get(session.Roomid); ok {
 		return room.GetUsers()
@@ -107,7 +151,15 @@ func (rooms *roomManager) JoinRoom(roomID, roomName, roomType string, credential
 		return nil, NewDataError("default_room_disabled", "The default room is not enabled")
 	}
 
-	roomWorker, err := rooms.GetOrCreate(roomID, roomName, roomType, credentials, sessionAuthenticated)
+	if roles := rooms.getConfiguredRoomRoles(roomName); len(roles) > 0 && !session.HasRole(roles...) {
+		return nil, NewDataError("room_join_requires_role", "Room join requires a role")
+	}
+
+	if rooms.AccessTokens != nil && !rooms.AccessTokens.AllowsRoom(session.Id, roomName) {
+		return nil, NewDataError("room_join_token_not_allowed", "The access token does not allow to join this room")
+	}
+
+	roomWorker, err := rooms.GetOrCreate(roomID, roomName, roomType, credentials, session, sessionAuthenticated)
 	if err != nil {
 		return nil, err
 	}
@@ -129,8 +181,43 @@ func (rooms *roomManager) UpdateRoom(session *Session, room *DataRoom) (*DataRoo
 	if !session.Hello || session.Roomid != roomID {
 		return nil, NewDataError("not_in_room", "Cannot update other rooms")
 	}
+	if room.Metadata != nil && len(rooms.RoomMetadataRoles) > 0 && !session.HasRole(rooms.RoomMetadataRoles...) {
+		return nil, NewDataError("room_metadata_not_allowed", "Not allowed to update room metadata")
+	}
+	if room.Metadata != nil && room.Metadata.IcePool != "" {
+		if _, ok := rooms.IcePools[room.Metadata.IcePool]; !ok {
+			return nil, NewDataError("unknown_ice_pool", "Unknown ICE server pool")
+		}
+	}
 	if roomWorker, ok := rooms.Get(session.Roomid); ok {
-		return room, roomWorker.Update(room)
+		if room.Metadata != nil && !rooms.mayChangeRoomOwners(session, roomWorker) {
+			// Keep the owners, they may edit and delete all chat messages.
+			var owners []string
+			if metadata := roomWorker.GetMetadata(); metadata != nil {
+				owners = metadata.Owners
+			}
+			room.Metadata.Owners = owners
+		}
+		err := roomWorker.Update(room)
+		if room.Credentials != nil {
+			event := &AuditEvent{
+				Action:     "room.pin",
+				Outcome:    AuditOutcomeSuccess,
+				Actor:      session.Userid(),
+				Session:    session.Id,
+				RemoteAddr: session.RemoteAddr(),
+				Target:     roomID,
+				Reason:     "set",
+			}
+			if len(room.Credentials.PIN) == 0 {
+				event.Reason = "cleared"
+			}
+			if err != nil {
+				event.Outcome = AuditOutcomeFailure
+			}
+			rooms.Audit(event)
+		}
+		return room, err
 	}
 	// Set default room type if room was not found.
 	room.Type = rooms.RoomTypeDefault
@@ -139,6 +226,19 @@ func (rooms *roomManager) UpdateRoom(session *Session, room *DataRoom) (*DataRoo
 	return room, nil
 }
 
+// mayChangeRoomOwners returns true if the session is an owner of the room,
+// has one of the owner roles or is allowed by the policy.
+func (rooms *roomManager) mayChangeRoomOwners(session *Session, room RoomWorker) bool {
+	if room.IsOwner(session.Userid()) {
+		return true
+	}
+	if len(rooms.RoomOwnerRoles) > 0 && session.HasRole(rooms.RoomOwnerRoles...) {
+		return true
+	}
+
+	return rooms.Policy != nil && rooms.Policy.Allowed(session, PermissionRoomOwners, room.GetType())
+}
+
 func (rooms *roomManager) Broadcast(sessionID, roomID string, outgoing *DataOutgoing) {
 	message, err := rooms.EncodeOutgoing(outgoing)
 	if err != nil {
@@ -182,10 +282,13 @@ func (rooms *roomManager) Get(roomID string) (room RoomWorker, ok bool) {
 	return
 }
 
-func (rooms *roomManager) GetOrCreate(roomID, roomName, roomType string, credentials *DataRoomCredentials, sessionAuthenticated bool) (RoomWorker, error) {
+func (rooms *roomManager) GetOrCreate(roomID, roomName, roomType string, credentials *DataRoomCredentials, session *Session, sessionAuthenticated bool) (RoomWorker, error) {
 	if rooms.AuthorizeRoomJoin && rooms.UsersEnabled && !sessionAuthenticated {
 		return nil, NewDataError("room_join_requires_account", "Room join requires a user account 1")
 	}
+	if !rooms.Allowed(session, PermissionRoomJoin, roomName) {
+		return nil, NewDataError("room_join_not_allowed", "Not allowed to join this room")
+	}
 
 	if room, ok := rooms.Get(roomID); ok {
 		return room, nil
@@ -194,6 +297,9 @@ func (rooms *roomManager) GetOrCreate(roomID, roomName, roomType string, credent
 	if roomType == "" {
 		roomType = rooms.getConfiguredRoomType(roomName)
 	}
+	if !rooms.Allowed(session, PermissionRoomCreate, roomType) {
+		return nil, NewDataError("room_create_not_allowed", "Not allowed to create rooms of this type")
+	}
 
 	rooms.Lock()
 	// Need to re-check, another thread might have created the room while we waited for the lock.
@@ -210,14 +316,17 @@ func (rooms *roomManager) GetOrCreate(roomID, roomName, roomType string, credent
 	room := NewRoomWorker(rooms, roomID, roomName, roomType, credentials)
 	rooms.roomTable[roomID] = room
 	rooms.Unlock()
+	event := &BusEventRoom{Version: BusEventVersion, Roomid: roomID, Name: roomName, Type: roomType}
+	rooms.trigger(BusManagerRoomCreated, session.Id, event)
 	go func() {
 		// Start room, this blocks until room expired.
 		room.Start()
 		// Cleanup room when we are done.
 		rooms.Lock()
-		defer rooms.Unlock()
 		delete(rooms.roomTable, roomID)
+		rooms.Unlock()
 		log.Printf("Cleaned up room '%s'\n", roomID)
+		rooms.trigger(BusManagerRoomExpired, "", event)
 	}()
 
 	return room, nil
@@ -245,8 +354,21 @@ func (rooms *roomManager) MakeRoomID(roomName, roomType string) string {
 	return fmt.Sprintf("%s:%s", roomType, roomName)
 }
 
+func (rooms *roomManager) getConfiguredRoomRoles(roomName string) []string {
+	for _, roomRoles := range rooms.RoomRoles {
+		if roomRoles.Regexp.MatchString(roomName) {
+			return roomRoles.Roles
+		}
+	}
+
+	return nil
+}
+
 func (rooms *roomManager) getConfiguredRoomType(roomName string) string {
-	if roomType, found := rooms.roomTypes[roomName]; found {
+	rooms.RLock()
+	roomType, found := rooms.roomTypes[roomName]
+	rooms.RUnlock()
+	if found {
 		// Type of this room was overwritten through NATS.
 		return roomType
 	}
@@ -23,13 +23,11 @@ package channelling
 
 import (
 	"testing"
-
-	"channelling"
 )
 
 func NewTestRoomManager() (RoomManager, *Config) {
 	config := &Config{
-		RoomTypeDefault: channelling.RoomTypeRoom,
+		RoomTypeDefault: RoomTypeRoom,
 	}
 	return NewRoomManager(config, nil), config
 }
@@ -40,16 +38,16 @@ func Test_RoomManager_JoinRoom_ReturnsAnErrorForUnauthenticatedSessionsWhenCreat
 	config.AuthorizeRoomCreation = true
 
 	unauthenticatedSession := &Session{}
-	_, err := roomManager.JoinRoom(channelling.RoomTypeRoom+":foo", "foo", channelling.RoomTypeRoom, nil, unauthenticatedSession, false, nil)
+	_, err := roomManager.JoinRoom(RoomTypeRoom+":foo", "foo", RoomTypeRoom, nil, unauthenticatedSession, false, nil)
 	assertDataError(t, err, "room_join_requires_account")
 
 	authenticatedSession := &Session{userid: "9870457"}
-	_, err = roomManager.JoinRoom(channelling.RoomTypeRoom+":foo", "foo", channelling.RoomTypeRoom, nil, authenticatedSession, true, nil)
+	_, err = roomManager.JoinRoom(RoomTypeRoom+":foo", "foo", RoomTypeRoom, nil, authenticatedSession, true, nil)
 	if err != nil {
 		t.Fatalf("Unexpected error %v joining room while authenticated", err)
 	}
 
-	_, err = roomManager.JoinRoom(channelling.RoomTypeRoom+":foo", "foo", channelling.RoomTypeRoom, nil, unauthenticatedSession, false, nil)
+	_, err = roomManager.JoinRoom(RoomTypeRoom+":foo", "foo", RoomTypeRoom, nil, unauthenticatedSession, false, nil)
 	if err != nil {
 		t.Fatalf("Unexpected error %v joining room while unauthenticated", err)
 	}
@@ -61,16 +59,16 @@ func Test_RoomManager_JoinRoom_ReturnsAnErrorForUnauthenticatedSessionsWhenJoinR
 	config.AuthorizeRoomJoin = true
 
 	unauthenticatedSession := &Session{}
-	_, err := roomManager.JoinRoom(channelling.RoomTypeRoom+":foo", "foo", channelling.RoomTypeRoom, nil, unauthenticatedSession, false, nil)
+	_, err := roomManager.JoinRoom(RoomTypeRoom+":foo", "foo", RoomTypeRoom, nil, unauthenticatedSession, false, nil)
 	assertDataError(t, err, "room_join_requires_account")
 
 	authenticatedSession := &Session{userid: "9870457"}
-	_, err = roomManager.JoinRoom(channelling.RoomTypeRoom+":foo", "foo", channelling.RoomTypeRoom, nil, authenticatedSession, true, nil)
+	_, err = roomManager.JoinRoom(RoomTypeRoom+":foo", "foo", RoomTypeRoom, nil, authenticatedSession, true, nil)
 	if err != nil {
 		t.Fatalf("Unexpected error %v joining room while authenticated", err)
 	}
 
-	_, err = roomManager.JoinRoom(channelling.RoomTypeRoom+":foo", "foo", channelling.RoomTypeRoom, nil, unauthenticatedSession, false, nil)
+	_, err = roomManager.JoinRoom(RoomTypeRoom+":foo", "foo", RoomTypeRoom, nil, unauthenticatedSession, false, nil)
 	assertDataError(t, err, "room_join_requires_account")
 }
 
@@ -83,36 +81,117 @@ func Test_RoomManager_UpdateRoom_ReturnsAnErrorIfNoRoomHasBeenJoined(t *testing.
 
 func Test_RoomManager_UpdateRoom_ReturnsAnErrorIfUpdatingAnUnjoinedRoom(t *testing.T) {
 	roomManager, _ := NewTestRoomManager()
-	session := &Session{Hello: true, Roomid: channelling.RoomTypeRoom + ":foo"}
+	session := &Session{Hello: true, Roomid: RoomTypeRoom + ":foo"}
 	_, err := roomManager.UpdateRoom(session, &DataRoom{Name: "bar"})
 	assertDataError(t, err, "not_in_room")
 }
 
 func Test_RoomManager_UpdateRoom_ReturnsACorrectlyTypedDocument(t *testing.T) {
 	roomManager, _ := NewTestRoomManager()
-	session := &Session{Hello: true, Roomid: channelling.RoomTypeRoom + ":foo"}
+	session := &Session{Hello: true, Roomid: RoomTypeRoom + ":foo"}
 	room, err := roomManager.UpdateRoom(session, &DataRoom{Name: "foo"})
 	if err != nil {
 		t.Fatalf("Unexpected error %v updating room", err)
 	}
 
-	if room.Type != channelling.RoomTypeRoom {
-		t.Errorf("Expected document type to be %s, but was %v", channelling.RoomTypeRoom, room.Type)
+	if room.Type != RoomTypeRoom {
+		t.Errorf("Expected document type to be %s, but was %v", RoomTypeRoom, room.Type)
 	}
 }
 
 func Test_RoomManager_TypeThroughNats(t *testing.T) {
 	theRoomManager, _ := NewTestRoomManager()
 	rm := theRoomManager.(*roomManager)
-	if rt := rm.getConfiguredRoomType("foo"); rt != channelling.RoomTypeRoom {
-		t.Errorf("Expected room type to be %s, but was %v", channelling.RoomTypeRoom, rt)
+	if rt := rm.getConfiguredRoomType("foo"); rt != RoomTypeRoom {
+		t.Errorf("Expected room type to be %s, but was %v", RoomTypeRoom, rt)
 	}
 	rm.setNatsRoomType(&roomTypeMessage{Path: "foo", Type: "Conference"})
 	if rt := rm.getConfiguredRoomType("foo"); rt != "Conference" {
 		t.Errorf("Expected room type to be %s, but was %v", "Conference", rt)
 	}
 	rm.setNatsRoomType(&roomTypeMessage{Path: "foo", Type: ""})
-	if rt := rm.getConfiguredRoomType("foo"); rt != channelling.RoomTypeRoom {
-		t.Errorf("Expected room type to be %s, but was %v", channelling.RoomTypeRoom, rt)
+	if rt := rm.getConfiguredRoomType("foo"); rt != RoomTypeRoom {
+		t.Errorf("Expected room type to be %s, but was %v", RoomTypeRoom, rt)
+	}
+}
+
+func Test_RoomManager_JoinRoom_ChecksThePolicy(t *testing.T) {
+	roomManager, config := NewTestRoomManager()
+	roles, _ := ParsePolicyRules([]byte(`{"roles": {"*": ["room.join:lobby"], "player": ["room.join", "room.create:Room"]}}`))
+	config.Policy = &policy{roles: roles}
+
+	anonymous := &Session{}
+	_, err := roomManager.JoinRoom(RoomTypeRoom+":foo", "foo", RoomTypeRoom, nil, anonymous, false, nil)
+	assertDataError(t, err, "room_join_not_allowed")
+
+	_, err = roomManager.JoinRoom(RoomTypeRoom+":lobby", "lobby", RoomTypeRoom, nil, anonymous, false, nil)
+	assertDataError(t, err, "room_create_not_allowed")
+
+	player := &Session{userid: "player-1", roles: []string{"player"}}
+	_, err = roomManager.JoinRoom(RoomTypeRoom+":lobby", "lobby", RoomTypeRoom, nil, player, true, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v creating room with role", err)
+	}
+
+	_, err = roomManager.JoinRoom(RoomTypeRoom+":lobby", "lobby", RoomTypeRoom, nil, anonymous, false, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v joining existing room", err)
+	}
+}
+
+func Test_RoomManager_UpdateRoom_KeepsOwnersOfNonOwners(t *testing.T) {
+	roomManager, config := NewTestRoomManager()
+	config.RoomOwnerRoles = []string{"admin"}
+	roomID := RoomTypeRoom + ":foo"
+	admin := &Session{Id: "1", userid: "admin-1", roles: []string{"admin"}}
+	alice := &Session{Id: "2", userid: "alice"}
+	mallory := &Session{Id: "3", userid: "mallory"}
+	for _, session := range []*Session{admin, alice, mallory} {
+		if _, err := roomManager.JoinRoom(roomID, "foo", RoomTypeRoom, nil, session, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		session.Hello, session.Roomid = true, roomID
+	}
+
+	room, err := roomManager.UpdateRoom(admin, &DataRoom{Name: "foo", Metadata: &DataRoomMetadata{Owners: []string{"alice"}}})
+	if err != nil || len(room.Metadata.Owners) != 1 {
+		t.Fatalf("Expected owners set by admin role, but got %+v %v", room, err)
+	}
+
+	room, err = roomManager.UpdateRoom(mallory, &DataRoom{Name: "foo", Metadata: &DataRoomMetadata{Title: "Mine", Owners: []string{"mallory"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(room.Metadata.Owners) != 1 || room.Metadata.Owners[0] != "alice" || room.Metadata.Title != "Mine" {
+		t.Errorf("Expected owners to be kept, but got %+v", room.Metadata)
+	}
+	if worker, _ := roomManager.Get(roomID); worker.IsOwner("mallory") {
+		t.Error("Expected non-owner not to become owner")
+	}
+
+	room, _ = roomManager.UpdateRoom(alice, &DataRoom{Name: "foo", Metadata: &DataRoomMetadata{Owners: []string{"alice", "bob"}}})
+	if len(room.Metadata.Owners) != 2 {
+		t.Errorf("Expected owner to change owners, but got %+v", room.Metadata)
+	}
+}
+
+func Test_RoomManager_ConfigureRoom_SetsRoomTypesConcurrently(t *testing.T) {
+	theRoomManager, _ := NewTestRoomManager()
+	rm := theRoomManager.(*roomManager)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			rm.ConfigureRoom("foo", "Conference", nil)
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		rm.MakeRoomID("foo", "")
+	}
+	<-done
+
+	if roomID := rm.MakeRoomID("foo", ""); roomID != "Conference:foo" {
+		t.Errorf("Expected configured room type, but got %s", roomID)
 	}
 }
@@ -25,6 +25,9 @@ type RoomWorker interface {
 	Join(*DataRoomCredentials, *Session, Sender) (*DataRoom, error)
 	Leave(sessionID string)
 	GetType() string
+	GetName() string
+	IsOwner(userid string) bool
+	GetMetadata() *DataRoomMetadata
 }
 
 type roomWorker struct {
@@ -43,11 +46,13 @@ type roomWorker struct {
 	name        string
 	roomType    string
 	credentials *DataRoomCredentials
+	metadata    *DataRoomMetadata
 }
 
 type roomUser struct {
 	*Session
 	Sender
+	userid string // User id when joined, for the left event.
 }
 
 func NewRoomWorker(manager *roomManager, roomID, roomName, roomType string, credentials *DataRoomCredentials) RoomWorker {
@@ -131,6 +136,37 @@ func (r *roomWorker) GetType() string {
 	return r.roomType
 }
 
+func (r *roomWorker) GetName() string {
+	return r.name
+}
+
+// IsOwner returns true if userid is listed as owner in the room metadata.
+func (r *roomWorker) IsOwner(userid string) bool {
+	if userid == "" {
+		return false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.metadata != nil {
+		for _, owner := range r.metadata.Owners {
+			if owner == userid {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// GetMetadata returns a copy of the room metadata, or nil.
+func (r *roomWorker) GetMetadata() *DataRoomMetadata {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return copyRoomMetadata(r.metadata)
+}
+
 func (r *roomWorker) Run(f func()) bool {
 	select {
 	case r.workers <- f:
@@ -156,6 +192,15 @@ func (r *roomWorker) Update(room *DataRoom) error {
 				r.credentials = nil
 			}
 		}
+		// Replace metadata, an empty document clears it.
+		if room.Metadata != nil {
+			if isEmptyRoomMetadata(room.Metadata) {
+				r.metadata = nil
+			} else {
+				r.metadata = copyRoomMetadata(room.Metadata)
+			}
+		}
+		room.Metadata = copyRoomMetadata(r.metadata)
 		r.mutex.Unlock()
 		fault <- nil
 	}
@@ -233,6 +278,8 @@ type joinResult struct {
 }
 
 func (r *roomWorker) Join(credentials *DataRoomCredentials, session *Session, sender Sender) (*DataRoom, error) {
+	// The session is locked while joining.
+	userid := session.userid
 	results := make(chan joinResult, 1)
 	worker := func() {
 		r.mutex.Lock()
@@ -254,11 +301,13 @@ func (r *roomWorker) Join(credentials *DataRoomCredentials, session *Session, se
 			}
 		}
 
-		r.users[session.Id] = &roomUser{session, sender}
+		r.users[session.Id] = &roomUser{session, sender, userid}
+		event := &BusEventMember{Version: BusEventVersion, Roomid: r.id, Userid: userid}
 		// NOTE(lcooper): Needs to be a copy, else we risk races with
 		// a subsequent modification of room properties.
-		result := joinResult{&DataRoom{Name: r.name, Type: r.roomType}, nil}
+		result := joinResult{&DataRoom{Name: r.name, Type: r.roomType, Metadata: copyRoomMetadata(r.metadata)}, nil}
 		r.mutex.Unlock()
+		r.manager.trigger(BusManagerJoined, session.Id, event)
 		results <- result
 	}
 	r.Run(worker)
@@ -269,11 +318,50 @@ func (r *roomWorker) Join(credentials *DataRoomCredentials, session *Session, se
 
 func (r *roomWorker) Leave(sessionID string) {
 	worker := func() {
+		var event *BusEventMember
 		r.mutex.Lock()
-		if _, ok := r.users[sessionID]; ok {
+		if user, ok := r.users[sessionID]; ok {
 			delete(r.users, sessionID)
+			event = &BusEventMember{Version: BusEventVersion, Roomid: r.id, Userid: user.userid}
 		}
 		r.mutex.Unlock()
+		if event != nil {
+			r.manager.trigger(BusManagerLeft, sessionID, event)
+		}
 	}
 	r.Run(worker)
 }
+
+func isEmptyRoomMetadata(metadata *DataRoomMetadata) bool {
+	return metadata.Title == "" &&
+		metadata.Description == "" &&
+		metadata.DeviceId == "" &&
+		metadata.IcePool == "" &&
+		len(metadata.StreamURLs) == 0 &&
+		len(metadata.Extra) == 0 &&
+		len(metadata.Owners) == 0
+}
+
+func copyRoomMetadata(metadata *DataRoomMetadata) *DataRoomMetadata {
+	if metadata == nil {
+		return nil
+	}
+
+	c := *metadata
+	if metadata.StreamURLs != nil {
+		c.StreamURLs = make([]string, len(metadata.StreamURLs))
+		copy(c.StreamURLs, metadata.StreamURLs)
+	}
+	if metadata.Owners != nil {
+		c.Owners = make([]string, len(metadata.Owners))
+		copy(c.Owners, metadata.Owners)
+	}
+	if metadata.Extra != nil {
+		c.Extra = make(map[string]string, len(metadata.Extra))
+		for key, value := range metadata.Extra {
+			c.Extra[key] = value
+		}
+	}
+
+	return &c
+}
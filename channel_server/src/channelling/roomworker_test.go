@@ -23,14 +23,12 @@ package channelling
 
 import (
 	"testing"
-
-	"channelling"
 )
 
 const (
-	testRoomID   string = channelling.RoomTypeRoom + ":a-room-name"
+	testRoomID   string = RoomTypeRoom + ":a-room-name"
 	testRoomName string = "a-room-name"
-	testRoomType string = channelling.RoomTypeRoom
+	testRoomType string = RoomTypeRoom
 )
 
 func NewTestRoomWorker() RoomWorker {
@@ -126,3 +124,41 @@ func Test_RoomWorker_Update_RetainsCredentialsWhenOtherPropertiesAreUpdated(t *t
 		t.Fatalf("Unexpected error joining room %v", err)
 	}
 }
+
+func Test_RoomWorker_Update_RetainsMetadataWhenOtherPropertiesAreUpdated(t *testing.T) {
+	worker := NewTestRoomWorker()
+
+	if err := worker.Update(&DataRoom{Metadata: &DataRoomMetadata{Title: "Claw 1", DeviceId: "wawaji-1"}}); err != nil {
+		t.Fatalf("Failed to update room: %v", err)
+	}
+
+	if err := worker.Update(&DataRoom{}); err != nil {
+		t.Fatalf("Failed to update room: %v", err)
+	}
+
+	room, err := worker.Join(nil, &Session{}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error joining room %v", err)
+	}
+
+	if room.Metadata == nil || room.Metadata.DeviceId != "wawaji-1" {
+		t.Errorf("Expected room metadata to contain device wawaji-1, but got %#v", room.Metadata)
+	}
+}
+
+func Test_RoomWorker_Update_AllowsClearingMetadata(t *testing.T) {
+	worker := NewTestRoomWorker()
+
+	if err := worker.Update(&DataRoom{Metadata: &DataRoomMetadata{Title: "Claw 1"}}); err != nil {
+		t.Fatalf("Failed to update room: %v", err)
+	}
+
+	room := &DataRoom{Metadata: &DataRoomMetadata{}}
+	if err := worker.Update(room); err != nil {
+		t.Fatalf("Failed to update room: %v", err)
+	}
+
+	if room.Metadata != nil {
+		t.Errorf("Expected room metadata to be cleared, but got %#v", room.Metadata)
+	}
+}
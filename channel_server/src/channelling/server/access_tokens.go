@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"channelling"
+
+	"github.com/gorilla/mux"
+)
+
+// AccessTokenRequest creates or changes an access token. Omitted fields
+// are not changed.
+type AccessTokenRequest struct {
+	Token       string    `json:"token"`
+	Label       *string   `json:"label"`
+	Expires     *int64    `json:"expires"`
+	Duration    *int64    `json:"duration"`
+	Rooms       *[]string `json:"rooms"`
+	MaxSessions *int      `json:"maxSessions"`
+	MaxUses     *int      `json:"maxUses"`
+	Revoked     *bool     `json:"revoked"`
+}
+
+func (atr *AccessTokenRequest) apply(token *channelling.AccessToken) {
+	if atr.Label != nil {
+		token.Label = *atr.Label
+	}
+	if atr.Expires != nil {
+		token.Expires = *atr.Expires
+	}
+	if atr.Duration != nil {
+		token.Duration = *atr.Duration
+	}
+	if atr.Rooms != nil {
+		token.Rooms = *atr.Rooms
+	}
+	if atr.MaxSessions != nil {
+		token.MaxSessions = *atr.MaxSessions
+	}
+	if atr.MaxUses != nil {
+		token.MaxUses = *atr.MaxUses
+	}
+	if atr.Revoked != nil {
+		token.Revoked = *atr.Revoked
+	}
+}
+
+// AccessTokensAdmin manages access tokens. Requests must send the admin
+// secret as Bearer token in the Authorization header.
+type AccessTokensAdmin struct {
+	Tokens channelling.AccessTokens
+	Secret string
+	Config *channelling.Config
+}
+
+func (admin *AccessTokensAdmin) authorize(request *http.Request) bool {
+	secret := bearerToken(request)
+	if admin.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(admin.Secret)) == 1 {
+		return true
+	}
+	admin.Config.Audit(auditEvent(request, "tokens.admin", "", "", errNotAllowed))
+	return false
+}
+
+func (admin *AccessTokensAdmin) Get(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("tokens_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	token := mux.Vars(request)["token"]
+	if token == "" {
+		return 200, admin.Tokens.List(), http.Header{"Content-Type": {"application/json"}}
+	}
+	accessToken, ok := admin.Tokens.Get(token)
+	if !ok {
+		return 404, NewApiError("tokens_unknown", "Unknown token"), http.Header{"Content-Type": {"application/json"}}
+	}
+	return 200, accessToken, http.Header{"Content-Type": {"application/json"}}
+}
+
+// Post creates a token, with a random token when none is given.
+func (admin *AccessTokensAdmin) Post(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("tokens_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var atr AccessTokenRequest
+	if err := json.NewDecoder(request.Body).Decode(&atr); err != nil {
+		return 400, NewApiError("tokens_bad_request", "Failed to parse request"), http.Header{"Content-Type": {"application/json"}}
+	}
+	if len(atr.Token) > 100 {
+		return 413, NewApiError("auth_too_large", "Auth too large"), http.Header{"Content-Type": {"application/json"}}
+	}
+	accessToken := &channelling.AccessToken{Token: atr.Token}
+	atr.apply(accessToken)
+	accessToken, err := admin.Tokens.Create(accessToken)
+	if err != nil {
+		admin.Config.Audit(auditEvent(request, "tokens.create", "admin", atr.Token, err))
+		return 400, NewApiError("tokens_create_failed", fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+	}
+	admin.Config.Audit(auditEvent(request, "tokens.create", "admin", accessToken.Token, nil))
+
+	log.Printf("Access token created %s\n", accessToken.Label)
+	return 200, accessToken, http.Header{"Content-Type": {"application/json"}}
+}
+
+// Patch changes the limits of a token, or revokes it.
+func (admin *AccessTokensAdmin) Patch(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("tokens_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var atr AccessTokenRequest
+	if err := json.NewDecoder(request.Body).Decode(&atr); err != nil {
+		return 400, NewApiError("tokens_bad_request", "Failed to parse request"), http.Header{"Content-Type": {"application/json"}}
+	}
+	accessToken, err := admin.Tokens.Update(mux.Vars(request)["token"], atr.apply)
+	admin.Config.Audit(auditEvent(request, "tokens.update", "admin", mux.Vars(request)["token"], err))
+	if err == channelling.ErrAccessTokenUnknown {
+		return 404, NewApiError("tokens_unknown", "Unknown token"), http.Header{"Content-Type": {"application/json"}}
+	} else if err != nil {
+		return 400, NewApiError("tokens_update_failed", fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+	}
+	return 200, accessToken, http.Header{"Content-Type": {"application/json"}}
+}
+
+func (admin *AccessTokensAdmin) Delete(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("tokens_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	err := admin.Tokens.Delete(mux.Vars(request)["token"])
+	admin.Config.Audit(auditEvent(request, "tokens.delete", "admin", mux.Vars(request)["token"], err))
+	if err != nil {
+		return 404, NewApiError("tokens_unknown", "Unknown token"), http.Header{"Content-Type": {"application/json"}}
+	}
+	return 200, &struct {
+		Success bool `json:"success"`
+	}{true}, http.Header{"Content-Type": {"application/json"}}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"channelling"
+)
+
+var errNotAllowed = errors.New("not allowed")
+
+// auditEvent returns an audit event for the request, which failed when
+// err is not nil.
+func auditEvent(request *http.Request, action, actor, target string, err error) *channelling.AuditEvent {
+	event := &channelling.AuditEvent{
+		Action:     action,
+		Outcome:    channelling.AuditOutcomeSuccess,
+		Actor:      actor,
+		RemoteAddr: request.RemoteAddr,
+		Target:     target,
+	}
+	if err != nil {
+		event.Outcome = channelling.AuditOutcomeFailure
+		event.Reason = err.Error()
+	}
+
+	return event
+}
+
+// AuditAdmin queries the audit log. Requests must send the admin secret as
+// Bearer token in the Authorization header.
+type AuditAdmin struct {
+	Log    channelling.AuditLog
+	Secret string
+}
+
+func (admin *AuditAdmin) Get(request *http.Request) (int, interface{}, http.Header) {
+	secret := bearerToken(request)
+	if admin.Secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(admin.Secret)) != 1 {
+		return 403, NewApiError("audit_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	query := request.URL.Query()
+	filter := &channelling.AuditFilter{
+		Action:  query.Get("action"),
+		Outcome: query.Get("outcome"),
+		Actor:   query.Get("actor"),
+		Session: query.Get("session"),
+		Target:  query.Get("target"),
+	}
+	var err error
+	if filter.Since, err = parseAuditTime(query.Get("since")); err != nil {
+		return 400, NewApiError("audit_bad_request", "Invalid since"), http.Header{"Content-Type": {"application/json"}}
+	}
+	if filter.Until, err = parseAuditTime(query.Get("until")); err != nil {
+		return 400, NewApiError("audit_bad_request", "Invalid until"), http.Header{"Content-Type": {"application/json"}}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return 400, NewApiError("audit_bad_request", "Invalid limit"), http.Header{"Content-Type": {"application/json"}}
+		}
+	}
+
+	events, err := admin.Log.Query(filter)
+	if err != nil {
+		return 500, NewApiError("audit_query_failed", "Failed to query audit log"), http.Header{"Content-Type": {"application/json"}}
+	}
+	if events == nil {
+		events = []*channelling.AuditEvent{}
+	}
+	return 200, events, http.Header{"Content-Type": {"application/json"}}
+}
+
+// parseAuditTime parses Unix time in seconds.
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
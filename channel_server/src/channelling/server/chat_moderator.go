@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"channelling"
+
+	"github.com/strukturag/phoenix"
+)
+
+const (
+	chatFilterSection = "chatfilter"
+)
+
+var chatFilterOptions = map[string]bool{
+	"floodMessages":        true,
+	"floodInterval":        true,
+	"maxLength":            true,
+	"blacklist":            true,
+	"blacklistAction":      true,
+	"stripLinks":           true,
+	"linkReplacement":      true,
+	"classifier":           true,
+	"classifierFailAction": true,
+	"classifierTimeout":    true,
+}
+
+// NewChatModerator creates the chat filter chains from the chatfilter
+// section. All options can be overridden per room type (and User for
+// unicast chats) by prefixing the option with the type, for example
+// Conference_maxLength. Room types without options of their own use the
+// chain of the generic options. Returns nil when chat filtering is
+// disabled.
+func NewChatModerator(container phoenix.Container, busManager channelling.BusManager) (channelling.ChatModerator, error) {
+	if !container.GetBoolDefault(chatFilterSection, "enabled", false) {
+		return nil, nil
+	}
+
+	options, _ := container.GetOptions(chatFilterSection)
+	chains := make(map[string][]channelling.ChatFilter)
+	for _, roomType := range chatFilterRoomTypes(options) {
+		chain, err := newChatFilterChain(container, options, roomType, busManager)
+		if err != nil {
+			return nil, err
+		}
+		chains[roomType] = chain
+	}
+
+	moderatorRoles := strings.Split(container.GetStringDefault(chatFilterSection, "moderatorRoles", "moderator"), " ")
+	trimAndRemoveDuplicates(&moderatorRoles)
+
+	return channelling.NewChatModerator(chains, moderatorRoles), nil
+}
+
+// chatFilterRoomTypes returns the empty type of the generic options and the
+// room types which prefix chat filter options.
+func chatFilterRoomTypes(options []string) []string {
+	roomTypes := []string{""}
+	seen := make(map[string]bool)
+	for _, option := range options {
+		idx := strings.LastIndex(option, "_")
+		if idx <= 0 {
+			continue
+		}
+		roomType, name := option[:idx], option[idx+1:]
+		if (chatFilterOptions[name] || strings.HasPrefix(name, "replace")) && !seen[roomType] {
+			seen[roomType] = true
+			roomTypes = append(roomTypes, roomType)
+		}
+	}
+
+	return roomTypes
+}
+
+func newChatFilterChain(container phoenix.Container, options []string, roomType string, busManager channelling.BusManager) ([]channelling.ChatFilter, error) {
+	prefix := ""
+	if roomType != "" {
+		prefix = fmt.Sprintf("%s_", roomType)
+	}
+	getString := func(option, defaultValue string) string {
+		return container.GetStringDefault(chatFilterSection, prefix+option, container.GetStringDefault(chatFilterSection, option, defaultValue))
+	}
+	getInt := func(option string, defaultValue int) int {
+		return getIntDefault(container, chatFilterSection, prefix+option, getIntDefault(container, chatFilterSection, option, defaultValue))
+	}
+	getBool := func(option string) bool {
+		return container.GetBoolDefault(chatFilterSection, prefix+option, container.GetBoolDefault(chatFilterSection, option, false))
+	}
+
+	chain := []channelling.ChatFilter{}
+
+	// Flood detection first, so dropped messages do not reach the classifier.
+	chain = append(chain, channelling.NewFloodChatFilter(getInt("floodMessages", 0), time.Duration(getInt("floodInterval", 10))*time.Second))
+	chain = append(chain, channelling.NewMaxLengthChatFilter(getInt("maxLength", 0)))
+
+	words := strings.Split(getString("blacklist", ""), " ")
+	trimAndRemoveDuplicates(&words)
+	if len(words) > 0 {
+		blacklistAction := getString("blacklistAction", "drop")
+		action, ok := channelling.ParseChatFilterAction(blacklistAction)
+		if !ok && blacklistAction != "mask" {
+			return nil, fmt.Errorf("Invalid chat filter blacklistAction '%s'", blacklistAction)
+		}
+		chain = append(chain, channelling.NewBlacklistChatFilter(words, action, blacklistAction == "mask"))
+	}
+
+	replacements, err := newChatFilterReplacements(container, options, prefix)
+	if err != nil {
+		return nil, err
+	}
+	chain = append(chain, channelling.NewReplaceChatFilter(replacements))
+
+	if getBool("stripLinks") {
+		chain = append(chain, channelling.NewLinkChatFilter(getString("linkReplacement", "[link]")))
+	}
+
+	if getBool("classifier") {
+		failAction, ok := channelling.ParseChatFilterAction(getString("classifierFailAction", "allow"))
+		if !ok {
+			return nil, fmt.Errorf("Invalid chat filter classifierFailAction")
+		}
+		timeout := time.Duration(getInt("classifierTimeout", 500)) * time.Millisecond
+		chain = append(chain, channelling.NewBusChatFilter(busManager, timeout, failAction))
+	}
+
+	return chain, nil
+}
+
+// newChatFilterReplacements reads all replace options in the form
+// "regexp => replacement", sorted by option name. Options with the room
+// type prefix replace the generic ones.
+func newChatFilterReplacements(container phoenix.Container, options []string, prefix string) ([]*channelling.ChatFilterReplacement, error) {
+	var generic, typed []string
+	for _, option := range options {
+		if strings.HasPrefix(option, "replace") {
+			generic = append(generic, option)
+		} else if prefix != "" && strings.HasPrefix(option, prefix+"replace") {
+			typed = append(typed, option)
+		}
+	}
+	if len(typed) > 0 {
+		generic = typed
+	}
+	sort.Strings(generic)
+
+	replacements := make([]*channelling.ChatFilterReplacement, 0, len(generic))
+	for _, option := range generic {
+		value := container.GetStringDefault(chatFilterSection, option, "")
+		parts := strings.SplitN(value, " => ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid chat filter %s '%s', expected 'regexp => replacement'", option, value)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression in chat filter %s: %s", option, err)
+		}
+		replacements = append(replacements, &channelling.ChatFilterReplacement{Regexp: re, Replacement: strings.TrimSpace(parts[1])})
+	}
+	if len(replacements) > 0 {
+		log.Printf("Using %d chat filter replacements for %s\n", len(replacements), strings.TrimSuffix(prefix, "_"))
+	}
+
+	return replacements, nil
+}
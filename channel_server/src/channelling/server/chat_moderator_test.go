@@ -0,0 +1,14 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_ChatFilterRoomTypes(t *testing.T) {
+	options := []string{"enabled", "maxLength", "replace1", "Conference_maxLength", "Town_Hall_stripLinks", "Lobby_replace1", "Conference_blacklist", "Other_unknown"}
+	roomTypes := chatFilterRoomTypes(options)
+	if expected := []string{"", "Conference", "Town_Hall", "Lobby"}; !reflect.DeepEqual(roomTypes, expected) {
+		t.Errorf("Expected room types %v, but got %v", expected, roomTypes)
+	}
+}
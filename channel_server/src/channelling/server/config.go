@@ -22,8 +22,13 @@
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
@@ -77,6 +82,12 @@ func NewConfig(container phoenix.Container, tokens bool) (*channelling.Config, e
 	turnURIs := strings.Split(turnURIsString, " ")
 	trimAndRemoveDuplicates(&turnURIs)
 
+	roomMetadataRolesString := container.GetStringDefault("app", "roomMetadataRoles", "")
+	roomMetadataRoles := strings.Split(roomMetadataRolesString, " ")
+	trimAndRemoveDuplicates(&roomMetadataRoles)
+	roomOwnerRoles := strings.Split(container.GetStringDefault("app", "roomOwnerRoles", ""), " ")
+	trimAndRemoveDuplicates(&roomOwnerRoles)
+
 	// Get enabled modules.
 	modulesTable := map[string]bool{
 		"screensharing": true,
@@ -118,6 +129,118 @@ func NewConfig(container phoenix.Container, tokens bool) (*channelling.Config, e
 		}
 	}
 
+	roomRoles := []*channelling.RoomRoles{}
+	if options, _ := container.GetOptions("roomroles"); len(options) > 0 {
+		for _, option := range options {
+			roles := strings.Split(container.GetStringDefault("roomroles", option, ""), " ")
+			trimAndRemoveDuplicates(&roles)
+			if len(roles) == 0 {
+				continue
+			}
+
+			re, err := regexp.Compile(option)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid regular expression '%s' for room roles: %s", option, err)
+			}
+
+			roomRoles = append(roomRoles, &channelling.RoomRoles{Regexp: re, Roles: roles})
+			log.Printf("Requiring roles %s for rooms %s\n", roles, option)
+		}
+	}
+
+	turnRoleTTLs := make(map[string]int)
+	if options, _ := container.GetOptions("turnttl"); len(options) > 0 {
+		for _, option := range options {
+			ttl, err := container.GetInt("turnttl", option)
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("Invalid TURN ttl for role %s", option)
+			}
+			turnRoleTTLs[option] = ttl
+			log.Printf("Using TURN ttl %d for role %s\n", ttl, option)
+		}
+	}
+
+	// TURN pools are configured as roomType or roomType/region, with * for
+	// any room type or region.
+	turnPools := []*channelling.TurnPool{}
+	if options, _ := container.GetOptions("turnpools"); len(options) > 0 {
+		for _, option := range options {
+			uris := strings.Split(container.GetStringDefault("turnpools", option, ""), " ")
+			trimAndRemoveDuplicates(&uris)
+			if len(uris) == 0 {
+				continue
+			}
+
+			pool := &channelling.TurnPool{RoomType: option, Region: channelling.TurnPoolAny, URIs: uris}
+			if idx := strings.Index(option, "/"); idx >= 0 {
+				pool.RoomType, pool.Region = option[:idx], option[idx+1:]
+			}
+			if pool.RoomType == "" || pool.Region == "" {
+				return nil, fmt.Errorf("Invalid TURN pool '%s'", option)
+			}
+			turnPools = append(turnPools, pool)
+			log.Printf("Using TURN pool %s for room type %s and region %s\n", uris, pool.RoomType, pool.Region)
+		}
+	}
+
+	turnRegionNetworks := []*channelling.TurnRegionNetwork{}
+	if options, _ := container.GetOptions("turnregions"); len(options) > 0 {
+		for _, option := range options {
+			cidrs := strings.Split(container.GetStringDefault("turnregions", option, ""), " ")
+			trimAndRemoveDuplicates(&cidrs)
+			network := &channelling.TurnRegionNetwork{Region: option}
+			for _, cidr := range cidrs {
+				_, ipNet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid network '%s' for TURN region %s: %s", cidr, option, err)
+				}
+				network.Networks = append(network.Networks, ipNet)
+			}
+			turnRegionNetworks = append(turnRegionNetworks, network)
+		}
+	}
+
+	// ICE pools are named lists of STUN and TURN URIs, which rooms select
+	// in their metadata or by name in the roomicepools section.
+	icePools := make(map[string]*channelling.IcePool)
+	if options, _ := container.GetOptions("icepools"); len(options) > 0 {
+		for _, option := range options {
+			uris := strings.Split(container.GetStringDefault("icepools", option, ""), " ")
+			trimAndRemoveDuplicates(&uris)
+			pool := &channelling.IcePool{Name: option}
+			for _, uri := range uris {
+				switch {
+				case strings.HasPrefix(uri, "stun:") || strings.HasPrefix(uri, "stuns:"):
+					pool.StunURIs = append(pool.StunURIs, uri)
+				case strings.HasPrefix(uri, "turn:") || strings.HasPrefix(uri, "turns:"):
+					pool.TurnURIs = append(pool.TurnURIs, uri)
+				default:
+					return nil, fmt.Errorf("Invalid URI '%s' in ICE pool %s", uri, option)
+				}
+			}
+			icePools[option] = pool
+			log.Printf("Using ICE pool %s with %s\n", option, uris)
+		}
+	}
+
+	roomIcePools := []*channelling.RoomIcePool{}
+	if options, _ := container.GetOptions("roomicepools"); len(options) > 0 {
+		for _, option := range options {
+			name := container.GetStringDefault("roomicepools", option, "")
+			if _, ok := icePools[name]; !ok {
+				return nil, fmt.Errorf("Unknown ICE pool '%s' for rooms %s", name, option)
+			}
+
+			re, err := regexp.Compile(option)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid regular expression '%s' for room ICE pool: %s", option, err)
+			}
+
+			roomIcePools = append(roomIcePools, &channelling.RoomIcePool{Regexp: re, Pool: name})
+			log.Printf("Using ICE pool %s for rooms %s\n", name, option)
+		}
+	}
+
 	return &channelling.Config{
 		Title:                           container.GetStringDefault("app", "title", "Channel Server"),
 		Ver:                             ver,
@@ -127,6 +250,12 @@ func NewConfig(container phoenix.Container, tokens bool) (*channelling.Config, e
 		Renegotiation:                   container.GetBoolDefault("app", "renegotiation", false),
 		StunURIs:                        stunURIs,
 		TurnURIs:                        turnURIs,
+		TurnTTL:                         getIntDefault(container, "app", "turnTTL", channelling.TurnTTLDefault),
+		TurnRoleTTLs:                    turnRoleTTLs,
+		TurnPools:                       turnPools,
+		TurnRegionNetworks:              turnRegionNetworks,
+		IcePools:                        icePools,
+		RoomIcePools:                    roomIcePools,
 		Tokens:                          tokens,
 		Version:                         version,
 		UsersEnabled:                    container.GetBoolDefault("users", "enabled", false),
@@ -143,9 +272,197 @@ func NewConfig(container phoenix.Container, tokens bool) (*channelling.Config, e
 		ContentSecurityPolicyReportOnly: container.GetStringDefault("app", "contentSecurityPolicyReportOnly", ""),
 		RoomTypeDefault:                 defaultRoomType,
 		RoomTypes:                       roomTypes,
+		RoomMetadataRoles:               roomMetadataRoles,
+		RoomOwnerRoles:                  roomOwnerRoles,
+		ChatHistoryEnabled:              container.GetBoolDefault("chathistory", "enabled", false),
+		OfflineMessagesEnabled:          container.GetBoolDefault("offlinemessages", "enabled", false),
+		BusChatContent:                  container.GetBoolDefault("nats", "triggerChatContent", false),
+		RoomRoles:                       roomRoles,
 	}, nil
 }
 
+// NewChatHistoryLimits reads the chat history retention limits. The options
+// maxMessages and maxAge (in seconds) set the defaults, which can be
+// overridden per room type (and User for unicast conversations) by
+// prefixing the option with the type, for example Conference_maxMessages.
+func NewChatHistoryLimits(container phoenix.Container) map[string]*channelling.ChatHistoryLimits {
+	defaults := &channelling.ChatHistoryLimits{
+		MaxMessages: getIntDefault(container, "chathistory", "maxMessages", 100),
+		MaxAge:      time.Duration(getIntDefault(container, "chathistory", "maxAge", 0)) * time.Second,
+	}
+	limits := map[string]*channelling.ChatHistoryLimits{
+		"": defaults,
+	}
+	for _, historyType := range []string{channelling.RoomTypeRoom, channelling.RoomTypeConference, channelling.ChatHistoryTypeUser} {
+		limits[historyType] = &channelling.ChatHistoryLimits{
+			MaxMessages: getIntDefault(container, "chathistory", fmt.Sprintf("%s_maxMessages", historyType), defaults.MaxMessages),
+			MaxAge:      time.Duration(getIntDefault(container, "chathistory", fmt.Sprintf("%s_maxAge", historyType), int(defaults.MaxAge/time.Second))) * time.Second,
+		}
+	}
+
+	return limits
+}
+
+// NewOfflineMessages creates the offline messages store with how many
+// messages are kept per offline user and for how long (maxAge in seconds,
+// default one week), and how many for all users (maxTotal).
+func NewOfflineMessages(container phoenix.Container) channelling.OfflineMessages {
+	limits := &channelling.ChatHistoryLimits{
+		MaxMessages: getIntDefault(container, "offlinemessages", "maxMessages", 100),
+		MaxAge:      time.Duration(getIntDefault(container, "offlinemessages", "maxAge", 604800)) * time.Second,
+	}
+	maxTotal := getIntDefault(container, "offlinemessages", "maxTotal", channelling.OfflineMessagesMaxTotalDefault)
+	return channelling.NewOfflineMessages(limits, maxTotal)
+}
+
+// NewPolicy loads the role policy file of the policy section, which is
+// checked for changes every reloadInterval seconds (default 10). Returns
+// nil when no policy file is configured.
+func NewPolicy(container phoenix.Container) (channelling.Policy, error) {
+	filename := container.GetStringDefault("policy", "file", "")
+	if filename == "" {
+		return nil, nil
+	}
+	reloadInterval := time.Duration(getIntDefault(container, "policy", "reloadInterval", 10)) * time.Second
+	policy, err := channelling.NewPolicy(filename, reloadInterval)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load policy %s: %s", filename, err)
+	}
+	log.Println("Policy is enabled!")
+
+	return policy, nil
+}
+
+// NewAuditLog creates the audit log, when an audit file is configured.
+// Events are also published to the bus when a subject is configured.
+func NewAuditLog(container phoenix.Container, publisher channelling.AuditPublisher) (channelling.AuditLog, error) {
+	filename := container.GetStringDefault("audit", "file", "")
+	if filename == "" {
+		return nil, nil
+	}
+	maxSize := int64(getIntDefault(container, "audit", "maxSize", 100)) * 1024 * 1024
+	maxFiles := getIntDefault(container, "audit", "maxFiles", 5)
+	subject := container.GetStringDefault("audit", "subject", "")
+	auditLog, err := channelling.NewAuditLog(filename, maxSize, maxFiles, publisher, subject)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open audit log %s: %s", filename, err)
+	}
+	log.Printf("Audit log is enabled: %s\n", filename)
+
+	return auditLog, nil
+}
+
+// NewPipelineLog creates the on-disk pipeline log, when a log directory is
+// configured in the pipelines section.
+func NewPipelineLog(container phoenix.Container) (channelling.PipelineLog, error) {
+	dir := container.GetStringDefault("pipelines", "log", "")
+	if dir == "" {
+		return nil, nil
+	}
+	segmentSize := int64(getIntDefault(container, "pipelines", "segmentSize", 16)) * 1024 * 1024
+	maxSegments := getIntDefault(container, "pipelines", "maxSegments", 64)
+	retention := time.Duration(getIntDefault(container, "pipelines", "retention", 7*24*3600)) * time.Second
+	pipelineLog, err := channelling.NewPipelineLog(dir, segmentSize, maxSegments, retention)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open pipeline log %s: %s", dir, err)
+	}
+	log.Printf("Pipeline log is enabled: %s\n", dir)
+
+	return pipelineLog, nil
+}
+
+// NewBusOutbox creates the outbox of the bus events. Events are stored in
+// [nats] outbox when set and kept in memory otherwise.
+func NewBusOutbox(container phoenix.Container) (channelling.BusOutbox, error) {
+	dir := container.GetStringDefault("nats", "outbox", "")
+	capacity := getIntDefault(container, "nats", "outboxCapacity", channelling.BusOutboxCapacityDefault)
+	outbox, err := channelling.NewBusOutbox(dir, capacity)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open bus outbox %s: %s", dir, err)
+	}
+	if dir != "" {
+		log.Printf("Bus outbox is enabled: %s (%d pending)\n", dir, outbox.Len())
+	}
+
+	return outbox, nil
+}
+
+// NewWebhookBus creates a bus posting the trigger events to the webhooks
+// of the webhookurls section, named options with the URL and optionally
+// the comma separated triggers posted to it. It returns nil without
+// webhooks.
+func NewWebhookBus(container phoenix.Container, apiConsumer channelling.ChannellingAPIConsumer, id string, triggers map[string]bool) (channelling.BusManager, error) {
+	options, _ := container.GetOptions("webhookurls")
+	if len(options) == 0 {
+		return nil, nil
+	}
+
+	webhooks := []*channelling.Webhook{}
+	for _, option := range options {
+		fields := strings.Fields(container.GetStringDefault("webhookurls", option, ""))
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("Invalid webhook %s", option)
+		}
+		if parsed, err := url.Parse(fields[0]); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, fmt.Errorf("Invalid URL '%s' for webhook %s", fields[0], option)
+		}
+		webhook := &channelling.Webhook{Name: option, URL: fields[0]}
+		if len(fields) == 2 {
+			webhook.Events = channelling.ParseBusTriggers(fields[1])
+		}
+		webhooks = append(webhooks, webhook)
+		log.Printf("Posting bus events to webhook %s\n", option)
+	}
+
+	secret := container.GetStringDefault("webhooks", "secret", "")
+	if secret == "" {
+		log.Println("Warning: webhook events are not signed, set [webhooks] secret")
+	}
+	concurrency := getIntDefault(container, "webhooks", "concurrency", 4)
+	retries := getIntDefault(container, "webhooks", "retries", 5)
+	timeout := time.Duration(getIntDefault(container, "webhooks", "timeout", 10)) * time.Second
+
+	return channelling.NewWebhookBus(apiConsumer, id, webhooks, secret, concurrency, retries, timeout, triggers), nil
+}
+
+// NewSinkFactory creates the factory of the sinks of pipeline sessions.
+// File sinks record to [pipelines] sinkDir and are only available when it
+// is set.
+func NewSinkFactory(container phoenix.Container, bus channelling.BusManager) channelling.SinkFactory {
+	fileDir := container.GetStringDefault("pipelines", "sinkDir", "")
+	webhookTimeout := time.Duration(getIntDefault(container, "pipelines", "webhookTimeout", 10)) * time.Second
+	return channelling.NewSinkFactory(bus, fileDir, webhookTimeout)
+}
+
+// NewPipelineTokens signs the pipeline access tokens with [pipelines]
+// tokenSecret, or a key derived from the session secret when it is not set,
+// so tokens of other purposes are never accepted. They expire after
+// [pipelines] tokenLifetime seconds.
+func NewPipelineTokens(container phoenix.Container, sessionSecret []byte) channelling.PipelineTokens {
+	lifetime := time.Duration(getIntDefault(container, "pipelines", "tokenLifetime", 0)) * time.Second
+	var secret []byte
+	if secretString := container.GetStringDefault("pipelines", "tokenSecret", ""); secretString != "" {
+		var err error
+		if secret, err = hex.DecodeString(secretString); err != nil {
+			log.Println("Warning: tokenSecret value is not hex encoded", err)
+			secret = []byte(secretString)
+		}
+	} else if len(sessionSecret) > 0 {
+		mac := hmac.New(sha256.New, sessionSecret)
+		mac.Write([]byte("pipeline-tokens"))
+		secret = mac.Sum(nil)
+	}
+	return channelling.NewPipelineTokens(secret, lifetime)
+}
+
+func getIntDefault(container phoenix.Container, section, option string, defaultValue int) int {
+	if value, err := container.GetInt(section, option); err == nil {
+		return value
+	}
+
+	return defaultValue
+}
+
 // Helper function to clean up string arrays.
 func trimAndRemoveDuplicates(data *[]string) {
 	found := make(map[string]bool)
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"channelling"
+
+	"github.com/gorilla/mux"
+)
+
+// DeviceRequest creates or changes a device. Omitted fields are not
+// changed.
+type DeviceRequest struct {
+	Id           string    `json:"id"`
+	Name         *string   `json:"name"`
+	Capabilities *[]string `json:"capabilities"`
+	Controllers  *[]string `json:"controllers"`
+	ControlRoles *[]string `json:"controlRoles"`
+	Disabled     *bool     `json:"disabled"`
+	Fingerprint  *string   `json:"fingerprint"`
+	IssueKey     bool      `json:"issueKey"`
+}
+
+func (dr *DeviceRequest) apply(device *channelling.Device) {
+	if dr.Name != nil {
+		device.Name = *dr.Name
+	}
+	if dr.Capabilities != nil {
+		device.Capabilities = *dr.Capabilities
+	}
+	if dr.Controllers != nil {
+		device.Controllers = *dr.Controllers
+	}
+	if dr.ControlRoles != nil {
+		device.ControlRoles = *dr.ControlRoles
+	}
+	if dr.Disabled != nil {
+		device.Disabled = *dr.Disabled
+	}
+	if dr.Fingerprint != nil {
+		device.Fingerprint = *dr.Fingerprint
+	}
+}
+
+// DeviceResponse returns the device, with the API key only when it was
+// just created.
+type DeviceResponse struct {
+	*channelling.Device
+	Key string `json:"key,omitempty"`
+}
+
+// DevicesAdmin manages devices. Requests must send the admin secret as
+// Bearer token in the Authorization header.
+type DevicesAdmin struct {
+	Devices channelling.DeviceRegistry
+	Secret  string
+	Config  *channelling.Config
+}
+
+func (admin *DevicesAdmin) authorize(request *http.Request) bool {
+	secret := bearerToken(request)
+	if admin.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(admin.Secret)) == 1 {
+		return true
+	}
+	admin.Config.Audit(auditEvent(request, "devices.admin", "", "", errNotAllowed))
+	return false
+}
+
+func (admin *DevicesAdmin) Get(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("devices_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	id := mux.Vars(request)["id"]
+	if id == "" {
+		return 200, admin.Devices.List(), http.Header{"Content-Type": {"application/json"}}
+	}
+	device, ok := admin.Devices.Get(id)
+	if !ok {
+		return 404, NewApiError("devices_unknown", "Unknown device"), http.Header{"Content-Type": {"application/json"}}
+	}
+	return 200, device, http.Header{"Content-Type": {"application/json"}}
+}
+
+// Post registers a device. The API key is returned only once.
+func (admin *DevicesAdmin) Post(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("devices_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var dr DeviceRequest
+	if err := json.NewDecoder(request.Body).Decode(&dr); err != nil {
+		return 400, NewApiError("devices_bad_request", "Failed to parse request"), http.Header{"Content-Type": {"application/json"}}
+	}
+	device := &channelling.Device{Id: dr.Id}
+	dr.apply(device)
+	device, key, err := admin.Devices.Create(device)
+	admin.Config.Audit(auditEvent(request, "devices.create", "admin", dr.Id, err))
+	if err != nil {
+		return 400, NewApiError("devices_create_failed", fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	log.Printf("Device created %s\n", device.Id)
+	return 200, &DeviceResponse{device, key}, http.Header{"Content-Type": {"application/json"}}
+}
+
+// Patch changes a device. With issueKey a new API key is returned, which
+// replaces the previous one.
+func (admin *DevicesAdmin) Patch(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("devices_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var dr DeviceRequest
+	if err := json.NewDecoder(request.Body).Decode(&dr); err != nil {
+		return 400, NewApiError("devices_bad_request", "Failed to parse request"), http.Header{"Content-Type": {"application/json"}}
+	}
+	id := mux.Vars(request)["id"]
+	device, err := admin.Devices.Update(id, dr.apply)
+	admin.Config.Audit(auditEvent(request, "devices.update", "admin", id, err))
+	if err == channelling.ErrDeviceUnknown {
+		return 404, NewApiError("devices_unknown", "Unknown device"), http.Header{"Content-Type": {"application/json"}}
+	} else if err != nil {
+		return 400, NewApiError("devices_update_failed", fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var key string
+	if dr.IssueKey {
+		key, err = admin.Devices.IssueKey(id)
+		admin.Config.Audit(auditEvent(request, "devices.key", "admin", id, err))
+		if err != nil {
+			return 400, NewApiError("devices_update_failed", fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+		}
+		log.Printf("Device key issued %s\n", id)
+	}
+	return 200, &DeviceResponse{device, key}, http.Header{"Content-Type": {"application/json"}}
+}
+
+func (admin *DevicesAdmin) Delete(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("devices_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	err := admin.Devices.Delete(mux.Vars(request)["id"])
+	admin.Config.Audit(auditEvent(request, "devices.delete", "admin", mux.Vars(request)["id"], err))
+	if err != nil {
+		return 404, NewApiError("devices_unknown", "Unknown device"), http.Header{"Content-Type": {"application/json"}}
+	}
+	return 200, &struct {
+		Success bool `json:"success"`
+	}{true}, http.Header{"Content-Type": {"application/json"}}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"natsserver"
+
+	"github.com/strukturag/phoenix"
+)
+
+// NewNatsServer creates the embedded NATS server when enabled with
+// embedded in the nats section. It listens on embeddedListen (local only by
+// default), requires embeddedToken from clients when set and limits the
+// clients with embeddedMaxConnections and embeddedMaxSubscriptions.
+func NewNatsServer(container phoenix.Runtime) (*natsserver.Server, error) {
+	if !container.GetBoolDefault("nats", "embedded", false) {
+		return nil, nil
+	}
+
+	return natsserver.NewServer(&natsserver.Config{
+		Listen:           container.GetStringDefault("nats", "embeddedListen", natsserver.DefaultListen),
+		Token:            container.GetStringDefault("nats", "embeddedToken", ""),
+		MaxPayload:       getIntDefault(container, "nats", "embeddedMaxPayload", 0),
+		MaxConnections:   getIntDefault(container, "nats", "embeddedMaxConnections", 0),
+		MaxSubscriptions: getIntDefault(container, "nats", "embeddedMaxSubscriptions", 0),
+	})
+}
@@ -22,7 +22,9 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -31,9 +33,12 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// Pipelines reads and sends to pipelines. Requests must send a pipeline
+// token of the sink of the pipeline, which allows writing for Post.
 type Pipelines struct {
 	channelling.PipelineManager
-	API channelling.ChannellingAPI
+	API    channelling.ChannellingAPI
+	Config *channelling.Config
 }
 
 func (pipelines *Pipelines) Get(request *http.Request) (int, interface{}, http.Header) {
@@ -42,10 +47,9 @@ func (pipelines *Pipelines) Get(request *http.Request) (int, interface{}, http.H
 	if !ok {
 		return http.StatusNotFound, "", nil
 	}
-
-	pipeline, ok := pipelines.GetPipelineByID(id)
-	if !ok {
-		return http.StatusNotFound, "", nil
+	if claims, err := authorizePipeline(pipelines, request, id, false); err != nil {
+		pipelines.Config.Audit(pipelineAuditEvent(request, "pipeline.read", claims, id, err))
+		return pipelineForbidden(err)
 	}
 
 	since := 0
@@ -57,7 +61,19 @@ func (pipelines *Pipelines) Get(request *http.Request) (int, interface{}, http.H
 		limit, _ = strconv.Atoi(limitParam)
 	}
 
-	result, err := pipeline.JSONFeed(since, limit)
+	var result []byte
+	var err error
+	if pipeline, ok := pipelines.GetPipelineByID(id); ok {
+		result, err = pipeline.JSONFeed(since, limit)
+	} else if pipelineLog := pipelines.GetPipelineLog(); pipelineLog != nil && pipelineLog.Has(id) {
+		// Replay pipelines which have expired from the log.
+		var records []*channelling.PipelineRecord
+		if records, err = pipelineLog.Records(id, since, limit); err == nil {
+			result, err = channelling.PipelineJSONFeed(records)
+		}
+	} else {
+		return http.StatusNotFound, "", nil
+	}
 	if err != nil {
 		return http.StatusInternalServerError, err.Error(), nil
 	}
@@ -72,6 +88,11 @@ func (pipelines *Pipelines) Post(request *http.Request) (int, interface{}, http.
 		return http.StatusNotFound, "", nil
 	}
 
+	claims, err := authorizePipeline(pipelines, request, id, true)
+	if err != nil {
+		pipelines.Config.Audit(pipelineAuditEvent(request, "pipeline.send", claims, id, err))
+		return pipelineForbidden(err)
+	}
 	pipeline, ok := pipelines.GetPipelineByID(id)
 	if !ok {
 		return http.StatusNotFound, "", nil
@@ -96,5 +117,73 @@ func (pipelines *Pipelines) Post(request *http.Request) (int, interface{}, http.
 	}
 	pipelines.API.OnIncomingProcessed(pipeline, session, &incoming, reply, err)
 
+	// Record the injected message, which is sent as the target session.
+	event := pipelineAuditEvent(request, "pipeline.send", claims, id, err)
+	event.Session = session.Id
+	pipelines.Config.Audit(event)
+
 	return http.StatusOK, result, nil
 }
+
+// PipelineExport exports all stored messages of a pipeline as newline
+// separated JSON. Requests must send a pipeline token like for Pipelines.
+type PipelineExport struct {
+	channelling.PipelineManager
+	Config *channelling.Config
+}
+
+func (export *PipelineExport) Get(request *http.Request) (int, interface{}, http.Header) {
+	id, ok := mux.Vars(request)["id"]
+	if !ok {
+		return http.StatusNotFound, "", nil
+	}
+	claims, err := authorizePipeline(export, request, id, false)
+	export.Config.Audit(pipelineAuditEvent(request, "pipeline.export", claims, id, err))
+	if err != nil {
+		return pipelineForbidden(err)
+	}
+
+	pipelineLog := export.GetPipelineLog()
+	if pipelineLog == nil || !pipelineLog.Has(id) {
+		return http.StatusNotFound, "", nil
+	}
+
+	var buffer bytes.Buffer
+	if err := channelling.ExportPipeline(pipelineLog, id, &buffer); err != nil {
+		return http.StatusInternalServerError, err.Error(), nil
+	}
+
+	return http.StatusOK, buffer.Bytes(), http.Header{
+		"Content-Type":        {"application/x-ndjson"},
+		"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", id+".ndjson")},
+	}
+}
+
+// authorizePipeline validates the pipeline token of the request, sent as
+// Bearer token or token query parameter.
+func authorizePipeline(pipelineManager channelling.PipelineManager, request *http.Request, id string, write bool) (*channelling.PipelineToken, error) {
+	token := bearerToken(request)
+	if token == "" {
+		token = request.FormValue("token")
+	}
+
+	return pipelineManager.AuthorizePipeline(id, token, write)
+}
+
+func pipelineAuditEvent(request *http.Request, action string, claims *channelling.PipelineToken, id string, err error) *channelling.AuditEvent {
+	actor := ""
+	if claims != nil {
+		actor = "sink:" + claims.Sink
+	}
+
+	return auditEvent(request, action, actor, id, err)
+}
+
+func pipelineForbidden(err error) (int, interface{}, http.Header) {
+	code := "pipeline_forbidden"
+	if dataError, ok := err.(*channelling.DataError); ok {
+		code = dataError.Code
+	}
+
+	return http.StatusForbidden, NewApiError(code, err.Error()), http.Header{"Content-Type": {"application/json"}}
+}
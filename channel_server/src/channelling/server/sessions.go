@@ -48,7 +48,8 @@ type SessionNonceRequest struct {
 type Sessions struct {
 	channelling.SessionValidator
 	channelling.SessionStore
-	Users *Users
+	Users  *Users
+	Config *channelling.Config
 }
 
 // Patch is used to add a userid to a given session (login).
@@ -88,13 +89,16 @@ func (sessions *Sessions) Patch(request *http.Request) (int, interface{}, http.H
 	}
 
 	var userid string
+	identity := &UserIdentity{}
 	// Validate with users handler.
 	if sessions.Users.handler != nil {
-		userid, err = sessions.Users.handler.Validate(&snr, request)
-		if err != nil {
+		identity, err = sessions.Users.ValidateUserIdentity(&snr, request)
+		if err != nil || identity == nil {
 			error = true
+			identity = &UserIdentity{}
 			log.Println("Session patch failed - users validation failed.", err)
 		}
+		userid = identity.Userid
 		// Make sure that we have a user.
 		if userid == "" {
 			error = true
@@ -109,7 +113,7 @@ func (sessions *Sessions) Patch(request *http.Request) (int, interface{}, http.H
 	if !error {
 		// FIXME(longsleep): Not running this might reveal error state with a timing attack.
 		if session, ok := sessions.GetSession(snr.Id); ok {
-			nonce, err = session.Authorize(sessions.Realm(), &channelling.SessionToken{Id: snr.Id, Sid: snr.Sid, Userid: userid})
+			nonce, err = session.Authorize(sessions.Realm(), &channelling.SessionToken{Id: snr.Id, Sid: snr.Sid, Userid: userid, Roles: identity.Roles, DisplayName: identity.DisplayName})
 		} else {
 			err = errors.New("no such session")
 		}
@@ -121,10 +125,20 @@ func (sessions *Sessions) Patch(request *http.Request) (int, interface{}, http.H
 	}
 
 	if error {
+		actor := userid
+		if actor == "" {
+			actor = snr.UseridCombo
+		}
+		event := auditEvent(request, "session.patch", actor, "", errors.New("session patch failed"))
+		event.Session = snr.Id
+		sessions.Config.Audit(event)
 		return 403, NewApiError("session_patch_failed", "Failed to patch session"), http.Header{"Content-Type": {"application/json"}}
 	}
 
 	log.Printf("Session patch successfull %s -> %s\n", snr.Id, userid)
+	event := auditEvent(request, "session.patch", userid, "", nil)
+	event.Session = snr.Id
+	sessions.Config.Audit(event)
 	return 200, &SessionNonce{Nonce: nonce, Userid: userid, Success: true}, http.Header{"Content-Type": {"application/json"}}
 
 }
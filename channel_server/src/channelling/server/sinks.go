@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"channelling"
+
+	"github.com/gorilla/mux"
+)
+
+// Sinks is the callback end point of webhook sinks. Requests must send the
+// token of the sink as Bearer token in the Authorization header.
+type Sinks struct {
+	channelling.PipelineManager
+}
+
+func (sinks *Sinks) Post(request *http.Request) (int, interface{}, http.Header) {
+	sink, ok := AuthorizeSink(sinks.PipelineManager, request)
+	if !ok {
+		return 404, NewApiError("sink_unknown", "Unknown sink"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var incoming channelling.DataIncoming
+	if err := json.NewDecoder(request.Body).Decode(&incoming); err != nil {
+		return 400, NewApiError("sink_bad_request", err.Error()), http.Header{"Content-Type": {"application/json"}}
+	}
+	if err := sink.Receive(&incoming); err != nil {
+		return 409, NewApiError("sink_not_attached", err.Error()), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	return 200, &struct {
+		Success bool `json:"success"`
+	}{true}, http.Header{"Content-Type": {"application/json"}}
+}
+
+// AuthorizeSink returns the receiving sink of the request, when the request
+// sends the token of the sink as Bearer token or token query parameter.
+func AuthorizeSink(pipelineManager channelling.PipelineManager, request *http.Request) (channelling.ReceivingSink, bool) {
+	sink, ok := pipelineManager.GetSink(mux.Vars(request)["id"])
+	if !ok {
+		return nil, false
+	}
+	receivingSink, ok := sink.(channelling.ReceivingSink)
+	if !ok {
+		return nil, false
+	}
+	token := bearerToken(request)
+	if token == "" {
+		token = request.FormValue("token")
+	}
+	expected := sink.Export().Token
+	if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return nil, false
+	}
+
+	return receivingSink, true
+}
@@ -27,21 +27,35 @@ import (
 	"time"
 
 	"channelling"
+	"natsserver"
+	"turnserver"
 )
 
 type Stat struct {
 	details bool
-	Runtime *RuntimeStat         `json:"runtime"`
-	Hub     *channelling.HubStat `json:"hub"`
+	Runtime *RuntimeStat          `json:"runtime"`
+	Hub     *channelling.HubStat  `json:"hub"`
+	Turn    *turnserver.Stats     `json:"turn,omitempty"`
+	Bus     *channelling.BusStats `json:"bus,omitempty"`
+	Nats    *natsserver.Stats     `json:"nats,omitempty"`
 }
 
-func NewStat(details bool, statsGenerator channelling.StatsGenerator) *Stat {
+func NewStat(details bool, statsGenerator channelling.StatsGenerator, turnServer *turnserver.Server, busManager channelling.BusManager, natsServer *natsserver.Server) *Stat {
 	stat := &Stat{
 		details: details,
 		Runtime: &RuntimeStat{},
 		Hub:     statsGenerator.Stat(details),
 	}
 	stat.Runtime.Read()
+	if turnServer != nil {
+		stat.Turn = turnServer.Stats()
+	}
+	if busManager != nil {
+		stat.Bus = busManager.Stats()
+	}
+	if natsServer != nil {
+		stat.Nats = natsServer.Stats()
+	}
 	return stat
 }
 
@@ -72,11 +86,14 @@ func (stat *RuntimeStat) Read() {
 
 type Stats struct {
 	channelling.StatsGenerator
+	TurnServer *turnserver.Server
+	BusManager channelling.BusManager
+	NatsServer *natsserver.Server
 }
 
 func (stats *Stats) Get(request *http.Request) (int, interface{}, http.Header) {
 
 	details := request.Form.Get("details") == "1"
-	return 200, NewStat(details, stats), http.Header{"Content-Type": {"application/json; charset=utf-8"}, "Access-Control-Allow-Origin": {"*"}}
+	return 200, NewStat(details, stats, stats.TurnServer, stats.BusManager, stats.NatsServer), http.Header{"Content-Type": {"application/json; charset=utf-8"}, "Access-Control-Allow-Origin": {"*"}}
 
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strings"
@@ -15,6 +16,7 @@ type Token struct {
 
 type Tokens struct {
 	Provider channelling.TokenProvider
+	Config   *channelling.Config
 }
 
 func (tokens Tokens) Post(request *http.Request) (int, interface{}, http.Header) {
@@ -29,9 +31,11 @@ func (tokens Tokens) Post(request *http.Request) (int, interface{}, http.Header)
 
 	if valid != "" {
 		log.Printf("Good incoming token request: %s\n", auth)
+		tokens.Config.Audit(auditEvent(request, "token.validate", "", "", nil))
 		return 200, &Token{Token: valid, Success: true}, http.Header{"Content-Type": {"application/json"}}
 	}
 	log.Printf("Wrong incoming token request: %s\n", auth)
+	tokens.Config.Audit(auditEvent(request, "token.validate", "", "", errors.New("invalid token")))
 	return 403, NewApiError("invalid_token", "Invalid token"), http.Header{"Content-Type": {"application/json"}}
 
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"turnserver"
+
+	"github.com/strukturag/phoenix"
+)
+
+// NewTurnServer creates the embedded STUN/TURN server when listeners are
+// configured in the turn section. TURN validates the credentials created
+// with the secret, without secret only STUN is available. TURN over TLS
+// (listenTLS) uses the certificate of the https section.
+func NewTurnServer(container phoenix.Runtime, secret []byte, realm string) (*turnserver.Server, error) {
+	listenUDP := container.GetStringDefault("turn", "listenUDP", "")
+	listenTCP := container.GetStringDefault("turn", "listenTCP", "")
+	listenTLS := container.GetStringDefault("turn", "listenTLS", "")
+	if listenUDP == "" && listenTCP == "" && listenTLS == "" {
+		return nil, nil
+	}
+
+	config := &turnserver.Config{
+		ListenUDP:      listenUDP,
+		ListenTCP:      listenTCP,
+		ListenTLS:      listenTLS,
+		Realm:          container.GetStringDefault("turn", "realm", realm),
+		Secret:         secret,
+		RelayPortMin:   getIntDefault(container, "turn", "relayPortMin", 0),
+		RelayPortMax:   getIntDefault(container, "turn", "relayPortMax", 0),
+		MaxAllocations: getIntDefault(container, "turn", "maxAllocations", 0),
+	}
+	if address := container.GetStringDefault("turn", "relayAddress", ""); address != "" {
+		if config.RelayAddress = net.ParseIP(address); config.RelayAddress == nil {
+			return nil, fmt.Errorf("Invalid TURN relay address %s", address)
+		}
+	}
+	if address := container.GetStringDefault("turn", "externalAddress", ""); address != "" {
+		if config.ExternalAddress = net.ParseIP(address); config.ExternalAddress == nil {
+			return nil, fmt.Errorf("Invalid TURN external address %s", address)
+		}
+	}
+
+	// Private, loopback and link-local peers are denied unless allowed.
+	allowedPeers := strings.Split(container.GetStringDefault("turn", "allowedPeers", ""), " ")
+	trimAndRemoveDuplicates(&allowedPeers)
+	for _, cidr := range allowedPeers {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TURN allowed peer network '%s': %s", cidr, err)
+		}
+		config.AllowedPeers = append(config.AllowedPeers, network)
+	}
+
+	if listenTLS != "" {
+		// TURN over TLS uses the certificate of the HTTPS listener.
+		tlsConfig, err := container.TLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("TLS configuration error for TURN: %s", err)
+		}
+		config.TLSConfig = tlsConfig
+	}
+
+	return turnserver.NewServer(config)
+}
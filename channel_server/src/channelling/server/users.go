@@ -59,6 +59,21 @@ type UsersHandler interface {
 	Create(snr *UserNonce, request *http.Request) (*UserNonce, error)
 }
 
+// UserIdentity is a user with the information provided by an
+// UsersIdentityHandler.
+type UserIdentity struct {
+	Userid      string
+	DisplayName string
+	Roles       []string
+}
+
+// UsersIdentityHandler is implemented by users handlers which provide a
+// display name and roles in addition to the userid.
+type UsersIdentityHandler interface {
+	GetIdentity(request *http.Request) (*UserIdentity, error)
+	ValidateIdentity(snr *SessionNonceRequest, request *http.Request) (*UserIdentity, error)
+}
+
 type UsersSharedsecretHandler struct {
 	secret []byte
 }
@@ -339,6 +354,12 @@ func (users *Users) createHandler(mode string, runtime phoenix.Runtime) (handler
 			headerName = "x-users"
 		}
 		handler = &UsersHTTPHeaderHandler{headerName: headerName}
+	case "jwt":
+		handler, err = newUsersJWTHandler(runtime)
+	case "oidc":
+		handler, err = newUsersOIDCHandler(users, runtime)
+	case "local":
+		handler, err = newUsersLocalHandler(runtime)
 	case "certificate":
 		var err2 error
 		verifiedHeader, _ := runtime.GetString("users", "certificate_verifiedHeader")
@@ -409,6 +430,48 @@ func (users *Users) createHandler(mode string, runtime phoenix.Runtime) (handler
 
 }
 
+// GetUserIdentity returns the user of the request, including display name
+// and roles when the handler provides them.
+func (users *Users) GetUserIdentity(request *http.Request) (*UserIdentity, error) {
+	if identityHandler, ok := users.handler.(UsersIdentityHandler); ok {
+		identity, err := identityHandler.GetIdentity(request)
+		if err != nil {
+			log.Printf("Failed to get identity from handler: %s", err)
+		} else if identity != nil {
+			log.Printf("Users handler get success: %s\n", identity.Userid)
+		}
+		return identity, err
+	}
+
+	userid, err := users.GetUserID(request)
+	if userid == "" {
+		return nil, err
+	}
+	return &UserIdentity{Userid: userid}, err
+}
+
+// ValidateUserIdentity validates the user of a session nonce request.
+func (users *Users) ValidateUserIdentity(snr *SessionNonceRequest, request *http.Request) (*UserIdentity, error) {
+	if identityHandler, ok := users.handler.(UsersIdentityHandler); ok {
+		return identityHandler.ValidateIdentity(snr, request)
+	}
+
+	userid, err := users.handler.Validate(snr, request)
+	return &UserIdentity{Userid: userid}, err
+}
+
+// OIDCHandler returns the handler of the oidc users mode.
+func (users *Users) OIDCHandler() (*UsersOIDCHandler, bool) {
+	handler, ok := users.handler.(*UsersOIDCHandler)
+	return handler, ok
+}
+
+// LocalHandler returns the handler of the local users mode.
+func (users *Users) LocalHandler() (*UsersLocalHandler, bool) {
+	handler, ok := users.handler.(*UsersLocalHandler)
+	return handler, ok
+}
+
 func (users *Users) GetUserID(request *http.Request) (userid string, err error) {
 	if users.handler == nil {
 		return
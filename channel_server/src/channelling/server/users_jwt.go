@@ -0,0 +1,546 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/strukturag/phoenix"
+)
+
+const (
+	jwksCheckInterval = 5 * time.Second
+)
+
+// jwtKey is a key usable to verify JSON Web Tokens.
+type jwtKey struct {
+	Kid string
+	Alg string // Empty when usable with all algorithms of its type.
+	Key interface{}
+}
+
+func (key *jwtKey) usableFor(alg, kid string) bool {
+	if kid != "" && key.Kid != "" && kid != key.Kid {
+		return false
+	}
+	if key.Alg != "" && key.Alg != alg {
+		return false
+	}
+
+	switch key.Key.(type) {
+	case []byte:
+		return alg == "HS256"
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256"
+	}
+
+	return false
+}
+
+// jwtKeySource provides keys which might change over time.
+type jwtKeySource interface {
+	Keys() []*jwtKey
+}
+
+// jwksFile is a JSON Web Key Set file which is loaded again when it changes.
+type jwksFile struct {
+	sync.Mutex
+	filename  string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+	keys      []*jwtKey
+}
+
+func (f *jwksFile) Keys() []*jwtKey {
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.lastCheck) < jwksCheckInterval {
+		return f.keys
+	}
+	f.lastCheck = now
+
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		log.Println("Failed to check JWKS file", err)
+		return f.keys
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.keys
+	}
+
+	data, err := ioutil.ReadFile(f.filename)
+	if err == nil {
+		var keys []*jwtKey
+		if keys, err = parseJWKS(data); err == nil {
+			f.keys = keys
+			f.modTime = info.ModTime()
+			f.size = info.Size()
+			log.Printf("Loaded %d keys from JWKS file %s\n", len(keys), f.filename)
+		}
+	}
+	if err != nil {
+		log.Println("Failed to load JWKS file", f.filename, err)
+	}
+
+	return f.keys
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func parseJWKS(data []byte) ([]*jwtKey, error) {
+	var set struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*jwtKey, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.key()
+		if err != nil {
+			log.Printf("Ignoring JWK '%s': %s\n", jwk.Kid, err)
+			continue
+		}
+		keys = append(keys, &jwtKey{Kid: jwk.Kid, Alg: jwk.Alg, Key: key})
+	}
+
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) key() (interface{}, error) {
+	switch jwk.Kty {
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// loadJWTPublicKey loads a PEM encoded RSA or ECDSA public key or
+// certificate.
+func loadJWTPublicKey(filename string) (interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		var certificate *x509.Certificate
+		if certificate, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = certificate.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+
+	return nil, errors.New("unsupported public key type")
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtVerifier verifies JSON Web Tokens and their registered claims.
+type jwtVerifier struct {
+	mutex      sync.RWMutex
+	keys       []*jwtKey
+	jwks       jwtKeySource
+	algorithms map[string]bool
+	audience   string
+	issuer     string
+	leeway     time.Duration
+	requireExp bool
+}
+
+func (v *jwtVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	header := &jwtHeader{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, fmt.Errorf("invalid token header: %s", err)
+	}
+	if !v.algorithms[header.Alg] {
+		return nil, fmt.Errorf("token algorithm %s not allowed", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid token signature encoding")
+	}
+	if !v.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %s", err)
+	}
+	if err := v.verifyClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// keySource returns the key set of the verifier, which might be set after
+// it is in use.
+func (v *jwtVerifier) keySource() jwtKeySource {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	return v.jwks
+}
+
+// setKeySource sets the key set unless the verifier has one.
+func (v *jwtVerifier) setKeySource(jwks jwtKeySource) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.jwks == nil {
+		v.jwks = jwks
+	}
+}
+
+func (v *jwtVerifier) verifySignature(header *jwtHeader, signed, signature []byte) bool {
+	keys := v.keys
+	if jwks := v.keySource(); jwks != nil {
+		keys = append(keys[:len(keys):len(keys)], jwks.Keys()...)
+	}
+
+	hashed := sha256.Sum256(signed)
+	for _, key := range keys {
+		if !key.usableFor(header.Alg, header.Kid) {
+			continue
+		}
+		switch k := key.Key.(type) {
+		case []byte:
+			m := hmac.New(sha256.New, k)
+			m.Write(signed)
+			if hmac.Equal(m.Sum(nil), signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed[:], signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if len(signature) != 64 {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(k, hashed[:], r, s) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (v *jwtVerifier) verifyClaims(claims map[string]interface{}, now time.Time) error {
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(v.leeway)) {
+			return errors.New("token expired")
+		}
+	} else if v.requireExp {
+		return errors.New("token without expiration")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(v.leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("token not yet valid")
+		}
+	}
+	if v.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.issuer {
+			return errors.New("invalid token issuer")
+		}
+	}
+	if v.audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == v.audience
+		case []interface{}:
+			for _, a := range aud {
+				if s, _ := a.(string); s == v.audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return errors.New("invalid token audience")
+		}
+	}
+
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// lookupClaim returns the claim with the given name. Names can contain
+// dots to access nested claims, for example realm_access.roles.
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	var value interface{} = claims
+	for _, key := range strings.Split(name, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+
+	return value
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	switch value := lookupClaim(claims, name).(type) {
+	case string:
+		return value
+	case float64:
+		return fmt.Sprintf("%.0f", value)
+	}
+
+	return ""
+}
+
+// claimStrings returns an array claim, or a space separated string claim.
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := lookupClaim(claims, name).(type) {
+	case string:
+		values := strings.Split(value, " ")
+		trimAndRemoveDuplicates(&values)
+		return values
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+// newUserIdentity maps the claims of a token to an UserIdentity.
+func newUserIdentity(claims map[string]interface{}, useridClaim, displayNameClaim, rolesClaim string) (*UserIdentity, error) {
+	identity := &UserIdentity{
+		Userid:      claimString(claims, useridClaim),
+		DisplayName: claimString(claims, displayNameClaim),
+		Roles:       claimStrings(claims, rolesClaim),
+	}
+	if identity.Userid == "" {
+		return nil, fmt.Errorf("token without %s claim", useridClaim)
+	}
+
+	return identity, nil
+}
+
+// UsersJWTHandler authenticates users with signed JSON Web Tokens.
+type UsersJWTHandler struct {
+	verifier         *jwtVerifier
+	useridClaim      string
+	displayNameClaim string
+	rolesClaim       string
+}
+
+func (uh *UsersJWTHandler) identity(token string) (*UserIdentity, error) {
+	claims, err := uh.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUserIdentity(claims, uh.useridClaim, uh.displayNameClaim, uh.rolesClaim)
+}
+
+// GetIdentity reads the token from the Authorization header or from the t
+// parameter of the WebSocket connection.
+func (uh *UsersJWTHandler) GetIdentity(request *http.Request) (*UserIdentity, error) {
+	token := bearerToken(request)
+	if token == "" {
+		if t := request.FormValue("t"); strings.Count(t, ".") == 2 {
+			token = t
+		}
+	}
+	if token == "" {
+		return nil, nil
+	}
+
+	return uh.identity(token)
+}
+
+// ValidateIdentity reads the token from the Authorization header or from
+// the secret of the request.
+func (uh *UsersJWTHandler) ValidateIdentity(snr *SessionNonceRequest, request *http.Request) (*UserIdentity, error) {
+	token := bearerToken(request)
+	if token == "" {
+		token = snr.Secret
+	}
+	if token == "" {
+		return nil, errors.New("no token provided")
+	}
+
+	return uh.identity(token)
+}
+
+func (uh *UsersJWTHandler) Get(request *http.Request) (userid string, err error) {
+	var identity *UserIdentity
+	if identity, err = uh.GetIdentity(request); identity != nil {
+		userid = identity.Userid
+	}
+	return
+}
+
+func (uh *UsersJWTHandler) Validate(snr *SessionNonceRequest, request *http.Request) (string, error) {
+	identity, err := uh.ValidateIdentity(snr, request)
+	if err != nil {
+		return "", err
+	}
+	return identity.Userid, nil
+}
+
+func (uh *UsersJWTHandler) Create(un *UserNonce, request *http.Request) (*UserNonce, error) {
+	return nil, errors.New("create is not possible in jwt mode")
+}
+
+func newUsersJWTHandler(runtime phoenix.Runtime) (*UsersJWTHandler, error) {
+	algorithms := strings.Split(runtime.GetStringDefault("users", "jwt_algorithms", "HS256 RS256 ES256"), " ")
+	trimAndRemoveDuplicates(&algorithms)
+	verifier := &jwtVerifier{
+		algorithms: make(map[string]bool),
+		audience:   runtime.GetStringDefault("users", "jwt_audience", ""),
+		issuer:     runtime.GetStringDefault("users", "jwt_issuer", ""),
+		leeway:     time.Duration(getIntDefault(runtime, "users", "jwt_leeway", 60)) * time.Second,
+		requireExp: runtime.GetBoolDefault("users", "jwt_requireExp", true),
+	}
+	for _, alg := range algorithms {
+		switch alg {
+		case "HS256", "RS256", "ES256":
+			verifier.algorithms[alg] = true
+		default:
+			return nil, fmt.Errorf("Cannot enable jwt users handler: Unsupported algorithm %s.", alg)
+		}
+	}
+
+	if secret := runtime.GetStringDefault("users", "jwt_secret", ""); secret != "" {
+		verifier.keys = append(verifier.keys, &jwtKey{Alg: "HS256", Key: []byte(secret)})
+	}
+	if publicKeyFn := runtime.GetStringDefault("users", "jwt_publicKey", ""); publicKeyFn != "" {
+		key, err := loadJWTPublicKey(publicKeyFn)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot enable jwt users handler: Failed to load public key: %s", err)
+		}
+		verifier.keys = append(verifier.keys, &jwtKey{Key: key})
+		log.Printf("Users JWT public key loaded from %s\n", publicKeyFn)
+	}
+	if jwksFn := runtime.GetStringDefault("users", "jwt_jwks", ""); jwksFn != "" {
+		verifier.jwks = &jwksFile{filename: jwksFn}
+		verifier.jwks.Keys()
+	}
+	if len(verifier.keys) == 0 && verifier.jwks == nil {
+		return nil, errors.New("Cannot enable jwt users handler: No secret, public key or JWKS.")
+	}
+
+	return &UsersJWTHandler{
+		verifier:         verifier,
+		useridClaim:      runtime.GetStringDefault("users", "jwt_useridClaim", "sub"),
+		displayNameClaim: runtime.GetStringDefault("users", "jwt_displayNameClaim", "name"),
+		rolesClaim:       runtime.GetStringDefault("users", "jwt_rolesClaim", "roles"),
+	}, nil
+}
+
+func bearerToken(request *http.Request) string {
+	authorization := request.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+
+	return ""
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func encodeTestJWT(t *testing.T, alg string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func newTestJWTHandler(keys ...*jwtKey) *UsersJWTHandler {
+	return &UsersJWTHandler{
+		verifier: &jwtVerifier{
+			keys:       keys,
+			algorithms: map[string]bool{"HS256": true, "ES256": true},
+			audience:   "rtn",
+			leeway:     time.Minute,
+			requireExp: true,
+		},
+		useridClaim:      "sub",
+		displayNameClaim: "name",
+		rolesClaim:       "realm_access.roles",
+	}
+}
+
+func Test_UsersJWTHandler_GetIdentity_HS256(t *testing.T) {
+	secret := []byte("secret")
+	uh := newTestJWTHandler(&jwtKey{Alg: "HS256", Key: secret})
+	sign := func(data []byte) []byte {
+		m := hmac.New(sha256.New, secret)
+		m.Write(data)
+		return m.Sum(nil)
+	}
+
+	token := encodeTestJWT(t, "HS256", map[string]interface{}{
+		"sub":          "player-1",
+		"name":         "Player One",
+		"aud":          []string{"other", "rtn"},
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"realm_access": map[string]interface{}{"roles": []string{"player", "moderator"}},
+	}, sign)
+	request, _ := http.NewRequest("GET", "/ws?t="+token, nil)
+	identity, err := uh.GetIdentity(request)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if identity.Userid != "player-1" || identity.DisplayName != "Player One" || len(identity.Roles) != 2 || identity.Roles[1] != "moderator" {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+
+	expired := encodeTestJWT(t, "HS256", map[string]interface{}{"sub": "player-1", "aud": "rtn", "exp": time.Now().Add(-time.Hour).Unix()}, sign)
+	request, _ = http.NewRequest("GET", "/ws", nil)
+	request.Header.Set("Authorization", "Bearer "+expired)
+	if _, err := uh.GetIdentity(request); err == nil {
+		t.Error("Expected expired token to fail")
+	}
+
+	wrongAudience := encodeTestJWT(t, "HS256", map[string]interface{}{"sub": "player-1", "aud": "other", "exp": time.Now().Add(time.Hour).Unix()}, sign)
+	if _, err := uh.ValidateIdentity(&SessionNonceRequest{Secret: wrongAudience}, request); err == nil {
+		t.Error("Expected token with wrong audience to fail")
+	}
+
+	forged := encodeTestJWT(t, "HS256", map[string]interface{}{"sub": "player-1", "aud": "rtn", "exp": time.Now().Add(time.Hour).Unix()}, func(data []byte) []byte {
+		return []byte("forged-signature")
+	})
+	if _, err := uh.ValidateIdentity(&SessionNonceRequest{Secret: forged}, &http.Request{Header: http.Header{}}); err == nil {
+		t.Error("Expected token with invalid signature to fail")
+	}
+}
+
+func Test_UsersJWTHandler_ValidateIdentity_ES256(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uh := newTestJWTHandler(&jwtKey{Key: &privateKey.PublicKey})
+
+	token := encodeTestJWT(t, "ES256", map[string]interface{}{
+		"sub": "player-2",
+		"aud": "rtn",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}, func(data []byte) []byte {
+		hashed := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashed[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+		return signature
+	})
+	request := &http.Request{Header: http.Header{"Authorization": {"Bearer " + token}}}
+	identity, err := uh.ValidateIdentity(&SessionNonceRequest{}, request)
+	if err != nil || identity.Userid != "player-2" {
+		t.Errorf("Expected player-2, but got %+v %v", identity, err)
+	}
+}
@@ -0,0 +1,620 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"channelling"
+
+	"github.com/gorilla/mux"
+	"github.com/strukturag/phoenix"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	localUserMaxDisplayName = 100
+	localUserMaxAvatar      = 64 * 1024
+)
+
+var (
+	localUseridPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]{2,63}$`)
+
+	errLocalUserExists        = errors.New("user exists")
+	errLocalUserUnknown       = errors.New("unknown user")
+	errLocalUserInvalidLogin  = errors.New("invalid userid or password")
+	errLocalUserDisabled      = errors.New("user is disabled")
+	errLocalUserInvalidUserid = errors.New("invalid userid")
+)
+
+// LocalUser is an account of the local users database.
+type LocalUser struct {
+	Userid       string   `json:"userid"`
+	DisplayName  string   `json:"displayName,omitempty"`
+	Avatar       string   `json:"avatar,omitempty"`
+	Roles        []string `json:"roles,omitempty"`
+	Disabled     bool     `json:"disabled,omitempty"`
+	PasswordHash string   `json:"passwordHash,omitempty"`
+	Created      int64    `json:"created"`
+	Updated      int64    `json:"updated"`
+}
+
+// public returns a copy without the password hash.
+func (user *LocalUser) public() *LocalUser {
+	c := *user
+	c.PasswordHash = ""
+	return &c
+}
+
+// localUsersDatabase stores the local users in a JSON file, which is
+// written completely on every change.
+type localUsersDatabase struct {
+	sync.RWMutex
+	filename string
+	users    map[string]*LocalUser
+}
+
+func newLocalUsersDatabase(filename string) (*localUsersDatabase, error) {
+	db := &localUsersDatabase{
+		filename: filename,
+		users:    make(map[string]*LocalUser),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var stored struct {
+		Users []*LocalUser `json:"users"`
+	}
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("invalid users database %s: %s", filename, err)
+	}
+	for _, user := range stored.Users {
+		db.users[user.Userid] = user
+	}
+
+	return db, nil
+}
+
+// save writes the database to a temporary file first, so a crash never
+// leaves a partial database behind. Must be called with the lock held.
+func (db *localUsersDatabase) save() error {
+	var stored struct {
+		Users []*LocalUser `json:"users"`
+	}
+	for _, user := range db.users {
+		stored.Users = append(stored.Users, user)
+	}
+	sort.Sort(localUsersByUserid(stored.Users))
+	data, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := db.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, db.filename)
+}
+
+func (db *localUsersDatabase) Len() int {
+	db.RLock()
+	defer db.RUnlock()
+	return len(db.users)
+}
+
+func (db *localUsersDatabase) Get(userid string) (*LocalUser, bool) {
+	db.RLock()
+	defer db.RUnlock()
+	user, ok := db.users[userid]
+	if !ok {
+		return nil, false
+	}
+	c := *user
+	return &c, true
+}
+
+func (db *localUsersDatabase) List() []*LocalUser {
+	db.RLock()
+	defer db.RUnlock()
+	users := make([]*LocalUser, 0, len(db.users))
+	for _, user := range db.users {
+		users = append(users, user.public())
+	}
+	sort.Sort(localUsersByUserid(users))
+	return users
+}
+
+func (db *localUsersDatabase) Add(user *LocalUser) error {
+	db.Lock()
+	defer db.Unlock()
+	if _, ok := db.users[user.Userid]; ok {
+		return errLocalUserExists
+	}
+	user.Created = time.Now().Unix()
+	user.Updated = user.Created
+	db.users[user.Userid] = user
+	if err := db.save(); err != nil {
+		delete(db.users, user.Userid)
+		return err
+	}
+	return nil
+}
+
+// Update changes the user with the given function and stores the result.
+func (db *localUsersDatabase) Update(userid string, update func(*LocalUser) error) (*LocalUser, error) {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.users[userid]
+	if !ok {
+		return nil, errLocalUserUnknown
+	}
+	c := *user
+	if err := update(&c); err != nil {
+		return nil, err
+	}
+	c.Updated = time.Now().Unix()
+	db.users[userid] = &c
+	if err := db.save(); err != nil {
+		db.users[userid] = user
+		return nil, err
+	}
+	return c.public(), nil
+}
+
+func (db *localUsersDatabase) Delete(userid string) error {
+	db.Lock()
+	defer db.Unlock()
+	user, ok := db.users[userid]
+	if !ok {
+		return errLocalUserUnknown
+	}
+	delete(db.users, userid)
+	if err := db.save(); err != nil {
+		db.users[userid] = user
+		return err
+	}
+	return nil
+}
+
+type localUsersByUserid []*LocalUser
+
+func (a localUsersByUserid) Len() int           { return len(a) }
+func (a localUsersByUserid) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a localUsersByUserid) Less(i, j int) bool { return a[i].Userid < a[j].Userid }
+
+// UsersLocalHandler authenticates users against the local users database.
+type UsersLocalHandler struct {
+	db                *localUsersDatabase
+	bcryptCost        int
+	minPasswordLength int
+	adminRole         string
+	defaultRoles      []string
+	dummyHash         []byte
+}
+
+func newUsersLocalHandler(runtime phoenix.Runtime) (*UsersLocalHandler, error) {
+	filename := runtime.GetStringDefault("users", "local_database", "")
+	if filename == "" {
+		return nil, errors.New("Cannot enable local users handler: No database.")
+	}
+	db, err := newLocalUsersDatabase(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	uh := &UsersLocalHandler{
+		db:                db,
+		bcryptCost:        getIntDefault(runtime, "users", "local_bcryptCost", bcrypt.DefaultCost),
+		minPasswordLength: getIntDefault(runtime, "users", "local_minPasswordLength", 8),
+		adminRole:         runtime.GetStringDefault("users", "local_adminRole", "admin"),
+		defaultRoles:      strings.Fields(runtime.GetStringDefault("users", "local_defaultRoles", "")),
+	}
+	if uh.bcryptCost < bcrypt.MinCost || uh.bcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("Cannot enable local users handler: Invalid bcrypt cost %d.", uh.bcryptCost)
+	}
+	// Compared against when the user does not exist, to not reveal which
+	// users exist by timing.
+	if uh.dummyHash, err = bcrypt.GenerateFromPassword([]byte("dummy-password"), uh.bcryptCost); err != nil {
+		return nil, err
+	}
+
+	// Create the first admin of an empty database.
+	if adminPassword := runtime.GetStringDefault("users", "local_adminPassword", ""); adminPassword != "" && db.Len() == 0 {
+		adminUserid := runtime.GetStringDefault("users", "local_adminUserid", "admin")
+		if _, err = uh.Register(adminUserid, adminPassword, "", []string{uh.adminRole}); err != nil {
+			return nil, fmt.Errorf("Cannot create local admin user: %s", err)
+		}
+		log.Printf("Created local admin user %s\n", adminUserid)
+	}
+
+	return uh, nil
+}
+
+func (uh *UsersLocalHandler) hashPassword(password string) (string, error) {
+	if len(password) < uh.minPasswordLength {
+		return "", fmt.Errorf("password must have at least %d characters", uh.minPasswordLength)
+	}
+	// bcrypt only uses the first 72 bytes.
+	if len(password) > 72 {
+		return "", errors.New("password is too long")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), uh.bcryptCost)
+	return string(hash), err
+}
+
+// Register creates a new user.
+func (uh *UsersLocalHandler) Register(userid, password, displayName string, roles []string) (*LocalUser, error) {
+	if !localUseridPattern.MatchString(userid) {
+		return nil, errLocalUserInvalidUserid
+	}
+	if err := validateLocalUserProfile(displayName, ""); err != nil {
+		return nil, err
+	}
+	hash, err := uh.hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	if roles == nil {
+		roles = uh.defaultRoles
+	}
+	user := &LocalUser{
+		Userid:       userid,
+		DisplayName:  displayName,
+		Roles:        roles,
+		PasswordHash: hash,
+	}
+	if err = uh.db.Add(user); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Local user registered %s\n", userid)
+	return user.public(), nil
+}
+
+// Login checks the password and returns the identity of the user.
+func (uh *UsersLocalHandler) Login(userid, password string) (*UserIdentity, error) {
+	user, ok := uh.db.Get(userid)
+	hash := uh.dummyHash
+	if ok {
+		hash = []byte(user.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return nil, errLocalUserInvalidLogin
+	}
+	if user.Disabled {
+		return nil, errLocalUserDisabled
+	}
+
+	return &UserIdentity{Userid: user.Userid, DisplayName: user.DisplayName, Roles: user.Roles}, nil
+}
+
+// ChangePassword sets a new password after checking the current one.
+func (uh *UsersLocalHandler) ChangePassword(userid, password, newPassword string) error {
+	if _, err := uh.Login(userid, password); err != nil {
+		return err
+	}
+	hash, err := uh.hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	_, err = uh.db.Update(userid, func(user *LocalUser) error {
+		user.PasswordHash = hash
+		return nil
+	})
+	return err
+}
+
+func (uh *UsersLocalHandler) Get(request *http.Request) (userid string, err error) {
+	return
+}
+
+func (uh *UsersLocalHandler) Validate(snr *SessionNonceRequest, request *http.Request) (string, error) {
+	identity, err := uh.ValidateIdentity(snr, request)
+	if err != nil {
+		return "", err
+	}
+	return identity.Userid, nil
+}
+
+func (uh *UsersLocalHandler) Create(un *UserNonce, request *http.Request) (*UserNonce, error) {
+	return nil, errors.New("create is not possible in local mode, use register")
+}
+
+// UserExists returns true when the user is in the database and not
+// disabled.
+func (uh *UsersLocalHandler) UserExists(userid string) bool {
+	user, ok := uh.db.Get(userid)
+	return ok && !user.Disabled
+}
+
+func (uh *UsersLocalHandler) GetIdentity(request *http.Request) (*UserIdentity, error) {
+	return nil, nil
+}
+
+// ValidateIdentity logs in with the userid as useridcombo and the password
+// as secret.
+func (uh *UsersLocalHandler) ValidateIdentity(snr *SessionNonceRequest, request *http.Request) (*UserIdentity, error) {
+	return uh.Login(snr.UseridCombo, snr.Secret)
+}
+
+func validateLocalUserProfile(displayName, avatar string) error {
+	if len(displayName) > localUserMaxDisplayName {
+		return errors.New("display name is too long")
+	}
+	if len(avatar) > localUserMaxAvatar {
+		return errors.New("avatar is too large")
+	}
+	return nil
+}
+
+// LocalUserRequest is the request of the local users end points.
+type LocalUserRequest struct {
+	Id          string    `json:"id"`  // Public session id.
+	Sid         string    `json:"sid"` // Private session id.
+	Userid      string    `json:"userid"`
+	Password    string    `json:"password"`
+	NewPassword string    `json:"newPassword"`
+	DisplayName string    `json:"displayName"`
+	Avatar      *string   `json:"avatar"`
+	Roles       *[]string `json:"roles"`
+	Disabled    *bool     `json:"disabled"`
+}
+
+// LocalUsers provides registration, login and password changes of the
+// local users mode.
+type LocalUsers struct {
+	Users        *Users
+	Handler      *UsersLocalHandler
+	Registration bool
+	Config       *channelling.Config
+}
+
+func (lu *LocalUsers) Post(request *http.Request) (int, interface{}, http.Header) {
+	var lur LocalUserRequest
+	if err := json.NewDecoder(request.Body).Decode(&lur); err != nil {
+		return 400, NewApiError("users_bad_request", "Failed to parse request"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	switch mux.Vars(request)["action"] {
+	case "register":
+		if !lu.Registration {
+			return 403, NewApiError("users_registration_disabled", "Registration is disabled"), http.Header{"Content-Type": {"application/json"}}
+		}
+		_, err := lu.Handler.Register(lur.Userid, lur.Password, lur.DisplayName, nil)
+		lu.Config.Audit(auditEvent(request, "users.register", lur.Userid, lur.Userid, err))
+		if err != nil {
+			code := "users_register_failed"
+			if err == errLocalUserExists {
+				code = "users_exists"
+			}
+			return 400, NewApiError(code, fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+		}
+		return lu.login(request, &lur)
+	case "login":
+		return lu.login(request, &lur)
+	case "password":
+		err := lu.Handler.ChangePassword(lur.Userid, lur.Password, lur.NewPassword)
+		lu.Config.Audit(auditEvent(request, "users.password", lur.Userid, lur.Userid, err))
+		if err != nil {
+			log.Println("Local user password change failed", lur.Userid, err)
+			return 403, NewApiError("users_password_failed", fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+		}
+		return 200, &struct {
+			Success bool `json:"success"`
+		}{true}, http.Header{"Content-Type": {"application/json"}}
+	}
+
+	return 404, NewApiError("users_unknown_action", "Unknown action"), http.Header{"Content-Type": {"application/json"}}
+}
+
+// login authorizes the session of the request and returns the nonce for
+// the Authentication channelling message.
+func (lu *LocalUsers) login(request *http.Request, lur *LocalUserRequest) (int, interface{}, http.Header) {
+	// Do this before session validation to avoid timing information.
+	identity, err := lu.Handler.Login(lur.Userid, lur.Password)
+
+	if !lu.Users.ValidateSession(lur.Id, lur.Sid) {
+		lu.audit(request, lur, errors.New("invalid session"))
+		return 403, NewApiError("users_invalid_session", "Invalid session"), http.Header{"Content-Type": {"application/json"}}
+	}
+	if err != nil {
+		log.Println("Local user login failed", lur.Userid, err)
+		lu.audit(request, lur, err)
+		return 403, NewApiError("users_login_failed", "Invalid userid or password"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var nonce string
+	if session, ok := lu.Users.SessionStore.GetSession(lur.Id); ok {
+		nonce, err = session.Authorize(lu.Users.Realm(), &channelling.SessionToken{
+			Id:          lur.Id,
+			Sid:         lur.Sid,
+			Userid:      identity.Userid,
+			Roles:       identity.Roles,
+			DisplayName: identity.DisplayName,
+		})
+	} else {
+		err = errors.New("no such session")
+	}
+	lu.audit(request, lur, err)
+	if err != nil {
+		return 400, NewApiError("users_request_failed", fmt.Sprintf("Error: %q", err)), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	log.Printf("Local user login successfull %s -> %s\n", lur.Id, identity.Userid)
+	return 200, &SessionNonce{Nonce: nonce, Userid: identity.Userid, Success: true}, http.Header{"Content-Type": {"application/json"}}
+}
+
+func (lu *LocalUsers) audit(request *http.Request, lur *LocalUserRequest, err error) {
+	event := auditEvent(request, "users.login", lur.Userid, "", err)
+	event.Session = lur.Id
+	lu.Config.Audit(event)
+}
+
+// LocalUsersAdmin manages the local users. Requests must pass id and sid
+// of a session whose user has the admin role in the X-Session-Id and
+// X-Session-Sid headers. With a policy, the admin permission for users is
+// required instead. Deleted and disabled users are revoked.
+type LocalUsersAdmin struct {
+	Users   *Users
+	Handler *UsersLocalHandler
+	Config  *channelling.Config
+}
+
+func (admin *LocalUsersAdmin) authorize(request *http.Request) bool {
+	if admin.allowed(request) {
+		return true
+	}
+	admin.audit(request, "users.admin", "", errNotAllowed)
+	return false
+}
+
+func (admin *LocalUsersAdmin) allowed(request *http.Request) bool {
+	id, sid := request.Header.Get("X-Session-Id"), request.Header.Get("X-Session-Sid")
+	if !admin.Users.ValidateSession(id, sid) {
+		return false
+	}
+	session, ok := admin.Users.SessionStore.GetSession(id)
+	if !ok || session.Userid() == "" {
+		return false
+	}
+	if admin.Config != nil && admin.Config.Policy != nil {
+		return admin.Config.Allowed(session, channelling.PermissionAdmin, "users")
+	}
+	return session.HasRole(admin.Handler.adminRole)
+}
+
+// audit records an admin action with the user of the admin session as
+// actor.
+func (admin *LocalUsersAdmin) audit(request *http.Request, action, userid string, err error) {
+	var actor string
+	if session, ok := admin.Users.SessionStore.GetSession(request.Header.Get("X-Session-Id")); ok {
+		actor = session.Userid()
+	}
+	admin.Config.Audit(auditEvent(request, action, actor, userid, err))
+}
+
+func (admin *LocalUsersAdmin) Get(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("users_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	userid := mux.Vars(request)["userid"]
+	if userid == "" {
+		return 200, admin.Handler.db.List(), http.Header{"Content-Type": {"application/json"}}
+	}
+	user, ok := admin.Handler.db.Get(userid)
+	if !ok {
+		return 404, NewApiError("users_unknown", "Unknown user"), http.Header{"Content-Type": {"application/json"}}
+	}
+	return 200, user.public(), http.Header{"Content-Type": {"application/json"}}
+}
+
+// Post creates a user.
+func (admin *LocalUsersAdmin) Post(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("users_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var lur LocalUserRequest
+	if err := json.NewDecoder(request.Body).Decode(&lur); err != nil {
+		return 400, NewApiError("users_bad_request", "Failed to parse request"), http.Header{"Content-Type": {"application/json"}}
+	}
+	var roles []string
+	if lur.Roles != nil {
+		roles = *lur.Roles
+	}
+	user, err := admin.Handler.Register(lur.Userid, lur.Password, lur.DisplayName, roles)
+	if err == nil && (lur.Avatar != nil || lur.Disabled != nil) {
+		user, err = admin.update(lur.Userid, &lur)
+	}
+	admin.audit(request, "users.create", lur.Userid, err)
+	if err != nil {
+		return 400, NewApiError("users_create_failed", fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+	}
+	return 200, user, http.Header{"Content-Type": {"application/json"}}
+}
+
+// Patch changes profile, roles, disabled flag or password of a user.
+func (admin *LocalUsersAdmin) Patch(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("users_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	var lur LocalUserRequest
+	if err := json.NewDecoder(request.Body).Decode(&lur); err != nil {
+		return 400, NewApiError("users_bad_request", "Failed to parse request"), http.Header{"Content-Type": {"application/json"}}
+	}
+	user, err := admin.update(mux.Vars(request)["userid"], &lur)
+	admin.audit(request, "users.update", mux.Vars(request)["userid"], err)
+	if err == nil && user.Disabled {
+		admin.Users.RevokeUser(user.Userid)
+	}
+	if err == errLocalUserUnknown {
+		return 404, NewApiError("users_unknown", "Unknown user"), http.Header{"Content-Type": {"application/json"}}
+	} else if err != nil {
+		return 400, NewApiError("users_update_failed", fmt.Sprintf("Error: %s", err)), http.Header{"Content-Type": {"application/json"}}
+	}
+	return 200, user, http.Header{"Content-Type": {"application/json"}}
+}
+
+func (admin *LocalUsersAdmin) Delete(request *http.Request) (int, interface{}, http.Header) {
+	if !admin.authorize(request) {
+		return 403, NewApiError("users_not_allowed", "Not allowed"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	err := admin.Handler.db.Delete(mux.Vars(request)["userid"])
+	admin.audit(request, "users.delete", mux.Vars(request)["userid"], err)
+	if err != nil {
+		return 404, NewApiError("users_unknown", "Unknown user"), http.Header{"Content-Type": {"application/json"}}
+	}
+	admin.Users.RevokeUser(mux.Vars(request)["userid"])
+	return 200, &struct {
+		Success bool `json:"success"`
+	}{true}, http.Header{"Content-Type": {"application/json"}}
+}
+
+func (admin *LocalUsersAdmin) update(userid string, lur *LocalUserRequest) (*LocalUser, error) {
+	var hash string
+	if lur.NewPassword != "" {
+		var err error
+		if hash, err = admin.Handler.hashPassword(lur.NewPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	return admin.Handler.db.Update(userid, func(user *LocalUser) error {
+		if lur.DisplayName != "" {
+			user.DisplayName = lur.DisplayName
+		}
+		if lur.Avatar != nil {
+			user.Avatar = *lur.Avatar
+		}
+		if err := validateLocalUserProfile(user.DisplayName, user.Avatar); err != nil {
+			return err
+		}
+		if lur.Roles != nil {
+			user.Roles = *lur.Roles
+		}
+		if lur.Disabled != nil {
+			user.Disabled = *lur.Disabled
+		}
+		if hash != "" {
+			user.PasswordHash = hash
+		}
+		return nil
+	})
+}
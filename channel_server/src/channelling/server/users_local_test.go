@@ -0,0 +1,81 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestLocalHandler(t *testing.T, filename string) *UsersLocalHandler {
+	db, err := newLocalUsersDatabase(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.MinCost)
+	return &UsersLocalHandler{
+		db:                db,
+		bcryptCost:        bcrypt.MinCost,
+		minPasswordLength: 8,
+		adminRole:         "admin",
+		dummyHash:         dummyHash,
+	}
+}
+
+func Test_UsersLocalHandler_RegisterAndLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "users.json")
+
+	uh := newTestLocalHandler(t, filename)
+	if _, err := uh.Register("player-1", "short", "", nil); err == nil {
+		t.Error("Expected short password to fail")
+	}
+	if _, err := uh.Register("x", "password-1", "", nil); err != errLocalUserInvalidUserid {
+		t.Errorf("Expected invalid userid, but got %v", err)
+	}
+	user, err := uh.Register("player-1", "password-1", "Player One", []string{"moderator"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if user.PasswordHash != "" {
+		t.Error("Expected password hash not to be returned")
+	}
+	if _, err := uh.Register("player-1", "password-2", "", nil); err != errLocalUserExists {
+		t.Errorf("Expected user to exist, but got %v", err)
+	}
+
+	// Load the database again from disk.
+	uh = newTestLocalHandler(t, filename)
+	identity, err := uh.ValidateIdentity(&SessionNonceRequest{UseridCombo: "player-1", Secret: "password-1"}, nil)
+	if err != nil || identity.Userid != "player-1" || identity.DisplayName != "Player One" || len(identity.Roles) != 1 {
+		t.Errorf("Unexpected identity %+v %v", identity, err)
+	}
+	if _, err := uh.Login("player-1", "password-2"); err != errLocalUserInvalidLogin {
+		t.Errorf("Expected invalid login, but got %v", err)
+	}
+	if _, err := uh.Login("player-2", "password-1"); err != errLocalUserInvalidLogin {
+		t.Errorf("Expected invalid login, but got %v", err)
+	}
+
+	if err := uh.ChangePassword("player-1", "password-1", "password-2"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := uh.Login("player-1", "password-2"); err != nil {
+		t.Errorf("Expected login with new password, but got %v", err)
+	}
+
+	disabled := true
+	admin := &LocalUsersAdmin{Handler: uh}
+	if _, err := admin.update("player-1", &LocalUserRequest{Disabled: &disabled}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := uh.Login("player-1", "password-2"); err != errLocalUserDisabled {
+		t.Errorf("Expected disabled user, but got %v", err)
+	}
+}
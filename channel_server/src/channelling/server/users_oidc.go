@@ -0,0 +1,522 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"channelling"
+
+	"github.com/strukturag/phoenix"
+)
+
+const (
+	oidcLoginTimeout    = 10 * time.Minute
+	oidcRefreshInterval = 30 * time.Second
+	oidcRefreshBefore   = 2 * time.Minute
+	oidcJWKSMaxAge      = 10 * time.Minute
+	oidcHTTPTimeout     = 10 * time.Second
+)
+
+// oidcDiscovery is the part of the OpenID provider metadata we need.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IDToken      string `json:"id_token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// oidcLogin is a started login waiting for the callback.
+type oidcLogin struct {
+	id       string
+	sid      string
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+// oidcIdentity is an authorized identity which is refreshed while its
+// session lives.
+type oidcIdentity struct {
+	userid       string
+	refreshToken string
+	expires      time.Time
+}
+
+// jwksURL is a JSON Web Key Set fetched from an URL and refreshed
+// periodically.
+type jwksURL struct {
+	sync.Mutex
+	url     string
+	client  *http.Client
+	fetched time.Time
+	keys    []*jwtKey
+}
+
+func (j *jwksURL) Keys() []*jwtKey {
+	j.Lock()
+	defer j.Unlock()
+
+	if time.Since(j.fetched) < oidcJWKSMaxAge {
+		return j.keys
+	}
+	j.fetched = time.Now()
+
+	response, err := j.client.Get(j.url)
+	if err != nil {
+		log.Println("Failed to fetch JWKS", j.url, err)
+		return j.keys
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err == nil && response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	if err == nil {
+		var keys []*jwtKey
+		if keys, err = parseJWKS(data); err == nil {
+			j.keys = keys
+		}
+	}
+	if err != nil {
+		log.Println("Failed to load JWKS", j.url, err)
+	}
+
+	return j.keys
+}
+
+// UsersOIDCHandler authenticates users with the OpenID Connect
+// authorization code flow with PKCE.
+type UsersOIDCHandler struct {
+	sync.Mutex
+	users            *Users
+	client           *http.Client
+	issuer           string
+	discoveryURL     string
+	discovery        *oidcDiscovery
+	jwksFilename     string
+	clientID         string
+	clientSecret     string
+	redirectURL      string
+	scopes           string
+	useridClaim      string
+	displayNameClaim string
+	rolesClaim       string
+	verifier         *jwtVerifier
+	logins           map[string]*oidcLogin
+	identities       map[string]*oidcIdentity
+}
+
+func newUsersOIDCHandler(users *Users, runtime phoenix.Runtime) (*UsersOIDCHandler, error) {
+	uh := &UsersOIDCHandler{
+		users:            users,
+		client:           &http.Client{Timeout: oidcHTTPTimeout},
+		issuer:           strings.TrimSuffix(runtime.GetStringDefault("users", "oidc_issuer", ""), "/"),
+		discoveryURL:     runtime.GetStringDefault("users", "oidc_discovery", ""),
+		jwksFilename:     runtime.GetStringDefault("users", "oidc_jwks", ""),
+		clientID:         runtime.GetStringDefault("users", "oidc_clientId", ""),
+		clientSecret:     runtime.GetStringDefault("users", "oidc_clientSecret", ""),
+		redirectURL:      runtime.GetStringDefault("users", "oidc_redirectURL", ""),
+		scopes:           runtime.GetStringDefault("users", "oidc_scopes", "openid profile"),
+		useridClaim:      runtime.GetStringDefault("users", "oidc_useridClaim", "sub"),
+		displayNameClaim: runtime.GetStringDefault("users", "oidc_displayNameClaim", "name"),
+		rolesClaim:       runtime.GetStringDefault("users", "oidc_rolesClaim", "roles"),
+		logins:           make(map[string]*oidcLogin),
+		identities:       make(map[string]*oidcIdentity),
+	}
+	if uh.issuer == "" || uh.clientID == "" || uh.redirectURL == "" {
+		return nil, errors.New("Cannot enable oidc users handler: issuer, clientId and redirectURL are required.")
+	}
+	if uh.discoveryURL == "" {
+		uh.discoveryURL = fmt.Sprintf("%s/.well-known/openid-configuration", uh.issuer)
+	}
+
+	uh.verifier = &jwtVerifier{
+		algorithms: map[string]bool{"RS256": true, "ES256": true},
+		audience:   uh.clientID,
+		issuer:     uh.issuer,
+		leeway:     time.Duration(getIntDefault(runtime, "users", "oidc_leeway", 60)) * time.Second,
+		requireExp: true,
+	}
+	if uh.clientSecret != "" {
+		// ID tokens might be signed with the client secret.
+		uh.verifier.algorithms["HS256"] = true
+		uh.verifier.keys = append(uh.verifier.keys, &jwtKey{Alg: "HS256", Key: []byte(uh.clientSecret)})
+	}
+	if uh.jwksFilename != "" {
+		uh.verifier.jwks = &jwksFile{filename: uh.jwksFilename}
+	}
+
+	go func() {
+		for _ = range time.Tick(oidcRefreshInterval) {
+			uh.refresh()
+		}
+	}()
+
+	return uh, nil
+}
+
+// getDiscovery loads the discovery document from the configured URL or
+// file once.
+func (uh *UsersOIDCHandler) getDiscovery() (*oidcDiscovery, error) {
+	uh.Lock()
+	defer uh.Unlock()
+	if uh.discovery != nil {
+		return uh.discovery, nil
+	}
+
+	var data []byte
+	var err error
+	if strings.HasPrefix(uh.discoveryURL, "http://") || strings.HasPrefix(uh.discoveryURL, "https://") {
+		var response *http.Response
+		if response, err = uh.client.Get(uh.discoveryURL); err == nil {
+			data, err = ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if err == nil && response.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status %d", response.StatusCode)
+			}
+		}
+	} else {
+		data, err = ioutil.ReadFile(uh.discoveryURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load discovery document: %s", err)
+	}
+
+	discovery := &oidcDiscovery{}
+	if err = json.Unmarshal(data, discovery); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %s", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != uh.issuer {
+		return nil, fmt.Errorf("discovery issuer %s does not match", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" {
+		return nil, errors.New("discovery document without endpoints")
+	}
+	if uh.verifier.keySource() == nil {
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("discovery document without jwks_uri")
+		}
+		uh.verifier.setKeySource(&jwksURL{url: discovery.JWKSURI, client: uh.client})
+	}
+	uh.discovery = discovery
+
+	return discovery, nil
+}
+
+// AuthorizationURL starts a login for the session and returns the URL to
+// redirect the browser to.
+func (uh *UsersOIDCHandler) AuthorizationURL(id, sid string) (string, error) {
+	discovery, err := uh.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	login := &oidcLogin{
+		id:       id,
+		sid:      sid,
+		verifier: randomOIDCString(),
+		nonce:    randomOIDCString(),
+		expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	state := randomOIDCString()
+	challenge := sha256.Sum256([]byte(login.verifier))
+
+	uh.Lock()
+	uh.logins[state] = login
+	uh.Unlock()
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {uh.clientID},
+		"redirect_uri":          {uh.redirectURL},
+		"scope":                 {uh.scopes},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Callback finishes the login with the state and code from the callback and
+// returns the authorized userid and session nonce.
+func (uh *UsersOIDCHandler) Callback(state, code string) (*SessionNonce, error) {
+	uh.Lock()
+	login, ok := uh.logins[state]
+	delete(uh.logins, state)
+	uh.Unlock()
+	if !ok || login.expires.Before(time.Now()) {
+		return nil, errors.New("unknown or expired login")
+	}
+
+	token, err := uh.requestToken(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {uh.redirectURL},
+		"code_verifier": {login.verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, err := uh.verifier.Verify(token.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %s", err)
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	identity, err := newUserIdentity(claims, uh.useridClaim, uh.displayNameClaim, uh.rolesClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	if !uh.users.ValidateSession(login.id, login.sid) {
+		return nil, errors.New("invalid session")
+	}
+	session, ok := uh.users.SessionStore.GetSession(login.id)
+	if !ok {
+		return nil, errors.New("no such session")
+	}
+	nonce, err := session.Authorize(uh.users.realm, &channelling.SessionToken{
+		Id:          login.id,
+		Sid:         login.sid,
+		Userid:      identity.Userid,
+		Roles:       identity.Roles,
+		DisplayName: identity.DisplayName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if token.RefreshToken != "" {
+		uh.Lock()
+		uh.identities[login.id] = &oidcIdentity{
+			userid:       identity.Userid,
+			refreshToken: token.RefreshToken,
+			expires:      tokenExpiration(token, claims),
+		}
+		uh.Unlock()
+	}
+
+	log.Printf("OIDC login successfull %s -> %s\n", login.id, identity.Userid)
+	return &SessionNonce{Nonce: nonce, Userid: identity.Userid, Success: true}, nil
+}
+
+func (uh *UsersOIDCHandler) requestToken(form url.Values) (*oidcTokenResponse, error) {
+	discovery, err := uh.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form.Set("client_id", uh.clientID)
+	if uh.clientSecret != "" {
+		form.Set("client_secret", uh.clientSecret)
+	}
+	response, err := uh.client.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %s", err)
+	}
+	defer response.Body.Close()
+
+	token := &oidcTokenResponse{}
+	if err = json.NewDecoder(response.Body).Decode(token); err != nil {
+		return nil, fmt.Errorf("invalid token response: %s", err)
+	}
+	if response.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("token request failed with status %d: %s", response.StatusCode, token.Error)
+	}
+	if token.IDToken == "" && form.Get("grant_type") == "authorization_code" {
+		return nil, errors.New("token response without id token")
+	}
+
+	return token, nil
+}
+
+// refresh refreshes identities which are about to expire and forgets the
+// logins and identities which are no longer needed.
+func (uh *UsersOIDCHandler) refresh() {
+	now := time.Now()
+	expiring := make(map[string]*oidcIdentity)
+	uh.Lock()
+	for state, login := range uh.logins {
+		if login.expires.Before(now) {
+			delete(uh.logins, state)
+		}
+	}
+	for id, identity := range uh.identities {
+		if _, ok := uh.users.SessionStore.GetSession(id); !ok {
+			delete(uh.identities, id)
+		} else if identity.expires.Sub(now) < oidcRefreshBefore {
+			expiring[id] = identity
+		}
+	}
+	uh.Unlock()
+
+	for id, identity := range expiring {
+		uh.refreshIdentity(id, identity)
+	}
+}
+
+func (uh *UsersOIDCHandler) refreshIdentity(id string, identity *oidcIdentity) {
+	session, ok := uh.users.SessionStore.GetSession(id)
+	if !ok {
+		return
+	}
+
+	token, err := uh.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {identity.refreshToken},
+	})
+	var refreshed *UserIdentity
+	var claims map[string]interface{}
+	if err == nil && token.IDToken != "" {
+		if claims, err = uh.verifier.Verify(token.IDToken); err == nil {
+			if refreshed, err = newUserIdentity(claims, uh.useridClaim, uh.displayNameClaim, uh.rolesClaim); err == nil && refreshed.Userid != identity.userid {
+				err = errors.New("refreshed identity has another userid")
+			}
+		}
+	}
+	if err != nil {
+		// Identity is gone, revoke the roles it granted and its tokens.
+		log.Printf("OIDC refresh failed for %s: %s\n", identity.userid, err)
+		uh.users.Revoke(session, identity.userid)
+		uh.Lock()
+		delete(uh.identities, id)
+		uh.Unlock()
+		return
+	}
+
+	uh.Lock()
+	if token.RefreshToken != "" {
+		identity.refreshToken = token.RefreshToken
+	}
+	identity.expires = tokenExpiration(token, claims)
+	uh.Unlock()
+	if refreshed != nil && session.Userid() == identity.userid {
+		session.SetRoles(refreshed.Roles)
+	}
+}
+
+func (uh *UsersOIDCHandler) Get(request *http.Request) (userid string, err error) {
+	return
+}
+
+func (uh *UsersOIDCHandler) Validate(snr *SessionNonceRequest, request *http.Request) (string, error) {
+	return "", errors.New("validate is not possible in oidc mode, use the login flow")
+}
+
+func (uh *UsersOIDCHandler) Create(un *UserNonce, request *http.Request) (*UserNonce, error) {
+	return nil, errors.New("create is not possible in oidc mode")
+}
+
+// tokenExpiration returns when the identity of the token expires.
+func tokenExpiration(token *oidcTokenResponse, claims map[string]interface{}) time.Time {
+	if exp, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0)
+	}
+	if token.ExpiresIn > 0 {
+		return time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	return time.Now().Add(time.Hour)
+}
+
+func randomOIDCString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// OIDCLogin starts the OpenID Connect login for a session.
+type OIDCLogin struct {
+	Users   *Users
+	Handler *UsersOIDCHandler
+}
+
+func (login *OIDCLogin) Post(request *http.Request) (int, interface{}, http.Header) {
+	var snr SessionNonceRequest
+	if err := json.NewDecoder(request.Body).Decode(&snr); err != nil || snr.Id == "" || snr.Sid == "" {
+		return 400, NewApiError("oidc_bad_request", "Failed to parse request"), http.Header{"Content-Type": {"application/json"}}
+	}
+	if !login.Users.ValidateSession(snr.Id, snr.Sid) {
+		return 403, NewApiError("oidc_invalid_session", "Invalid session"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	authorizationURL, err := login.Handler.AuthorizationURL(snr.Id, snr.Sid)
+	if err != nil {
+		log.Println("OIDC login failed", err)
+		return 502, NewApiError("oidc_unavailable", "Identity provider is not available"), http.Header{"Content-Type": {"application/json"}}
+	}
+
+	return 200, &struct {
+		Success bool   `json:"success"`
+		URL     string `json:"url"`
+	}{true, authorizationURL}, http.Header{"Content-Type": {"application/json"}}
+}
+
+// OIDCCallback is the redirect target of the identity provider.
+type OIDCCallback struct {
+	Handler *UsersOIDCHandler
+	Config  *channelling.Config
+}
+
+func (callback *OIDCCallback) Get(request *http.Request) (int, interface{}, http.Header) {
+	query := request.URL.Query()
+	var result interface{}
+	status := 200
+	if errorCode := query.Get("error"); errorCode != "" {
+		status, result = 403, NewApiError("oidc_login_failed", errorCode)
+		callback.Config.Audit(auditEvent(request, "users.oidc.login", "", "", errors.New(errorCode)))
+	} else if nonce, err := callback.Handler.Callback(query.Get("state"), query.Get("code")); err != nil {
+		log.Println("OIDC callback failed", err)
+		status, result = 403, NewApiError("oidc_login_failed", "Failed to login")
+		callback.Config.Audit(auditEvent(request, "users.oidc.login", "", "", err))
+	} else {
+		result = nonce
+		callback.Config.Audit(auditEvent(request, "users.oidc.login", nonce.Userid, "", nil))
+	}
+
+	if strings.HasPrefix(request.Header.Get("Accept"), "application/json") {
+		return status, result, http.Header{"Content-Type": {"application/json"}}
+	}
+
+	// Pass the result to the window which opened the login.
+	data, _ := json.Marshal(result)
+	page := fmt.Sprintf(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Login</title></head><body><script>
+var result = %s;
+if (window.opener) {
+	window.opener.postMessage({"type": "oidc", "oidc": result}, window.location.origin);
+	window.close();
+}
+</script></body></html>
+`, data)
+	return status, []byte(page), http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"channelling"
+
+	"github.com/gorilla/securecookie"
+)
+
+type fakeOIDCSessions struct {
+	session *channelling.Session
+}
+
+func (fake *fakeOIDCSessions) GetSession(id string) (*channelling.Session, bool) {
+	if fake.session != nil && fake.session.Id == id {
+		return fake.session, true
+	}
+	return nil, false
+}
+
+func (fake *fakeOIDCSessions) ValidateSession(id, sid string) bool {
+	return fake.session != nil && fake.session.Id == id && fake.session.Sid == sid
+}
+
+func (fake *fakeOIDCSessions) Realm() string {
+	return "test"
+}
+
+func Test_UsersOIDCHandler_LoginWithMockIssuer(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issuer, challenge, nonce string
+	signIDToken := func(claims map[string]interface{}) string {
+		return encodeTestJWT(t, "ES256", claims, func(data []byte) []byte {
+			hashed := sha256.Sum256(data)
+			r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashed[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			signature := make([]byte, 64)
+			rBytes, sBytes := r.Bytes(), s.Bytes()
+			copy(signature[32-len(rBytes):32], rBytes)
+			copy(signature[64-len(sBytes):], sBytes)
+			return signature
+		})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/authorize",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(privateKey.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(privateKey.Y.Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verified := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "code-1" || base64.RawURLEncoding.EncodeToString(verified[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id_token": signIDToken(map[string]interface{}{
+				"iss":   issuer,
+				"sub":   "player-1",
+				"name":  "Player One",
+				"aud":   "rtn",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"nonce": nonce,
+				"roles": []string{"moderator"},
+			}),
+			"refresh_token": "refresh-1",
+		})
+	})
+	issuerServer := httptest.NewServer(mux)
+	defer issuerServer.Close()
+	issuer = issuerServer.URL
+
+	session := channelling.NewSession(nil, nil, nil, nil, nil, securecookie.New(securecookie.GenerateRandomKey(64), nil), "id-1", "sid-1")
+	sessions := &fakeOIDCSessions{session}
+	uh := &UsersOIDCHandler{
+		users:            &Users{SessionStore: sessions, SessionValidator: sessions, realm: "test"},
+		client:           issuerServer.Client(),
+		issuer:           issuer,
+		discoveryURL:     issuer + "/.well-known/openid-configuration",
+		clientID:         "rtn",
+		redirectURL:      "https://rtn.example.com/api/v1/oidc/callback",
+		scopes:           "openid profile",
+		useridClaim:      "sub",
+		displayNameClaim: "name",
+		rolesClaim:       "roles",
+		verifier: &jwtVerifier{
+			algorithms: map[string]bool{"ES256": true},
+			audience:   "rtn",
+			issuer:     issuer,
+			leeway:     time.Minute,
+			requireExp: true,
+		},
+		logins:     make(map[string]*oidcLogin),
+		identities: make(map[string]*oidcIdentity),
+	}
+
+	authorizationURL, err := uh.AuthorizationURL("id-1", "sid-1")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	parsed, _ := url.Parse(authorizationURL)
+	query := parsed.Query()
+	if parsed.Path != "/authorize" || query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "rtn" {
+		t.Fatalf("Unexpected authorization URL %s", authorizationURL)
+	}
+	challenge, nonce = query.Get("code_challenge"), query.Get("nonce")
+
+	if _, err := uh.Callback("unknown-state", "code-1"); err == nil {
+		t.Error("Expected unknown state to fail")
+	}
+
+	sessionNonce, err := uh.Callback(query.Get("state"), "code-1")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessionNonce.Userid != "player-1" || sessionNonce.Nonce == "" {
+		t.Errorf("Unexpected session nonce %+v", sessionNonce)
+	}
+	if identity, ok := uh.identities["id-1"]; !ok || identity.refreshToken != "refresh-1" {
+		t.Errorf("Expected identity to be refreshable, but got %+v", identity)
+	}
+
+	if _, err := uh.Callback(query.Get("state"), "code-1"); err == nil {
+		t.Error("Expected state to be usable only once")
+	}
+}
+
+func Test_UsersOIDCHandler_RefreshFailureRevokesIdentity(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+	})
+	issuerServer := httptest.NewServer(mux)
+	defer issuerServer.Close()
+
+	secret := securecookie.GenerateRandomKey(32)
+	tickets := channelling.NewTickets(secret, secret, "test")
+	sessionManager := channelling.NewSessionManager(&channelling.Config{}, tickets, nil, nil, nil, nil, secret)
+	st := tickets.DecodeSessionToken("")
+	session := sessionManager.CreateSession(st, "")
+	sessions := &fakeOIDCSessions{session}
+	uh := &UsersOIDCHandler{
+		users:      &Users{SessionStore: sessions, SessionValidator: sessions, SessionManager: sessionManager, realm: "test"},
+		client:     issuerServer.Client(),
+		discovery:  &oidcDiscovery{TokenEndpoint: issuerServer.URL + "/token"},
+		identities: make(map[string]*oidcIdentity),
+	}
+
+	// Authorized, but the nonce has not been used yet.
+	if _, err := session.Authorize(tickets.Realm(), &channelling.SessionToken{Id: st.Id, Sid: st.Sid, Userid: "player-1", Roles: []string{"moderator"}}); err != nil {
+		t.Fatal(err)
+	}
+	uh.refreshIdentity(st.Id, &oidcIdentity{userid: "player-1", refreshToken: "refresh-1"})
+
+	if session.Nonce != "" || len(session.Roles()) != 0 {
+		t.Errorf("Expected nonce and roles to be revoked, but got %q %v", session.Nonce, session.Roles())
+	}
+	reconnected := sessionManager.CreateSession(&channelling.SessionToken{Id: st.Id, Sid: st.Sid, Userid: "player-1", Roles: []string{"moderator"}}, "player-1")
+	if userid := reconnected.Userid(); userid != "" {
+		t.Errorf("Expected session token of revoked user to be rejected, but got %s", userid)
+	}
+}
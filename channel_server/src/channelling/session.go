@@ -28,6 +28,15 @@ type Session struct {
 	Roomid            string
 	mutex             sync.RWMutex
 	userid            string
+	roles             []string
+	displayName       string
+	authorized        *SessionToken
+	deviceID          string
+	capabilities      []string
+	remoteAddr        string
+	region            string
+	transports        []string
+	iceServers        string
 	fake              bool
 	stamp             int64
 	attestation       *SessionAttestation
@@ -162,6 +171,15 @@ func (s *Session) LeaveRoom() {
 	s.doLeaveRoom("soft")
 }
 
+// CurrentRoom returns the id of the current room and true, or false when
+// the session has not joined a room.
+func (s *Session) CurrentRoom() (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.Roomid, s.Hello
+}
+
 func (s *Session) Broadcast(m interface{}) {
 	s.mutex.RLock()
 	if s.Hello {
@@ -328,6 +346,8 @@ func (s *Session) Authorize(realm string, st *SessionToken) (string, error) {
 	if err != nil {
 		err = NewDataError("unknown", err.Error())
 	}
+	// Remember roles and display name until the nonce is used.
+	s.authorized = &SessionToken{Userid: st.Userid, Roles: st.Roles, DisplayName: st.DisplayName}
 
 	return s.Nonce, err
 }
@@ -352,11 +372,23 @@ func (s *Session) Authenticate(realm string, st *SessionToken, userid string) er
 		if err != nil {
 			return NewDataError("invalid_session_token", err.Error())
 		}
-		
+
 		if st.Userid != userid {
 			return NewDataError("invalid_session_token", "user id mismatch")
 		}
 		s.Nonce = ""
+		// Never use roles sent by the client, only those authorized.
+		st = s.authorized
+		s.authorized = nil
+		if st == nil || st.Userid != userid {
+			st = &SessionToken{}
+		}
+	}
+	if len(st.Roles) > 0 {
+		s.roles = st.Roles
+	}
+	if st.DisplayName != "" {
+		s.displayName = st.DisplayName
 	}
 
 	s.userid = userid
@@ -366,11 +398,20 @@ func (s *Session) Authenticate(realm string, st *SessionToken, userid string) er
 	return nil
 }
 
+// Revoke forgets the roles and a pending authorization of the session.
+func (s *Session) Revoke() {
+	s.mutex.Lock()
+	s.roles = nil
+	s.Nonce = ""
+	s.authorized = nil
+	s.mutex.Unlock()
+}
+
 func (s *Session) Token() *SessionToken {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	return &SessionToken{Id: s.Id, Sid: s.Sid, Userid: s.userid}
+	return &SessionToken{Id: s.Id, Sid: s.Sid, Userid: s.userid, Roles: s.roles, DisplayName: s.displayName}
 }
 
 func (s *Session) Data() *DataSession {
@@ -378,13 +419,16 @@ func (s *Session) Data() *DataSession {
 	defer s.mutex.RUnlock()
 
 	return &DataSession{
-		Id:     s.Id,
-		Userid: s.userid,
-		Ua:     s.Ua,
-		Status: s.Status,
-		Rev:    s.UpdateRev,
-		Prio:   s.Prio,
-		stamp:  s.stamp,
+		Id:           s.Id,
+		Userid:       s.userid,
+		DisplayName:  s.displayName,
+		DeviceId:     s.deviceID,
+		Capabilities: s.capabilities,
+		Ua:           s.Ua,
+		Status:       s.Status,
+		Rev:          s.UpdateRev,
+		Prio:         s.Prio,
+		stamp:        s.stamp,
 	}
 }
 
@@ -396,6 +440,133 @@ func (s *Session) Userid() (userid string) {
 	return
 }
 
+// DisplayName returns the display name provided by the users handler.
+func (s *Session) DisplayName() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.displayName
+}
+
+// SetRemoteAddr sets the remote address of the connection of the session.
+func (s *Session) SetRemoteAddr(remoteAddr string) {
+	s.mutex.Lock()
+	s.remoteAddr = remoteAddr
+	s.mutex.Unlock()
+}
+
+// RemoteAddr returns the remote address of the connection of the session.
+func (s *Session) RemoteAddr() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.remoteAddr
+}
+
+// SetRegion sets the network region of the session, used to select TURN
+// servers.
+func (s *Session) SetRegion(region string) {
+	s.mutex.Lock()
+	s.region = region
+	s.mutex.Unlock()
+}
+
+// Region returns the network region of the session.
+func (s *Session) Region() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.region
+}
+
+// SetTransports sets the transports the ICE servers of the session are
+// filtered for, empty for all transports.
+func (s *Session) SetTransports(transports []string) {
+	s.mutex.Lock()
+	s.transports = transports
+	s.mutex.Unlock()
+}
+
+// Transports returns the transports of the ICE servers of the session.
+func (s *Session) Transports() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.transports
+}
+
+// SetIceServers remembers the ICE servers sent to the session and returns
+// true when they changed.
+func (s *Session) SetIceServers(iceServers string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changed := s.iceServers != iceServers
+	s.iceServers = iceServers
+	return changed
+}
+
+// SetDevice marks the session as session of the device.
+func (s *Session) SetDevice(deviceID string, capabilities []string) {
+	s.mutex.Lock()
+	s.deviceID = deviceID
+	s.capabilities = capabilities
+	s.mutex.Unlock()
+}
+
+// DeviceId returns the id of the device, or an empty string for sessions
+// which are not device sessions.
+func (s *Session) DeviceId() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.deviceID
+}
+
+// HasCapability returns true if the session is a device session with the
+// capability.
+func (s *Session) HasCapability(capability string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, c := range s.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles returns the roles attached to this session.
+func (s *Session) Roles() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.roles
+}
+
+func (s *Session) SetRoles(roles []string) {
+	s.mutex.Lock()
+	s.roles = roles
+	s.mutex.Unlock()
+}
+
+// HasRole returns true if the session has any of the given roles.
+func (s *Session) HasRole(roles ...string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, role := range roles {
+		for _, r := range s.roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (s *Session) SetUseridFake(userid string) {
 	s.mutex.Lock()
 	s.userid = userid
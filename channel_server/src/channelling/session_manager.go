@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/securecookie"
 	"log"
@@ -20,6 +21,9 @@ type SessionManager interface {
 	SessionCreator
 	DestroySession(sessionID, userID string)
 	Authenticate(*Session, *SessionToken, string) error
+	Revoke(session *Session, userid string)
+	RevokeUser(userid string)
+	UserExists(userid string) bool
 	GetUserSessions(session *Session, id string) []*DataSession
 	DecodeSessionToken(token string) (st *SessionToken)
 }
@@ -35,6 +39,8 @@ type sessionManager struct {
 	userTable            map[string]*User
 	sessionTable         map[string]*Session
 	sessionByUserIDTable map[string]*Session
+	revokedUsers         map[string]time.Time
+	knownUsers           map[string]bool
 	useridRetriever      func(*http.Request) (string, error)
 	attestations         *securecookie.SecureCookie
 }
@@ -51,6 +57,8 @@ func NewSessionManager(config *Config, tickets Tickets, unicaster Unicaster, bro
 		make(map[string]*User),
 		make(map[string]*Session),
 		make(map[string]*Session),
+		make(map[string]time.Time),
+		make(map[string]bool),
 		nil,
 		nil,
 	}
@@ -127,6 +135,14 @@ func (sessionManager *sessionManager) DestroySession(sessionID, userID string) {
 }
 
 func (sessionManager *sessionManager) Authenticate(session *Session, st *SessionToken, userid string) error {
+	if userid != "" {
+		sessionManager.RLock()
+		revoked, ok := sessionManager.revokedUsers[userid]
+		sessionManager.RUnlock()
+		if ok && time.Since(revoked) < sessionTokenMaxAge {
+			return NewDataError("authentication_revoked", "authentication of user has been revoked")
+		}
+	}
 	if err := session.Authenticate(sessionManager.Realm(), st, userid); err != nil {
 		return err
 	}
@@ -136,6 +152,11 @@ func (sessionManager *sessionManager) Authenticate(session *Session, st *Session
 	// Authentication success.
 	suserid := session.Userid()
 	sessionManager.Lock()
+	if userid == "" {
+		// Authorized again with a nonce.
+		delete(sessionManager.revokedUsers, suserid)
+	}
+	sessionManager.knownUsers[suserid] = true
 	user, ok := sessionManager.userTable[suserid]
 	if !ok {
 		user = NewUser(suserid)
@@ -147,6 +168,59 @@ func (sessionManager *sessionManager) Authenticate(session *Session, st *Session
 	return nil
 }
 
+// Revoke drops the roles and pending authorization of the session and
+// rejects session tokens of the user until it is authorized again, or
+// until all session tokens issued before have expired.
+func (sessionManager *sessionManager) Revoke(session *Session, userid string) {
+	session.Revoke()
+	if userid == "" {
+		return
+	}
+
+	sessionManager.revokeUserid(userid)
+}
+
+// RevokeUser revokes all sessions of the user, like Revoke does for a
+// single session.
+func (sessionManager *sessionManager) RevokeUser(userid string) {
+	if userid == "" {
+		return
+	}
+
+	sessionManager.revokeUserid(userid)
+	user, ok := sessionManager.GetUser(userid)
+	if !ok {
+		return
+	}
+	for _, session := range user.Sessions() {
+		session.Revoke()
+	}
+}
+
+func (sessionManager *sessionManager) revokeUserid(userid string) {
+	now := time.Now()
+	sessionManager.Lock()
+	for revokedUserid, revoked := range sessionManager.revokedUsers {
+		if now.Sub(revoked) >= sessionTokenMaxAge {
+			delete(sessionManager.revokedUsers, revokedUserid)
+		}
+	}
+	sessionManager.revokedUsers[userid] = now
+	sessionManager.Unlock()
+}
+
+// UserExists checks the user directory of the config. Without directory,
+// users exist once they authenticated since the start.
+func (sessionManager *sessionManager) UserExists(userid string) bool {
+	if sessionManager.config.Users != nil {
+		return sessionManager.config.Users.UserExists(userid)
+	}
+
+	sessionManager.RLock()
+	defer sessionManager.RUnlock()
+	return sessionManager.knownUsers[userid]
+}
+
 func (sessionManager *sessionManager) GetUserSessions(session *Session, userid string) (users []*DataSession) {
 	var (
 		user *User
@@ -0,0 +1,39 @@
+package channelling
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_SessionManager_Revoke_ExpiresRevokedUsers(t *testing.T) {
+	sessionManager := NewSessionManager(&Config{}, nil, nil, nil, nil, nil, []byte("secret")).(*sessionManager)
+	sessionManager.revokedUsers["bob"] = time.Now().Add(-sessionTokenMaxAge)
+
+	sessionManager.Revoke(&Session{}, "alice")
+	if _, ok := sessionManager.revokedUsers["bob"]; ok {
+		t.Error("Expected expired revocation to be removed")
+	}
+	if _, ok := sessionManager.revokedUsers["alice"]; !ok {
+		t.Error("Expected user to be revoked")
+	}
+}
+
+func Test_SessionManager_RevokeUser_RevokesAllSessions(t *testing.T) {
+	sessionManager := NewSessionManager(&Config{}, nil, nil, nil, nil, nil, []byte("secret")).(*sessionManager)
+	user := NewUser("alice")
+	sessions := []*Session{{Id: "1", roles: []string{"admin"}}, {Id: "2", roles: []string{"admin"}}}
+	for _, session := range sessions {
+		user.AddSession(session)
+	}
+	sessionManager.userTable["alice"] = user
+
+	sessionManager.RevokeUser("alice")
+	for _, session := range sessions {
+		if session.HasRole("admin") {
+			t.Errorf("Expected roles of session %s to be revoked", session.Id)
+		}
+	}
+	if err := sessionManager.Authenticate(&Session{}, &SessionToken{Userid: "alice"}, "alice"); err == nil {
+		t.Error("Expected authentication of revoked user to fail")
+	}
+}
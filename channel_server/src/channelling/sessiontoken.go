@@ -1,10 +1,12 @@
 package channelling
 
 type SessionToken struct {
-	Id     		string 	// Public session id.
-	Sid    		string 	// Secret session id.
-	Userid 		string 	// Public user id.
-	Appid		string	// Appid
-	AppSecret	string	// AppSecret
-	Nonce  		string 	`json:"Nonce,omitempty"` // User autentication nonce.
-}
\ No newline at end of file
+	Id          string   // Public session id.
+	Sid         string   // Secret session id.
+	Userid      string   // Public user id.
+	Appid       string   // Appid
+	AppSecret   string   // AppSecret
+	Nonce       string   `json:"Nonce,omitempty"`       // User autentication nonce.
+	Roles       []string `json:"Roles,omitempty"`       // Roles of the user.
+	DisplayName string   `json:"DisplayName,omitempty"` // Display name of the user.
+}
@@ -1,7 +1,21 @@
 package channelling
 
 import (
-	"github.com/nats-io/nats"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"randomstring"
+)
+
+const (
+	SinkTypeNATS      = "nats"
+	SinkTypeWebhook   = "webhook"
+	SinkTypeFile      = "file"
+	SinkTypeWebSocket = "websocket"
 )
 
 // Sink connects a Pipeline with end points in both directions by
@@ -12,5 +26,116 @@ type Sink interface {
 	Enabled() bool
 	Close()
 	Export() *DataSink
-	BindRecvChan(channel interface{}) (*nats.Subscription, error)
+	// BindRecvChan delivers the data received by the sink to the channel.
+	BindRecvChan(channel chan *DataIncoming) error
+	// UnbindRecvChan stops delivering to the channel when it is still
+	// bound, so it can be closed.
+	UnbindRecvChan(channel chan *DataIncoming)
+}
+
+// ReceivingSink is a sink which gets its incoming data pushed by the
+// server, eg. through the webhook callback end point.
+type ReceivingSink interface {
+	Sink
+	Receive(*DataIncoming) error
+}
+
+// WebSocketSink is a sink to which a backend service attaches with a
+// WebSocket connection.
+type WebSocketSink interface {
+	ReceivingSink
+	// ServeWebSocket serves the connection until it is closed.
+	ServeWebSocket(conn *websocket.Conn)
+}
+
+// SinkFactory creates the sinks selected when pipeline sessions are
+// created.
+type SinkFactory interface {
+	NewSink(id string, request *SinkRequest) (Sink, error)
+}
+
+type sinkFactory struct {
+	bus            BusManager
+	fileDir        string
+	webhookTimeout time.Duration
+}
+
+// NewSinkFactory creates NATS sinks with the bus, file sinks in fileDir
+// (file sinks are not available when empty) and webhook sinks which time
+// out after webhookTimeout.
+func NewSinkFactory(bus BusManager, fileDir string, webhookTimeout time.Duration) SinkFactory {
+	return &sinkFactory{bus, fileDir, webhookTimeout}
+}
+
+func (factory *sinkFactory) NewSink(id string, request *SinkRequest) (Sink, error) {
+	sinkType := SinkTypeNATS
+	if request != nil && request.Type != "" {
+		sinkType = request.Type
+	}
+
+	switch sinkType {
+	case SinkTypeNATS:
+		if sink := factory.bus.CreateSink(id); sink != nil {
+			return sink, nil
+		}
+		return nil, NewDataError("sink_not_available", "NATS sinks are not available")
+	case SinkTypeWebhook:
+		if request.URL == "" {
+			return nil, NewDataError("bad_request", "webhook sink requires URL")
+		}
+		return newWebhookSink(id, request.URL, factory.webhookTimeout), nil
+	case SinkTypeFile:
+		if factory.fileDir == "" {
+			return nil, NewDataError("sink_not_available", "File sinks are not available")
+		}
+		return newFileSink(id, factory.fileDir)
+	case SinkTypeWebSocket:
+		return newWebSocketSink(id), nil
+	}
+
+	return nil, NewDataError("bad_request", fmt.Sprintf("unknown sink type %s", sinkType))
+}
+
+// sinkReceiver delivers the incoming data of a sink to the channel bound
+// by the pipeline.
+type sinkReceiver struct {
+	mutex   sync.Mutex
+	channel chan *DataIncoming
+}
+
+func (receiver *sinkReceiver) BindRecvChan(channel chan *DataIncoming) error {
+	receiver.mutex.Lock()
+	receiver.channel = channel
+	receiver.mutex.Unlock()
+	return nil
+}
+
+func (receiver *sinkReceiver) UnbindRecvChan(channel chan *DataIncoming) {
+	receiver.mutex.Lock()
+	if receiver.channel == channel {
+		receiver.channel = nil
+	}
+	receiver.mutex.Unlock()
+}
+
+func (receiver *sinkReceiver) Receive(incoming *DataIncoming) error {
+	// Send with the lock held, the pipeline unbinds the channel before
+	// closing it.
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.channel == nil {
+		return errors.New("sink is not attached to a pipeline")
+	}
+
+	select {
+	case receiver.channel <- incoming:
+		return nil
+	default:
+		return errors.New("pipeline receive queue full")
+	}
+}
+
+// newSinkToken returns the secret of sinks with server end points.
+func newSinkToken() string {
+	return randomstring.NewRandomString(32)
 }
@@ -0,0 +1,277 @@
+package channelling
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const sinkQueueSize = 100
+
+var errSinkClosed = errors.New("sink is closed")
+
+// webhookSink POSTs outgoing data as JSON to an URL. Replies are sent to
+// the callback end point of the sink.
+type webhookSink struct {
+	sinkReceiver
+	sync.RWMutex
+	id     string
+	url    string
+	token  string
+	client *http.Client
+	queue  chan *DataSinkOutgoing
+	closed bool
+}
+
+func newWebhookSink(id, url string, timeout time.Duration) *webhookSink {
+	sink := &webhookSink{
+		id:     id,
+		url:    url,
+		token:  newSinkToken(),
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan *DataSinkOutgoing, sinkQueueSize),
+	}
+	go sink.post()
+
+	return sink
+}
+
+// post sends the queued data in order.
+func (sink *webhookSink) post() {
+	for outgoing := range sink.queue {
+		body, err := json.Marshal(outgoing)
+		if err != nil {
+			log.Println("Failed to encode webhook sink data", err)
+			continue
+		}
+		request, err := http.NewRequest("POST", sink.url, bytes.NewReader(body))
+		if err != nil {
+			log.Println("Failed to create webhook sink request", err)
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-Sink-Id", sink.id)
+		request.Header.Set("X-Sink-Token", sink.token)
+		response, err := sink.client.Do(request)
+		if err != nil {
+			log.Println("Failed to post to webhook sink", sink.url, err)
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			log.Println("Webhook sink returned status", sink.url, response.StatusCode)
+		}
+	}
+}
+
+func (sink *webhookSink) Write(outgoing *DataSinkOutgoing) error {
+	sink.RLock()
+	defer sink.RUnlock()
+	if sink.closed {
+		return errSinkClosed
+	}
+	select {
+	case sink.queue <- outgoing:
+		return nil
+	default:
+		return errors.New("webhook sink queue full")
+	}
+}
+
+func (sink *webhookSink) Enabled() bool {
+	sink.RLock()
+	defer sink.RUnlock()
+	return !sink.closed
+}
+
+func (sink *webhookSink) Close() {
+	sink.Lock()
+	if !sink.closed {
+		sink.closed = true
+		close(sink.queue)
+	}
+	sink.Unlock()
+}
+
+func (sink *webhookSink) Export() *DataSink {
+	return &DataSink{Type: SinkTypeWebhook, Id: sink.id, Token: sink.token}
+}
+
+// fileSink records outgoing data as newline separated JSON. It does not
+// receive data.
+type fileSink struct {
+	sinkReceiver
+	sync.Mutex
+	id      string
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newFileSink(id, dir string) (*fileSink, error) {
+	filename := filepath.Join(dir, fmt.Sprintf("%s.ndjson", sinkFilename(id)))
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{id: id, file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// sinkFilename replaces all characters of id which are not safe in file
+// names.
+func sinkFilename(id string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, id)
+}
+
+func (sink *fileSink) Write(outgoing *DataSinkOutgoing) error {
+	sink.Lock()
+	defer sink.Unlock()
+	if sink.file == nil {
+		return errSinkClosed
+	}
+	return sink.encoder.Encode(outgoing)
+}
+
+func (sink *fileSink) Enabled() bool {
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.file != nil
+}
+
+func (sink *fileSink) Close() {
+	sink.Lock()
+	if sink.file != nil {
+		sink.file.Close()
+		sink.file = nil
+	}
+	sink.Unlock()
+}
+
+func (sink *fileSink) Export() *DataSink {
+	return &DataSink{Type: SinkTypeFile, Id: sink.id}
+}
+
+// webSocketSink queues outgoing data until a backend service attaches with
+// a WebSocket connection, which also sends the incoming data.
+type webSocketSink struct {
+	sinkReceiver
+	sync.RWMutex
+	id     string
+	token  string
+	queue  chan *DataSinkOutgoing
+	conn   *websocket.Conn
+	closed bool
+}
+
+func newWebSocketSink(id string) *webSocketSink {
+	return &webSocketSink{
+		id:    id,
+		token: newSinkToken(),
+		queue: make(chan *DataSinkOutgoing, sinkQueueSize),
+	}
+}
+
+func (sink *webSocketSink) Write(outgoing *DataSinkOutgoing) error {
+	sink.RLock()
+	defer sink.RUnlock()
+	if sink.closed {
+		return errSinkClosed
+	}
+	select {
+	case sink.queue <- outgoing:
+		return nil
+	default:
+		return errors.New("websocket sink queue full")
+	}
+}
+
+func (sink *webSocketSink) Enabled() bool {
+	sink.RLock()
+	defer sink.RUnlock()
+	return !sink.closed
+}
+
+func (sink *webSocketSink) Close() {
+	sink.Lock()
+	if !sink.closed {
+		sink.closed = true
+		close(sink.queue)
+		if sink.conn != nil {
+			sink.conn.Close()
+		}
+	}
+	sink.Unlock()
+}
+
+func (sink *webSocketSink) Export() *DataSink {
+	return &DataSink{Type: SinkTypeWebSocket, Id: sink.id, Token: sink.token}
+}
+
+// ServeWebSocket replaces any previous connection of the sink.
+func (sink *webSocketSink) ServeWebSocket(conn *websocket.Conn) {
+	sink.Lock()
+	if sink.closed {
+		sink.Unlock()
+		conn.Close()
+		return
+	}
+	if sink.conn != nil {
+		sink.conn.Close()
+	}
+	sink.conn = conn
+	sink.Unlock()
+
+	done := make(chan bool)
+	go sink.writePump(conn, done)
+	for {
+		incoming := &DataIncoming{}
+		if err := conn.ReadJSON(incoming); err != nil {
+			break
+		}
+		if err := sink.Receive(incoming); err != nil {
+			log.Println("Failed to receive from websocket sink", sink.id, err)
+		}
+	}
+	close(done)
+	conn.Close()
+
+	sink.Lock()
+	if sink.conn == conn {
+		sink.conn = nil
+	}
+	sink.Unlock()
+}
+
+func (sink *webSocketSink) writePump(conn *websocket.Conn, done chan bool) {
+	for {
+		select {
+		case <-done:
+			return
+		case outgoing, ok := <-sink.queue:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(outgoing); err != nil {
+				log.Println("Failed to write to websocket sink", sink.id, err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
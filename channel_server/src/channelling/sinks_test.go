@@ -0,0 +1,173 @@
+package channelling
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_SinkFactory_NewSink(t *testing.T) {
+	factory := NewSinkFactory(NewBusManager(NewChannellingAPIConsumer(), "", false, "", nil, nil), "", time.Second)
+	for _, request := range []*SinkRequest{nil, {Type: SinkTypeFile}, {Type: SinkTypeWebhook}, {Type: "carrier-pigeon"}} {
+		if sink, err := factory.NewSink("backend", request); err == nil {
+			t.Errorf("Expected sink %+v to fail, but got %+v", request, sink)
+		}
+	}
+}
+
+func Test_WebhookSink_WriteAndReceive(t *testing.T) {
+	received := make(chan *DataSinkOutgoing, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		outgoing := &DataSinkOutgoing{}
+		if err := json.NewDecoder(r.Body).Decode(outgoing); err != nil || r.Header.Get("X-Sink-Id") != "backend" || r.Header.Get("X-Sink-Token") == "" {
+			t.Errorf("Unexpected webhook request %v %v", r.Header, err)
+		}
+		received <- outgoing
+	}))
+	defer server.Close()
+
+	sink, err := NewSinkFactory(nil, "", time.Second).NewSink("backend", &SinkRequest{Type: SinkTypeWebhook, URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if exported := sink.Export(); exported.Type != SinkTypeWebhook || exported.Token == "" {
+		t.Errorf("Unexpected export %+v", exported)
+	}
+
+	sink.Write(&DataSinkOutgoing{Pipe: "call.a.b", Outgoing: &DataOutgoing{To: "b"}})
+	select {
+	case outgoing := <-received:
+		if outgoing.Pipe != "call.a.b" || outgoing.Outgoing.To != "b" {
+			t.Errorf("Unexpected outgoing %+v", outgoing)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Webhook was not called")
+	}
+
+	receivingSink := sink.(ReceivingSink)
+	if err := receivingSink.Receive(&DataIncoming{Type: "Answer"}); err == nil {
+		t.Error("Expected receive without pipeline to fail")
+	}
+	channel := make(chan *DataIncoming, 1)
+	sink.BindRecvChan(channel)
+	if err := receivingSink.Receive(&DataIncoming{Type: "Answer"}); err != nil || (<-channel).Type != "Answer" {
+		t.Errorf("Expected incoming data, but got %v", err)
+	}
+	sink.UnbindRecvChan(channel)
+	close(channel)
+	if err := receivingSink.Receive(&DataIncoming{Type: "Answer"}); err == nil {
+		t.Error("Expected receive on closed pipeline to fail")
+	}
+}
+
+func Test_FileSink_Records(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewSinkFactory(nil, dir, time.Second).NewSink("../backend", &SinkRequest{Type: SinkTypeFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write(&DataSinkOutgoing{Pipe: "call.a.b"})
+	sink.Write(&DataSinkOutgoing{Pipe: "call.a.b"})
+	sink.Close()
+	if sink.Enabled() || sink.Write(&DataSinkOutgoing{}) == nil {
+		t.Error("Expected closed sink")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "___backend.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Errorf("Expected 2 recorded lines, but got %q", data)
+	}
+}
+
+func Test_WebSocketSink_Serve(t *testing.T) {
+	sink, err := NewSinkFactory(nil, "", time.Second).NewSink("backend", &SinkRequest{Type: SinkTypeWebSocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	channel := make(chan *DataIncoming, 1)
+	sink.BindRecvChan(channel)
+
+	// Data is queued until the backend attaches.
+	sink.Write(&DataSinkOutgoing{Pipe: "call.a.b"})
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sink.(WebSocketSink).ServeWebSocket(conn)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	outgoing := &DataSinkOutgoing{}
+	if err := conn.ReadJSON(outgoing); err != nil || outgoing.Pipe != "call.a.b" {
+		t.Fatalf("Unexpected outgoing %+v %v", outgoing, err)
+	}
+
+	conn.WriteJSON(&DataIncoming{Type: "Answer"})
+	select {
+	case incoming := <-channel:
+		if incoming.Type != "Answer" {
+			t.Errorf("Unexpected incoming %+v", incoming)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No incoming data")
+	}
+}
+
+func Test_Pipeline_CloseUnbindsSink(t *testing.T) {
+	manager := NewPipelineManager(NewBusManager(NewChannellingAPIConsumer(), "", false, "", nil, nil), nil, nil, nil, nil, nil, nil)
+	sink, err := NewSinkFactory(nil, "", time.Second).NewSink("backend", &SinkRequest{Type: SinkTypeWebSocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	receivingSink := sink.(ReceivingSink)
+
+	pipeline := NewPipeline(manager, PipelineNamespaceCall, "call.a.b", nil, time.Minute)
+	if err := pipeline.Attach(sink); err != nil {
+		t.Fatal(err)
+	}
+	sink.BindRecvChan(pipeline.recvQueue)
+	pipeline.Close()
+	if err := receivingSink.Receive(&DataIncoming{Type: "Answer"}); err == nil {
+		t.Error("Expected receive on closed pipeline to fail")
+	}
+
+	// Closing a pipeline keeps the sink bound to another one.
+	pipeline = NewPipeline(manager, PipelineNamespaceCall, "call.a.c", nil, time.Minute)
+	pipeline.Attach(sink)
+	sink.BindRecvChan(pipeline.recvQueue)
+	channel := make(chan *DataIncoming, 1)
+	sink.BindRecvChan(channel)
+	pipeline.Close()
+	if err := receivingSink.Receive(&DataIncoming{Type: "Answer"}); err != nil {
+		t.Errorf("Expected incoming data, but got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	"randomstring"
 
@@ -13,6 +14,11 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// sessionTokenMaxAge is the lifetime of session tokens.
+	sessionTokenMaxAge = 30 * 24 * time.Hour
+)
+
 var (
 	// Can be set from tests to disable some log outputs.
 	silentOutput = false
@@ -50,7 +56,7 @@ func NewTickets(sessionSecret, encryptionSecret []byte, realm string) Tickets {
 		encryptionSecret,
 	}
 	tickets.SecureCookie = securecookie.New(sessionSecret, encryptionSecret)
-	tickets.MaxAge(86400 * 30) // 30 days
+	tickets.MaxAge(int(sessionTokenMaxAge / time.Second))
 	tickets.HashFunc(sha256.New)
 	tickets.BlockFunc(aes.NewCipher)
 
@@ -1,5 +1,126 @@
 package channelling
 
+import (
+	"net"
+	"strings"
+)
+
+const (
+	// TurnTTLDefault is the lifetime of TURN credentials in seconds when
+	// not configured.
+	TurnTTLDefault = 3600
+	// TurnPoolAny matches all room types or regions.
+	TurnPoolAny = "*"
+)
+
 type TurnDataCreator interface {
 	CreateTurnData(*Session) *DataTurn
 }
+
+// TurnPool are the TURN servers for sessions in rooms of RoomType from
+// Region. TurnPoolAny matches all room types or regions.
+type TurnPool struct {
+	RoomType string
+	Region   string
+	URIs     []string
+}
+
+func (pool *TurnPool) match(roomType, region string) (bool, int) {
+	score := 0
+	if pool.RoomType != TurnPoolAny {
+		if pool.RoomType != roomType {
+			return false, 0
+		}
+		score += 2
+	}
+	if pool.Region != TurnPoolAny {
+		if pool.Region != region {
+			return false, 0
+		}
+		score++
+	}
+	return true, score
+}
+
+// TurnRegionNetwork maps the remote addresses of Networks to Region.
+type TurnRegionNetwork struct {
+	Region   string
+	Networks []*net.IPNet
+}
+
+// TurnTTLForSession returns the TURN credential lifetime for the roles of
+// the session, the longest of all matching role lifetimes.
+func (config *Config) TurnTTLForSession(session *Session) int {
+	ttl := config.TurnTTL
+	if ttl <= 0 {
+		ttl = TurnTTLDefault
+	}
+	roleTTL := 0
+	for role, value := range config.TurnRoleTTLs {
+		if value > roleTTL && session.HasRole(role) {
+			roleTTL = value
+		}
+	}
+	if roleTTL > 0 {
+		return roleTTL
+	}
+	return ttl
+}
+
+// TurnURIsForSession returns the TURN servers of the pool of the current
+// room, else of the most specific pool matching type of the current room
+// and region of the session, or the global TURN servers. The servers are
+// filtered by the transports of the session.
+func (config *Config) TurnURIsForSession(session *Session) []string {
+	if pool := config.roomIcePool(session); pool != nil && len(pool.TurnURIs) > 0 {
+		return FilterIceURIs(pool.TurnURIs, session.Transports())
+	}
+	return FilterIceURIs(config.turnPoolURIs(session), session.Transports())
+}
+
+func (config *Config) turnPoolURIs(session *Session) []string {
+	if len(config.TurnPools) == 0 {
+		return config.TurnURIs
+	}
+
+	var roomType string
+	if roomID, ok := session.CurrentRoom(); ok && session.RoomStatusManager != nil {
+		if room, ok := session.RoomStatusManager.Get(roomID); ok {
+			roomType = room.GetType()
+		}
+	}
+	region := session.Region()
+
+	uris := config.TurnURIs
+	best := -1
+	for _, pool := range config.TurnPools {
+		if ok, score := pool.match(roomType, region); ok && score > best {
+			uris, best = pool.URIs, score
+		}
+	}
+	return uris
+}
+
+// TurnRegion returns the region of the network containing the address,
+// which is either an IP or the first entry of a X-Forwarded-For header.
+func (config *Config) TurnRegion(address string) string {
+	if idx := strings.Index(address, ","); idx >= 0 {
+		address = address[:idx]
+	}
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	for _, network := range config.TurnRegionNetworks {
+		for _, ipNet := range network.Networks {
+			if ipNet.Contains(ip) {
+				return network.Region
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package channelling
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_Config_TurnForSession(t *testing.T) {
+	_, europe, _ := net.ParseCIDR("192.0.2.0/24")
+	config := &Config{
+		RoomTypeDefault: RoomTypeRoom,
+		TurnTTL:         600,
+		TurnRoleTTLs:    map[string]int{"device": 86400, "player": 1800},
+		TurnURIs:        []string{"turn:global"},
+		TurnPools: []*TurnPool{
+			{RoomType: TurnPoolAny, Region: "eu", URIs: []string{"turn:eu"}},
+			{RoomType: RoomTypeConference, Region: TurnPoolAny, URIs: []string{"turn:conference"}},
+			{RoomType: RoomTypeConference, Region: "eu", URIs: []string{"turn:conference-eu"}},
+		},
+		TurnRegionNetworks: []*TurnRegionNetwork{{Region: "eu", Networks: []*net.IPNet{europe}}},
+	}
+	rooms := NewRoomManager(config, nil)
+
+	session := &Session{Id: "1", RoomStatusManager: rooms}
+	if ttl := config.TurnTTLForSession(session); ttl != 600 {
+		t.Errorf("Expected configured ttl, but got %d", ttl)
+	}
+	session.SetRoles([]string{"player", "device"})
+	if ttl := config.TurnTTLForSession(session); ttl != 86400 {
+		t.Errorf("Expected longest role ttl, but got %d", ttl)
+	}
+
+	if uris := config.TurnURIsForSession(session); uris[0] != "turn:global" {
+		t.Errorf("Expected global TURN servers, but got %v", uris)
+	}
+	session.SetRegion(config.TurnRegion("192.0.2.10, 10.0.0.1"))
+	if uris := config.TurnURIsForSession(session); uris[0] != "turn:eu" {
+		t.Errorf("Expected region TURN servers, but got %v", uris)
+	}
+
+	if _, err := rooms.JoinRoom(RoomTypeConference+":claw", "claw", RoomTypeConference, nil, session, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	session.Hello, session.Roomid = true, RoomTypeConference+":claw"
+	if uris := config.TurnURIsForSession(session); uris[0] != "turn:conference-eu" {
+		t.Errorf("Expected room type and region TURN servers, but got %v", uris)
+	}
+	session.SetRegion("us")
+	if uris := config.TurnURIsForSession(session); uris[0] != "turn:conference" {
+		t.Errorf("Expected room type TURN servers, but got %v", uris)
+	}
+
+	if region := config.TurnRegion("198.51.100.1:4321"); region != "" {
+		t.Errorf("Expected no region, but got %s", region)
+	}
+}
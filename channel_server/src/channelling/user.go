@@ -51,6 +51,32 @@ func (u *User) RemoveSession(sessionID string) bool {
 	return last
 }
 
+// SessionIds returns the ids of all sessions of the user.
+func (u *User) SessionIds() []string {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	ids := make([]string, 0, len(u.sessionTable))
+	for id := range u.sessionTable {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// Sessions returns all sessions of the user.
+func (u *User) Sessions() []*Session {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(u.sessionTable))
+	for _, session := range u.sessionTable {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
 func (u *User) Data() *DataUser {
 	u.mutex.RLock()
 	defer u.mutex.RUnlock()
@@ -3,3 +3,9 @@ package channelling
 type UserStore interface {
 	GetUser(id string) (user *User, ok bool)
 }
+
+// UserDirectory knows the accounts of users modes which keep them.
+type UserDirectory interface {
+	// UserExists returns true when userid is an enabled account.
+	UserExists(userid string) bool
+}
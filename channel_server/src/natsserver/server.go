@@ -0,0 +1,190 @@
+// Package natsserver runs an embedded gnatsd server for the channelling
+// bus, device_manager and backend services running next to the channel
+// server. It serves a single node without clustering.
+package natsserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	gnatsd "github.com/nats-io/gnatsd/server"
+)
+
+const (
+	// DefaultListen is the listen address of the embedded server, only
+	// reachable locally.
+	DefaultListen = "127.0.0.1:4222"
+	// DefaultMaxPayload is the maximum size of published messages.
+	DefaultMaxPayload = 1024 * 1024
+	// DefaultMaxConnections is the maximum number of clients.
+	DefaultMaxConnections = 1024
+	// DefaultMaxSubscriptions is the maximum number of subscriptions of
+	// a client.
+	DefaultMaxSubscriptions = 1024
+	// DefaultPingInterval is the interval in which clients are pinged,
+	// clients not answering two pings are disconnected.
+	DefaultPingInterval = 30 * time.Second
+
+	maxPingsOut  = 2
+	authTimeout  = 5 * time.Second
+	startTimeout = 10 * time.Second
+)
+
+// Config configures the NATS server.
+type Config struct {
+	Listen           string        // TCP listen address, eg. "127.0.0.1:4222".
+	Token            string        // Authorization token of the clients, no authorization when empty.
+	MaxPayload       int           // Maximum message size, defaults to DefaultMaxPayload.
+	MaxConnections   int           // Maximum number of clients, defaults to DefaultMaxConnections.
+	MaxSubscriptions int           // Maximum subscriptions per client, defaults to DefaultMaxSubscriptions.
+	PingInterval     time.Duration // Ping interval, defaults to DefaultPingInterval.
+}
+
+// Stats are the connection and message metrics of the server.
+type Stats struct {
+	Connections      int    `json:"connections"`
+	ConnectionsTotal uint64 `json:"connectionsTotal"`
+	Subscriptions    int    `json:"subscriptions"`
+	MessagesIn       uint64 `json:"messagesIn"`
+	MessagesOut      uint64 `json:"messagesOut"`
+	SlowConsumers    uint64 `json:"slowConsumers"`
+}
+
+// Server is a NATS server.
+type Server struct {
+	config *Config
+	server *gnatsd.Server
+}
+
+// NewServer creates a server for the configuration. Without token it only
+// listens on loopback addresses.
+func NewServer(config *Config) (*Server, error) {
+	if config.Listen == "" {
+		return nil, errors.New("no listen address")
+	}
+	if config.Token == "" && !isLoopback(config.Listen) {
+		return nil, fmt.Errorf("refusing to listen on %s without token", config.Listen)
+	}
+	host, portString, err := net.SplitHostPort(config.Listen)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portString)
+	}
+	if port == 0 {
+		// Any free port, gnatsd would use its default port for 0.
+		port = gnatsd.RANDOM_PORT
+	}
+	if config.MaxPayload <= 0 {
+		config.MaxPayload = DefaultMaxPayload
+	}
+	if config.MaxConnections <= 0 {
+		config.MaxConnections = DefaultMaxConnections
+	}
+	if config.MaxSubscriptions <= 0 {
+		config.MaxSubscriptions = DefaultMaxSubscriptions
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = DefaultPingInterval
+	}
+
+	server := gnatsd.New(&gnatsd.Options{
+		Host:          host,
+		Port:          port,
+		Authorization: config.Token,
+		AuthTimeout:   authTimeout.Seconds(),
+		MaxPayload:    config.MaxPayload,
+		MaxConn:       config.MaxConnections,
+		MaxSubs:       config.MaxSubscriptions,
+		PingInterval:  config.PingInterval,
+		MaxPingsOut:   maxPingsOut,
+		// Signals are handled by the channel server.
+		NoSigs: true,
+	})
+	if server == nil {
+		return nil, errors.New("invalid NATS server options")
+	}
+
+	return &Server{
+		config: config,
+		server: server,
+	}, nil
+}
+
+// isLoopback returns true when the host of the listen address only
+// resolves to loopback addresses.
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil || host == "" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Start runs the server in the background and waits until it accepts
+// connections.
+func (s *Server) Start() error {
+	go s.server.Start()
+	if !s.server.ReadyForConnections(startTimeout) {
+		s.server.Shutdown()
+		return fmt.Errorf("failed to listen on %s", s.config.Listen)
+	}
+	log.Printf("NATS server listening on %s\n", s.server.Addr())
+
+	return nil
+}
+
+// Close stops the server and disconnects all clients.
+func (s *Server) Close() {
+	s.server.Shutdown()
+}
+
+// URL returns the address clients connect to, including the token.
+func (s *Server) URL() string {
+	host, port, _ := net.SplitHostPort(s.server.Addr().String())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	u := &url.URL{Scheme: "nats", Host: net.JoinHostPort(host, port)}
+	if s.config.Token != "" {
+		u.User = url.User(s.config.Token)
+	}
+	return u.String()
+}
+
+// Stats returns the current metrics.
+func (s *Server) Stats() *Stats {
+	varz, err := s.server.Varz(nil)
+	if err != nil {
+		return &Stats{}
+	}
+
+	return &Stats{
+		Connections:      varz.Connections,
+		ConnectionsTotal: varz.TotalConnections,
+		Subscriptions:    int(varz.Subscriptions),
+		MessagesIn:       uint64(varz.InMsgs),
+		MessagesOut:      uint64(varz.OutMsgs),
+		SlowConsumers:    uint64(varz.SlowConsumers),
+	}
+}
@@ -0,0 +1,144 @@
+package natsserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+func newTestServer(t *testing.T, token string) *Server {
+	server, err := NewServer(&Config{Listen: "127.0.0.1:0", Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func Test_Server_PublishSubscribe(t *testing.T) {
+	server := newTestServer(t, "")
+	defer server.Close()
+
+	nc, err := nats.Connect(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	received := make(chan *nats.Msg, 10)
+	for _, subject := range []string{"channelling.trigger.joined", "channelling.*.joined", "channelling.>", "channelling.trigger"} {
+		if _, err := nc.ChanSubscribe(subject, received); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued := make(chan *nats.Msg, 10)
+	for i := 0; i < 3; i++ {
+		if _, err := nc.ChanQueueSubscribe("channelling.trigger.>", "workers", queued); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nc.Publish("channelling.trigger.joined", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	nc.Flush()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-received:
+			if string(msg.Data) != "hello" {
+				t.Errorf("Unexpected message %s", msg.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected 3 messages, but got %d", i)
+		}
+	}
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("Expected queue group message")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(received) != 0 || len(queued) != 0 {
+		t.Errorf("Unexpected additional messages %d %d", len(received), len(queued))
+	}
+
+	if stats := server.Stats(); stats.Connections != 1 || stats.Subscriptions != 7 || stats.MessagesIn != 1 || stats.MessagesOut != 4 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func Test_Server_RequestReply(t *testing.T) {
+	server := newTestServer(t, "secret")
+	defer server.Close()
+
+	if _, err := nats.Connect("nats://wrong@" + server.server.Addr().String()); err == nil {
+		t.Error("Expected invalid token to fail")
+	}
+
+	responder, err := nats.Connect(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer responder.Close()
+	responder.Subscribe("channelling.session.join", func(msg *nats.Msg) {
+		responder.Publish(msg.Reply, append([]byte("joined "), msg.Data...))
+	})
+	responder.Flush()
+
+	requester, err := nats.Connect(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer requester.Close()
+	reply, err := requester.Request("channelling.session.join", []byte("a"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Data) != "joined a" {
+		t.Errorf("Unexpected reply %s", reply.Data)
+	}
+}
+
+func Test_Server_MaxConnections(t *testing.T) {
+	server, err := NewServer(&Config{Listen: "127.0.0.1:0", MaxConnections: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	nc, err := nats.Connect(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	if nc, err := nats.Connect(server.URL()); err == nil {
+		nc.Close()
+		t.Error("Expected connection beyond the limit to fail")
+	}
+}
+
+func Test_NewServer_RequiresTokenOnPublicAddresses(t *testing.T) {
+	for _, test := range []struct {
+		listen, token string
+		ok            bool
+	}{
+		{"127.0.0.1:4222", "", true},
+		{"[::1]:4222", "", true},
+		{"localhost:4222", "", true},
+		{":4222", "", false},
+		{"0.0.0.0:4222", "", false},
+		{"[::]:4222", "", false},
+		{"192.0.2.1:4222", "", false},
+		{"0.0.0.0:4222", "secret", true},
+	} {
+		if _, err := NewServer(&Config{Listen: test.listen, Token: test.token}); (err == nil) != test.ok {
+			t.Errorf("Unexpected result %v for %s with token %q", err, test.listen, test.token)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package turnserver
+
+import (
+	"crypto/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type channelBinding struct {
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+// allocation is a relay of a client.
+type allocation struct {
+	sync.Mutex
+	server        *Server
+	client        client
+	username      string
+	relay         *net.UDPConn
+	relayAddr     *net.UDPAddr
+	transactionID [12]byte
+	response      []byte
+	expires       time.Time
+	permissions   map[string]time.Time
+	channels      map[uint16]*channelBinding
+	peers         map[string]uint16
+}
+
+func newAllocation(s *Server, c client, username string, relay *net.UDPConn, lifetime time.Duration) *allocation {
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	return &allocation{
+		server:      s,
+		client:      c,
+		username:    username,
+		relay:       relay,
+		relayAddr:   &net.UDPAddr{IP: s.config.ExternalAddress, Port: port},
+		expires:     time.Now().Add(lifetime),
+		permissions: make(map[string]time.Time),
+		channels:    make(map[uint16]*channelBinding),
+		peers:       make(map[string]uint16),
+	}
+}
+
+func (a *allocation) close() {
+	a.relay.Close()
+}
+
+func (a *allocation) refresh(lifetime time.Duration) {
+	a.Lock()
+	a.expires = time.Now().Add(lifetime)
+	a.Unlock()
+}
+
+// expire removes expired permissions and channels, and returns true when
+// the allocation itself expired.
+func (a *allocation) expire(now time.Time) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	for ip, expires := range a.permissions {
+		if now.After(expires) {
+			delete(a.permissions, ip)
+		}
+	}
+	for channel, binding := range a.channels {
+		if now.After(binding.expires) {
+			delete(a.channels, channel)
+			delete(a.peers, binding.peer.String())
+		}
+	}
+	return now.After(a.expires)
+}
+
+func (a *allocation) permit(ip net.IP) {
+	a.Lock()
+	a.permissions[ip.String()] = time.Now().Add(permissionLifetime)
+	a.Unlock()
+}
+
+func (a *allocation) permitted(ip net.IP) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	expires, ok := a.permissions[ip.String()]
+	return ok && time.Now().Before(expires)
+}
+
+// bind binds the channel to the peer, which also installs a permission.
+// Channels can not be rebound to another peer.
+func (a *allocation) bind(channel uint16, peer *net.UDPAddr) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if binding, ok := a.channels[channel]; ok && binding.peer.String() != peer.String() {
+		return false
+	}
+	if bound, ok := a.peers[peer.String()]; ok && bound != channel {
+		return false
+	}
+	now := time.Now()
+	a.channels[channel] = &channelBinding{peer, now.Add(channelLifetime)}
+	a.peers[peer.String()] = channel
+	a.permissions[peer.IP.String()] = now.Add(permissionLifetime)
+	return true
+}
+
+func (a *allocation) channelPeer(channel uint16) *net.UDPAddr {
+	a.Lock()
+	defer a.Unlock()
+
+	if binding, ok := a.channels[channel]; ok {
+		return binding.peer
+	}
+	return nil
+}
+
+func (a *allocation) toPeer(peer *net.UDPAddr, data []byte) {
+	if !a.permitted(peer.IP) || !a.server.peerAllowed(peer.IP) {
+		return
+	}
+	if n, err := a.relay.WriteToUDP(data, peer); err == nil {
+		atomic.AddUint64(&a.server.counters.bytesToPeers, uint64(n))
+	}
+}
+
+// readRelay forwards data from permitted peers to the client, as
+// ChannelData when a channel is bound, else as Data indication.
+func (a *allocation) readRelay() {
+	b := make([]byte, maxMessageSize)
+	for {
+		n, peer, err := a.relay.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		if !a.permitted(peer.IP) {
+			continue
+		}
+		atomic.AddUint64(&a.server.counters.bytesFromPeers, uint64(n))
+
+		a.Lock()
+		channel, bound := a.peers[peer.String()]
+		a.Unlock()
+		if bound {
+			a.client.send(channelData(channel, b[:n], a.client.stream()))
+			continue
+		}
+
+		var transactionID [12]byte
+		rand.Read(transactionID[:])
+		indication := newMessage(methodData, classIndication, transactionID)
+		indication.addXorAddress(attrXorPeerAddress, peer)
+		indication.add(attrData, b[:n])
+		a.client.send(indication.encode(nil))
+	}
+}
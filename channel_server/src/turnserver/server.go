@@ -0,0 +1,752 @@
+// Package turnserver implements an embedded STUN (RFC 5389) and TURN
+// (RFC 5766) server with UDP relays. TURN uses the REST style credentials
+// of the channelling hub, which are derived from a shared secret.
+package turnserver
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	software = "channel-server"
+
+	defaultLifetime    = 10 * time.Minute
+	maxLifetime        = time.Hour
+	permissionLifetime = 5 * time.Minute
+	channelLifetime    = 10 * time.Minute
+	nonceLifetime      = time.Hour
+	cleanupInterval    = 30 * time.Second
+	maxMessageSize     = 65536
+)
+
+// Config configures the STUN/TURN server.
+type Config struct {
+	ListenUDP       string // UDP listen address, eg. ":3478".
+	ListenTCP       string // TCP listen address, eg. ":3478".
+	ListenTLS       string // TURN over TLS listen address, eg. ":5349".
+	TLSConfig       *tls.Config
+	Realm           string
+	Secret          []byte // Shared secret of the TURN credentials, TURN is disabled when empty.
+	RelayAddress    net.IP // Address the relays are bound to.
+	ExternalAddress net.IP // Address announced for relays, defaults to RelayAddress.
+	RelayPortMin    int
+	RelayPortMax    int
+	MaxAllocations  int // Maximum concurrent allocations, 0 for unlimited.
+	// AllowedPeers are networks relays may send to although they are
+	// denied by default (loopback, private, link-local and unspecified
+	// addresses), eg. a LAN of the server.
+	AllowedPeers []*net.IPNet
+}
+
+// deniedPeers are the networks relays do not send to by default, so TURN
+// can not be used to reach the server itself or its internal networks.
+var deniedPeers = parseNetworks(
+	"0.0.0.0/8",      // Unspecified.
+	"10.0.0.0/8",     // RFC 1918.
+	"100.64.0.0/10",  // Carrier-grade NAT.
+	"127.0.0.0/8",    // Loopback.
+	"169.254.0.0/16", // Link-local.
+	"172.16.0.0/12",  // RFC 1918.
+	"192.168.0.0/16", // RFC 1918.
+	"224.0.0.0/3",    // Multicast, reserved and broadcast.
+	"::/128",         // Unspecified.
+	"::1/128",        // Loopback.
+	"fc00::/7",       // Unique local.
+	"fe80::/10",      // Link-local.
+	"ff00::/8",       // Multicast.
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Stats are the allocation metrics of the server.
+type Stats struct {
+	Allocations      int    `json:"allocations"`
+	AllocationsTotal uint64 `json:"allocationsTotal"`
+	BindingRequests  uint64 `json:"bindingRequests"`
+	AuthFailures     uint64 `json:"authFailures"`
+	BytesToPeers     uint64 `json:"bytesToPeers"`
+	BytesFromPeers   uint64 `json:"bytesFromPeers"`
+}
+
+type counters struct {
+	allocationsTotal uint64
+	bindingRequests  uint64
+	authFailures     uint64
+	bytesToPeers     uint64
+	bytesFromPeers   uint64
+}
+
+// Server is a STUN/TURN server.
+type Server struct {
+	config      *Config
+	counters    *counters
+	nonceKey    []byte
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	tlsListener net.Listener
+	mutex       sync.Mutex
+	allocations map[string]*allocation
+	closed      chan bool
+}
+
+// NewServer creates a server for the configuration.
+func NewServer(config *Config) (*Server, error) {
+	if config.ListenUDP == "" && config.ListenTCP == "" && config.ListenTLS == "" {
+		return nil, errors.New("no listen address")
+	}
+	if config.ListenTLS != "" && config.TLSConfig == nil {
+		return nil, errors.New("tls configuration required for TURN over TLS")
+	}
+	if len(config.Secret) > 0 && config.RelayAddress == nil {
+		return nil, errors.New("relay address required for TURN")
+	}
+	if config.ExternalAddress == nil {
+		config.ExternalAddress = config.RelayAddress
+	}
+	nonceKey := make([]byte, 32)
+	if _, err := rand.Read(nonceKey); err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		config:      config,
+		counters:    &counters{},
+		nonceKey:    nonceKey,
+		allocations: make(map[string]*allocation),
+		closed:      make(chan bool),
+	}, nil
+}
+
+// Start opens the listeners and serves them in the background.
+func (s *Server) Start() error {
+	if s.config.ListenUDP != "" {
+		conn, err := net.ListenPacket("udp", s.config.ListenUDP)
+		if err != nil {
+			return err
+		}
+		s.udpConn = conn
+		go s.serveUDP()
+		log.Printf("STUN/TURN server listening on udp %s\n", conn.LocalAddr())
+	}
+	if s.config.ListenTCP != "" {
+		listener, err := net.Listen("tcp", s.config.ListenTCP)
+		if err != nil {
+			if s.udpConn != nil {
+				s.udpConn.Close()
+			}
+			return err
+		}
+		s.tcpListener = listener
+		go s.serveTCP(listener)
+		log.Printf("STUN/TURN server listening on tcp %s\n", listener.Addr())
+	}
+	if s.config.ListenTLS != "" {
+		listener, err := tls.Listen("tcp", s.config.ListenTLS, s.config.TLSConfig)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		s.tlsListener = listener
+		go s.serveTCP(listener)
+		log.Printf("STUN/TURN server listening on tls %s\n", listener.Addr())
+	}
+	go s.cleanup()
+
+	return nil
+}
+
+// Close stops the listeners and removes all allocations.
+func (s *Server) Close() {
+	close(s.closed)
+	s.closeListeners()
+	s.mutex.Lock()
+	for key, a := range s.allocations {
+		a.close()
+		delete(s.allocations, key)
+	}
+	s.mutex.Unlock()
+}
+
+func (s *Server) closeListeners() {
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	if s.tlsListener != nil {
+		s.tlsListener.Close()
+	}
+}
+
+// Stats returns the current metrics.
+func (s *Server) Stats() *Stats {
+	s.mutex.Lock()
+	allocations := len(s.allocations)
+	s.mutex.Unlock()
+
+	return &Stats{
+		Allocations:      allocations,
+		AllocationsTotal: atomic.LoadUint64(&s.counters.allocationsTotal),
+		BindingRequests:  atomic.LoadUint64(&s.counters.bindingRequests),
+		AuthFailures:     atomic.LoadUint64(&s.counters.authFailures),
+		BytesToPeers:     atomic.LoadUint64(&s.counters.bytesToPeers),
+		BytesFromPeers:   atomic.LoadUint64(&s.counters.bytesFromPeers),
+	}
+}
+
+// client is the transport connection of a client.
+type client interface {
+	send(b []byte)
+	addr() *net.UDPAddr
+	stream() bool
+	key() string
+}
+
+type udpClient struct {
+	conn net.PacketConn
+	from net.Addr
+}
+
+func (c *udpClient) send(b []byte) {
+	c.conn.WriteTo(b, c.from)
+}
+
+func (c *udpClient) addr() *net.UDPAddr {
+	addr, _ := c.from.(*net.UDPAddr)
+	return addr
+}
+
+func (c *udpClient) stream() bool {
+	return false
+}
+
+func (c *udpClient) key() string {
+	return "udp:" + c.from.String()
+}
+
+type tcpClient struct {
+	sync.Mutex
+	conn net.Conn
+}
+
+func (c *tcpClient) send(b []byte) {
+	c.Lock()
+	c.conn.Write(b)
+	c.Unlock()
+}
+
+func (c *tcpClient) addr() *net.UDPAddr {
+	addr, _ := c.conn.RemoteAddr().(*net.TCPAddr)
+	if addr == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+}
+
+func (c *tcpClient) stream() bool {
+	return true
+}
+
+func (c *tcpClient) key() string {
+	return "tcp:" + c.conn.RemoteAddr().String()
+}
+
+func (s *Server) serveUDP() {
+	b := make([]byte, maxMessageSize)
+	for {
+		n, from, err := s.udpConn.ReadFrom(b)
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				log.Println("STUN/TURN udp read failed", err)
+			}
+			return
+		}
+		s.handle(&udpClient{s.udpConn, from}, b[:n])
+	}
+}
+
+func (s *Server) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				log.Println("STUN/TURN tcp accept failed", err)
+			}
+			return
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *Server) serveTCPConn(conn net.Conn) {
+	c := &tcpClient{conn: conn}
+	defer func() {
+		conn.Close()
+		s.removeAllocation(c.key())
+	}()
+
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	b := make([]byte, maxMessageSize+headerSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		switch {
+		case header[0]&0xC0 == 0:
+			length += headerSize
+		case isChannelData(header):
+			length = (4 + length + 3) &^ 3
+		default:
+			return
+		}
+		copy(b, header)
+		if _, err := io.ReadFull(reader, b[4:length]); err != nil {
+			return
+		}
+		s.handle(c, b[:length])
+	}
+}
+
+func (s *Server) handle(c client, b []byte) {
+	if isChannelData(b) {
+		s.handleChannelData(c, b)
+		return
+	}
+	m, err := decodeMessage(b)
+	if err != nil {
+		return
+	}
+
+	switch m.class {
+	case classRequest:
+		s.handleRequest(c, m)
+	case classIndication:
+		if m.method == methodSend {
+			s.handleSend(c, m)
+		}
+	}
+}
+
+func (s *Server) handleRequest(c client, m *message) {
+	if m.method == methodBinding {
+		atomic.AddUint64(&s.counters.bindingRequests, 1)
+		response := newMessage(methodBinding, classSuccess, m.transactionID)
+		response.addXorAddress(attrXorMappedAddress, c.addr())
+		response.add(attrSoftware, []byte(software))
+		c.send(response.encode(nil))
+		return
+	}
+
+	switch m.method {
+	case methodAllocate, methodRefresh, methodCreatePermission, methodChannelBind:
+	default:
+		s.sendError(c, m, 400, "Bad Request", nil)
+		return
+	}
+	if len(s.config.Secret) == 0 {
+		s.sendError(c, m, 403, "Forbidden", nil)
+		return
+	}
+	username, key, ok := s.authenticate(c, m)
+	if !ok {
+		return
+	}
+
+	switch m.method {
+	case methodAllocate:
+		s.handleAllocate(c, m, username, key)
+		return
+	}
+
+	a := s.getAllocation(c.key())
+	if a == nil {
+		s.sendError(c, m, 437, "Allocation Mismatch", key)
+		return
+	}
+	if a.username != username {
+		s.sendError(c, m, 441, "Wrong Credentials", key)
+		return
+	}
+	switch m.method {
+	case methodRefresh:
+		s.handleRefresh(c, m, a, key)
+	case methodCreatePermission:
+		s.handleCreatePermission(c, m, a, key)
+	case methodChannelBind:
+		s.handleChannelBind(c, m, a, key)
+	}
+}
+
+// authenticate validates the long-term credentials of the request, which
+// are REST style credentials with a password derived from the secret.
+func (s *Server) authenticate(c client, m *message) (string, []byte, bool) {
+	if m.integrityOffset < 0 {
+		s.sendChallenge(c, m, 401, "Unauthorized")
+		return "", nil, false
+	}
+	username := m.getString(attrUsername)
+	if username == "" || m.getString(attrRealm) != s.config.Realm {
+		s.sendError(c, m, 400, "Bad Request", nil)
+		return "", nil, false
+	}
+	if !s.validNonce(m.getString(attrNonce)) {
+		s.sendChallenge(c, m, 438, "Stale Nonce")
+		return "", nil, false
+	}
+
+	if idx := strings.Index(username, ":"); idx > 0 {
+		expiration, err := strconv.ParseInt(username[:idx], 10, 64)
+		if err != nil || expiration < time.Now().Unix() {
+			atomic.AddUint64(&s.counters.authFailures, 1)
+			s.sendChallenge(c, m, 401, "Unauthorized")
+			return "", nil, false
+		}
+	}
+	mac := hmac.New(sha1.New, s.config.Secret)
+	mac.Write([]byte(username))
+	password := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	key := longTermKey(username, s.config.Realm, password)
+	if !m.checkIntegrity(key) {
+		atomic.AddUint64(&s.counters.authFailures, 1)
+		s.sendChallenge(c, m, 401, "Unauthorized")
+		return "", nil, false
+	}
+
+	return username, key, true
+}
+
+func (s *Server) nonce() string {
+	timestamp := fmt.Sprintf("%016x", time.Now().Unix())
+	mac := hmac.New(sha256.New, s.nonceKey)
+	mac.Write([]byte(timestamp))
+	return timestamp + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (s *Server) validNonce(nonce string) bool {
+	if len(nonce) != 32 {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.nonceKey)
+	mac.Write([]byte(nonce[:16]))
+	if !hmac.Equal([]byte(nonce[16:]), []byte(hex.EncodeToString(mac.Sum(nil))[:16])) {
+		return false
+	}
+	timestamp, err := strconv.ParseInt(nonce[:16], 16, 64)
+	return err == nil && time.Since(time.Unix(timestamp, 0)) < nonceLifetime
+}
+
+func (s *Server) sendChallenge(c client, m *message, code int, reason string) {
+	response := newMessage(m.method, classError, m.transactionID)
+	response.addError(code, reason)
+	response.add(attrRealm, []byte(s.config.Realm))
+	response.add(attrNonce, []byte(s.nonce()))
+	c.send(response.encode(nil))
+}
+
+func (s *Server) sendError(c client, m *message, code int, reason string, key []byte) {
+	response := newMessage(m.method, classError, m.transactionID)
+	response.addError(code, reason)
+	c.send(response.encode(key))
+}
+
+func (s *Server) handleAllocate(c client, m *message, username string, key []byte) {
+	s.mutex.Lock()
+	if a, ok := s.allocations[c.key()]; ok {
+		s.mutex.Unlock()
+		if a.transactionID == m.transactionID {
+			// Retransmission of the request.
+			c.send(a.response)
+		} else {
+			s.sendError(c, m, 437, "Allocation Mismatch", key)
+		}
+		return
+	}
+	if s.config.MaxAllocations > 0 && len(s.allocations) >= s.config.MaxAllocations {
+		s.mutex.Unlock()
+		s.sendError(c, m, 486, "Allocation Quota Reached", key)
+		return
+	}
+	s.mutex.Unlock()
+
+	transport, ok := m.get(attrRequestedTransport)
+	if !ok || len(transport) < 1 {
+		s.sendError(c, m, 400, "Bad Request", key)
+		return
+	}
+	if transport[0] != transportUDP {
+		s.sendError(c, m, 442, "Unsupported Transport Protocol", key)
+		return
+	}
+
+	relay, err := s.listenRelay()
+	if err != nil {
+		log.Println("Failed to allocate TURN relay", err)
+		s.sendError(c, m, 508, "Insufficient Capacity", key)
+		return
+	}
+	lifetime := requestedLifetime(m)
+	a := newAllocation(s, c, username, relay, lifetime)
+	a.transactionID = m.transactionID
+
+	response := newMessage(methodAllocate, classSuccess, m.transactionID)
+	response.addXorAddress(attrXorRelayedAddress, a.relayAddr)
+	response.addUint32(attrLifetime, uint32(lifetime/time.Second))
+	response.addXorAddress(attrXorMappedAddress, c.addr())
+	response.add(attrSoftware, []byte(software))
+	a.response = response.encode(key)
+
+	s.mutex.Lock()
+	if _, ok := s.allocations[c.key()]; ok {
+		s.mutex.Unlock()
+		relay.Close()
+		s.sendError(c, m, 437, "Allocation Mismatch", key)
+		return
+	}
+	s.allocations[c.key()] = a
+	s.mutex.Unlock()
+	atomic.AddUint64(&s.counters.allocationsTotal, 1)
+
+	go a.readRelay()
+	c.send(a.response)
+}
+
+func (s *Server) listenRelay() (*net.UDPConn, error) {
+	min, max := s.config.RelayPortMin, s.config.RelayPortMax
+	if min <= 0 || max < min {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: s.config.RelayAddress})
+	}
+
+	b := make([]byte, 2)
+	rand.Read(b)
+	offset := int(binary.BigEndian.Uint16(b))
+	count := max - min + 1
+	var err error
+	for i := 0; i < count; i++ {
+		port := min + (offset+i)%count
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: s.config.RelayAddress, Port: port}); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func requestedLifetime(m *message) time.Duration {
+	lifetime := defaultLifetime
+	if value, ok := m.get(attrLifetime); ok && len(value) == 4 {
+		lifetime = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+		if lifetime > maxLifetime {
+			lifetime = maxLifetime
+		} else if lifetime > 0 && lifetime < defaultLifetime {
+			lifetime = defaultLifetime
+		}
+	}
+	return lifetime
+}
+
+func (s *Server) handleRefresh(c client, m *message, a *allocation, key []byte) {
+	lifetime := requestedLifetime(m)
+	if lifetime == 0 {
+		s.removeAllocation(c.key())
+	} else {
+		a.refresh(lifetime)
+	}
+
+	response := newMessage(methodRefresh, classSuccess, m.transactionID)
+	response.addUint32(attrLifetime, uint32(lifetime/time.Second))
+	c.send(response.encode(key))
+}
+
+// peerAllowed returns true when relays may exchange data with the peer.
+func (s *Server) peerAllowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range s.config.AllowedPeers {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range deniedPeers {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleCreatePermission(c client, m *message, a *allocation, key []byte) {
+	var peers []*net.UDPAddr
+	for _, attr := range m.attributes {
+		if attr.typ != attrXorPeerAddress {
+			continue
+		}
+		peer, err := (&message{transactionID: m.transactionID, attributes: []attribute{attr}}).getXorAddress(attrXorPeerAddress)
+		if err != nil {
+			s.sendError(c, m, 400, "Bad Request", key)
+			return
+		}
+		peers = append(peers, peer)
+	}
+	if len(peers) == 0 {
+		s.sendError(c, m, 400, "Bad Request", key)
+		return
+	}
+	for _, peer := range peers {
+		if !s.peerAllowed(peer.IP) {
+			s.sendError(c, m, 403, "Forbidden", key)
+			return
+		}
+	}
+	for _, peer := range peers {
+		a.permit(peer.IP)
+	}
+
+	c.send(newMessage(methodCreatePermission, classSuccess, m.transactionID).encode(key))
+}
+
+func (s *Server) handleChannelBind(c client, m *message, a *allocation, key []byte) {
+	number, ok := m.get(attrChannelNumber)
+	peer, err := m.getXorAddress(attrXorPeerAddress)
+	if !ok || len(number) < 2 || err != nil {
+		s.sendError(c, m, 400, "Bad Request", key)
+		return
+	}
+	if !s.peerAllowed(peer.IP) {
+		s.sendError(c, m, 403, "Forbidden", key)
+		return
+	}
+	channel := binary.BigEndian.Uint16(number)
+	if channel < channelNumberMin || channel > channelNumberMax || !a.bind(channel, peer) {
+		s.sendError(c, m, 400, "Bad Request", key)
+		return
+	}
+
+	c.send(newMessage(methodChannelBind, classSuccess, m.transactionID).encode(key))
+}
+
+func (s *Server) handleSend(c client, m *message) {
+	a := s.getAllocation(c.key())
+	if a == nil {
+		return
+	}
+	peer, err := m.getXorAddress(attrXorPeerAddress)
+	data, ok := m.get(attrData)
+	if err != nil || !ok {
+		return
+	}
+	a.toPeer(peer, data)
+}
+
+func (s *Server) handleChannelData(c client, b []byte) {
+	a := s.getAllocation(c.key())
+	if a == nil {
+		return
+	}
+	channel := binary.BigEndian.Uint16(b[0:2])
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if 4+length > len(b) {
+		return
+	}
+	if peer := a.channelPeer(channel); peer != nil {
+		a.toPeer(peer, b[4:4+length])
+	}
+}
+
+func (s *Server) getAllocation(key string) *allocation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.allocations[key]
+}
+
+func (s *Server) removeAllocation(key string) {
+	s.mutex.Lock()
+	a, ok := s.allocations[key]
+	delete(s.allocations, key)
+	s.mutex.Unlock()
+	if ok {
+		a.close()
+	}
+}
+
+func (s *Server) cleanup() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			for key, a := range s.allocations {
+				if a.expire(now) {
+					delete(s.allocations, key)
+					a.close()
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// URIs returns the STUN and TURN URIs of the listeners for the external
+// address, or nothing without external address.
+func (s *Server) URIs() (stunURIs []string, turnURIs []string) {
+	if s.config.ExternalAddress == nil {
+		return nil, nil
+	}
+	host := s.config.ExternalAddress.String()
+	if s.udpConn != nil {
+		_, port, _ := net.SplitHostPort(s.udpConn.LocalAddr().String())
+		stunURIs = append(stunURIs, fmt.Sprintf("stun:%s", net.JoinHostPort(host, port)))
+		turnURIs = append(turnURIs, fmt.Sprintf("turn:%s?transport=udp", net.JoinHostPort(host, port)))
+	}
+	if s.tcpListener != nil {
+		_, port, _ := net.SplitHostPort(s.tcpListener.Addr().String())
+		turnURIs = append(turnURIs, fmt.Sprintf("turn:%s?transport=tcp", net.JoinHostPort(host, port)))
+	}
+	if s.tlsListener != nil {
+		_, port, _ := net.SplitHostPort(s.tlsListener.Addr().String())
+		turnURIs = append(turnURIs, fmt.Sprintf("turns:%s?transport=tcp", net.JoinHostPort(host, port)))
+	}
+	if len(s.config.Secret) == 0 {
+		turnURIs = nil
+	}
+	return stunURIs, turnURIs
+}
@@ -0,0 +1,241 @@
+package turnserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn *net.UDPConn
+	key  []byte
+}
+
+func (c *testClient) roundTrip(m *message) *message {
+	c.conn.Write(m.encode(c.key))
+	response := c.read()
+	if response.transactionID != m.transactionID {
+		c.t.Fatalf("Unexpected transaction id in %+v", response)
+	}
+	return response
+}
+
+func (c *testClient) read() *message {
+	b := make([]byte, maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := c.conn.Read(b)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if isChannelData(b[:n]) {
+		return &message{raw: b[:n]}
+	}
+	m, err := decodeMessage(b[:n])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func newRequest(method uint16) *message {
+	var transactionID [12]byte
+	rand.Read(transactionID[:])
+	return newMessage(method, classRequest, transactionID)
+}
+
+func errorCode(m *message) int {
+	value, ok := m.get(attrErrorCode)
+	if !ok || len(value) < 4 {
+		return 0
+	}
+	return int(value[2])*100 + int(value[3])
+}
+
+func Test_Server_AllocateAndRelay(t *testing.T) {
+	secret := []byte("turn-secret")
+	server, err := NewServer(&Config{
+		ListenUDP:    "127.0.0.1:0",
+		Realm:        "local",
+		Secret:       secret,
+		RelayAddress: net.ParseIP("127.0.0.1"),
+		AllowedPeers: parseNetworks("127.0.0.0/8"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := net.DialUDP("udp", nil, server.udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &testClient{t: t, conn: conn}
+
+	// STUN binding returns the address of the client.
+	response := client.roundTrip(newRequest(methodBinding))
+	if mapped, err := response.getXorAddress(attrXorMappedAddress); err != nil || mapped.String() != conn.LocalAddr().String() {
+		t.Errorf("Unexpected mapped address %v %v", mapped, err)
+	}
+
+	// Allocations require credentials.
+	request := newRequest(methodAllocate)
+	request.add(attrRequestedTransport, []byte{transportUDP, 0, 0, 0})
+	response = client.roundTrip(request)
+	nonce := response.getString(attrNonce)
+	if response.class != classError || errorCode(response) != 401 || nonce == "" {
+		t.Fatalf("Expected challenge, but got %+v", response)
+	}
+
+	username := fmt.Sprintf("%d:user", time.Now().Add(time.Hour).Unix())
+	authenticated := func(method uint16, password string) *message {
+		request := newRequest(method)
+		request.add(attrUsername, []byte(username))
+		request.add(attrRealm, []byte("local"))
+		request.add(attrNonce, []byte(nonce))
+		client.key = longTermKey(username, "local", password)
+		return request
+	}
+	request = authenticated(methodAllocate, "wrong")
+	request.add(attrRequestedTransport, []byte{transportUDP, 0, 0, 0})
+	if response = client.roundTrip(request); errorCode(response) != 401 {
+		t.Fatalf("Expected wrong password to fail, but got %+v", response)
+	}
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write([]byte(username))
+	password := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	request = authenticated(methodAllocate, password)
+	request.add(attrRequestedTransport, []byte{transportUDP, 0, 0, 0})
+	response = client.roundTrip(request)
+	if response.class != classSuccess || !response.checkIntegrity(client.key) {
+		t.Fatalf("Expected allocation, but got %+v", response)
+	}
+	relayed, err := response.getXorAddress(attrXorRelayedAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	request = authenticated(methodCreatePermission, password)
+	request.addXorAddress(attrXorPeerAddress, peerAddr)
+	if response = client.roundTrip(request); response.class != classSuccess {
+		t.Fatalf("Expected permission, but got %+v", response)
+	}
+	request = authenticated(methodCreatePermission, password)
+	request.addXorAddress(attrXorPeerAddress, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234})
+	if response = client.roundTrip(request); errorCode(response) != 403 {
+		t.Fatalf("Expected private peer to be forbidden, but got %+v", response)
+	}
+
+	// Data from the peer is sent as Data indication.
+	peer.WriteToUDP([]byte("from peer"), relayed)
+	indication := client.read()
+	if data, _ := indication.get(attrData); indication.method != methodData || string(data) != "from peer" {
+		t.Errorf("Unexpected data indication %+v", indication)
+	}
+
+	// Send indications are relayed to the peer.
+	send := newMessage(methodSend, classIndication, newRequest(methodSend).transactionID)
+	send.addXorAddress(attrXorPeerAddress, peerAddr)
+	send.add(attrData, []byte("to peer"))
+	conn.Write(send.encode(nil))
+	b := make([]byte, 100)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, from, err := peer.ReadFromUDP(b); err != nil || string(b[:n]) != "to peer" || from.Port != relayed.Port {
+		t.Fatalf("Unexpected relayed data %q from %v %v", b[:n], from, err)
+	}
+
+	// Channels relay ChannelData.
+	request = authenticated(methodChannelBind, password)
+	request.add(attrChannelNumber, []byte{0x40, 0x01, 0, 0})
+	request.addXorAddress(attrXorPeerAddress, peerAddr)
+	if response = client.roundTrip(request); response.class != classSuccess {
+		t.Fatalf("Expected channel binding, but got %+v", response)
+	}
+	conn.Write(channelData(0x4001, []byte("channel to peer"), false))
+	if n, _, err := peer.ReadFromUDP(b); err != nil || string(b[:n]) != "channel to peer" {
+		t.Fatalf("Unexpected channel data %q %v", b[:n], err)
+	}
+	peer.WriteToUDP([]byte("channel from peer"), relayed)
+	if data := client.read().raw; binary.BigEndian.Uint16(data[0:2]) != 0x4001 || string(data[4:]) != "channel from peer" {
+		t.Errorf("Unexpected channel data %q", data)
+	}
+
+	stats := server.Stats()
+	if stats.Allocations != 1 || stats.AllocationsTotal != 1 || stats.AuthFailures != 1 || stats.BytesToPeers == 0 || stats.BytesFromPeers == 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Refresh with zero lifetime removes the allocation.
+	request = authenticated(methodRefresh, password)
+	request.addUint32(attrLifetime, 0)
+	if response = client.roundTrip(request); response.class != classSuccess || server.Stats().Allocations != 0 {
+		t.Errorf("Expected allocation to be removed, but got %+v", response)
+	}
+}
+
+func Test_Server_PeerAllowed(t *testing.T) {
+	server, err := NewServer(&Config{ListenUDP: "127.0.0.1:0", AllowedPeers: parseNetworks("192.168.1.0/24")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for address, allowed := range map[string]bool{
+		"203.0.113.5":      true,
+		"2001:db8::1":      true,
+		"192.168.1.20":     true,
+		"192.168.2.20":     false,
+		"10.0.0.1":         false,
+		"172.20.0.1":       false,
+		"127.0.0.1":        false,
+		"::ffff:127.0.0.1": false,
+		"::1":              false,
+		"0.0.0.0":          false,
+		"::":               false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+	} {
+		if server.peerAllowed(net.ParseIP(address)) != allowed {
+			t.Errorf("Expected peer %s allowed to be %v", address, allowed)
+		}
+	}
+}
+
+func Test_DecodeMessage_IgnoresAttributesAfterIntegrity(t *testing.T) {
+	key := longTermKey("user", "local", "password")
+	request := newRequest(methodCreatePermission)
+	request.add(attrUsername, []byte("user"))
+	b := request.encode(key)
+
+	// Replace the FINGERPRINT with an unprotected peer address.
+	b = appendAttribute(b[:len(b)-8], attrXorPeerAddress, request.xorAddress(&net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 1}))
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerSize))
+
+	m, err := decodeMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.checkIntegrity(key) {
+		t.Error("Expected valid message integrity")
+	}
+	if _, ok := m.get(attrXorPeerAddress); ok {
+		t.Error("Expected attribute after MESSAGE-INTEGRITY to be ignored")
+	}
+}
@@ -0,0 +1,291 @@
+package turnserver
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+)
+
+// STUN message classes and methods, see RFC 5389 and RFC 5766.
+const (
+	classRequest    = 0x0000
+	classIndication = 0x0010
+	classSuccess    = 0x0100
+	classError      = 0x0110
+
+	methodBinding          = 0x001
+	methodAllocate         = 0x003
+	methodRefresh          = 0x004
+	methodSend             = 0x006
+	methodData             = 0x007
+	methodCreatePermission = 0x008
+	methodChannelBind      = 0x009
+)
+
+// STUN and TURN attributes.
+const (
+	attrMappedAddress      = 0x0001
+	attrUsername           = 0x0006
+	attrMessageIntegrity   = 0x0008
+	attrErrorCode          = 0x0009
+	attrUnknownAttributes  = 0x000A
+	attrChannelNumber      = 0x000C
+	attrLifetime           = 0x000D
+	attrXorPeerAddress     = 0x0012
+	attrData               = 0x0013
+	attrRealm              = 0x0014
+	attrNonce              = 0x0015
+	attrXorRelayedAddress  = 0x0016
+	attrRequestedTransport = 0x0019
+	attrDontFragment       = 0x001A
+	attrXorMappedAddress   = 0x0020
+	attrSoftware           = 0x8022
+	attrFingerprint        = 0x8028
+)
+
+const (
+	magicCookie      = 0x2112A442
+	fingerprintXor   = 0x5354554e
+	headerSize       = 20
+	transportUDP     = 17
+	channelNumberMin = 0x4000
+	channelNumberMax = 0x7FFF
+)
+
+var (
+	errMessageTooShort = errors.New("stun message too short")
+	errNotStun         = errors.New("not a stun message")
+	errBadAttribute    = errors.New("bad stun attribute")
+)
+
+type attribute struct {
+	typ   uint16
+	value []byte
+}
+
+// message is a STUN message.
+type message struct {
+	method        uint16
+	class         uint16
+	transactionID [12]byte
+	attributes    []attribute
+	// integrityOffset is the offset of the MESSAGE-INTEGRITY attribute in
+	// raw, or -1 when the message has none.
+	integrityOffset int
+	raw             []byte
+}
+
+func isStunMessage(b []byte) bool {
+	return len(b) >= headerSize && b[0]&0xC0 == 0 && binary.BigEndian.Uint32(b[4:8]) == magicCookie
+}
+
+func isChannelData(b []byte) bool {
+	return len(b) >= 4 && b[0]&0xC0 == 0x40
+}
+
+func decodeMessage(b []byte) (*message, error) {
+	if len(b) < headerSize {
+		return nil, errMessageTooShort
+	}
+	if !isStunMessage(b) {
+		return nil, errNotStun
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length%4 != 0 || headerSize+length > len(b) {
+		return nil, errMessageTooShort
+	}
+	typ := binary.BigEndian.Uint16(b[0:2])
+	m := &message{
+		method:          typ&0x000F | (typ&0x00E0)>>1 | (typ&0x3E00)>>2,
+		class:           typ & 0x0110,
+		integrityOffset: -1,
+		raw:             b[:headerSize+length],
+	}
+	copy(m.transactionID[:], b[8:20])
+
+	offset := headerSize
+	for offset+4 <= headerSize+length {
+		attrType := binary.BigEndian.Uint16(b[offset : offset+2])
+		attrLength := int(binary.BigEndian.Uint16(b[offset+2 : offset+4]))
+		if offset+4+attrLength > headerSize+length {
+			return nil, errBadAttribute
+		}
+		switch {
+		case m.integrityOffset >= 0 && attrType != attrFingerprint:
+			// Attributes after MESSAGE-INTEGRITY are not protected by it
+			// and are ignored, except the FINGERPRINT.
+		case attrType == attrMessageIntegrity:
+			m.integrityOffset = offset
+			fallthrough
+		default:
+			m.attributes = append(m.attributes, attribute{attrType, b[offset+4 : offset+4+attrLength]})
+		}
+		offset += 4 + (attrLength+3)&^3
+	}
+
+	return m, nil
+}
+
+func newMessage(method, class uint16, transactionID [12]byte) *message {
+	return &message{method: method, class: class, transactionID: transactionID, integrityOffset: -1}
+}
+
+func (m *message) get(typ uint16) ([]byte, bool) {
+	for _, attr := range m.attributes {
+		if attr.typ == typ {
+			return attr.value, true
+		}
+	}
+	return nil, false
+}
+
+func (m *message) getString(typ uint16) string {
+	value, _ := m.get(typ)
+	return string(value)
+}
+
+func (m *message) add(typ uint16, value []byte) {
+	m.attributes = append(m.attributes, attribute{typ, value})
+}
+
+func (m *message) addUint32(typ uint16, value uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	m.add(typ, b)
+}
+
+func (m *message) addError(code int, reason string) {
+	b := make([]byte, 4+len(reason))
+	b[2] = byte(code / 100)
+	b[3] = byte(code % 100)
+	copy(b[4:], reason)
+	m.add(attrErrorCode, b)
+}
+
+func (m *message) addXorAddress(typ uint16, addr *net.UDPAddr) {
+	m.add(typ, m.xorAddress(addr))
+}
+
+func (m *message) xorAddress(addr *net.UDPAddr) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+	b := make([]byte, 4+len(ip))
+	b[1] = family
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port)^uint16(magicCookie>>16))
+	key := m.xorKey()
+	for i := range ip {
+		b[4+i] = ip[i] ^ key[i]
+	}
+	return b
+}
+
+func (m *message) xorKey() []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key[0:4], magicCookie)
+	copy(key[4:], m.transactionID[:])
+	return key
+}
+
+func (m *message) getXorAddress(typ uint16) (*net.UDPAddr, error) {
+	b, ok := m.get(typ)
+	if !ok || len(b) < 8 {
+		return nil, errBadAttribute
+	}
+	var ip net.IP
+	switch b[1] {
+	case 0x01:
+		ip = make(net.IP, 4)
+	case 0x02:
+		if len(b) < 20 {
+			return nil, errBadAttribute
+		}
+		ip = make(net.IP, 16)
+	default:
+		return nil, errBadAttribute
+	}
+	key := m.xorKey()
+	for i := range ip {
+		ip[i] = b[4+i] ^ key[i]
+	}
+	port := binary.BigEndian.Uint16(b[2:4]) ^ uint16(magicCookie>>16)
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// encode returns the wire format of the message. The MESSAGE-INTEGRITY is
+// added when key is not nil, followed by a FINGERPRINT.
+func (m *message) encode(key []byte) []byte {
+	typ := m.method&0x000F | (m.method&0x0070)<<1 | (m.method&0x0F80)<<2 | m.class
+	b := make([]byte, headerSize, 256)
+	binary.BigEndian.PutUint16(b[0:2], typ)
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	copy(b[8:20], m.transactionID[:])
+	for _, attr := range m.attributes {
+		b = appendAttribute(b, attr.typ, attr.value)
+	}
+
+	if key != nil {
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerSize+24))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(b)
+		b = appendAttribute(b, attrMessageIntegrity, mac.Sum(nil))
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerSize+8))
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(b)^fingerprintXor)
+	b = appendAttribute(b, attrFingerprint, crc)
+
+	return b
+}
+
+func appendAttribute(b []byte, typ uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header[0:2], typ)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+	b = append(b, header...)
+	b = append(b, value...)
+	if padding := (4 - len(value)%4) % 4; padding > 0 {
+		b = append(b, make([]byte, padding)...)
+	}
+	return b
+}
+
+// checkIntegrity validates the MESSAGE-INTEGRITY of a decoded message.
+func (m *message) checkIntegrity(key []byte) bool {
+	if m.integrityOffset < 0 || len(m.raw) < m.integrityOffset+24 {
+		return false
+	}
+	b := make([]byte, m.integrityOffset)
+	copy(b, m.raw[:m.integrityOffset])
+	binary.BigEndian.PutUint16(b[2:4], uint16(m.integrityOffset-headerSize+24))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(b)
+	return hmac.Equal(mac.Sum(nil), m.raw[m.integrityOffset+4:m.integrityOffset+24])
+}
+
+// longTermKey returns the key for the long-term credential mechanism.
+func longTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
+
+// channelData returns a ChannelData message, padded to 4 bytes for stream
+// transports.
+func channelData(channel uint16, data []byte, padded bool) []byte {
+	length := 4 + len(data)
+	if padded {
+		length = (length + 3) &^ 3
+	}
+	b := make([]byte, length)
+	binary.BigEndian.PutUint16(b[0:2], channel)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(data)))
+	copy(b[4:], data)
+	return b
+}